@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/haxip-com/go-redis/src/redis"
+)
+
+func main() {
+	os.Exit(redis.CheckRDBMain(os.Args[1:], os.Stdout))
+}
@@ -82,6 +82,10 @@ func handleArray(r *bufio.Reader) (Value, error) {
 		return nil, fmt.Errorf("cannot parse the length delimiter for Array: %w", err)
 	}
 
+	if length == -1 {
+		return nil, nil
+	}
+
 	returnValues := make([]Value, length)
 	
 	for i:=0; i < length; i++ {
@@ -178,6 +182,9 @@ func Serialize(v Value) ([]byte, error) {
 		}
 		return []byte("$" + strconv.Itoa(len(t)) + "\r\n" + string(t) + "\r\n"), nil
 	case Array:
+		if t == nil {
+			return []byte("*-1\r\n"), nil
+		}
 		result := "*" + strconv.Itoa(len(t)) + "\r\n"
 		for _, elem := range t {
 			serialized, err := Serialize(elem)
@@ -112,6 +112,20 @@ func TestDeserializeNestedArray(t *testing.T) {
 	}
 }
 
+func TestDeserializeNullArray(t *testing.T) {
+	input := []byte("*-1\r\n")
+	r := bufio.NewReader(bytes.NewReader(input))
+
+	value, err := Deserialize(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if value != nil {
+		t.Errorf("Expected nil Array, got %v", value)
+	}
+}
+
 func TestDeserializeIncompleteBulkString(t *testing.T) {
 	input := []byte("$5\r\nhi\r\n")
 	r := bufio.NewReader(bytes.NewReader(input))
@@ -159,6 +173,18 @@ func TestSerialize(t *testing.T) {
 			expected: []byte("$-1\r\n"),
 			wantErr:  false,
 		},
+		{
+			name:     "Array nil",
+			input:    Array(nil),
+			expected: []byte("*-1\r\n"),
+			wantErr:  false,
+		},
+		{
+			name:     "Array empty",
+			input:    Array{},
+			expected: []byte("*0\r\n"),
+			wantErr:  false,
+		},
 		{
 			name: "Array of mixed types",
 			input: Array{
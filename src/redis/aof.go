@@ -0,0 +1,694 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+const (
+	defaultAppendFilename = "appendonly.aof"
+
+	aofFsyncAlways   = "always"
+	aofFsyncEverySec = "everysec"
+	aofFsyncNo       = "no"
+)
+
+// aofState is the append-only file. Every write command that succeeds is
+// appended to its current incremental file as RESP, with relative
+// expirations rewritten as absolute times so that replaying the files
+// rebuilds the same dataset.
+type aofState struct {
+	// propMu is held by write commands from execution until they have been
+	// appended, so the file lists commands in the order they took effect.
+	propMu sync.Mutex
+	// pending holds commands run on behalf of blocked clients while another
+	// command was executing. Guarded by Store.mu.
+	pending []parser.Array
+
+	mu             sync.Mutex
+	enabled        bool
+	filename       string
+	dirname        string
+	fsync          string
+	loadTruncated  bool
+	useRDBPreamble bool
+	dir            string       // the AOF directory in use while enabled
+	manifest       *aofManifest // nil until loaded or first written
+	file           *os.File     // the last incremental file
+	size           int64        // bytes written to file
+	buf            []byte       // commands not yet written, after a write error
+	unsynced       bool
+	lastFsync      time.Time
+	writeErr       error
+
+	// Replication offsets just past the last command fed to the AOF, and
+	// the last one known to be on disk, for WAITAOF.
+	bufOffset     int64
+	fsyncedOffset int64
+
+	// Rewrites. The AOF size is baseSize, plus prevIncrSize for the
+	// incremental files before the current one, plus size.
+	autoRewritePercentage int
+	autoRewriteMinSize    int64
+	rewriting             bool
+	lastRewriteTry        time.Time
+	lastRewriteOK         bool
+	baseSize              int64
+	prevIncrSize          int64
+	rewriteBaseSize       int64 // AOF size after the last rewrite or load
+}
+
+// commandArgs builds a command to propagate.
+func commandArgs(args ...string) parser.Array {
+	arr := make(parser.Array, len(args))
+	for i, a := range args {
+		arr[i] = parser.BulkString(a)
+	}
+	return arr
+}
+
+// propagationArgs returns args as bulk strings, the only form written to
+// the AOF.
+func propagationArgs(args parser.Array) parser.Array {
+	arr := make(parser.Array, len(args))
+	for i, a := range args {
+		switch v := a.(type) {
+		case parser.SimpleString:
+			arr[i] = parser.BulkString(v)
+		default:
+			arr[i] = v
+		}
+	}
+	return arr
+}
+
+// alsoPropagate records a command run on behalf of a blocked client, to be
+// propagated after the command that served it. Caller must hold s.mu.
+func (s *Store) alsoPropagate(args ...string) {
+	s.aof.pending = append(s.aof.pending, commandArgs(args...))
+}
+
+func (s *Store) drainPending() []parser.Array {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.aof.pending
+	s.aof.pending = nil
+	return pending
+}
+
+// call runs a command handler for c. Write commands run one at a time, and
+// are refused while the AOF cannot be written.
+func (s *Store) call(c *Client, cmd string, args parser.Array, write bool, run func() parser.Value) parser.Value {
+	if !write {
+		return run()
+	}
+	// The stream of our master is applied with propMu already held.
+	if c.master == nil {
+		s.aof.propMu.Lock()
+		defer s.aof.propMu.Unlock()
+	}
+	if err := s.aofWriteError(); err != nil {
+		return parser.Error("MISCONF Errors writing to the AOF file: " + err.Error())
+	}
+	start := time.Now()
+	reply := s.countWrite(true, run())
+	var cmds []parser.Array
+	if _, failed := reply.(parser.Error); !failed {
+		cmds = s.propagatedCommands(cmd, propagationArgs(args), reply, start)
+	}
+	s.propagate(append(cmds, s.drainPending()...))
+	c.woff = s.replOffset()
+	return reply
+}
+
+// propagate feeds commands that changed the dataset to the replicas and
+// appends them to the AOF. Caller must hold s.aof.propMu.
+func (s *Store) propagate(cmds []parser.Array) {
+	if len(cmds) == 0 {
+		return
+	}
+	var buf []byte
+	for _, c := range cmds {
+		b, _ := parser.Serialize(c)
+		buf = append(buf, b...)
+	}
+	s.feedAppendOnlyFile(buf, s.replicationFeed(buf))
+}
+
+// propagatedCommands returns the commands that reproduce the effect of a
+// successful write. Relative expirations become absolute, so that the file
+// replays the same way at any later time.
+func (s *Store) propagatedCommands(cmd string, args parser.Array, reply parser.Value, start time.Time) []parser.Array {
+	argString := func(i int) string {
+		bs, _ := args[i].(parser.BulkString)
+		return string(bs)
+	}
+	switch cmd {
+	case "SET":
+		return []parser.Array{rewriteSetExpiry(args, start)}
+	case "SETEX", "PSETEX":
+		unit := time.Second
+		if cmd == "PSETEX" {
+			unit = time.Millisecond
+		}
+		n, _ := strconv.ParseInt(argString(2), 10, 64)
+		at := start.Add(time.Duration(n) * unit).UnixMilli()
+		return []parser.Array{{parser.BulkString("SET"), args[1], args[3], parser.BulkString("PXAT"), parser.BulkString(strconv.FormatInt(at, 10))}}
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		if reply != parser.Integer(1) {
+			return nil
+		}
+		return s.expiryCommands(argString(1))
+	case "GETEX":
+		if v, ok := reply.(parser.BulkString); !ok || v == nil || len(args) == 2 {
+			return nil
+		}
+		if strings.EqualFold(argString(2), "PERSIST") {
+			return []parser.Array{commandArgs("PERSIST", argString(1))}
+		}
+		return s.expiryCommands(argString(1))
+	case "RESTORE":
+		ttl, _ := strconv.ParseInt(argString(2), 10, 64)
+		for i := 4; i < len(args); i++ {
+			if strings.EqualFold(argString(i), "ABSTTL") {
+				return []parser.Array{args}
+			}
+		}
+		if ttl > 0 {
+			rewritten := append(parser.Array{}, args...)
+			rewritten[2] = parser.BulkString(strconv.FormatInt(start.UnixMilli()+ttl, 10))
+			return []parser.Array{append(rewritten, parser.BulkString("ABSTTL"))}
+		}
+	case "INCRBYFLOAT":
+		// Replaying the increment could round differently, so the result is
+		// propagated instead.
+		return []parser.Array{{parser.BulkString("SET"), args[1], reply, parser.BulkString("KEEPTTL")}}
+	}
+	return []parser.Array{args}
+}
+
+// rewriteSetExpiry replaces the EX, PX and EXAT options of SET with PXAT.
+func rewriteSetExpiry(args parser.Array, start time.Time) parser.Array {
+	out := append(parser.Array{}, args[:3]...)
+	for i := 3; i < len(args); i++ {
+		opt, _ := args[i].(parser.BulkString)
+		var unit time.Duration
+		switch strings.ToUpper(string(opt)) {
+		case "EX", "EXAT":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		default:
+			out = append(out, args[i])
+			continue
+		}
+		if i+1 >= len(args) {
+			return args
+		}
+		bs, _ := args[i+1].(parser.BulkString)
+		n, _ := strconv.ParseInt(string(bs), 10, 64)
+		var at int64
+		if strings.EqualFold(string(opt), "EXAT") {
+			at = n * 1000
+		} else {
+			at = start.Add(time.Duration(n) * unit).UnixMilli()
+		}
+		out = append(out, parser.BulkString("PXAT"), parser.BulkString(strconv.FormatInt(at, 10)))
+		i++
+	}
+	return out
+}
+
+// expiryCommands describes the expiry key has after a command changed it:
+// PEXPIREAT with the stored time, or DEL if the time had already passed.
+func (s *Store) expiryCommands(key string) []parser.Array {
+	if s.Exists(key) == 0 {
+		return []parser.Array{commandArgs("DEL", key)}
+	}
+	at, err := s.volatileKeyMap.GetSetExpiry(key)
+	if err != nil {
+		return []parser.Array{commandArgs("PERSIST", key)}
+	}
+	return []parser.Array{commandArgs("PEXPIREAT", key, strconv.FormatInt(at.UnixMilli(), 10))}
+}
+
+func (s *Store) aofWriteError() error {
+	s.aof.mu.Lock()
+	defer s.aof.mu.Unlock()
+	return s.aof.writeErr
+}
+
+// feedAppendOnlyFile appends commands, serialized, to the AOF, and with
+// appendfsync always syncs it before returning. offset is the replication
+// offset just past them.
+func (s *Store) feedAppendOnlyFile(cmds []byte, offset int64) {
+	a := &s.aof
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.enabled {
+		return
+	}
+	a.buf = append(a.buf, cmds...)
+	a.bufOffset = offset
+	if a.writeLocked() && a.fsync == aofFsyncAlways {
+		a.syncLocked()
+		s.repl.acked.notify()
+	}
+}
+
+// writeLocked writes the buffered commands. A failed write is undone, so
+// the file never ends in a partial command, and retried by the cron.
+func (a *aofState) writeLocked() bool {
+	if len(a.buf) == 0 {
+		return true
+	}
+	n, err := a.file.Write(a.buf)
+	if err != nil {
+		if n > 0 {
+			if terr := a.file.Truncate(a.size); terr != nil {
+				// The partial command stays in the file; skip what was
+				// written so the rest completes it.
+				a.size += int64(n)
+				a.buf = a.buf[n:]
+			}
+		}
+		if a.writeErr == nil {
+			log.Println("Error writing to the AOF file:", err)
+		}
+		a.writeErr = err
+		return false
+	}
+	a.size += int64(n)
+	a.buf = a.buf[:0]
+	a.unsynced = true
+	if a.writeErr != nil {
+		log.Println("AOF write error looks solved, writes are accepted again")
+		a.writeErr = nil
+	}
+	return true
+}
+
+func (a *aofState) syncLocked() {
+	if err := a.file.Sync(); err != nil {
+		log.Println("Error syncing the AOF file:", err)
+		a.writeErr = err
+		return
+	}
+	if len(a.buf) == 0 {
+		a.fsyncedOffset = a.bufOffset
+	}
+	a.unsynced = false
+	a.lastFsync = time.Now()
+	a.writeErr = nil
+}
+
+// aofCron retries failed writes and syncs, with appendfsync everysec syncs
+// the file once a second, and starts a rewrite once the AOF has grown
+// enough.
+func (s *Store) aofCron(now time.Time) {
+	a := &s.aof
+	a.mu.Lock()
+	if !a.enabled {
+		a.mu.Unlock()
+		return
+	}
+	if len(a.buf) == 0 || a.writeLocked() {
+		if a.writeErr != nil || a.fsync == aofFsyncEverySec && a.unsynced && now.Sub(a.lastFsync) >= time.Second {
+			a.syncLocked()
+			s.repl.acked.notify()
+		}
+	}
+	growth, due := a.rewriteDueLocked(now)
+	a.mu.Unlock()
+	if due {
+		log.Printf("Starting automatic rewriting of AOF on %d%% growth", growth)
+		if err := s.BGRewriteAOF(); err != nil && err != errRewriteInProgress {
+			log.Println("Can't rewrite the append only file:", err)
+		}
+	}
+}
+
+// aofDir returns the directory the AOF is kept in, below dir.
+func (s *Store) aofDir() string {
+	s.persistence.mu.Lock()
+	dir := s.persistence.dir
+	s.persistence.mu.Unlock()
+	s.aof.mu.Lock()
+	defer s.aof.mu.Unlock()
+	return filepath.Join(dir, s.aof.dirname)
+}
+
+// openAppendOnly starts logging to the last incremental file of the AOF
+// just loaded, adding one to the manifest if it lists none.
+func (s *Store) openAppendOnly() error {
+	dir := s.aofDir()
+	a := &s.aof
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.manifest.incrs) == 0 {
+		m := a.manifest.clone()
+		incr := m.nextIncr(a.filename)
+		f, err := createAOFFile(dir, incr.name)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		m.incrs = append(m.incrs, incr)
+		if err := persistAOFManifest(dir, a.filename, m); err != nil {
+			return err
+		}
+		a.manifest = m
+	}
+	f, err := os.OpenFile(filepath.Join(dir, a.manifest.incrs[len(a.manifest.incrs)-1].name), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// Loading counted the current file with the ones before it.
+	a.dir, a.file, a.size, a.enabled = dir, f, info.Size(), true
+	a.prevIncrSize -= info.Size()
+	a.lastFsync = time.Now()
+	return nil
+}
+
+// createAOFFile creates an empty file in dir and makes its name durable.
+func createAOFFile(dir, name string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// StartAppendOnly turns the AOF on at runtime. Writes are logged to a new
+// incremental file at once, and the dataset as of that moment is written
+// as a new base file. It returns once both are listed in the manifest.
+func (s *Store) StartAppendOnly() error {
+	s.aof.propMu.Lock()
+	s.aof.mu.Lock()
+	enabled := s.aof.enabled
+	s.aof.mu.Unlock()
+	if enabled {
+		s.aof.propMu.Unlock()
+		return nil
+	}
+	rw, err := s.beginRewrite(true)
+	s.aof.propMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := s.finishRewrite(rw); err != nil {
+		s.StopAppendOnly()
+		os.Remove(filepath.Join(rw.dir, rw.incr.name))
+		return err
+	}
+	return nil
+}
+
+// StopAppendOnly syncs and closes the AOF.
+func (s *Store) StopAppendOnly() error {
+	s.aof.propMu.Lock()
+	defer s.aof.propMu.Unlock()
+	a := &s.aof
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closeLocked()
+}
+
+func (a *aofState) closeLocked() error {
+	if !a.enabled {
+		return nil
+	}
+	a.writeLocked()
+	err := a.file.Sync()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.enabled, a.file, a.buf, a.writeErr = false, nil, nil, nil
+	return err
+}
+
+// writeAOFDataset writes entries as RESTORE commands with absolute expiry
+// times.
+func writeAOFDataset(w io.Writer, entries []rdbEntry) error {
+	bw := bufio.NewWriter(w)
+	for _, e := range entries {
+		payload, err := createDumpPayload(e.val)
+		if err != nil {
+			return err
+		}
+		cmd := parser.Array{parser.BulkString("RESTORE"), parser.BulkString(e.key), parser.BulkString("0"), parser.BulkString(payload)}
+		if !e.expireAt.IsZero() {
+			cmd[2] = parser.BulkString(strconv.FormatInt(e.expireAt.UnixMilli(), 10))
+			cmd = append(cmd, parser.BulkString("ABSTTL"))
+		}
+		b, _ := parser.Serialize(cmd)
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var errAOFTruncated = errors.New("unexpected end of file")
+
+// LoadAppendOnly replays the AOF: the base file and then the incremental
+// files listed in its manifest. A single-file AOF from before manifests is
+// first moved into the AOF directory as its base. It returns the number of
+// keys and commands loaded, and whether there was an AOF to load.
+func (s *Store) LoadAppendOnly() (int, bool, error) {
+	dir := s.aofDir()
+	s.aof.mu.Lock()
+	filename := s.aof.filename
+	s.aof.mu.Unlock()
+	m, err := loadAOFManifest(dir, filename)
+	if err != nil {
+		return 0, true, err
+	}
+	if m == nil {
+		if m, err = s.upgradeAppendOnly(dir, filename); m == nil || err != nil {
+			return 0, m != nil, err
+		}
+	}
+	m = removeAOFHistory(dir, filename, m)
+
+	files := m.files()
+	loaded := 0
+	var sizes []int64
+	for i, f := range files {
+		n, err := s.loadAppendOnlyFile(filepath.Join(dir, f.name), i == len(files)-1)
+		loaded += n
+		if err != nil {
+			return loaded, true, err
+		}
+		info, err := os.Stat(filepath.Join(dir, f.name))
+		if err != nil {
+			return loaded, true, err
+		}
+		sizes = append(sizes, info.Size())
+	}
+	s.persistence.dirty.Store(0)
+
+	a := &s.aof
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.manifest = m
+	a.baseSize, a.prevIncrSize, a.rewriteBaseSize = 0, 0, 0
+	for i, size := range sizes {
+		if i == 0 && m.base != nil {
+			a.baseSize = size
+		} else {
+			a.prevIncrSize += size
+		}
+		a.rewriteBaseSize += size
+	}
+	return loaded, true, nil
+}
+
+// upgradeAppendOnly turns a single-file AOF in the data directory into the
+// base of a new manifest. It returns nil if there is no such file.
+func (s *Store) upgradeAppendOnly(dir, filename string) (*aofManifest, error) {
+	old := filepath.Join(filepath.Dir(dir), filename)
+	if _, err := os.Stat(old); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	log.Printf("Moving the append only file %s into %s", old, dir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	m := &aofManifest{base: &aofFile{name: filename, seq: 1, typ: aofBaseFile}, baseSeq: 1}
+	if err := persistAOFManifest(dir, filename, m); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(old, filepath.Join(dir, filename)); err != nil {
+		return nil, err
+	}
+	return m, syncDir(dir)
+}
+
+// removeAOFHistory deletes the files a rewrite made obsolete, when a crash
+// or an error stopped it from deleting them, and returns the manifest
+// without them.
+func removeAOFHistory(dir, filename string, m *aofManifest) *aofManifest {
+	if len(m.history) == 0 {
+		return m
+	}
+	for _, f := range m.history {
+		if err := os.Remove(filepath.Join(dir, f.name)); err != nil && !os.IsNotExist(err) {
+			log.Println("Can't remove an obsolete AOF file:", err)
+			return m
+		}
+	}
+	clean := m.clone()
+	clean.history = nil
+	if err := persistAOFManifest(dir, filename, clean); err != nil {
+		log.Println("Can't persist the AOF manifest:", err)
+		return m
+	}
+	return clean
+}
+
+// loadAppendOnlyFile loads one file of the AOF, an RDB file or commands,
+// and returns the number of keys or commands loaded. Only the last file
+// may end in the middle of a command: it is then truncated to its last
+// complete command when aof-load-truncated is on.
+func (s *Store) loadAppendOnlyFile(path string, last bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	magic := make([]byte, 5)
+	if _, err := io.ReadFull(f, magic); err == nil && string(magic) == "REDIS" {
+		return s.LoadRDB(path)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	loaded, valid, err := s.replayAOF(f)
+	if errors.Is(err, errAOFTruncated) {
+		if !last {
+			return loaded, fmt.Errorf("%w reading %s, which is not the last file of the AOF", errAOFTruncated, path)
+		}
+		return loaded, s.handleTruncatedAOF(path, valid)
+	}
+	return loaded, err
+}
+
+// replayAOF runs the commands in the file f through the command dispatcher.
+// It returns the number of commands run and the offset just after the last
+// of them. Reading stops at the first error, which wraps errAOFTruncated
+// when the file ends in the middle of a command.
+func (s *Store) replayAOF(f *os.File) (int, int64, error) {
+	counter := &countingReader{r: f}
+	r := bufio.NewReader(counter)
+	client := &Client{}
+	var valid int64
+	loaded := 0
+	badFormat := func() (int, int64, error) {
+		return loaded, valid, fmt.Errorf("Bad file format reading the append only file %s at offset %d", f.Name(), valid)
+	}
+	for {
+		prefix, err := r.Peek(1)
+		if err == io.EOF {
+			return loaded, valid, nil
+		}
+		if err != nil {
+			return loaded, valid, err
+		}
+		if prefix[0] != '*' {
+			return badFormat()
+		}
+		v, err := parser.Deserialize(r)
+		if err != nil {
+			// A command cut short, usually by a crash during a write, runs
+			// into the end of the file.
+			if _, perr := r.Peek(1); perr != io.EOF || !aofCutShort(f, err) {
+				return badFormat()
+			}
+			return loaded, valid, fmt.Errorf("%w reading the append only file %s at offset %d", errAOFTruncated, f.Name(), valid)
+		}
+		arr, ok := v.(parser.Array)
+		if !ok || len(arr) == 0 {
+			return badFormat()
+		}
+		name, _ := arr[0].(parser.BulkString)
+		if _, ok := commands[strings.ToUpper(string(name))]; !ok {
+			return loaded, valid, fmt.Errorf("Unknown command '%s' reading the append only file %s at offset %d", name, f.Name(), valid)
+		}
+		dispatch(client, s, arr)
+		valid = counter.n - int64(r.Buffered())
+		loaded++
+	}
+}
+
+// aofCutShort reports whether a parse error that used up the file f came
+// from the file ending mid-command, rather than from a malformed last line.
+func aofCutShort(f *os.File, err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	info, serr := f.Stat()
+	if serr != nil || info.Size() == 0 {
+		return false
+	}
+	last := make([]byte, 1)
+	if _, rerr := f.ReadAt(last, info.Size()-1); rerr != nil {
+		return false
+	}
+	return last[0] != '\n'
+}
+
+func (s *Store) handleTruncatedAOF(path string, valid int64) error {
+	s.aof.mu.Lock()
+	loadTruncated := s.aof.loadTruncated
+	s.aof.mu.Unlock()
+	if !loadTruncated {
+		return fmt.Errorf("%w reading the append only file at offset %d; set aof-load-truncated yes to load the commands before it", errAOFTruncated, valid)
+	}
+	log.Printf("!!! Warning: short read while loading the AOF file %s!!!", path)
+	log.Printf("AOF %s loaded anyway because aof-load-truncated is enabled, truncating it to %d bytes", path, valid)
+	return os.Truncate(path, valid)
+}
+
+func parseAppendFsync(val string) (string, error) {
+	switch v := strings.ToLower(val); v {
+	case aofFsyncAlways, aofFsyncEverySec, aofFsyncNo:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument(s) must be one of the following: always, everysec, no")
+}
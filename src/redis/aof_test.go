@@ -0,0 +1,577 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func newAOFStore(t *testing.T) *Store {
+	t.Helper()
+	store := newPersistentStore(t)
+	if err := store.StartAppendOnly(); err != nil {
+		t.Fatalf("StartAppendOnly: %v", err)
+	}
+	t.Cleanup(func() { store.StopAppendOnly() })
+	return store
+}
+
+func run(store *Store, args ...string) parser.Value {
+	return dispatch(&Client{}, store, commandArgs(args...))
+}
+
+// incrPath returns the path of the incremental file writes go to.
+func incrPath(store *Store) string {
+	store.aof.mu.Lock()
+	defer store.aof.mu.Unlock()
+	m := store.aof.manifest
+	return filepath.Join(store.aof.dir, m.incrs[len(m.incrs)-1].name)
+}
+
+// loadAOF loads the AOF written by store into a new store.
+func loadAOF(t *testing.T, store *Store) *Store {
+	t.Helper()
+	loaded := newStore()
+	loaded.persistence.dir = store.persistence.dir
+	if _, found, err := loaded.LoadAppendOnly(); err != nil || !found {
+		t.Fatalf("LoadAppendOnly: %v %v", found, err)
+	}
+	return loaded
+}
+
+// aofCommands returns the commands in an AOF file, as strings.
+func aofCommands(t *testing.T, path string) [][]string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	var cmds [][]string
+	for {
+		if _, err := r.Peek(1); err != nil {
+			break
+		}
+		v, err := parser.Deserialize(r)
+		if err != nil {
+			t.Fatalf("parsing the AOF: %v", err)
+		}
+		cmds = append(cmds, bulkStrings(v))
+	}
+	return cmds
+}
+
+func TestAOFReplay(t *testing.T) {
+	store := newAOFStore(t)
+	src := newStore()
+	src.RPush("src", []byte("x"))
+	payload, _, _ := src.Dump("src")
+
+	run(store, "SET", "str", "v")
+	run(store, "SET", "ex", "v", "EX", "100")
+	run(store, "SET", "exat", "v", "EXAT", "4102444800")
+	run(store, "SETEX", "setex", "100", "v")
+	run(store, "PSETEX", "psetex", "100000", "v")
+	run(store, "SET", "expire", "v")
+	run(store, "EXPIRE", "expire", "100")
+	run(store, "SET", "gone", "v")
+	run(store, "EXPIRE", "gone", "-1")
+	run(store, "SET", "getex", "v")
+	run(store, "GETEX", "getex", "PX", "50000")
+	for i := 0; i < 3; i++ {
+		run(store, "INCRBYFLOAT", "float", "0.1")
+	}
+	run(store, "RPUSH", "list", "c", "a", "b")
+	run(store, "LPOP", "list")
+	run(store, "SORT", "list", "ALPHA", "STORE", "sorted")
+	run(store, "SORT", "list", "ALPHA")
+	run(store, "RESTORE", "restored", "100000", string(payload))
+	run(store, "GEOADD", "geo", "13.361389", "38.115556", "Palermo")
+	if _, ok := run(store, "INCR", "list").(parser.Error); !ok {
+		t.Fatalf("expected INCR on a list to fail")
+	}
+
+	for _, cmd := range aofCommands(t, incrPath(store)) {
+		switch name := strings.ToUpper(cmd[0]); name {
+		case "SETEX", "PSETEX", "EXPIRE", "GETEX", "INCRBYFLOAT", "INCR":
+			t.Errorf("unexpected %s in the AOF", name)
+		case "SET":
+			for _, arg := range cmd[3:] {
+				if arg == "EX" || arg == "EXAT" {
+					t.Errorf("unexpected relative expiry in %q", cmd)
+				}
+			}
+		case "SORT":
+			if len(cmd) != 5 {
+				t.Errorf("expected only SORT with STORE to be logged, got %q", cmd)
+			}
+		}
+	}
+
+	loaded := loadAOF(t, store)
+	if loaded.persistence.dirty.Load() != 0 {
+		t.Errorf("expected loading to leave no unsaved changes")
+	}
+	keys := []string{"str", "ex", "exat", "setex", "psetex", "expire", "getex", "float", "list", "sorted", "restored", "geo"}
+	for _, key := range keys {
+		want, _, _ := store.Dump(key)
+		got, exists, _ := loaded.Dump(key)
+		if !exists || !bytes.Equal(got, want) {
+			t.Errorf("%s: replayed value differs", key)
+		}
+		wantAt, wantErr := store.volatileKeyMap.GetSetExpiry(key)
+		gotAt, gotErr := loaded.volatileKeyMap.GetSetExpiry(key)
+		if (wantErr == nil) != (gotErr == nil) || wantErr == nil && wantAt.Sub(gotAt).Abs() > 2*time.Millisecond {
+			t.Errorf("%s: expected expiry %v, got %v", key, wantAt, gotAt)
+		}
+	}
+	if loaded.Exists("gone") != 0 {
+		t.Errorf("expected gone to be deleted on replay")
+	}
+	if v, _ := loaded.Get("float"); string(v) != "0.3" {
+		t.Errorf("expected 0.3, got %q", v)
+	}
+}
+
+// TestAOFReplayCuckoo checks that replaying insertions that relocate
+// fingerprints builds the same filter.
+func TestAOFReplayCuckoo(t *testing.T) {
+	store := newAOFStore(t)
+	run(store, "CF.RESERVE", "cf", "64", "BUCKETSIZE", "2")
+	for i := 0; i < 200; i++ {
+		run(store, "CF.ADD", "cf", strconv.Itoa(i))
+		run(store, "CF.INSERTNX", "cf", "ITEMS", "x"+strconv.Itoa(i))
+	}
+	want, _, _ := store.Dump("cf")
+	if got, _, _ := loadAOF(t, store).Dump("cf"); !bytes.Equal(got, want) {
+		t.Errorf("expected the replayed filter to match")
+	}
+}
+
+// TestAOFReplayTopK checks that replaying additions that decay buckets
+// gives the same heavy hitters.
+func TestAOFReplayTopK(t *testing.T) {
+	store := newAOFStore(t)
+	run(store, "TOPK.RESERVE", "tk", "5", "8", "2", "0.9")
+	for i := 0; i < 500; i++ {
+		run(store, "TOPK.ADD", "tk", strconv.Itoa(i%37), strconv.Itoa(i%11))
+		run(store, "TOPK.INCRBY", "tk", "x"+strconv.Itoa(i%7), strconv.Itoa(i%5+1))
+	}
+	list := func(s *Store) string {
+		return fmt.Sprint(run(s, "TOPK.LIST", "tk", "WITHCOUNT"))
+	}
+	want, _, _ := store.Dump("tk")
+	loaded := loadAOF(t, store)
+	if got, exp := list(loaded), list(store); got != exp {
+		t.Errorf("expected TOPK.LIST %s after replay, got %s", exp, got)
+	}
+	if got, _, _ := loaded.Dump("tk"); !bytes.Equal(got, want) {
+		t.Errorf("expected the replayed sketch to match")
+	}
+}
+
+func TestAOFBlockedClientsPropagation(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+	srv.store.persistence.dir = t.TempDir()
+	if err := srv.store.StartAppendOnly(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.store.StopAppendOnly()
+
+	blocked, blockedReader := dial(t, srv)
+	defer blocked.Close()
+	mover, moverReader := dial(t, srv)
+	defer mover.Close()
+	pusher, pusherReader := dial(t, srv)
+	defer pusher.Close()
+
+	sendOnly(t, blocked, "BLPOP q 5")
+	waitBlockedOn(t, srv.store, "q", 1)
+	sendOnly(t, mover, "BLMOVE q dst RIGHT LEFT 5")
+	waitBlockedOn(t, srv.store, "q", 2)
+	sendCmd(t, pusher, pusherReader, "RPUSH q a b c")
+	expectKeyElem(t, readReply(t, blocked, blockedReader), "q", "a")
+	readReply(t, mover, moverReader)
+	sendCmd(t, pusher, pusherReader, "BLMPOP 0 1 q LEFT COUNT 5")
+	sendCmd(t, pusher, pusherReader, "BRPOP missing 0.01")
+
+	want := [][]string{
+		{"RPUSH", "q", "a", "b", "c"},
+		{"LPOP", "q"},
+		{"LMOVE", "q", "dst", "RIGHT", "LEFT"},
+		{"LMPOP", "1", "q", "LEFT", "COUNT", "1"},
+	}
+	if got := aofCommands(t, incrPath(srv.store)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestAOFTruncatedTail(t *testing.T) {
+	store := newAOFStore(t)
+	run(store, "SET", "a", "1")
+	run(store, "SET", "b", "2")
+	path := incrPath(store)
+	store.StopAppendOnly()
+	complete, _ := os.ReadFile(path)
+	os.WriteFile(path, append(bytes.Clone(complete), "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1"...), 0o644)
+
+	strict := newStore()
+	strict.aof.loadTruncated = false
+	if _, err := strict.loadAppendOnlyFile(path, true); err == nil {
+		t.Fatalf("expected an error with aof-load-truncated off")
+	}
+
+	loaded := newStore()
+	n, err := loaded.loadAppendOnlyFile(path, true)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 commands, got %d %v", n, err)
+	}
+	if v, _ := loaded.Get("b"); string(v) != "2" || loaded.Exists("c") != 0 {
+		t.Errorf("expected only the complete commands to be applied")
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, complete) {
+		t.Errorf("expected the file to be truncated to its last complete command")
+	}
+
+	cut := "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n"
+	for n := 1; n < len(cut); n++ {
+		os.WriteFile(path, append(bytes.Clone(complete), cut[:n]...), 0o644)
+		if n, err := newStore().loadAppendOnlyFile(path, true); err != nil || n != 2 {
+			t.Errorf("cut after %q: expected 2 commands, got %d %v", cut[:n], n, err)
+		}
+	}
+
+	for _, bad := range []string{"+OK\r\n", "*1\r\n$7\r\nUNKNOWN\r\n", "*1\r\n$3\r\nSET\r\n*x\r\n"} {
+		os.WriteFile(path, append(bytes.Clone(complete), bad...), 0o644)
+		if _, err := newStore().loadAppendOnlyFile(path, true); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func aofUnsynced(store *Store) bool {
+	store.aof.mu.Lock()
+	defer store.aof.mu.Unlock()
+	return store.aof.unsynced
+}
+
+func TestAOFFsyncPolicies(t *testing.T) {
+	store := newAOFStore(t)
+	run(store, "SET", "a", "1")
+	if !aofUnsynced(store) {
+		t.Errorf("expected everysec to leave the write unsynced")
+	}
+	store.aofCron(time.Now().Add(2 * time.Second))
+	if aofUnsynced(store) {
+		t.Errorf("expected the cron to sync after a second")
+	}
+
+	mustDo(t, store, "CONFIG", "SET", "appendfsync", "always")
+	run(store, "SET", "b", "2")
+	if aofUnsynced(store) {
+		t.Errorf("expected always to sync before replying")
+	}
+	if _, ok := run(store, "CONFIG", "SET", "appendfsync", "sometimes").(parser.Error); !ok {
+		t.Errorf("expected an invalid policy to be rejected")
+	}
+}
+
+func TestAOFEnableAtRuntime(t *testing.T) {
+	store := newPersistentStore(t)
+	store.Set("str", []byte("v"))
+	store.SetWithOptions("volatile", []byte("v"), setOptions{expireAt: time.Now().Add(time.Hour)})
+	store.RPush("list", []byte("a"), []byte("b"))
+
+	mustDo(t, store, "CONFIG", "SET", "appendonly", "yes")
+	run(store, "RPUSH", "list", "c")
+	mustDo(t, store, "CONFIG", "SET", "appendonly", "no")
+	run(store, "RPUSH", "list", "d")
+
+	loaded := loadAOF(t, store)
+	if v, _ := loaded.Get("str"); string(v) != "v" {
+		t.Errorf("expected str to be in the AOF, got %q", v)
+	}
+	if ttl, err := loaded.volatileKeyMap.GetTTL("volatile"); err != nil || ttl < 59*time.Minute {
+		t.Errorf("expected the TTL to survive, got %v %v", ttl, err)
+	}
+	if got := bulkStrings(mustDo(t, loaded, "LRANGE", "list", "0", "-1")); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("expected writes until the AOF was turned off, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(store.persistence.dir, defaultAppendDirname, aofManifestName(defaultAppendFilename))); err != nil {
+		t.Errorf("expected the AOF manifest in dir: %v", err)
+	}
+}
+
+func TestAOFManifest(t *testing.T) {
+	m := &aofManifest{
+		base:    &aofFile{name: "appendonly.aof.2.base.rdb", seq: 2, typ: aofBaseFile},
+		history: []aofFile{{name: "appendonly.aof.1.base.rdb", seq: 1, typ: aofHistoryFile}},
+		incrs: []aofFile{
+			{name: "appendonly.aof.3.incr.aof", seq: 3, typ: aofIncrFile},
+			{name: "with space.4.incr.aof", seq: 4, typ: aofIncrFile},
+		},
+		baseSeq: 2,
+		incrSeq: 4,
+	}
+	want := "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+		"file appendonly.aof.1.base.rdb seq 1 type h\n" +
+		"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+		"file \"with space.4.incr.aof\" seq 4 type i\n"
+	if got := m.String(); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	parsed, err := parseAOFManifest([]byte("# comment\n" + want))
+	if err != nil {
+		t.Fatalf("parseAOFManifest: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Errorf("expected %+v, got %+v", m, parsed)
+	}
+
+	for _, bad := range []string{
+		"",
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq 2 type i\nfile b seq 1 type i\n",
+		"file a seq 1 type x\n",
+		"file a seq x type i\n",
+		"file ../a seq 1 type i\n",
+		"file a seq 1\n",
+		"file \"a seq 1 type i\n",
+	} {
+		if _, err := parseAOFManifest([]byte(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func waitForRewrite(t *testing.T, store *Store) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		store.aof.mu.Lock()
+		rewriting := store.aof.rewriting
+		store.aof.mu.Unlock()
+		if !rewriting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("AOF rewrite did not finish")
+}
+
+func aofDirNames(t *testing.T, store *Store) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(store.persistence.dir, defaultAppendDirname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestAOFRewrite(t *testing.T) {
+	for _, preamble := range []string{"yes", "no"} {
+		t.Run("preamble "+preamble, func(t *testing.T) {
+			store := newAOFStore(t)
+			mustDo(t, store, "CONFIG", "SET", "aof-use-rdb-preamble", preamble)
+			for i := 0; i < 10; i++ {
+				run(store, "RPUSH", "list", "x")
+			}
+			run(store, "SET", "volatile", "v", "EX", "100")
+			if v := run(store, "BGREWRITEAOF"); v != parser.SimpleString("Background append only file rewriting started") {
+				t.Fatalf("unexpected reply %v", v)
+			}
+			waitForRewrite(t, store)
+			run(store, "SET", "after", "v")
+
+			ext := "rdb"
+			if preamble == "no" {
+				ext = "aof"
+			}
+			want := []string{"appendonly.aof.2.base." + ext, "appendonly.aof.2.incr.aof", "appendonly.aof.manifest"}
+			if got := aofDirNames(t, store); !reflect.DeepEqual(got, want) {
+				t.Errorf("expected files %q, got %q", want, got)
+			}
+			if got := aofCommands(t, incrPath(store)); !reflect.DeepEqual(got, [][]string{{"SET", "after", "v"}}) {
+				t.Errorf("expected only the later write in the new incremental file, got %q", got)
+			}
+
+			loaded := loadAOF(t, store)
+			if got := bulkStrings(mustDo(t, loaded, "LRANGE", "list", "0", "-1")); len(got) != 10 {
+				t.Errorf("expected 10 elements, got %q", got)
+			}
+			if ttl, err := loaded.volatileKeyMap.GetTTL("volatile"); err != nil || ttl < 99*time.Second {
+				t.Errorf("expected the TTL to survive, got %v %v", ttl, err)
+			}
+			if v, _ := loaded.Get("after"); string(v) != "v" {
+				t.Errorf("expected the write after the rewrite, got %q", v)
+			}
+		})
+	}
+}
+
+// TestAOFRewriteCrash checks that the AOF loads completely at each point of
+// a rewrite: writes made while the base is being written land in the new
+// incremental file, which the manifest lists before the rewrite completes.
+func TestAOFRewriteCrash(t *testing.T) {
+	store := newAOFStore(t)
+	run(store, "SET", "before", "1")
+	store.aof.propMu.Lock()
+	rw, err := store.beginRewrite(false)
+	store.aof.propMu.Unlock()
+	if err != nil {
+		t.Fatalf("beginRewrite: %v", err)
+	}
+	if v := run(store, "BGREWRITEAOF"); v != parser.Error(errRewriteInProgress.Error()) {
+		t.Errorf("expected a second rewrite to be refused, got %v", v)
+	}
+	run(store, "SET", "during", "2")
+	run(store, "DEL", "before")
+	for _, e := range rw.entries {
+		if e.key == "during" {
+			t.Errorf("expected the snapshot to miss writes after it")
+		}
+	}
+	store.aofCron(time.Now().Add(2 * time.Second))
+
+	check := func(stage string) {
+		loaded := loadAOF(t, store)
+		if loaded.Exists("before") != 0 || loaded.Exists("during") != 1 {
+			t.Errorf("%s: expected only during to exist", stage)
+		}
+	}
+	check("mid-rewrite")
+	if err := store.finishRewrite(rw); err != nil {
+		t.Fatalf("finishRewrite: %v", err)
+	}
+	check("after the rewrite")
+
+	// A crash after the new manifest but before the old files were deleted
+	// leaves them as history, deleted on the next load.
+	dir := filepath.Join(store.persistence.dir, defaultAppendDirname)
+	m, err := loadAOFManifest(dir, defaultAppendFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := aofFile{name: "appendonly.aof.1.incr.aof", seq: 1, typ: aofHistoryFile}
+	os.WriteFile(filepath.Join(dir, stale.name), []byte("garbage"), 0o644)
+	m.history = append(m.history, stale)
+	if err := persistAOFManifest(dir, defaultAppendFilename, m); err != nil {
+		t.Fatal(err)
+	}
+	check("with history")
+	if _, err := os.Stat(filepath.Join(dir, stale.name)); !os.IsNotExist(err) {
+		t.Errorf("expected the history file to be deleted, got %v", err)
+	}
+	if m, _ := loadAOFManifest(dir, defaultAppendFilename); len(m.history) != 0 {
+		t.Errorf("expected the history to be dropped from the manifest")
+	}
+}
+
+func TestAOFTruncatedEarlierFile(t *testing.T) {
+	store := newAOFStore(t)
+	run(store, "SET", "a", "1")
+	store.aof.propMu.Lock()
+	rw, err := store.beginRewrite(false)
+	store.aof.propMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.finishRewrite(rw)
+	store.StopAppendOnly()
+
+	m := store.aof.manifest
+	first := filepath.Join(store.aof.dir, m.incrs[0].name)
+	data, _ := os.ReadFile(first)
+	os.WriteFile(first, data[:len(data)-1], 0o644)
+	loaded := newStore()
+	loaded.persistence.dir = store.persistence.dir
+	if _, _, err := loaded.LoadAppendOnly(); !errors.Is(err, errAOFTruncated) {
+		t.Errorf("expected only the last file to be allowed to be truncated, got %v", err)
+	}
+}
+
+func TestAOFUpgrade(t *testing.T) {
+	store := newPersistentStore(t)
+	old := filepath.Join(store.persistence.dir, defaultAppendFilename)
+	os.WriteFile(old, []byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"), 0o644)
+	if _, found, err := store.LoadAppendOnly(); err != nil || !found {
+		t.Fatalf("LoadAppendOnly: %v %v", found, err)
+	}
+	if v, _ := store.Get("k"); string(v) != "v" {
+		t.Errorf("expected k to be loaded, got %q", v)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("expected the old file to be moved, got %v", err)
+	}
+	if err := store.openAppendOnly(); err != nil {
+		t.Fatal(err)
+	}
+	defer store.StopAppendOnly()
+	run(store, "SET", "k2", "v2")
+	if v, _ := loadAOF(t, store).Get("k2"); string(v) != "v2" {
+		t.Errorf("expected writes after the upgrade to be logged, got %q", v)
+	}
+	want := []string{"appendonly.aof", "appendonly.aof.1.incr.aof", "appendonly.aof.manifest"}
+	if got := aofDirNames(t, store); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected files %q, got %q", want, got)
+	}
+
+	empty := newPersistentStore(t)
+	if _, found, err := empty.LoadAppendOnly(); found || err != nil {
+		t.Errorf("expected no AOF, got %v %v", found, err)
+	}
+}
+
+func TestAOFAutoRewrite(t *testing.T) {
+	store := newAOFStore(t)
+	mustDo(t, store, "CONFIG", "SET", "auto-aof-rewrite-min-size", "1kb", "auto-aof-rewrite-percentage", "100")
+	if v := mustDo(t, store, "CONFIG", "GET", "auto-aof-rewrite-min-size"); bulkStrings(v)[1] != "1024" {
+		t.Errorf("unexpected min size %q", bulkStrings(v))
+	}
+	baseSeq := func() int64 {
+		store.aof.mu.Lock()
+		defer store.aof.mu.Unlock()
+		return store.aof.manifest.baseSeq
+	}
+	run(store, "SET", "k", strings.Repeat("x", 500))
+	store.aofCron(time.Now())
+	waitForRewrite(t, store)
+	if baseSeq() != 1 {
+		t.Fatalf("expected no rewrite below the minimum size")
+	}
+	for i := 0; i < 4; i++ {
+		run(store, "SET", "k", strings.Repeat("x", 500))
+	}
+	store.aofCron(time.Now())
+	waitForRewrite(t, store)
+	if baseSeq() != 2 {
+		t.Fatalf("expected a rewrite once the AOF doubled")
+	}
+	run(store, "SET", "k", strings.Repeat("x", 500))
+	store.aofCron(time.Now())
+	waitForRewrite(t, store)
+	if baseSeq() != 2 {
+		t.Errorf("expected no rewrite right after one")
+	}
+
+	for _, bad := range []string{"-1", "1xb", "lots"} {
+		if _, ok := run(store, "CONFIG", "SET", "auto-aof-rewrite-min-size", bad).(parser.Error); !ok {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
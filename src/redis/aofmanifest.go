@@ -0,0 +1,242 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The AOF is a directory of files tied together by a manifest, like the
+// multi-part AOF of Redis 7. The base file holds the dataset as of the last
+// rewrite, either as an RDB file or as commands, and the incremental files
+// hold the commands logged since then, oldest first. The manifest lists
+// them one per line:
+//
+//	file appendonly.aof.2.base.rdb seq 2 type b
+//	file appendonly.aof.5.incr.aof seq 5 type i
+//
+// Files a rewrite made obsolete are listed with type h until they have
+// been deleted. The manifest is only ever replaced by renaming a complete
+// new one over it, so a crash leaves either the old or the new set of files.
+const (
+	defaultAppendDirname = "appendonlydir"
+
+	aofBaseFile    = 'b'
+	aofIncrFile    = 'i'
+	aofHistoryFile = 'h'
+)
+
+type aofFile struct {
+	name string
+	seq  int64
+	typ  byte
+}
+
+type aofManifest struct {
+	base    *aofFile
+	incrs   []aofFile
+	history []aofFile
+	// The highest sequence numbers used so far, so new files never reuse a
+	// name.
+	baseSeq int64
+	incrSeq int64
+}
+
+func aofManifestName(filename string) string {
+	return filename + ".manifest"
+}
+
+func (m *aofManifest) clone() *aofManifest {
+	c := *m
+	if m.base != nil {
+		base := *m.base
+		c.base = &base
+	}
+	c.incrs = append([]aofFile(nil), m.incrs...)
+	c.history = append([]aofFile(nil), m.history...)
+	return &c
+}
+
+// files returns the files to load, in order.
+func (m *aofManifest) files() []aofFile {
+	var files []aofFile
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+// nextBase names a new base file. rdb selects the RDB format over commands.
+func (m *aofManifest) nextBase(filename string, rdb bool) aofFile {
+	m.baseSeq++
+	ext := "aof"
+	if rdb {
+		ext = "rdb"
+	}
+	return aofFile{name: fmt.Sprintf("%s.%d.base.%s", filename, m.baseSeq, ext), seq: m.baseSeq, typ: aofBaseFile}
+}
+
+// nextIncr names a new incremental file.
+func (m *aofManifest) nextIncr(filename string) aofFile {
+	m.incrSeq++
+	return aofFile{name: fmt.Sprintf("%s.%d.incr.aof", filename, m.incrSeq), seq: m.incrSeq, typ: aofIncrFile}
+}
+
+func (m *aofManifest) String() string {
+	var b strings.Builder
+	write := func(f aofFile) {
+		name := f.name
+		if strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || r == '"' || !unicode.IsPrint(r) }) >= 0 {
+			name = strconv.Quote(name)
+		}
+		fmt.Fprintf(&b, "file %s seq %d type %c\n", name, f.seq, f.typ)
+	}
+	if m.base != nil {
+		write(*m.base)
+	}
+	for _, f := range m.history {
+		write(f)
+	}
+	for _, f := range m.incrs {
+		write(f)
+	}
+	return b.String()
+}
+
+// splitManifestLine splits a line into fields, where a field starting with
+// a double quote is a Go quoted string.
+func splitManifestLine(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, err
+			}
+			field, _ := strconv.Unquote(quoted)
+			fields = append(fields, field)
+			line = line[len(quoted):]
+			continue
+		}
+		end := strings.IndexFunc(line, unicode.IsSpace)
+		if end < 0 {
+			end = len(line)
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+}
+
+func parseAOFManifest(data []byte) (*aofManifest, error) {
+	m := &aofManifest{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields, err := splitManifestLine(line)
+		if err != nil || len(fields)%2 != 0 {
+			return nil, fmt.Errorf("Invalid AOF manifest file format at line %d", n)
+		}
+		var f aofFile
+		for i := 0; i < len(fields); i += 2 {
+			switch val := fields[i+1]; fields[i] {
+			case "file":
+				f.name = val
+			case "seq":
+				f.seq, err = strconv.ParseInt(val, 10, 64)
+			case "type":
+				if len(val) == 1 {
+					f.typ = val[0]
+				}
+			}
+		}
+		if err != nil || f.name == "" || filepath.Base(f.name) != f.name || f.seq < 1 {
+			return nil, fmt.Errorf("Invalid AOF manifest file format at line %d", n)
+		}
+		switch f.typ {
+		case aofBaseFile:
+			if m.base != nil {
+				return nil, fmt.Errorf("Found duplicate base file information in the AOF manifest")
+			}
+			m.base = &f
+			m.baseSeq = f.seq
+		case aofIncrFile:
+			if f.seq <= m.incrSeq {
+				return nil, fmt.Errorf("Found a non-monotonic sequence number in the AOF manifest")
+			}
+			m.incrs = append(m.incrs, f)
+			m.incrSeq = f.seq
+		case aofHistoryFile:
+			m.history = append(m.history, f)
+		default:
+			return nil, fmt.Errorf("Unknown AOF file type %q in the AOF manifest", f.typ)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if m.base == nil && len(m.incrs) == 0 {
+		return nil, fmt.Errorf("Found an empty AOF manifest")
+	}
+	return m, nil
+}
+
+// loadAOFManifest reads the manifest in dir. It returns nil if there is
+// none.
+func loadAOFManifest(dir, filename string) (*aofManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, aofManifestName(filename)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseAOFManifest(data)
+}
+
+// persistAOFManifest replaces the manifest in dir with m. The new manifest
+// is synced before the rename and the directory after it, so the switch
+// survives a crash.
+func persistAOFManifest(dir, filename string, m *aofManifest) error {
+	tmp := filepath.Join(dir, "temp-"+aofManifestName(filename))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(m.String())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, aofManifestName(filename)))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renames and new files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,254 @@
+package redis
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+const (
+	defaultAutoRewritePercentage = 100
+	defaultAutoRewriteMinSize    = 64 << 20
+
+	// aofRewriteRetryDelay is how long automatic rewrites wait after a
+	// failed rewrite before trying again.
+	aofRewriteRetryDelay = 5 * time.Second
+)
+
+var errRewriteInProgress = fmt.Errorf("ERR Background append only file rewriting already in progress")
+
+// aofRewrite is a rewrite in progress: the dataset as of the moment it
+// started, and the incremental file holding the writes since then.
+type aofRewrite struct {
+	dir      string
+	filename string
+	rdb      bool
+	entries  []rdbEntry
+	release  func()   // releases entries
+	incr     *aofFile // nil when the AOF is off
+}
+
+// beginRewrite starts a rewrite. While the AOF is on, or when start turns
+// it on, writes move to a new incremental file. Caller must hold
+// s.aof.propMu, so that no write falls between the switch and the snapshot.
+func (s *Store) beginRewrite(start bool) (*aofRewrite, error) {
+	dir := s.aofDir()
+	offset := s.replOffset()
+	a := &s.aof
+	a.mu.Lock()
+	if a.rewriting {
+		a.mu.Unlock()
+		return nil, errRewriteInProgress
+	}
+	if a.enabled {
+		dir = a.dir
+	}
+	rw := &aofRewrite{dir: dir, filename: a.filename, rdb: a.useRDBPreamble}
+	if err := a.prepareRewriteLocked(rw, start); err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	if start {
+		// Every write so far is in the base file.
+		a.bufOffset, a.fsyncedOffset = offset, offset
+	}
+	a.rewriting = true
+	a.lastRewriteTry = time.Now()
+	a.mu.Unlock()
+	rw.entries, rw.release = s.snapshot()
+	return rw, nil
+}
+
+func (a *aofState) prepareRewriteLocked(rw *aofRewrite, start bool) error {
+	if err := os.MkdirAll(rw.dir, 0o755); err != nil {
+		return err
+	}
+	if a.manifest == nil {
+		m, err := loadAOFManifest(rw.dir, rw.filename)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			m = &aofManifest{}
+		}
+		a.manifest = m
+	}
+	if !a.enabled && !start {
+		return nil
+	}
+	incr, err := a.switchIncrLocked(rw.dir, start)
+	if err != nil {
+		return err
+	}
+	rw.incr = &incr
+	return nil
+}
+
+// switchIncrLocked sends writes to a new incremental file. While the AOF
+// is on, the new file is added to the manifest at once, so that after a
+// crash mid-rewrite it is still loaded after the others. When starting the
+// AOF, only the completed rewrite lists it.
+func (a *aofState) switchIncrLocked(dir string, start bool) (aofFile, error) {
+	m := a.manifest.clone()
+	incr := m.nextIncr(a.filename)
+	f, err := createAOFFile(dir, incr.name)
+	if err != nil {
+		return incr, err
+	}
+	abort := func(err error) (aofFile, error) {
+		f.Close()
+		os.Remove(filepath.Join(dir, incr.name))
+		return incr, err
+	}
+	if start {
+		a.enabled, a.dir, a.writeErr = true, dir, nil
+	} else {
+		if !a.writeLocked() {
+			return abort(a.writeErr)
+		}
+		if err := a.file.Sync(); err != nil {
+			return abort(err)
+		}
+		m.incrs = append(m.incrs, incr)
+		if err := persistAOFManifest(dir, a.filename, m); err != nil {
+			return abort(err)
+		}
+		a.file.Close()
+		a.prevIncrSize += a.size
+	}
+	a.manifest = m
+	a.file, a.size, a.unsynced, a.lastFsync = f, 0, false, time.Now()
+	return incr, nil
+}
+
+// finishRewrite writes the new base file and switches the manifest to it,
+// then deletes the files it replaced.
+func (s *Store) finishRewrite(rw *aofRewrite) error {
+	tmp, size, err := writeAOFBase(rw)
+	rw.release()
+	a := &s.aof
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rewriting = false
+	if err == nil {
+		err = a.switchBaseLocked(rw, tmp, size)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		a.lastRewriteOK = false
+		return err
+	}
+	a.lastRewriteOK = true
+	return nil
+}
+
+// writeAOFBase writes the snapshot of rw to a temporary file and returns
+// its path and size.
+func writeAOFBase(rw *aofRewrite) (string, int64, error) {
+	tmp := filepath.Join(rw.dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return tmp, 0, err
+	}
+	if rw.rdb {
+		err = writeRDB(f, rw.entries, true)
+	} else {
+		err = writeAOFDataset(f, rw.entries)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	var size int64
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return tmp, size, err
+}
+
+// switchBaseLocked renames the new base file into place and persists a
+// manifest listing it and the incremental file of the rewrite. Everything
+// before them becomes history.
+func (a *aofState) switchBaseLocked(rw *aofRewrite, tmp string, size int64) error {
+	m := a.manifest.clone()
+	base := m.nextBase(rw.filename, rw.rdb)
+	if err := os.Rename(tmp, filepath.Join(rw.dir, base.name)); err != nil {
+		return err
+	}
+	if m.base != nil {
+		m.history = append(m.history, aofFile{name: m.base.name, seq: m.base.seq, typ: aofHistoryFile})
+	}
+	m.base = &base
+	for _, f := range m.incrs {
+		if rw.incr == nil || f.seq != rw.incr.seq {
+			m.history = append(m.history, aofFile{name: f.name, seq: f.seq, typ: aofHistoryFile})
+		}
+	}
+	m.incrs = nil
+	if rw.incr != nil {
+		m.incrs = []aofFile{*rw.incr}
+	}
+	if err := persistAOFManifest(rw.dir, rw.filename, m); err != nil {
+		os.Remove(filepath.Join(rw.dir, base.name))
+		return err
+	}
+	a.manifest = removeAOFHistory(rw.dir, rw.filename, m)
+	a.baseSize, a.prevIncrSize, a.rewriteBaseSize = size, 0, size
+	if a.enabled {
+		a.rewriteBaseSize += a.size
+	}
+	return nil
+}
+
+// rewriteDueLocked reports whether the AOF has grown by
+// auto-aof-rewrite-percentage since the last rewrite, and by how much.
+func (a *aofState) rewriteDueLocked(now time.Time) (int64, bool) {
+	if a.rewriting || a.autoRewritePercentage == 0 ||
+		!a.lastRewriteOK && now.Sub(a.lastRewriteTry) < aofRewriteRetryDelay {
+		return 0, false
+	}
+	size := a.baseSize + a.prevIncrSize + a.size
+	if size <= a.autoRewriteMinSize {
+		return 0, false
+	}
+	growth := size*100/max(a.rewriteBaseSize, 1) - 100
+	return growth, growth >= int64(a.autoRewritePercentage)
+}
+
+// BGRewriteAOF rewrites the AOF from a separate goroutine. With the AOF
+// off it writes a base file alone, ready for the AOF to be turned on.
+func (s *Store) BGRewriteAOF() error {
+	s.aof.propMu.Lock()
+	rw, err := s.beginRewrite(false)
+	s.aof.propMu.Unlock()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.finishRewrite(rw); err != nil {
+			log.Println("Background AOF rewrite failed:", err)
+			return
+		}
+		log.Println("Background AOF rewrite finished successfully")
+	}()
+	return nil
+}
+
+func handleBGRewriteAOF(store *Store, args []parser.Value) parser.Value {
+	if err := store.BGRewriteAOF(); err != nil {
+		if err == errRewriteInProgress {
+			return parser.Error(err.Error())
+		}
+		return parser.Error("ERR " + err.Error())
+	}
+	return parser.SimpleString("Background append only file rewriting started")
+}
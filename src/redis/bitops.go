@@ -0,0 +1,739 @@
+package redis
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// maxStringSize is the largest string a command may create, matching Redis'
+// default proto-max-bulk-len.
+const maxStringSize = 512 * 1024 * 1024
+
+var (
+	errBitOffset = fmt.Errorf("ERR bit offset is not an integer or out of range")
+	errBitValue  = fmt.Errorf("ERR bit is not an integer or out of range")
+)
+
+// growString zero-pads the string at key to at least size bytes and returns
+// the (possibly reallocated) value. Caller must hold s.mu for writing.
+func (s *Store) growString(key string, val []byte, size int) []byte {
+	if size > len(val) {
+		if size <= cap(val) {
+			val = val[:size]
+		} else {
+			grown := make([]byte, size, size+size/4)
+			copy(grown, val)
+			val = grown
+		}
+	}
+	s.setKey(key, val)
+	return val
+}
+
+func (s *Store) SetBit(key string, offset uint64, bit byte) (byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, _, err := s.getStringForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	byteIdx := int(offset >> 3)
+	val = s.growString(key, val, byteIdx+1)
+	shift := 7 - offset&7
+	old := val[byteIdx] >> shift & 1
+	val[byteIdx] = val[byteIdx]&^(1<<shift) | bit<<shift
+	return old, nil
+}
+
+func (s *Store) GetBit(key string, offset uint64) (byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, _, err := s.getString(key)
+	if err != nil {
+		return 0, err
+	}
+	byteIdx := offset >> 3
+	if byteIdx >= uint64(len(val)) {
+		return 0, nil
+	}
+	return val[byteIdx] >> (7 - offset&7) & 1, nil
+}
+
+// bitRange resolves a BITCOUNT/BITPOS style start/end pair against a length,
+// returning ok=false for an empty range.
+func bitRange(start, end, length int64) (int64, int64, bool) {
+	if start < 0 {
+		start = length + start
+	}
+	if end < 0 {
+		end = length + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	return start, end, start <= end
+}
+
+// BitCount counts set bits. With hasRange, start and end select bytes, or
+// bits when bitUnit is set.
+func (s *Store) BitCount(key string, hasRange bool, start, end int64, bitUnit bool) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, exists, err := s.getString(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	if !hasRange {
+		return popCount(val), nil
+	}
+	length := int64(len(val))
+	if bitUnit {
+		length *= 8
+	}
+	start, end, ok := bitRange(start, end, length)
+	if !ok {
+		return 0, nil
+	}
+	if !bitUnit {
+		return popCount(val[start : end+1]), nil
+	}
+	first, last := start>>3, end>>3
+	count := popCount(val[first : last+1])
+	// Drop the bits of the first and last byte that fall outside the range.
+	count -= int64(bits.OnesCount8(val[first] >> (8 - start&7)))
+	count -= int64(bits.OnesCount8(val[last] << (end&7 + 1)))
+	return count, nil
+}
+
+func popCount(b []byte) int64 {
+	n := 0
+	for len(b) >= 8 {
+		n += bits.OnesCount64(uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
+			uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56)
+		b = b[8:]
+	}
+	for _, c := range b {
+		n += bits.OnesCount8(c)
+	}
+	return int64(n)
+}
+
+// BitPos finds the first bit set to bit. endGiven changes the result of a
+// failed search for a clear bit, as in Redis: without an explicit end the
+// string is considered padded with zeros on the right.
+func (s *Store) BitPos(key string, bit byte, hasStart bool, start int64, endGiven bool, end int64, bitUnit bool) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, exists, err := s.getString(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		if bit == 1 {
+			return -1, nil
+		}
+		return 0, nil
+	}
+	length := int64(len(val))
+	if bitUnit {
+		length *= 8
+	}
+	if !hasStart {
+		start = 0
+	}
+	if !endGiven {
+		end = length - 1
+	}
+	start, end, ok := bitRange(start, end, length)
+	if !ok {
+		return -1, nil
+	}
+
+	firstBit, lastBit := start*8, end*8+7
+	if bitUnit {
+		firstBit, lastBit = start, end
+	}
+	for i := firstBit; i <= lastBit; i++ {
+		// Whole bytes that cannot contain a match are skipped.
+		if i&7 == 0 && i+7 <= lastBit {
+			c := val[i>>3]
+			if bit == 1 && c == 0 || bit == 0 && c == 0xff {
+				i += 7
+				continue
+			}
+		}
+		if val[i>>3]>>(7-i&7)&1 == bit {
+			return i, nil
+		}
+	}
+	if bit == 0 && !endGiven {
+		return lastBit + 1, nil
+	}
+	return -1, nil
+}
+
+// BitOp stores the result of a bitwise operation over srcKeys in dest and
+// returns its length. Missing keys are treated as zero-filled strings.
+func (s *Store) BitOp(op, dest string, srcKeys []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srcs := make([][]byte, len(srcKeys))
+	maxLen := 0
+	for i, k := range srcKeys {
+		val, _, err := s.getString(k)
+		if err != nil {
+			return 0, err
+		}
+		srcs[i] = val
+		if len(val) > maxLen {
+			maxLen = len(val)
+		}
+	}
+	byteAt := func(src []byte, i int) byte {
+		if i < len(src) {
+			return src[i]
+		}
+		return 0
+	}
+	res := make([]byte, maxLen)
+	for i := range res {
+		first := byteAt(srcs[0], i)
+		var or, and, xor, seenTwice byte = 0, 0xff, 0, 0
+		for _, src := range srcs[1:] {
+			b := byteAt(src, i)
+			or |= b
+		}
+		for _, src := range srcs {
+			b := byteAt(src, i)
+			and &= b
+			seenTwice |= xor & b
+			xor ^= b
+		}
+		switch op {
+		case "AND":
+			res[i] = and
+		case "OR":
+			res[i] = first | or
+		case "XOR":
+			res[i] = xor
+		case "NOT":
+			res[i] = ^first
+		case "DIFF":
+			res[i] = first &^ or
+		case "DIFF1":
+			res[i] = ^first & or
+		case "ANDOR":
+			res[i] = first & or
+		case "ONE":
+			res[i] = xor &^ seenTwice
+		}
+	}
+	s.volatileKeyMap.Delete(dest)
+	if len(res) == 0 {
+		s.deleteKey(dest)
+		return 0, nil
+	}
+	s.setKey(dest, res)
+	return int64(len(res)), nil
+}
+
+// bitfieldType is a BITFIELD integer encoding such as i8 or u16.
+type bitfieldType struct {
+	signed bool
+	bits   uint
+}
+
+type bitfieldOverflow int
+
+const (
+	overflowWrap bitfieldOverflow = iota
+	overflowSat
+	overflowFail
+)
+
+type bitfieldOp struct {
+	kind     string // GET, SET or INCRBY
+	typ      bitfieldType
+	offset   uint64
+	arg      int64
+	overflow bitfieldOverflow
+}
+
+func getUnsignedBits(val []byte, offset uint64, n uint) uint64 {
+	var v uint64
+	for i := uint64(0); i < uint64(n); i++ {
+		byteIdx := (offset + i) >> 3
+		var bit uint64
+		if byteIdx < uint64(len(val)) {
+			bit = uint64(val[byteIdx]>>(7-(offset+i)&7)) & 1
+		}
+		v = v<<1 | bit
+	}
+	return v
+}
+
+func setUnsignedBits(val []byte, offset uint64, n uint, v uint64) {
+	for i := uint64(0); i < uint64(n); i++ {
+		bit := byte(v>>(uint64(n)-1-i)) & 1
+		byteIdx := (offset + i) >> 3
+		shift := 7 - (offset+i)&7
+		val[byteIdx] = val[byteIdx]&^(1<<shift) | bit<<shift
+	}
+}
+
+func getSignedBits(val []byte, offset uint64, n uint) int64 {
+	v := getUnsignedBits(val, offset, n)
+	if n < 64 && v&(1<<(n-1)) != 0 {
+		v |= ^uint64(0) << n
+	}
+	return int64(v)
+}
+
+// checkUnsignedOverflow mirrors Redis' checkUnsignedBitfieldOverflow: it
+// returns 1 on overflow, -1 on underflow, 0 otherwise, plus the value to
+// store under the WRAP or SAT policy.
+func checkUnsignedOverflow(value uint64, incr int64, n uint, policy bitfieldOverflow) (int, uint64) {
+	max := uint64(math.MaxUint64)
+	if n < 64 {
+		max = 1<<n - 1
+	}
+	maxIncr := int64(max - value)
+	minIncr := -int64(value)
+	wrapped := (value + uint64(incr)) & max
+	if value > max || (incr > 0 && incr > maxIncr) {
+		if policy == overflowSat {
+			return 1, max
+		}
+		return 1, wrapped
+	}
+	if incr < 0 && incr < minIncr {
+		if policy == overflowSat {
+			return -1, 0
+		}
+		return -1, wrapped
+	}
+	return 0, 0
+}
+
+// checkSignedOverflow mirrors Redis' checkSignedBitfieldOverflow.
+func checkSignedOverflow(value, incr int64, n uint, policy bitfieldOverflow) (int, int64) {
+	max := int64(math.MaxInt64)
+	if n < 64 {
+		max = 1<<(n-1) - 1
+	}
+	min := -max - 1
+	maxIncr := max - value
+	minIncr := min - value
+	wrap := func() int64 {
+		c := uint64(value) + uint64(incr)
+		if n < 64 {
+			mask := ^uint64(0) << n
+			if c&(1<<(n-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c)
+	}
+	if value > max || (n != 64 && incr > maxIncr) || (value >= 0 && incr > 0 && incr > maxIncr) {
+		if policy == overflowSat {
+			return 1, max
+		}
+		return 1, wrap()
+	}
+	if value < min || (n != 64 && incr < minIncr) || (value < 0 && incr < 0 && incr < minIncr) {
+		if policy == overflowSat {
+			return -1, min
+		}
+		return -1, wrap()
+	}
+	return 0, 0
+}
+
+// BitField runs ops in order and returns one reply per GET, SET and INCRBY.
+// A nil entry is an operation refused by OVERFLOW FAIL.
+func (s *Store) BitField(key string, ops []bitfieldOp) ([]*int64, error) {
+	write := false
+	for _, op := range ops {
+		if op.kind != "GET" {
+			write = true
+		}
+	}
+	if !write {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		val, _, err := s.getString(key)
+		if err != nil {
+			return nil, err
+		}
+		results := make([]*int64, len(ops))
+		for i, op := range ops {
+			v := bitfieldGet(val, op)
+			results[i] = &v
+		}
+		return results, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, _, err := s.getStringForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*int64, len(ops))
+	for i, op := range ops {
+		if op.kind == "GET" {
+			v := bitfieldGet(val, op)
+			results[i] = &v
+			continue
+		}
+		n := op.typ.bits
+		var stored, reply int64
+		var overflow int
+		if op.typ.signed {
+			old := getSignedBits(val, op.offset, n)
+			newVal := op.arg
+			incr := int64(0)
+			if op.kind == "INCRBY" {
+				newVal, incr = old, op.arg
+			}
+			var limit int64
+			overflow, limit = checkSignedOverflow(newVal, incr, n, op.overflow)
+			stored = newVal + incr
+			if overflow != 0 {
+				stored = limit
+			}
+			reply = old
+			if op.kind == "INCRBY" {
+				reply = stored
+			}
+		} else {
+			old := getUnsignedBits(val, op.offset, n)
+			newVal := uint64(op.arg)
+			incr := int64(0)
+			if op.kind == "INCRBY" {
+				newVal, incr = old, op.arg
+			}
+			var limit uint64
+			overflow, limit = checkUnsignedOverflow(newVal, incr, n, op.overflow)
+			sum := newVal + uint64(incr)
+			if overflow != 0 {
+				sum = limit
+			}
+			stored = int64(sum)
+			reply = int64(old)
+			if op.kind == "INCRBY" {
+				reply = stored
+			}
+		}
+		if overflow != 0 && op.overflow == overflowFail {
+			continue
+		}
+		val = s.growString(key, val, int((op.offset+uint64(n)-1)>>3)+1)
+		setUnsignedBits(val, op.offset, n, uint64(stored))
+		results[i] = &reply
+	}
+	return results, nil
+}
+
+func bitfieldGet(val []byte, op bitfieldOp) int64 {
+	if op.typ.signed {
+		return getSignedBits(val, op.offset, op.typ.bits)
+	}
+	return int64(getUnsignedBits(val, op.offset, op.typ.bits))
+}
+
+// ---- command handlers ----
+
+// parseBitOffset parses a SETBIT/GETBIT offset, or a BITFIELD offset when
+// typ is non-nil, where a leading '#' multiplies it by the type width.
+func parseBitOffset(v parser.Value, typ *bitfieldType) (uint64, error) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return 0, errBitOffset
+	}
+	str := string(bs)
+	multiply := false
+	if typ != nil && strings.HasPrefix(str, "#") {
+		multiply = true
+		str = str[1:]
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errBitOffset
+	}
+	offset := uint64(n)
+	width := uint64(1)
+	if typ != nil {
+		width = uint64(typ.bits)
+	}
+	if multiply {
+		if offset > math.MaxUint64/width {
+			return 0, errBitOffset
+		}
+		offset *= width
+	}
+	if (offset+width-1)>>3 >= maxStringSize {
+		return 0, errBitOffset
+	}
+	return offset, nil
+}
+
+func parseBitfieldType(v parser.Value) (bitfieldType, error) {
+	errType := fmt.Errorf("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	bs, ok := v.(parser.BulkString)
+	if !ok || len(bs) < 2 {
+		return bitfieldType{}, errType
+	}
+	var t bitfieldType
+	switch bs[0] {
+	case 'i', 'I':
+		t.signed = true
+	case 'u', 'U':
+	default:
+		return bitfieldType{}, errType
+	}
+	n, err := strconv.Atoi(string(bs[1:]))
+	if err != nil || n < 1 || (t.signed && n > 64) || (!t.signed && n > 63) {
+		return bitfieldType{}, errType
+	}
+	t.bits = uint(n)
+	return t, nil
+}
+
+func handleSetBit(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	offset, err := parseBitOffset(args[2], nil)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	bitBS, ok := args[3].(parser.BulkString)
+	if !ok || (string(bitBS) != "0" && string(bitBS) != "1") {
+		return parser.Error(errBitValue.Error())
+	}
+	old, err := store.SetBit(string(key), offset, bitBS[0]-'0')
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(old)
+}
+
+func handleGetBit(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	offset, err := parseBitOffset(args[2], nil)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	bit, err := store.GetBit(string(key), offset)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(bit)
+}
+
+// parseBitUnit parses the optional trailing BYTE|BIT argument.
+func parseBitUnit(v parser.Value) (bool, bool) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return false, false
+	}
+	switch strings.ToUpper(string(bs)) {
+	case "BYTE":
+		return false, true
+	case "BIT":
+		return true, true
+	}
+	return false, false
+}
+
+func handleBitCount(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	var start, end int
+	bitUnit := false
+	hasRange := len(args) > 2
+	switch len(args) {
+	case 2:
+	case 4, 5:
+		var errReply parser.Value
+		if start, errReply = intArg(args[2]); errReply != nil {
+			return errReply
+		}
+		if end, errReply = intArg(args[3]); errReply != nil {
+			return errReply
+		}
+		if len(args) == 5 {
+			if bitUnit, ok = parseBitUnit(args[4]); !ok {
+				return parser.Error("ERR syntax error")
+			}
+		}
+	default:
+		return parser.Error("ERR syntax error")
+	}
+	n, err := store.BitCount(string(key), hasRange, int64(start), int64(end), bitUnit)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleBitPos(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	bitBS, ok := args[2].(parser.BulkString)
+	if !ok || (string(bitBS) != "0" && string(bitBS) != "1") {
+		return parser.Error("ERR The bit argument must be 1 or 0.")
+	}
+	if len(args) > 6 {
+		return parser.Error("ERR syntax error")
+	}
+	var start, end int
+	var errReply parser.Value
+	bitUnit := false
+	if len(args) > 3 {
+		if start, errReply = intArg(args[3]); errReply != nil {
+			return errReply
+		}
+	}
+	if len(args) > 4 {
+		if end, errReply = intArg(args[4]); errReply != nil {
+			return errReply
+		}
+	}
+	if len(args) > 5 {
+		if bitUnit, ok = parseBitUnit(args[5]); !ok {
+			return parser.Error("ERR syntax error")
+		}
+	}
+	pos, err := store.BitPos(string(key), bitBS[0]-'0', len(args) > 3, int64(start), len(args) > 4, int64(end), bitUnit)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(pos)
+}
+
+func handleBitOp(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	op := strings.ToUpper(strs[0])
+	dest, srcs := strs[1], strs[2:]
+	switch op {
+	case "AND", "OR", "XOR", "ONE":
+	case "NOT":
+		if len(srcs) != 1 {
+			return parser.Error("ERR BITOP NOT must be called with a single source key.")
+		}
+	case "DIFF", "DIFF1", "ANDOR":
+		if len(srcs) < 2 {
+			return parser.Error(fmt.Sprintf("ERR BITOP %s must be called with at least two source keys.", op))
+		}
+	default:
+		return parser.Error("ERR syntax error")
+	}
+	n, err := store.BitOp(op, dest, srcs)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleBitField(store *Store, args []parser.Value) parser.Value {
+	return bitfieldCommand(store, args, false)
+}
+
+func handleBitFieldRO(store *Store, args []parser.Value) parser.Value {
+	return bitfieldCommand(store, args, true)
+}
+
+func bitfieldCommand(store *Store, args []parser.Value, readOnly bool) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	var ops []bitfieldOp
+	overflow := overflowWrap
+	for i := 2; i < len(args); {
+		sub, ok := args[i].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR syntax error")
+		}
+		kind := strings.ToUpper(string(sub))
+		if readOnly && kind != "GET" {
+			return parser.Error("ERR BITFIELD_RO only supports the GET subcommand")
+		}
+		need := map[string]int{"GET": 3, "SET": 4, "INCRBY": 4, "OVERFLOW": 2}[kind]
+		if need == 0 || i+need > len(args) {
+			return parser.Error("ERR syntax error")
+		}
+		if kind == "OVERFLOW" {
+			policy, _ := args[i+1].(parser.BulkString)
+			switch strings.ToUpper(string(policy)) {
+			case "WRAP":
+				overflow = overflowWrap
+			case "SAT":
+				overflow = overflowSat
+			case "FAIL":
+				overflow = overflowFail
+			default:
+				return parser.Error("ERR Invalid OVERFLOW type specified")
+			}
+			i += need
+			continue
+		}
+		typ, err := parseBitfieldType(args[i+1])
+		if err != nil {
+			return parser.Error(err.Error())
+		}
+		offset, err := parseBitOffset(args[i+2], &typ)
+		if err != nil {
+			return parser.Error(err.Error())
+		}
+		op := bitfieldOp{kind: kind, typ: typ, offset: offset, overflow: overflow}
+		if kind != "GET" {
+			n, errReply := intArg(args[i+3])
+			if errReply != nil {
+				return errReply
+			}
+			op.arg = int64(n)
+		}
+		ops = append(ops, op)
+		i += need
+	}
+	results, err := store.BitField(string(key), ops)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	arr := make([]parser.Value, len(results))
+	for i, r := range results {
+		if r == nil {
+			arr[i] = parser.BulkString(nil)
+		} else {
+			arr[i] = parser.Integer(*r)
+		}
+	}
+	return parser.Array(arr)
+}
@@ -0,0 +1,301 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestSetBitGetBit(t *testing.T) {
+	store := newStore()
+	old, err := store.SetBit("k", 7, 1)
+	if err != nil || old != 0 {
+		t.Fatalf("SetBit = %d, %v", old, err)
+	}
+	if val, _ := store.Get("k"); len(val) != 1 || val[0] != 0x01 {
+		t.Fatalf("expected \\x01, got %v", val)
+	}
+	old, _ = store.SetBit("k", 7, 0)
+	if old != 1 {
+		t.Errorf("expected old bit 1, got %d", old)
+	}
+	store.SetBit("k", 100, 1)
+	if bit, _ := store.GetBit("k", 100); bit != 1 {
+		t.Errorf("expected bit 100 set")
+	}
+	if bit, _ := store.GetBit("k", 1<<20); bit != 0 {
+		t.Errorf("expected bit past the end to be 0")
+	}
+
+	store.Set("n", []byte("1"))
+	store.Incr("n")
+	if bit, _ := store.GetBit("n", 6); bit != 1 {
+		t.Errorf("expected bit 6 of \"2\" to be set")
+	}
+	store.LPush("list", []byte("a"))
+	if _, err := store.SetBit("list", 0, 1); err != errWrongType {
+		t.Errorf("expected WRONGTYPE, got %v", err)
+	}
+}
+
+// TestInPlaceWritesKeepReadValues checks that GET shares the stored string
+// and that a string a reader holds is copied before it is changed in place.
+func TestInPlaceWritesKeepReadValues(t *testing.T) {
+	store := newStore()
+	store.Set("k", []byte("abc"))
+	first, _ := store.Get("k")
+	if second, _ := store.Get("k"); &first[0] != &second[0] {
+		t.Errorf("expected GET not to copy the value")
+	}
+	store.SetBit("k", 0, 1)
+	store.SetRange("k", 1, []byte("X"))
+	if string(first) != "abc" {
+		t.Errorf("expected the value read before the writes to be unchanged, got %q", first)
+	}
+	if val, _ := store.Get("k"); string(val) != "\xe1Xc" {
+		t.Errorf("expected the writes to apply, got %q", val)
+	}
+
+	held, _ := store.Get("k")
+	store.Rename("k", "dst", false)
+	store.SetBit("dst", 0, 0)
+	if string(held) != "\xe1Xc" {
+		t.Errorf("expected a renamed value to be copied before it is changed, got %q", held)
+	}
+}
+
+func TestBitCountRanges(t *testing.T) {
+	store := newStore()
+	store.Set("k", []byte("foobar"))
+	cases := []struct {
+		hasRange   bool
+		start, end int64
+		bitUnit    bool
+		want       int64
+	}{
+		{false, 0, 0, false, 26},
+		{true, 0, 0, false, 4},
+		{true, 1, 1, false, 6},
+		{true, -2, -1, false, 7},
+		{true, 5, 30, true, 17},
+		{true, 1, 0, false, 0},
+		{true, -100, 100, false, 26},
+	}
+	for _, c := range cases {
+		got, err := store.BitCount("k", c.hasRange, c.start, c.end, c.bitUnit)
+		if err != nil || got != c.want {
+			t.Errorf("BitCount(%d, %d, bit=%v) = %d, %v; want %d", c.start, c.end, c.bitUnit, got, err, c.want)
+		}
+	}
+	if got, _ := store.BitCount("missing", false, 0, 0, false); got != 0 {
+		t.Errorf("expected 0 for missing key, got %d", got)
+	}
+}
+
+func TestBitPos(t *testing.T) {
+	store := newStore()
+	store.Set("k", []byte{0xff, 0xf0, 0x00})
+	cases := []struct {
+		bit      byte
+		hasStart bool
+		start    int64
+		endGiven bool
+		end      int64
+		bitUnit  bool
+		want     int64
+	}{
+		{0, false, 0, false, 0, false, 12},
+		{1, true, 2, false, 0, false, -1},
+		{1, true, 1, false, 0, false, 8},
+		{1, true, 10, true, 15, true, 10},
+		{0, true, 0, true, 0, false, -1},
+	}
+	for _, c := range cases {
+		got, err := store.BitPos("k", c.bit, c.hasStart, c.start, c.endGiven, c.end, c.bitUnit)
+		if err != nil || got != c.want {
+			t.Errorf("BitPos(%d, %d, %d) = %d, %v; want %d", c.bit, c.start, c.end, got, err, c.want)
+		}
+	}
+
+	store.Set("ones", []byte{0xff})
+	if got, _ := store.BitPos("ones", 0, false, 0, false, 0, false); got != 8 {
+		t.Errorf("expected 8 past an all-ones string, got %d", got)
+	}
+	if got, _ := store.BitPos("missing", 0, false, 0, false, 0, false); got != 0 {
+		t.Errorf("expected 0 for missing key, got %d", got)
+	}
+	if got, _ := store.BitPos("missing", 1, false, 0, false, 0, false); got != -1 {
+		t.Errorf("expected -1 for missing key, got %d", got)
+	}
+}
+
+func TestBitOp(t *testing.T) {
+	store := newStore()
+	store.Set("a", []byte{0b1100})
+	store.Set("b", []byte{0b1010, 0xff})
+	store.Set("c", []byte{0b0110})
+	cases := []struct {
+		op   string
+		keys []string
+		want []byte
+	}{
+		{"AND", []string{"a", "b"}, []byte{0b1000, 0}},
+		{"OR", []string{"a", "b"}, []byte{0b1110, 0xff}},
+		{"XOR", []string{"a", "b"}, []byte{0b0110, 0xff}},
+		{"NOT", []string{"a"}, []byte{0xf3}},
+		{"DIFF", []string{"a", "b", "c"}, []byte{0, 0}},
+		{"DIFF", []string{"a", "c"}, []byte{0b1000}},
+		{"DIFF1", []string{"a", "b"}, []byte{0b0010, 0xff}},
+		{"ANDOR", []string{"a", "b", "c"}, []byte{0b1100, 0}},
+		{"ONE", []string{"a", "b", "c"}, []byte{0, 0xff}},
+		{"AND", []string{"a", "missing"}, []byte{0}},
+	}
+	for _, c := range cases {
+		n, err := store.BitOp(c.op, "dest", c.keys)
+		if err != nil || n != int64(len(c.want)) {
+			t.Errorf("BitOp %s %v = %d, %v", c.op, c.keys, n, err)
+			continue
+		}
+		if got, _ := store.Get("dest"); string(got) != string(c.want) {
+			t.Errorf("BitOp %s %v = %08b, want %08b", c.op, c.keys, got, c.want)
+		}
+	}
+
+	store.volatileKeyMap.Set("dest", time.Minute)
+	n, _ := store.BitOp("OR", "dest", []string{"missing"})
+	if n != 0 {
+		t.Errorf("expected empty result, got length %d", n)
+	}
+	if _, exists := store.Get("dest"); exists {
+		t.Errorf("expected empty result to delete dest")
+	}
+	if store.isVolatile("dest") {
+		t.Errorf("expected BITOP to clear the TTL of dest")
+	}
+}
+
+func TestBitFieldOverflow(t *testing.T) {
+	store := newStore()
+	incr := func(typ bitfieldType, by int64, policy bitfieldOverflow) *int64 {
+		t.Helper()
+		res, err := store.BitField("k", []bitfieldOp{{kind: "INCRBY", typ: typ, offset: 0, arg: by, overflow: policy}})
+		if err != nil {
+			t.Fatalf("BitField: %v", err)
+		}
+		return res[0]
+	}
+	u2 := bitfieldType{bits: 2}
+	if v := incr(u2, 5, overflowWrap); v == nil || *v != 1 {
+		t.Errorf("u2 wrap: expected 1, got %v", v)
+	}
+	if v := incr(u2, 10, overflowSat); v == nil || *v != 3 {
+		t.Errorf("u2 sat: expected 3, got %v", v)
+	}
+	if v := incr(u2, 1, overflowFail); v != nil {
+		t.Errorf("u2 fail: expected nil, got %d", *v)
+	}
+
+	store.Del("k")
+	i8 := bitfieldType{signed: true, bits: 8}
+	if v := incr(i8, 127, overflowWrap); v == nil || *v != 127 {
+		t.Errorf("i8: expected 127, got %v", v)
+	}
+	if v := incr(i8, 1, overflowWrap); v == nil || *v != -128 {
+		t.Errorf("i8 wrap: expected -128, got %v", v)
+	}
+	if v := incr(i8, -10, overflowSat); v == nil || *v != -128 {
+		t.Errorf("i8 sat: expected -128, got %v", v)
+	}
+
+	store.Del("k")
+	i64 := bitfieldType{signed: true, bits: 64}
+	incr(i64, 1<<62, overflowWrap)
+	if v := incr(i64, 1<<62, overflowSat); v == nil || *v != 1<<63-1 {
+		t.Errorf("i64 sat: expected max int64, got %v", v)
+	}
+}
+
+func TestBitFieldGetDoesNotCreateKey(t *testing.T) {
+	store := newStore()
+	res, err := store.BitField("k", []bitfieldOp{{kind: "GET", typ: bitfieldType{bits: 8}}})
+	if err != nil || len(res) != 1 || *res[0] != 0 {
+		t.Fatalf("unexpected result %v, %v", res, err)
+	}
+	if _, exists := store.Get("k"); exists {
+		t.Errorf("GET-only BITFIELD created the key")
+	}
+}
+
+func TestBitCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp := sendCmd(t, conn, reader, "SETBIT bits 9 1")
+	if num, ok := resp.(parser.Integer); !ok || num != 0 {
+		t.Errorf("expected 0, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "SETBIT bits 9 2")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR bit is not an integer or out of range" {
+		t.Errorf("expected bit error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "SETBIT bits 4294967296 1")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR bit offset is not an integer or out of range" {
+		t.Errorf("expected offset error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GETBIT bits 9")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BITCOUNT bits 0 -1 BIT")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BITCOUNT bits 0")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR syntax error" {
+		t.Errorf("expected syntax error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BITPOS bits 1")
+	if num, ok := resp.(parser.Integer); !ok || num != 9 {
+		t.Errorf("expected 9, got %v", resp)
+	}
+
+	resp = sendCmd(t, conn, reader, "BITOP DIFF dest bits")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR BITOP DIFF must be called with at least two source keys." {
+		t.Errorf("expected DIFF arity error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BITOP NOT dest bits")
+	if num, ok := resp.(parser.Integer); !ok || num != 2 {
+		t.Errorf("expected 2, got %v", resp)
+	}
+
+	resp = sendCmd(t, conn, reader, "BITFIELD bf SET u8 #1 200 GET u8 8 OVERFLOW FAIL INCRBY u8 8 100")
+	arr, ok := resp.(parser.Array)
+	if !ok || len(arr) != 3 {
+		t.Fatalf("expected 3 replies, got %v", resp)
+	}
+	if arr[0] != parser.Integer(0) || arr[1] != parser.Integer(200) {
+		t.Errorf("unexpected SET/GET replies %v", arr)
+	}
+	if arr[2] != nil {
+		t.Errorf("expected nil for failed INCRBY, got %v", arr[2])
+	}
+	resp = sendCmd(t, conn, reader, "BITFIELD bf GET u64 0")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is." {
+		t.Errorf("expected type error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BITFIELD_RO bf INCRBY u8 0 1")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR BITFIELD_RO only supports the GET subcommand" {
+		t.Errorf("expected read-only error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BITFIELD_RO bf GET i8 8")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 1 || arr[0] != parser.Integer(-56) {
+		t.Errorf("expected [-56], got %v", resp)
+	}
+}
@@ -0,0 +1,405 @@
+package redis
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+type unblockReason int
+
+const (
+	unblockTimeout unblockReason = iota
+	unblockError
+	unblockRoleChange
+)
+
+// blockedClient is a client parked on one or more list keys. serve is called
+// with s.mu held once one of the keys holds a non-empty list, and produces the
+// reply handed back to the waiting goroutine through result.
+type blockedClient struct {
+	client  *Client
+	keys    []string
+	serve   func(key string) parser.Value
+	result  chan parser.Value
+	unblock chan unblockReason
+	done    bool
+}
+
+// blockingState tracks blocked clients per key in arrival order, and the keys
+// that received new elements since blocked clients were last served.
+type blockingState struct {
+	waiters  map[string][]*blockedClient
+	ready    []string
+	readySet map[string]struct{}
+}
+
+// signalKeyAsReady records that key may now satisfy blocked clients. Caller
+// must hold s.mu.
+func (s *Store) signalKeyAsReady(key string) {
+	if _, ok := s.blocking.waiters[key]; !ok {
+		return
+	}
+	if s.blocking.readySet == nil {
+		s.blocking.readySet = make(map[string]struct{})
+	}
+	if _, ok := s.blocking.readySet[key]; ok {
+		return
+	}
+	s.blocking.readySet[key] = struct{}{}
+	s.blocking.ready = append(s.blocking.ready, key)
+}
+
+// serveBlockedClients hands elements of ready keys to blocked clients, oldest
+// first. Serving a client may push to another key (BLMOVE), which is then
+// processed in the same pass. Caller must hold s.mu.
+func (s *Store) serveBlockedClients() {
+	for len(s.blocking.ready) > 0 {
+		ready := s.blocking.ready
+		s.blocking.ready = nil
+		s.blocking.readySet = nil
+		for _, key := range ready {
+			for len(s.blocking.waiters[key]) > 0 {
+				if _, exists, err := s.getList(key); err != nil || !exists {
+					break
+				}
+				bc := s.blocking.waiters[key][0]
+				reply := bc.serve(key)
+				s.removeBlocked(bc)
+				bc.result <- reply
+			}
+		}
+	}
+}
+
+// unblockAll wakes every blocked client with reason. Caller must hold s.mu.
+func (s *Store) unblockAll(reason unblockReason) {
+	for _, queue := range s.blocking.waiters {
+		for _, bc := range queue {
+			select {
+			case bc.unblock <- reason:
+			default:
+			}
+		}
+	}
+}
+
+// removeBlocked takes bc out of every wait queue. Caller must hold s.mu.
+func (s *Store) removeBlocked(bc *blockedClient) {
+	bc.done = true
+	for _, key := range bc.keys {
+		queue := s.blocking.waiters[key]
+		for i, w := range queue {
+			if w == bc {
+				queue = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(s.blocking.waiters, key)
+		} else {
+			s.blocking.waiters[key] = queue
+		}
+	}
+	if bc.client != nil {
+		bc.client.mu.Lock()
+		bc.client.blocked = nil
+		bc.client.mu.Unlock()
+	}
+}
+
+// blockForKeys serves the client immediately from the first key holding a
+// list, or parks it until another client pushes to one of the keys, the
+// timeout elapses (zero blocks forever), the client is unblocked with CLIENT
+// UNBLOCK or the connection goes away. timeoutReply is returned in the
+// latter cases.
+//
+// serve records the commands it runs with alsoPropagate. When the client is
+// served by another command, they are propagated after that command.
+func (s *Store) blockForKeys(c *Client, keys []string, timeout time.Duration, timeoutReply parser.Value, serve func(key string) parser.Value) parser.Value {
+	s.aof.propMu.Lock()
+	s.mu.Lock()
+	for _, key := range keys {
+		_, exists, err := s.getList(key)
+		if err != nil {
+			s.mu.Unlock()
+			s.aof.propMu.Unlock()
+			return parser.Error(err.Error())
+		}
+		if exists {
+			reply := serve(key)
+			s.serveBlockedClients()
+			s.mu.Unlock()
+			s.propagate(s.drainPending())
+			s.aof.propMu.Unlock()
+			return reply
+		}
+	}
+
+	bc := &blockedClient{
+		client:  c,
+		serve:   serve,
+		result:  make(chan parser.Value, 1),
+		unblock: make(chan unblockReason, 1),
+	}
+	if s.blocking.waiters == nil {
+		s.blocking.waiters = make(map[string][]*blockedClient)
+	}
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		bc.keys = append(bc.keys, key)
+		s.blocking.waiters[key] = append(s.blocking.waiters[key], bc)
+	}
+	c.mu.Lock()
+	c.blocked = bc
+	c.mu.Unlock()
+	s.mu.Unlock()
+	s.aof.propMu.Unlock()
+
+	return s.waitBlocked(bc, timeout, timeoutReply)
+}
+
+func (s *Store) waitBlocked(bc *blockedClient, timeout time.Duration, timeoutReply parser.Value) parser.Value {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	gone, stopWatching := bc.client.watchDisconnect()
+	defer stopWatching()
+
+	reply := timeoutReply
+	select {
+	case r := <-bc.result:
+		return r
+	case <-expired:
+	case <-gone:
+	case reason := <-bc.unblock:
+		switch reason {
+		case unblockError:
+			reply = parser.Error("UNBLOCKED client unblocked via CLIENT UNBLOCK")
+		case unblockRoleChange:
+			reply = parser.Error("UNBLOCKED force unblock from blocking operation, instance state changed (master -> replica?)")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bc.done {
+		// Served while we were timing out: the element is already ours.
+		return <-bc.result
+	}
+	s.removeBlocked(bc)
+	return reply
+}
+
+// listMove pops an element from one end of src and pushes it to one end of
+// dst. It returns nil when src does not exist. Caller must hold s.mu.
+func (s *Store) listMove(src, dst string, from, to listWhere) ([]byte, error) {
+	_, exists, err := s.getList(src)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	if _, _, err := s.getList(dst); err != nil {
+		return nil, err
+	}
+	popped, _ := s.listPop(src, from, 1)
+	s.listPush(dst, to, popped[0])
+	return popped[0], nil
+}
+
+func parseBlockTimeout(v parser.Value) (time.Duration, parser.Value) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return 0, parser.Error("ERR wrong argument type")
+	}
+	secs, err := strconv.ParseFloat(string(bs), 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return 0, parser.Error("ERR timeout is not a float or out of range")
+	}
+	if secs < 0 {
+		return 0, parser.Error("ERR timeout is negative")
+	}
+	if secs > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, parser.Error("ERR timeout is out of range")
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+func parseListWhere(v parser.Value) (listWhere, bool) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return 0, false
+	}
+	switch strings.ToUpper(string(bs)) {
+	case "LEFT":
+		return listLeft, true
+	case "RIGHT":
+		return listRight, true
+	default:
+		return 0, false
+	}
+}
+
+func (w listWhere) String() string {
+	if w == listLeft {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// popCommand is the command that pops one element from w.
+func (w listWhere) popCommand() string {
+	if w == listLeft {
+		return "LPOP"
+	}
+	return "RPOP"
+}
+
+func bulkStringArgs(args []parser.Value) ([]string, bool) {
+	out := make([]string, len(args))
+	for i, a := range args {
+		bs, ok := a.(parser.BulkString)
+		if !ok {
+			return nil, false
+		}
+		out[i] = string(bs)
+	}
+	return out, true
+}
+
+func handleBLPop(c *Client, store *Store, args []parser.Value) parser.Value {
+	return blockingPop(c, store, args, listLeft)
+}
+
+func handleBRPop(c *Client, store *Store, args []parser.Value) parser.Value {
+	return blockingPop(c, store, args, listRight)
+}
+
+func blockingPop(c *Client, store *Store, args []parser.Value, where listWhere) parser.Value {
+	keys, ok := bulkStringArgs(args[1 : len(args)-1])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	timeout, errReply := parseBlockTimeout(args[len(args)-1])
+	if errReply != nil {
+		return errReply
+	}
+	return store.blockForKeys(c, keys, timeout, parser.Array(nil), func(key string) parser.Value {
+		popped, _ := store.listPop(key, where, 1)
+		store.alsoPropagate(where.popCommand(), key)
+		return parser.Array{parser.BulkString(key), parser.BulkString(popped[0])}
+	})
+}
+
+func handleBLMove(c *Client, store *Store, args []parser.Value) parser.Value {
+	src, ok1 := args[1].(parser.BulkString)
+	dst, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	from, ok1 := parseListWhere(args[3])
+	to, ok2 := parseListWhere(args[4])
+	if !ok1 || !ok2 {
+		return parser.Error("ERR syntax error")
+	}
+	timeout, errReply := parseBlockTimeout(args[5])
+	if errReply != nil {
+		return errReply
+	}
+	return store.blockForKeys(c, []string{string(src)}, timeout, parser.BulkString(nil), func(key string) parser.Value {
+		elem, err := store.listMove(key, string(dst), from, to)
+		if err != nil {
+			return parser.Error(err.Error())
+		}
+		store.alsoPropagate("LMOVE", key, string(dst), from.String(), to.String())
+		return parser.BulkString(elem)
+	})
+}
+
+// parseMPopArgs parses the "numkeys key [key ...] LEFT|RIGHT [COUNT count]"
+// tail shared by LMPOP and BLMPOP.
+func parseMPopArgs(args []parser.Value) ([]string, listWhere, int, parser.Value) {
+	numBS, ok := args[0].(parser.BulkString)
+	if !ok {
+		return nil, 0, 0, parser.Error("ERR wrong argument type")
+	}
+	numkeys, err := strconv.ParseInt(string(numBS), 10, 64)
+	if err != nil || numkeys <= 0 {
+		return nil, 0, 0, parser.Error("ERR numkeys should be greater than 0")
+	}
+	if numkeys > int64(len(args)-2) {
+		return nil, 0, 0, parser.Error("ERR syntax error")
+	}
+	keys, ok := bulkStringArgs(args[1 : 1+numkeys])
+	if !ok {
+		return nil, 0, 0, parser.Error("ERR wrong argument type")
+	}
+	rest := args[1+numkeys:]
+	where, ok := parseListWhere(rest[0])
+	if !ok {
+		return nil, 0, 0, parser.Error("ERR syntax error")
+	}
+	count := 1
+	rest = rest[1:]
+	if len(rest) > 0 {
+		opt, ok := rest[0].(parser.BulkString)
+		if !ok || len(rest) != 2 || strings.ToUpper(string(opt)) != "COUNT" {
+			return nil, 0, 0, parser.Error("ERR syntax error")
+		}
+		countBS, ok := rest[1].(parser.BulkString)
+		if !ok {
+			return nil, 0, 0, parser.Error("ERR wrong argument type")
+		}
+		n, err := strconv.ParseInt(string(countBS), 10, 64)
+		if err != nil || n <= 0 {
+			return nil, 0, 0, parser.Error("ERR count should be greater than 0")
+		}
+		if n > math.MaxInt32 {
+			n = math.MaxInt32
+		}
+		count = int(n)
+	}
+	return keys, where, count, nil
+}
+
+// mpopReply builds the [key, [elements]] reply of LMPOP and BLMPOP, listing
+// elements in the order they were popped.
+func mpopReply(key string, where listWhere, popped [][]byte) parser.Value {
+	elems := make([]parser.Value, len(popped))
+	for i, v := range popped {
+		if where == listRight {
+			elems[len(popped)-1-i] = parser.BulkString(v)
+		} else {
+			elems[i] = parser.BulkString(v)
+		}
+	}
+	return parser.Array{parser.BulkString(key), parser.Array(elems)}
+}
+
+func handleBLMPop(c *Client, store *Store, args []parser.Value) parser.Value {
+	timeout, errReply := parseBlockTimeout(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	keys, where, count, errReply := parseMPopArgs(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	return store.blockForKeys(c, keys, timeout, parser.Array(nil), func(key string) parser.Value {
+		popped, _ := store.listPop(key, where, count)
+		store.alsoPropagate("LMPOP", "1", key, where.String(), "COUNT", strconv.Itoa(len(popped)))
+		return mpopReply(key, where, popped)
+	})
+}
@@ -0,0 +1,369 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// sendOnly writes a command without waiting for its reply, for commands
+// expected to block.
+func sendOnly(t *testing.T, conn net.Conn, cmd string) {
+	serialized, _ := parser.SerializeFromString(cmd)
+	if _, err := conn.Write(serialized); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+}
+
+func readReply(t *testing.T, conn net.Conn, reader *bufio.Reader) parser.Value {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	resp, err := parser.Deserialize(reader)
+	if err != nil {
+		t.Fatalf("deserialize error: %v", err)
+	}
+	return resp
+}
+
+// waitBlockedOn polls until n clients are blocked on key.
+func waitBlockedOn(t *testing.T, store *Store, key string, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		store.mu.RLock()
+		got := len(store.blocking.waiters[key])
+		store.mu.RUnlock()
+		if got == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d clients blocked on %q", n, key)
+}
+
+func dial(t *testing.T, srv *testServer) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func expectKeyElem(t *testing.T, resp parser.Value, key, elem string) {
+	t.Helper()
+	arr, ok := resp.(parser.Array)
+	if !ok || len(arr) != 2 {
+		t.Fatalf("expected [key, element], got %v", resp)
+	}
+	if bs, ok := arr[0].(parser.BulkString); !ok || string(bs) != key {
+		t.Errorf("expected key %q, got %v", key, arr[0])
+	}
+	if bs, ok := arr[1].(parser.BulkString); !ok || string(bs) != elem {
+		t.Errorf("expected element %q, got %v", elem, arr[1])
+	}
+}
+
+func TestBLPopImmediate(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, reader := dial(t, srv)
+	defer conn.Close()
+
+	sendCmd(t, conn, reader, "RPUSH list2 x y")
+	resp := sendCmd(t, conn, reader, "BLPOP list1 list2 0")
+	expectKeyElem(t, resp, "list2", "x")
+
+	resp = sendCmd(t, conn, reader, "BRPOP list2 0")
+	expectKeyElem(t, resp, "list2", "y")
+}
+
+func TestBLPopWakesOnPush(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	blocked, blockedReader := dial(t, srv)
+	defer blocked.Close()
+	pusher, pusherReader := dial(t, srv)
+	defer pusher.Close()
+
+	sendOnly(t, blocked, "BLPOP mylist 5")
+	waitBlockedOn(t, srv.store, "mylist", 1)
+
+	resp := sendCmd(t, pusher, pusherReader, "RPUSH mylist a b")
+	if num, ok := resp.(parser.Integer); !ok || num != 2 {
+		t.Errorf("expected RPUSH to report 2, got %v", resp)
+	}
+	expectKeyElem(t, readReply(t, blocked, blockedReader), "mylist", "a")
+
+	resp = sendCmd(t, pusher, pusherReader, "LRANGE mylist 0 -1")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 1 {
+		t.Errorf("expected one element left, got %v", resp)
+	}
+}
+
+func TestBLPopWakesOnRenameAndCopy(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	blocked, blockedReader := dial(t, srv)
+	defer blocked.Close()
+	writer, writerReader := dial(t, srv)
+	defer writer.Close()
+
+	sendCmd(t, writer, writerReader, "RPUSH src a b")
+	// The first BLPOP takes "a" from dst, so the copy holds "b".
+	for _, tt := range []struct{ cmd, elem string }{{"RENAME src dst", "a"}, {"COPY dst dst2", "b"}} {
+		cmd, elem := tt.cmd, tt.elem
+		key := strings.Fields(cmd)[2]
+		sendOnly(t, blocked, "BLPOP "+key+" 5")
+		waitBlockedOn(t, srv.store, key, 1)
+		sendCmd(t, writer, writerReader, cmd)
+		expectKeyElem(t, readReply(t, blocked, blockedReader), key, elem)
+	}
+}
+
+func TestBLPopFIFOFairness(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	first, firstReader := dial(t, srv)
+	defer first.Close()
+	second, secondReader := dial(t, srv)
+	defer second.Close()
+	pusher, pusherReader := dial(t, srv)
+	defer pusher.Close()
+
+	sendOnly(t, first, "BLPOP q 5")
+	waitBlockedOn(t, srv.store, "q", 1)
+	sendOnly(t, second, "BLPOP q 5")
+	waitBlockedOn(t, srv.store, "q", 2)
+
+	sendCmd(t, pusher, pusherReader, "RPUSH q one")
+	expectKeyElem(t, readReply(t, first, firstReader), "q", "one")
+	waitBlockedOn(t, srv.store, "q", 1)
+
+	sendCmd(t, pusher, pusherReader, "RPUSH q two")
+	expectKeyElem(t, readReply(t, second, secondReader), "q", "two")
+}
+
+func TestBLPopTimeout(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, reader := dial(t, srv)
+	defer conn.Close()
+
+	start := time.Now()
+	resp := sendCmd(t, conn, reader, "BLPOP empty 0.1")
+	if resp != nil {
+		t.Errorf("expected null reply, got %v", resp)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("returned before the timeout elapsed")
+	}
+	waitBlockedOn(t, srv.store, "empty", 0)
+}
+
+func TestBLPopTimeoutErrors(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, reader := dial(t, srv)
+	defer conn.Close()
+
+	resp := sendCmd(t, conn, reader, "BLPOP k -1")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR timeout is negative" {
+		t.Errorf("expected negative timeout error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BLPOP k abc")
+	if err, ok := resp.(parser.Error); !ok || !bytes.Contains([]byte(err), []byte("not a float")) {
+		t.Errorf("expected float error, got %v", resp)
+	}
+}
+
+func TestBLPopWrongType(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, reader := dial(t, srv)
+	defer conn.Close()
+
+	sendCmd(t, conn, reader, "SET str v")
+	resp := sendCmd(t, conn, reader, "BLPOP str 0")
+	if err, ok := resp.(parser.Error); !ok || !bytes.Contains([]byte(err), []byte("WRONGTYPE")) {
+		t.Errorf("expected WRONGTYPE, got %v", resp)
+	}
+}
+
+func TestBLPopKeyTypeChangeWhileBlocked(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	blocked, blockedReader := dial(t, srv)
+	defer blocked.Close()
+	other, otherReader := dial(t, srv)
+	defer other.Close()
+
+	sendOnly(t, blocked, "BLPOP k 5")
+	waitBlockedOn(t, srv.store, "k", 1)
+
+	// A string under the key, then its deletion, must not wake the client.
+	sendCmd(t, other, otherReader, "SET k v")
+	sendCmd(t, other, otherReader, "DEL k")
+	waitBlockedOn(t, srv.store, "k", 1)
+
+	sendCmd(t, other, otherReader, "LPUSH k x")
+	expectKeyElem(t, readReply(t, blocked, blockedReader), "k", "x")
+}
+
+func TestBLMoveWakesAndChains(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	mover, moverReader := dial(t, srv)
+	defer mover.Close()
+	popper, popperReader := dial(t, srv)
+	defer popper.Close()
+	pusher, pusherReader := dial(t, srv)
+	defer pusher.Close()
+
+	sendOnly(t, mover, "BLMOVE src dst LEFT RIGHT 5")
+	waitBlockedOn(t, srv.store, "src", 1)
+	sendOnly(t, popper, "BLPOP dst 5")
+	waitBlockedOn(t, srv.store, "dst", 1)
+
+	sendCmd(t, pusher, pusherReader, "RPUSH src item")
+
+	if bs, ok := readReply(t, mover, moverReader).(parser.BulkString); !ok || string(bs) != "item" {
+		t.Errorf("expected BLMOVE to return 'item', got %v", bs)
+	}
+	expectKeyElem(t, readReply(t, popper, popperReader), "dst", "item")
+}
+
+func TestBLMoveWrongDestinationType(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	mover, moverReader := dial(t, srv)
+	defer mover.Close()
+	other, otherReader := dial(t, srv)
+	defer other.Close()
+
+	sendOnly(t, mover, "BLMOVE src dst LEFT RIGHT 5")
+	waitBlockedOn(t, srv.store, "src", 1)
+
+	sendCmd(t, other, otherReader, "SET dst notalist")
+	sendCmd(t, other, otherReader, "RPUSH src foo")
+
+	resp := readReply(t, mover, moverReader)
+	if err, ok := resp.(parser.Error); !ok || !bytes.Contains([]byte(err), []byte("WRONGTYPE")) {
+		t.Errorf("expected WRONGTYPE, got %v", resp)
+	}
+	resp = sendCmd(t, other, otherReader, "LLEN src")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected element to stay in src, got %v", resp)
+	}
+}
+
+func TestBLMPop(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, reader := dial(t, srv)
+	defer conn.Close()
+
+	sendCmd(t, conn, reader, "RPUSH l2 a b c")
+	resp := sendCmd(t, conn, reader, "BLMPOP 0 2 l1 l2 RIGHT COUNT 2")
+	arr, ok := resp.(parser.Array)
+	if !ok || len(arr) != 2 {
+		t.Fatalf("expected [key, elements], got %v", resp)
+	}
+	if bs, ok := arr[0].(parser.BulkString); !ok || string(bs) != "l2" {
+		t.Errorf("expected key l2, got %v", arr[0])
+	}
+	elems, ok := arr[1].(parser.Array)
+	if !ok || len(elems) != 2 {
+		t.Fatalf("expected 2 elements, got %v", arr[1])
+	}
+	expected := []string{"c", "b"}
+	for i, v := range elems {
+		if bs, ok := v.(parser.BulkString); !ok || string(bs) != expected[i] {
+			t.Errorf("index %d: expected %q, got %v", i, expected[i], v)
+		}
+	}
+
+	resp = sendCmd(t, conn, reader, "BLMPOP 0 0 l1 LEFT")
+	if err, ok := resp.(parser.Error); !ok || !bytes.Contains([]byte(err), []byte("numkeys")) {
+		t.Errorf("expected numkeys error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BLMPOP 0 1 l1 UP")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR syntax error" {
+		t.Errorf("expected syntax error, got %v", resp)
+	}
+}
+
+func TestClientUnblock(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	blocked, blockedReader := dial(t, srv)
+	defer blocked.Close()
+	other, otherReader := dial(t, srv)
+	defer other.Close()
+
+	idResp := sendCmd(t, blocked, blockedReader, "CLIENT ID")
+	id, ok := idResp.(parser.Integer)
+	if !ok {
+		t.Fatalf("expected integer id, got %v", idResp)
+	}
+
+	sendOnly(t, blocked, "BLPOP k 0")
+	waitBlockedOn(t, srv.store, "k", 1)
+	resp := sendCmd(t, other, otherReader, "CLIENT UNBLOCK "+strconv.FormatInt(int64(id), 10))
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	if resp := readReply(t, blocked, blockedReader); resp != nil {
+		t.Errorf("expected null reply, got %v", resp)
+	}
+
+	sendOnly(t, blocked, "BLPOP k 0")
+	waitBlockedOn(t, srv.store, "k", 1)
+	sendCmd(t, other, otherReader, "CLIENT UNBLOCK "+strconv.FormatInt(int64(id), 10)+" ERROR")
+	resp = readReply(t, blocked, blockedReader)
+	if err, ok := resp.(parser.Error); !ok || !bytes.HasPrefix([]byte(err), []byte("UNBLOCKED")) {
+		t.Errorf("expected UNBLOCKED error, got %v", resp)
+	}
+
+	// Client is no longer blocked.
+	resp = sendCmd(t, other, otherReader, "CLIENT UNBLOCK "+strconv.FormatInt(int64(id), 10))
+	if num, ok := resp.(parser.Integer); !ok || num != 0 {
+		t.Errorf("expected 0, got %v", resp)
+	}
+}
+
+func TestBLPopDisconnectReleasesWaiter(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	blocked, _ := dial(t, srv)
+	other, otherReader := dial(t, srv)
+	defer other.Close()
+
+	sendOnly(t, blocked, "BLPOP k 0")
+	waitBlockedOn(t, srv.store, "k", 1)
+	blocked.Close()
+	waitBlockedOn(t, srv.store, "k", 0)
+
+	// The element must not be consumed by the gone client.
+	sendCmd(t, other, otherReader, "RPUSH k x")
+	resp := sendCmd(t, other, otherReader, "LLEN k")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+}
@@ -0,0 +1,499 @@
+package redis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// Bloom filters follow RedisBloom: a scaling filter is a chain of
+// sub-filters, each `expansion` times larger than the one before and with
+// half its error rate, so the overall false positive rate stays bounded as
+// the filter grows. A non-scaling filter refuses items once it is full.
+const (
+	bloomDefaultErrorRate = 0.01
+	bloomDefaultCapacity  = 100
+	bloomDefaultExpansion = 2
+	bloomTighteningRatio  = 0.5
+	bloomHashSeed         = 0xc6a4a7935bd1e995
+)
+
+var (
+	errBloomNotFound  = fmt.Errorf("ERR not found")
+	errBloomExists    = fmt.Errorf("ERR item exists")
+	errBloomFull      = fmt.Errorf("ERR non scaling filter is full")
+	errBloomTooLarge  = fmt.Errorf("ERR filter is too large")
+	errSketchCorrupt  = fmt.Errorf("ERR corrupt payload for a probabilistic type")
+	errBloomErrorRate = fmt.Errorf("ERR 0 < error rate range < 1")
+)
+
+type bloomLayer struct {
+	bits      []uint64
+	hashes    int
+	capacity  int64
+	items     int64
+	errorRate float64
+}
+
+type bloomFilter struct {
+	layers    []*bloomLayer
+	expansion int64 // 0 for a non-scaling filter
+}
+
+// bloomLayerWords returns the number of 64-bit words a sub-filter for
+// capacity items at errorRate needs, along with its number of hashes.
+func bloomLayerWords(capacity int64, errorRate float64) (uint64, int) {
+	bpe := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	bits := math.Ceil(float64(capacity) * bpe)
+	return uint64(math.Ceil(bits / 64)), int(math.Ceil(math.Ln2 * bpe))
+}
+
+func newBloomLayer(capacity int64, errorRate float64) (*bloomLayer, error) {
+	words, hashes := bloomLayerWords(capacity, errorRate)
+	if words*8 > maxStringSize {
+		return nil, errBloomTooLarge
+	}
+	return &bloomLayer{
+		bits:      make([]uint64, words),
+		hashes:    hashes,
+		capacity:  capacity,
+		errorRate: errorRate,
+	}, nil
+}
+
+func newBloomFilter(capacity int64, errorRate float64, expansion int64) (*bloomFilter, error) {
+	layer, err := newBloomLayer(capacity, errorRate)
+	if err != nil {
+		return nil, err
+	}
+	return &bloomFilter{layers: []*bloomLayer{layer}, expansion: expansion}, nil
+}
+
+// bloomHash returns the two hashes that double hashing derives every bit
+// position from.
+func bloomHash(item []byte) (uint64, uint64) {
+	a := murmurHash64A(item, bloomHashSeed)
+	return a, murmurHash64A(item, a)
+}
+
+func (l *bloomLayer) test(a, b uint64) bool {
+	nbits := uint64(len(l.bits)) * 64
+	for i := 0; i < l.hashes; i++ {
+		x := (a + uint64(i)*b) % nbits
+		if l.bits[x/64]&(1<<(x%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *bloomLayer) set(a, b uint64) {
+	nbits := uint64(len(l.bits)) * 64
+	for i := 0; i < l.hashes; i++ {
+		x := (a + uint64(i)*b) % nbits
+		l.bits[x/64] |= 1 << (x % 64)
+	}
+}
+
+func (f *bloomFilter) exists(item []byte) bool {
+	a, b := bloomHash(item)
+	for _, l := range f.layers {
+		if l.test(a, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// add inserts item and reports whether it was new, growing the filter once
+// the newest sub-filter has reached its capacity.
+func (f *bloomFilter) add(item []byte) (bool, error) {
+	a, b := bloomHash(item)
+	for _, l := range f.layers {
+		if l.test(a, b) {
+			return false, nil
+		}
+	}
+	last := f.layers[len(f.layers)-1]
+	if last.items >= last.capacity {
+		if f.expansion == 0 {
+			return false, errBloomFull
+		}
+		next, err := newBloomLayer(last.capacity*f.expansion, last.errorRate*bloomTighteningRatio)
+		if err != nil {
+			return false, err
+		}
+		f.layers = append(f.layers, next)
+		last = next
+	}
+	last.set(a, b)
+	last.items++
+	return true, nil
+}
+
+func (f *bloomFilter) capacity() int64 {
+	n := int64(0)
+	for _, l := range f.layers {
+		n += l.capacity
+	}
+	return n
+}
+
+func (f *bloomFilter) items() int64 {
+	n := int64(0)
+	for _, l := range f.layers {
+		n += l.items
+	}
+	return n
+}
+
+func (f *bloomFilter) size() int64 {
+	n := int64(0)
+	for _, l := range f.layers {
+		n += int64(len(l.bits)) * 8
+	}
+	return n
+}
+
+// encode returns the persisted form of the filter: the expansion and layer
+// count, then each layer's parameters followed by its bit array.
+func (f *bloomFilter) encode() []byte {
+	b := binary.LittleEndian.AppendUint64(nil, uint64(f.expansion))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(f.layers)))
+	for _, l := range f.layers {
+		b = binary.LittleEndian.AppendUint64(b, uint64(l.capacity))
+		b = binary.LittleEndian.AppendUint64(b, uint64(l.items))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(l.errorRate))
+		b = binary.LittleEndian.AppendUint32(b, uint32(l.hashes))
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(l.bits)))
+		for _, w := range l.bits {
+			b = binary.LittleEndian.AppendUint64(b, w)
+		}
+	}
+	return b
+}
+
+func decodeBloomFilter(data []byte) (*bloomFilter, error) {
+	r := &sketchReader{b: data}
+	f := &bloomFilter{expansion: int64(r.u64())}
+	n := r.u32()
+	if f.expansion < 0 || n == 0 {
+		return nil, errSketchCorrupt
+	}
+	for i := uint32(0); i < n && !r.err; i++ {
+		l := &bloomLayer{
+			capacity:  int64(r.u64()),
+			items:     int64(r.u64()),
+			errorRate: math.Float64frombits(r.u64()),
+			hashes:    int(r.u32()),
+		}
+		words := r.u64()
+		if l.capacity <= 0 || l.items < 0 || l.hashes <= 0 || words == 0 || words > uint64(len(r.b))/8 {
+			return nil, errSketchCorrupt
+		}
+		l.bits = make([]uint64, words)
+		for j := range l.bits {
+			l.bits[j] = r.u64()
+		}
+		f.layers = append(f.layers, l)
+	}
+	if err := r.done(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// sketchReader decodes the persisted form of the probabilistic types. It
+// remembers a short read instead of failing at once, so decoders can check
+// a single error at the end.
+type sketchReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *sketchReader) u64() uint64 {
+	if len(r.b) < 8 {
+		r.err = true
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *sketchReader) u32() uint32 {
+	if len(r.b) < 4 {
+		r.err = true
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sketchReader) bytes(n uint64) []byte {
+	if uint64(len(r.b)) < n {
+		r.err = true
+		return nil
+	}
+	v := r.b[:n:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sketchReader) done() error {
+	if r.err || len(r.b) != 0 {
+		return errSketchCorrupt
+	}
+	return nil
+}
+
+// getBloom returns the Bloom filter stored at key. Caller must hold s.mu.
+func (s *Store) getBloom(key string) (*bloomFilter, bool, error) {
+	val, exists := s.lookupKeyRead(key)
+	if !exists {
+		return nil, false, nil
+	}
+	f, ok := val.(*bloomFilter)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return f, true, nil
+}
+
+// getBloomForWrite is getBloom for callers holding s.mu for writing.
+func (s *Store) getBloomForWrite(key string) (*bloomFilter, bool, error) {
+	val, exists := s.lookupKeyWrite(key)
+	if !exists {
+		return nil, false, nil
+	}
+	f, ok := val.(*bloomFilter)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return s.mutable(key, f).(*bloomFilter), true, nil
+}
+
+// BFReserve creates an empty filter at key. An expansion of 0 makes it
+// non-scaling.
+func (s *Store) BFReserve(key string, errorRate float64, capacity, expansion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.lookupKeyWrite(key); exists {
+		return errBloomExists
+	}
+	f, err := newBloomFilter(capacity, errorRate, expansion)
+	if err != nil {
+		return err
+	}
+	s.setKey(key, f)
+	return nil
+}
+
+// BFAdd adds items to the filter at key, creating it with the default
+// parameters if needed, and reports for each item whether it was new.
+func (s *Store) BFAdd(key string, items ...[]byte) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists, err := s.getBloomForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if f, err = newBloomFilter(bloomDefaultCapacity, bloomDefaultErrorRate, bloomDefaultExpansion); err != nil {
+			return nil, err
+		}
+		s.setKey(key, f)
+	}
+	added := make([]bool, len(items))
+	for i, item := range items {
+		if added[i], err = f.add(item); err != nil {
+			return nil, err
+		}
+	}
+	return added, nil
+}
+
+// BFExists reports for each item whether it may have been added.
+func (s *Store) BFExists(key string, items ...[]byte) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, exists, err := s.getBloom(key)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(items))
+	if exists {
+		for i, item := range items {
+			found[i] = f.exists(item)
+		}
+	}
+	return found, nil
+}
+
+// BFInfo returns the filter's capacity, size in bytes, number of
+// sub-filters, number of items and expansion rate.
+func (s *Store) BFInfo(key string) ([5]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, exists, err := s.getBloom(key)
+	if err != nil {
+		return [5]int64{}, err
+	}
+	if !exists {
+		return [5]int64{}, errBloomNotFound
+	}
+	return [5]int64{f.capacity(), f.size(), int64(len(f.layers)), f.items(), f.expansion}, nil
+}
+
+func boolsReply(bs []bool) parser.Value {
+	reply := make(parser.Array, len(bs))
+	for i, b := range bs {
+		if b {
+			reply[i] = parser.Integer(1)
+		} else {
+			reply[i] = parser.Integer(0)
+		}
+	}
+	return reply
+}
+
+// byteArgs returns the bulk string arguments as byte slices.
+func byteArgs(args []parser.Value) ([][]byte, bool) {
+	out := make([][]byte, len(args))
+	for i, a := range args {
+		bs, ok := a.(parser.BulkString)
+		if !ok {
+			return nil, false
+		}
+		out[i] = []byte(bs)
+	}
+	return out, true
+}
+
+func handleBFReserve(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	errorRate, err := strconv.ParseFloat(strs[1], 64)
+	if err != nil {
+		return parser.Error("ERR bad error rate")
+	}
+	capacity, err := strconv.ParseInt(strs[2], 10, 64)
+	if err != nil || capacity >= math.MaxUint32 {
+		return parser.Error("ERR bad capacity")
+	}
+	if errorRate <= 0 || errorRate >= 1 {
+		return parser.Error(errBloomErrorRate.Error())
+	}
+	if capacity <= 0 {
+		return parser.Error("ERR (capacity should be larger than 0)")
+	}
+	expansion, nonScaling := int64(bloomDefaultExpansion), false
+	for i := 3; i < len(strs); i++ {
+		switch strings.ToUpper(strs[i]) {
+		case "NONSCALING":
+			nonScaling = true
+		case "EXPANSION":
+			if i+1 == len(strs) {
+				return parser.Error("ERR syntax error")
+			}
+			i++
+			if expansion, err = strconv.ParseInt(strs[i], 10, 64); err != nil {
+				return parser.Error("ERR bad expansion")
+			}
+			if expansion < 1 {
+				return parser.Error("ERR expansion should be greater or equal to 1")
+			}
+		default:
+			return parser.Error("ERR syntax error")
+		}
+	}
+	if nonScaling {
+		expansion = 0
+	}
+	if err := store.BFReserve(strs[0], errorRate, capacity, expansion); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleBFAdd(store *Store, args []parser.Value) parser.Value {
+	reply := handleBFMAdd(store, args)
+	if arr, ok := reply.(parser.Array); ok {
+		return arr[0]
+	}
+	return reply
+}
+
+func handleBFMAdd(store *Store, args []parser.Value) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	added, err := store.BFAdd(string(items[0]), items[1:]...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return boolsReply(added)
+}
+
+func handleBFExists(store *Store, args []parser.Value) parser.Value {
+	reply := handleBFMExists(store, args)
+	if arr, ok := reply.(parser.Array); ok {
+		return arr[0]
+	}
+	return reply
+}
+
+func handleBFMExists(store *Store, args []parser.Value) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	found, err := store.BFExists(string(items[0]), items[1:]...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return boolsReply(found)
+}
+
+func handleBFInfo(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if len(strs) > 2 {
+		return parser.Error("ERR wrong number of arguments for 'BF.INFO' command")
+	}
+	info, err := store.BFInfo(strs[0])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	names := []string{"Capacity", "Size", "Number of filters", "Number of items inserted", "Expansion rate"}
+	value := func(i int) parser.Value {
+		if i == 4 && info[i] == 0 {
+			return parser.BulkString(nil)
+		}
+		return parser.Integer(info[i])
+	}
+	if len(strs) == 2 {
+		fields := []string{"CAPACITY", "SIZE", "FILTERS", "ITEMS", "EXPANSION"}
+		for i, field := range fields {
+			if strings.EqualFold(strs[1], field) {
+				return parser.Array{value(i)}
+			}
+		}
+		return parser.Error("ERR Invalid information value")
+	}
+	reply := make(parser.Array, 0, 2*len(names))
+	for i, name := range names {
+		reply = append(reply, parser.SimpleString(name), value(i))
+	}
+	return reply
+}
@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestBloomScaling(t *testing.T) {
+	store := newStore()
+	if err := store.BFReserve("bf", 0.01, 100, 2); err != nil {
+		t.Fatalf("BFReserve: %v", err)
+	}
+	if err := store.BFReserve("bf", 0.01, 100, 2); err != errBloomExists {
+		t.Errorf("expected item exists error, got %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := store.BFAdd("bf", []byte(fmt.Sprintf("item:%d", i))); err != nil {
+			t.Fatalf("BFAdd: %v", err)
+		}
+	}
+	info, _ := store.BFInfo("bf")
+	// 100 + 200 + 400 + 800 is the first capacity to hold 1000 items.
+	if info[0] != 1500 || info[2] != 4 || info[4] != 2 {
+		t.Errorf("unexpected info %v", info)
+	}
+	if info[3] > 1000 || info[3] < 980 {
+		t.Errorf("expected close to 1000 items, got %d", info[3])
+	}
+	for i := 0; i < 1000; i++ {
+		if found, _ := store.BFExists("bf", []byte(fmt.Sprintf("item:%d", i))); !found[0] {
+			t.Fatalf("false negative for item:%d", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if found, _ := store.BFExists("bf", []byte(fmt.Sprintf("other:%d", i))); found[0] {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("false positive rate too high: %d/10000", falsePositives)
+	}
+}
+
+func TestBloomNonScaling(t *testing.T) {
+	store := newStore()
+	store.BFReserve("bf", 0.001, 10, 0)
+	var err error
+	for i := 0; i < 20 && err == nil; i++ {
+		_, err = store.BFAdd("bf", []byte(fmt.Sprintf("%d", i)))
+	}
+	if err != errBloomFull {
+		t.Errorf("expected full error, got %v", err)
+	}
+	if added, _ := store.BFAdd("new", []byte("a"), []byte("a")); !added[0] || added[1] {
+		t.Errorf("expected BFAdd to create a filter, got %v", added)
+	}
+	if info, _ := store.BFInfo("new"); info[0] != bloomDefaultCapacity {
+		t.Errorf("expected default capacity, got %v", info)
+	}
+	if _, err := store.BFInfo("missing"); err != errBloomNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestBloomEncoding(t *testing.T) {
+	f, _ := newBloomFilter(10, 0.01, 2)
+	for i := 0; i < 50; i++ {
+		f.add([]byte(fmt.Sprintf("%d", i)))
+	}
+	data := f.encode()
+	g, err := decodeBloomFilter(data)
+	if err != nil {
+		t.Fatalf("decodeBloomFilter: %v", err)
+	}
+	if string(g.encode()) != string(data) {
+		t.Errorf("encoding does not round trip")
+	}
+	for i := 0; i < 50; i++ {
+		if !g.exists([]byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("decoded filter lost %d", i)
+		}
+	}
+	for _, bad := range [][]byte{nil, data[:len(data)-1], append(data, 0)} {
+		if _, err := decodeBloomFilter(bad); err != errSketchCorrupt {
+			t.Errorf("expected corrupt payload error, got %v", err)
+		}
+	}
+}
+
+func TestBloomCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp := sendCmd(t, conn, reader, "BF.RESERVE bf 0.001 1000 NONSCALING")
+	if str, ok := resp.(parser.SimpleString); !ok || str != "OK" {
+		t.Errorf("expected OK, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BF.RESERVE bad 1 1000")
+	if err, ok := resp.(parser.Error); !ok || err != "ERR 0 < error rate range < 1" {
+		t.Errorf("expected error rate error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BF.ADD bf a")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BF.MADD bf a b")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 2 || arr[0] != parser.Integer(0) || arr[1] != parser.Integer(1) {
+		t.Errorf("expected [0 1], got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BF.MEXISTS bf a c")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 2 || arr[0] != parser.Integer(1) || arr[1] != parser.Integer(0) {
+		t.Errorf("expected [1 0], got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BF.INFO bf ITEMS")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 1 || arr[0] != parser.Integer(2) {
+		t.Errorf("expected [2], got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "BF.INFO bf")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 10 || arr[0] != parser.SimpleString("Capacity") || arr[9] != nil {
+		t.Errorf("unexpected BF.INFO reply %v", resp)
+	}
+
+	sendCmd(t, conn, reader, "SET str x")
+	resp = sendCmd(t, conn, reader, "BF.ADD str a")
+	if err, ok := resp.(parser.Error); !ok || string(err) != errWrongType.Error() {
+		t.Errorf("expected WRONGTYPE, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GET bf")
+	if err, ok := resp.(parser.Error); !ok || string(err) != errWrongType.Error() {
+		t.Errorf("expected WRONGTYPE, got %v", resp)
+	}
+}
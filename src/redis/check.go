@@ -0,0 +1,251 @@
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckRDBMain and CheckAOFMain validate persistence files without a
+// running server, like redis-check-rdb and redis-check-aof. They read files
+// with the same code that loads them at startup, and are run by the
+// check-rdb and check-aof commands:
+//
+//	go build -o check-rdb ./src/check-rdb/
+//	go build -o check-aof ./src/check-aof/
+//
+// Both return exit status 1 when a file is not valid.
+
+// newCheckStore returns a store to load files into. Save rules are off, so
+// checking never writes a snapshot.
+func newCheckStore() *Store {
+	s := newStore()
+	s.persistence.mu.Lock()
+	s.persistence.saveParams = nil
+	s.persistence.mu.Unlock()
+	return s
+}
+
+// rdbCheckStats counts what an RDB file holds.
+type rdbCheckStats struct {
+	keys    int
+	expires int
+	expired int
+	types   map[string]int
+	skipped map[string]int
+}
+
+func printCounts(out io.Writer, format string, counts map[string]int) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, format, counts[name], name)
+	}
+}
+
+func (st *rdbCheckStats) print(out io.Writer) {
+	fmt.Fprintf(out, "[info] %d keys read\n", st.keys)
+	fmt.Fprintf(out, "[info] %d expires\n", st.expires)
+	fmt.Fprintf(out, "[info] %d already expired\n", st.expired)
+	printCounts(out, "[info] %d keys of type %s\n", st.types)
+	printCounts(out, "[info] %d skipped: %s\n", st.skipped)
+}
+
+// checkRDBData loads an RDB file into store, printing its auxiliary fields
+// and the first error to out.
+func checkRDBData(store *Store, name string, data []byte, out io.Writer) (*rdbCheckStats, error) {
+	fmt.Fprintf(out, "[offset 0] Checking RDB file %s\n", name)
+	stats := &rdbCheckStats{types: map[string]int{}, skipped: map[string]int{}}
+	now := time.Now()
+	_, err := store.loadRDBData(data, func(e rdbEntry) {
+		stats.keys++
+		stats.types[typeName(e.val)]++
+		if !e.expireAt.IsZero() {
+			stats.expires++
+			if !e.expireAt.After(now) {
+				stats.expired++
+			}
+		}
+	}, rdbHooks{
+		aux: func(offset int, key, val []byte) {
+			fmt.Fprintf(out, "[offset %d] AUX FIELD %s = '%s'\n", offset, key, val)
+		},
+		skipped: func(key []byte, what string) {
+			stats.skipped[what]++
+		},
+		skipUnsupported: true,
+	})
+	if err != nil {
+		fmt.Fprintln(out, "--- RDB ERROR DETECTED ---")
+		var lerr *rdbLoadError
+		if errors.As(err, &lerr) {
+			fmt.Fprintf(out, "[offset %d] %v\n", lerr.offset, lerr.err)
+			if lerr.key != nil {
+				fmt.Fprintf(out, "[additional info] Reading key '%s'\n", lerr.key)
+			}
+		} else {
+			fmt.Fprintf(out, "[offset 0] %v\n", err)
+		}
+		return stats, err
+	}
+	if version, _ := strconv.Atoi(string(data[5:9])); version < 5 {
+		fmt.Fprintf(out, "[offset %d] RDB version %d has no checksum\n", len(data), version)
+	} else if binary.LittleEndian.Uint64(data[len(data)-8:]) == 0 {
+		fmt.Fprintf(out, "[offset %d] RDB file was saved with checksum disabled: no check performed\n", len(data))
+	} else {
+		fmt.Fprintf(out, "[offset %d] Checksum OK\n", len(data))
+	}
+	fmt.Fprintf(out, "[offset %d] \\o/ RDB looks OK! \\o/\n", len(data))
+	return stats, nil
+}
+
+// CheckRDBMain checks the RDB file named by its only argument and prints
+// how many keys of each type it holds.
+func CheckRDBMain(args []string, out io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintln(out, "Usage: check-rdb <rdb-file-name>")
+		return 1
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintf(out, "Cannot check RDB file %s: %v\n", args[0], err)
+		return 1
+	}
+	stats, err := checkRDBData(newCheckStore(), args[0], data, out)
+	stats.print(out)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// CheckAOFMain checks an AOF: a manifest and the files it lists, or a
+// single file. With --fix, a last file that is not valid is truncated to
+// its last valid command.
+func CheckAOFMain(args []string, out io.Writer) int {
+	fix := len(args) == 2 && args[0] == "--fix"
+	if fix {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(out, "Usage: check-aof [--fix] <file.manifest|file.aof>")
+		return 1
+	}
+	store := newCheckStore()
+	var ok bool
+	if isAOFManifest(args[0]) {
+		ok = checkMultiPartAOF(store, args[0], fix, out)
+	} else {
+		ok = checkAOFFile(store, args[0], fix, true, out)
+	}
+	counts := map[string]int{}
+	entries, release := store.snapshot()
+	for _, e := range entries {
+		counts[typeName(e.val)]++
+	}
+	release()
+	fmt.Fprintf(out, "[info] %d keys loaded\n", len(entries))
+	printCounts(out, "[info] %d keys of type %s\n", counts)
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+func isAOFManifest(path string) bool {
+	if strings.HasSuffix(path, ".manifest") {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 5)
+	_, err = io.ReadFull(f, head)
+	return err == nil && string(head) == "file "
+}
+
+func checkMultiPartAOF(store *Store, path string, fix bool, out io.Writer) bool {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var m *aofManifest
+		if m, err = parseAOFManifest(data); err == nil {
+			fmt.Fprintln(out, "Start checking Multi Part AOF")
+			files := m.files()
+			for i, f := range files {
+				if !checkAOFFile(store, filepath.Join(filepath.Dir(path), f.name), fix, i == len(files)-1, out) {
+					return false
+				}
+			}
+			fmt.Fprintln(out, "All AOF files and manifest are valid")
+			return true
+		}
+	}
+	fmt.Fprintf(out, "Invalid AOF manifest %s: %v\n", path, err)
+	return false
+}
+
+// checkAOFFile replays one file of an AOF into store. Only the last file
+// of an AOF can be fixed.
+func checkAOFFile(store *Store, path string, fix, last bool, out io.Writer) bool {
+	name := filepath.Base(path)
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot check AOF file %s: %v\n", path, err)
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 5)
+	if _, err := io.ReadFull(f, magic); err == nil && string(magic) == "REDIS" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			_, err = checkRDBData(store, name, data, out)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "AOF %s is not valid\n", name)
+			return false
+		}
+		fmt.Fprintf(out, "AOF %s is valid\n", name)
+		return true
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fmt.Fprintf(out, "Cannot check AOF file %s: %v\n", path, err)
+		return false
+	}
+	n, valid, err := store.replayAOF(f)
+	var size int64
+	if info, serr := f.Stat(); serr == nil {
+		size = info.Size()
+	}
+	fmt.Fprintf(out, "AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n", name, size, valid, size-valid)
+	if err == nil {
+		fmt.Fprintf(out, "AOF %s is valid, %d commands\n", name, n)
+		return true
+	}
+	fmt.Fprintln(out, err)
+	switch {
+	case !last:
+		fmt.Fprintf(out, "AOF %s is not valid, and only the last file of an AOF can be fixed\n", name)
+		return false
+	case !fix:
+		fmt.Fprintf(out, "AOF %s is not valid. Use the --fix option to try fixing it.\n", name)
+		return false
+	}
+	if err := os.Truncate(path, valid); err != nil {
+		fmt.Fprintf(out, "Failed to truncate AOF %s: %v\n", name, err)
+		return false
+	}
+	fmt.Fprintf(out, "Successfully truncated AOF %s from %d to %d bytes, %d commands kept\n", name, size, valid, n)
+	return true
+}
@@ -0,0 +1,136 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRDB(t *testing.T) {
+	var out bytes.Buffer
+	golden := filepath.Join("testdata", "redis-7.2.rdb")
+	if code := CheckRDBMain([]string{golden}, &out); code != 0 {
+		t.Fatalf("expected the golden file to be valid:\n%s", out.String())
+	}
+	for _, want := range []string{
+		"AUX FIELD redis-ver = '7.2.4'",
+		"Checksum OK",
+		"[info] 7 keys read",
+		"[info] 2 keys of type zset",
+		"[info] 1 keys of type ReJSON-RL",
+		"[info] 2 skipped: set",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, out.String())
+		}
+	}
+
+	data, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"truncated", data[:700], "[offset 691] corrupt RDB value\n[additional info] Reading key 'bf'"},
+		{"checksum", append(bytes.Clone(data[:len(data)-1]), data[len(data)-1]^1), fmt.Sprintf("[offset %d] wrong RDB checksum", len(data)-8)},
+		{"signature", []byte("RADIS0011"), "[offset 0] wrong signature"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "dump.rdb")
+		os.WriteFile(path, tt.data, 0o644)
+		out.Reset()
+		if code := CheckRDBMain([]string{path}, &out); code != 1 {
+			t.Errorf("%s: expected exit status 1, got %d", tt.name, code)
+		}
+		if !strings.Contains(out.String(), "--- RDB ERROR DETECTED ---\n"+tt.want) {
+			t.Errorf("%s: expected %q in:\n%s", tt.name, tt.want, out.String())
+		}
+	}
+}
+
+func TestCheckAOF(t *testing.T) {
+	store := newAOFStore(t)
+	run(store, "RPUSH", "list", "a", "b")
+	store.aof.propMu.Lock()
+	rw, err := store.beginRewrite(false)
+	store.aof.propMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.finishRewrite(rw); err != nil {
+		t.Fatal(err)
+	}
+	run(store, "SET", "a", "1")
+	run(store, "SET", "b", "2")
+	store.aof.propMu.Lock()
+	rw, err = store.beginRewrite(false)
+	store.aof.propMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(store, "SET", "c", "3")
+	store.StopAppendOnly()
+	defer store.finishRewrite(rw)
+
+	dir := filepath.Join(store.persistence.dir, defaultAppendDirname)
+	manifest := filepath.Join(dir, aofManifestName(defaultAppendFilename))
+	var out bytes.Buffer
+	if code := CheckAOFMain([]string{manifest}, &out); code != 0 {
+		t.Fatalf("expected the AOF to be valid:\n%s", out.String())
+	}
+	for _, want := range []string{
+		"AOF appendonly.aof.2.base.rdb is valid",
+		"AOF appendonly.aof.2.incr.aof is valid, 2 commands",
+		"All AOF files and manifest are valid",
+		"[info] 4 keys loaded",
+		"[info] 3 keys of type string",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, out.String())
+		}
+	}
+
+	last := filepath.Join(dir, "appendonly.aof.3.incr.aof")
+	complete, _ := os.ReadFile(last)
+	os.WriteFile(last, append(bytes.Clone(complete), "*2\r\n$3\r\nDEL"...), 0o644)
+	out.Reset()
+	if code := CheckAOFMain([]string{manifest}, &out); code != 1 {
+		t.Errorf("expected a truncated AOF to be reported")
+	}
+	want := fmt.Sprintf("AOF analyzed: filename=appendonly.aof.3.incr.aof, size=%d, ok_up_to=%d, diff=11", len(complete)+11, len(complete))
+	if !strings.Contains(out.String(), want) || !strings.Contains(out.String(), "Use the --fix option") {
+		t.Errorf("expected %q in:\n%s", want, out.String())
+	}
+	if data, _ := os.ReadFile(last); len(data) != len(complete)+11 {
+		t.Errorf("expected the file to be left alone without --fix")
+	}
+
+	out.Reset()
+	if code := CheckAOFMain([]string{"--fix", manifest}, &out); code != 0 {
+		t.Errorf("expected --fix to succeed:\n%s", out.String())
+	}
+	if data, _ := os.ReadFile(last); !bytes.Equal(data, complete) {
+		t.Errorf("expected the file to be truncated to its last valid command")
+	}
+	out.Reset()
+	if code := CheckAOFMain([]string{last}, &out); code != 0 || !strings.Contains(out.String(), "valid, 1 commands") {
+		t.Errorf("expected the fixed file to be valid on its own:\n%s", out.String())
+	}
+
+	earlier := filepath.Join(dir, "appendonly.aof.2.incr.aof")
+	data, _ := os.ReadFile(earlier)
+	os.WriteFile(earlier, data[:len(data)-2], 0o644)
+	out.Reset()
+	if code := CheckAOFMain([]string{"--fix", manifest}, &out); code != 1 || !strings.Contains(out.String(), "only the last file of an AOF can be fixed") {
+		t.Errorf("expected an earlier file not to be fixed:\n%s", out.String())
+	}
+	if got, _ := os.ReadFile(earlier); len(got) != len(data)-2 {
+		t.Errorf("expected the earlier file to be left alone")
+	}
+}
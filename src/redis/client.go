@@ -0,0 +1,163 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// Client is the per-connection state shared by the connection goroutine and
+// commands, such as CLIENT UNBLOCK, that act on other connections.
+type Client struct {
+	id     int64
+	conn   net.Conn
+	reader *bufio.Reader
+
+	mu      sync.Mutex
+	blocked *blockedClient
+
+	// Replication, owned by the connection goroutine. replica is set once
+	// the peer is a replica that sent PSYNC, and master on the client that
+	// applies the stream of our master. woff is the replication offset just
+	// past the last write of the client, for WAIT and WAITAOF.
+	replPort int
+	replAddr string
+	replica  *replica
+	master   *masterLink
+	woff     int64
+
+	// asking is set by ASKING for the next command, which may then access
+	// a slot this node is importing.
+	asking bool
+}
+
+type clientRegistry struct {
+	mu      sync.RWMutex
+	clients map[int64]*Client
+}
+
+var (
+	nextClientID atomic.Int64
+	clients      = &clientRegistry{clients: make(map[int64]*Client)}
+)
+
+func newClient(conn net.Conn, reader *bufio.Reader) *Client {
+	c := &Client{
+		id:     nextClientID.Add(1),
+		conn:   conn,
+		reader: reader,
+	}
+	clients.mu.Lock()
+	clients.clients[c.id] = c
+	clients.mu.Unlock()
+	return c
+}
+
+func (c *Client) close() {
+	clients.mu.Lock()
+	delete(clients.clients, c.id)
+	clients.mu.Unlock()
+	if c.replica != nil {
+		c.replica.store.removeReplica(c.replica)
+	}
+}
+
+func (r *clientRegistry) get(id int64) (*Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.clients[id]
+	return c, ok
+}
+
+// watchDisconnect reports, through the returned channel, the peer closing the
+// connection while the client is blocked and not reading commands. The stop
+// function must be called before the connection is read from again.
+func (c *Client) watchDisconnect() (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	if c.conn == nil {
+		return gone, func() {}
+	}
+	exited := make(chan struct{})
+	c.conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(exited)
+		if _, err := c.reader.Peek(1); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+			close(gone)
+		}
+	}()
+	return gone, func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-exited
+	}
+}
+
+func handleClient(c *Client, store *Store, args []parser.Value) parser.Value {
+	sub, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	switch strings.ToUpper(string(sub)) {
+	case "ID":
+		if len(args) != 2 {
+			return parser.Error("ERR wrong number of arguments for 'client|id' command")
+		}
+		return parser.Integer(c.id)
+	case "UNBLOCK":
+		return handleClientUnblock(args)
+	default:
+		return parser.Error("ERR unknown subcommand '" + string(sub) + "'. Try CLIENT HELP.")
+	}
+}
+
+func handleClientUnblock(args []parser.Value) parser.Value {
+	if len(args) != 3 && len(args) != 4 {
+		return parser.Error("ERR wrong number of arguments for 'client|unblock' command")
+	}
+	idBS, ok := args[2].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	id, err := strconv.ParseInt(string(idBS), 10, 64)
+	if err != nil {
+		return parser.Error("ERR value is not an integer or out of range")
+	}
+	reason := unblockTimeout
+	if len(args) == 4 {
+		optBS, ok := args[3].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+		switch strings.ToUpper(string(optBS)) {
+		case "TIMEOUT":
+			reason = unblockTimeout
+		case "ERROR":
+			reason = unblockError
+		default:
+			return parser.Error("ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR")
+		}
+	}
+	target, ok := clients.get(id)
+	if !ok {
+		return parser.Integer(0)
+	}
+	target.mu.Lock()
+	bc := target.blocked
+	target.mu.Unlock()
+	if bc == nil {
+		return parser.Integer(0)
+	}
+	select {
+	case bc.unblock <- reason:
+	default:
+	}
+	return parser.Integer(1)
+}
@@ -0,0 +1,950 @@
+package redis
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// Cluster mode works as in Redis Cluster. The key space is split into
+// 16384 hash slots, each served by one master. A command whose keys hash to
+// a slot served by another node is answered with -MOVED <slot> <ip:port>,
+// and the client retries there. While a slot migrates, keys that already
+// moved are answered with -ASK instead: the client sends ASKING then the
+// command to the importing node, for that one command only.
+//
+// Nodes learn of each other, and of the slots each serves, over the
+// cluster bus; see clusterbus.go. The configuration is kept in nodes.conf,
+// so that a node restarts with the same ID and view of the cluster.
+const (
+	clusterBusPortOffset     = 10000
+	defaultClusterConfigFile = "nodes.conf"
+	clusterStateOK           = "ok"
+	clusterStateFail         = "fail"
+)
+
+// clusterNode is a node of the cluster as this node sees it.
+type clusterNode struct {
+	id           string
+	ip           string
+	port         int
+	busPort      int
+	master       *clusterNode // nil for masters
+	configEpoch  uint64
+	flags        int // nodePFail, nodeFail, nodeHandshake, nodeNoAddr, nodeMeet
+	ctime        time.Time
+	pingSent     time.Time
+	pongReceived time.Time
+	failTime     time.Time
+	// failReports holds when each master last reported the node as
+	// failing.
+	failReports map[string]time.Time
+	link        *clusterLink // outbound, nil while disconnected
+	connecting  bool
+	replOffset  int64
+}
+
+// clusterState is the configuration of the cluster as this node sees it:
+// the nodes it knows and the node serving each slot. migrating and
+// importing hold the target and source of the slots being moved to or
+// from this node.
+type clusterState struct {
+	mu           sync.RWMutex
+	enabled      bool // set at startup only
+	myself       *clusterNode
+	nodes        map[string]*clusterNode
+	currentEpoch uint64
+	slots        [clusterSlots]*clusterNode
+	migrating    [clusterSlots]*clusterNode
+	importing    [clusterSlots]*clusterNode
+	state        string
+
+	nodeTimeout         time.Duration
+	requireFullCoverage bool
+	port                int    // of the bus, 0 for the client port plus 10000
+	configFile          string // nodes.conf, in dir
+	configPath          string // set at startup
+	todoSave            bool
+
+	// blacklist holds the nodes forgotten with CLUSTER FORGET, until when
+	// gossip about them is ignored.
+	blacklist     map[string]time.Time
+	links         map[*clusterLink]bool
+	listener      net.Listener
+	done          chan struct{}
+	statsSent     [clusterMsgTypes]uint64
+	statsReceived [clusterMsgTypes]uint64
+}
+
+// slotKeys holds the keys of each hash slot, so that the CLUSTER commands
+// looking at one slot don't walk the whole dataset. It is only kept in
+// cluster mode.
+type slotKeys [clusterSlots]map[string]struct{}
+
+func (sk *slotKeys) add(key string) {
+	slot := keyHashSlot(key)
+	if sk[slot] == nil {
+		sk[slot] = make(map[string]struct{})
+	}
+	sk[slot][key] = struct{}{}
+}
+
+func (sk *slotKeys) remove(key string) {
+	slot := keyHashSlot(key)
+	delete(sk[slot], key)
+	if len(sk[slot]) == 0 {
+		sk[slot] = nil
+	}
+}
+
+// enableCluster turns on cluster mode, with the configuration saved in
+// nodes.conf or else as a new master serving no slots. It must be called
+// before the dataset is loaded.
+func (s *Store) enableCluster() error {
+	s.persistence.mu.Lock()
+	dir := s.persistence.dir
+	s.persistence.mu.Unlock()
+	cs := &s.cluster
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.enabled = true
+	cs.configPath = filepath.Join(dir, cs.configFile)
+	cs.links = make(map[*clusterLink]bool)
+	cs.blacklist = make(map[string]time.Time)
+	loaded, err := cs.loadConfig(cs.configPath)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", cs.configPath, err)
+	}
+	if !loaded {
+		// Node IDs are random like replication IDs.
+		cs.myself = &clusterNode{id: newReplID(), ctime: time.Now()}
+		cs.nodes = map[string]*clusterNode{cs.myself.id: cs.myself}
+		log.Printf("No cluster configuration found, I'm %s", cs.myself.id)
+	}
+	cs.myself.port = s.repl.port
+	cs.myself.busPort = cs.port
+	if cs.port == 0 {
+		cs.myself.busPort = s.repl.port + clusterBusPortOffset
+	}
+	cs.updateStateLocked()
+	cs.todoSave = true
+	if err := s.saveClusterConfigLocked(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.slotKeys = new(slotKeys)
+	s.mu.Unlock()
+	return nil
+}
+
+func (n *clusterNode) addr() string {
+	return n.ip + ":" + strconv.Itoa(n.port)
+}
+
+// clusterRedirect checks that the keys of a command hash to a single slot
+// this node serves. Otherwise it returns the error or the redirect to reply
+// with. It also ends the effect of ASKING, which only covers the next
+// command.
+func (s *Store) clusterRedirect(c *Client, arr parser.Array) parser.Value {
+	asking := c.asking
+	c.asking = false
+	if !s.cluster.enabled {
+		return nil
+	}
+	name, ok := arr[0].(parser.BulkString)
+	if !ok {
+		return nil
+	}
+	keys := getKeys(strings.ToUpper(string(name)), arr)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return parser.Error("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	cs := &s.cluster
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	n := cs.slots[slot]
+	if n == nil {
+		return parser.Error("CLUSTERDOWN Hash slot not served")
+	}
+	if cs.state != clusterStateOK {
+		return parser.Error("CLUSTERDOWN The cluster is down")
+	}
+	// Keys of a slot being moved may be on either side.
+	migrating := n == cs.myself && cs.migrating[slot] != nil
+	importing := n != cs.myself && cs.importing[slot] != nil
+	if migrating || importing {
+		missing := len(keys) - s.Exists(keys...)
+		switch {
+		case migrating && missing == len(keys):
+			return parser.Error(fmt.Sprintf("ASK %d %s", slot, cs.migrating[slot].addr()))
+		case migrating && missing > 0, importing && asking && len(keys) > 1 && missing > 0:
+			return parser.Error("TRYAGAIN Multiple keys request during rehashing of slot")
+		case importing && asking:
+			return nil
+		}
+	}
+	if n != cs.myself {
+		return parser.Error(fmt.Sprintf("MOVED %d %s", slot, n.addr()))
+	}
+	return nil
+}
+
+func handleAsking(c *Client, store *Store, args []parser.Value) parser.Value {
+	if !store.cluster.enabled {
+		return parser.Error("ERR This instance has cluster support disabled")
+	}
+	c.asking = true
+	return parser.SimpleString("OK")
+}
+
+func handleCluster(store *Store, args []parser.Value) parser.Value {
+	if !store.cluster.enabled {
+		return parser.Error("ERR This instance has cluster support disabled")
+	}
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	sub := strings.ToUpper(strs[0])
+	arity, known := clusterSubcommandArity[sub]
+	if !known {
+		return parser.Error("ERR unknown subcommand '" + strs[0] + "'. Try CLUSTER HELP.")
+	}
+	if !arityOK(arity, len(args)) {
+		return parser.Error("ERR wrong number of arguments for 'cluster|" + strings.ToLower(sub) + "' command")
+	}
+	cs := &store.cluster
+	switch sub {
+	case "KEYSLOT":
+		return parser.Integer(keyHashSlot(strs[1]))
+	case "COUNTKEYSINSLOT":
+		slot, err := strconv.Atoi(strs[1])
+		if err != nil {
+			return parser.Error("ERR value is not an integer or out of range")
+		}
+		if slot < 0 || slot >= clusterSlots {
+			return parser.Error("ERR Invalid slot")
+		}
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+		return parser.Integer(len(store.slotKeys[slot]))
+	case "GETKEYSINSLOT":
+		slot, err1 := strconv.Atoi(strs[1])
+		count, err2 := strconv.Atoi(strs[2])
+		if err1 != nil || err2 != nil {
+			return parser.Error("ERR value is not an integer or out of range")
+		}
+		if slot < 0 || slot >= clusterSlots || count < 0 {
+			return parser.Error("ERR Invalid slot or number of keys")
+		}
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+		reply := parser.Array{}
+		for key := range store.slotKeys[slot] {
+			if len(reply) == count {
+				break
+			}
+			reply = append(reply, parser.BulkString(key))
+		}
+		return reply
+	case "SLOTS":
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		return cs.slotsReply()
+	case "SHARDS":
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		return cs.shardsReply(store)
+	case "NODES":
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		return parser.BulkString(cs.nodesDescription(0))
+	case "ADDSLOTS", "DELSLOTS", "ADDSLOTSRANGE", "DELSLOTSRANGE":
+		reply := cs.changeSlots(sub, strs[1:])
+		store.saveClusterConfig()
+		return reply
+	case "SETSLOT":
+		reply := store.setSlot(strs[1:])
+		store.saveClusterConfig()
+		return reply
+	case "MEET":
+		return cs.meet(strs[1:])
+	case "FORGET":
+		reply := store.forgetNode(strs[1])
+		store.saveClusterConfig()
+		return reply
+	case "MYID":
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		return parser.BulkString(cs.myself.id)
+	case "INFO":
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		return parser.BulkString(cs.info())
+	case "RESET":
+		hard := false
+		if len(strs) > 2 {
+			return parser.Error("ERR syntax error")
+		}
+		if len(strs) == 2 {
+			switch strings.ToUpper(strs[1]) {
+			case "HARD":
+				hard = true
+			case "SOFT":
+			default:
+				return parser.Error("ERR syntax error")
+			}
+		}
+		return store.resetCluster(hard)
+	}
+	return nil
+}
+
+// clusterSubcommandArity holds the arity of each CLUSTER subcommand,
+// counting CLUSTER itself.
+var clusterSubcommandArity = map[string]int{
+	"KEYSLOT":         3,
+	"COUNTKEYSINSLOT": 3,
+	"GETKEYSINSLOT":   4,
+	"SLOTS":           2,
+	"SHARDS":          2,
+	"NODES":           2,
+	"ADDSLOTS":        -3,
+	"DELSLOTS":        -3,
+	"ADDSLOTSRANGE":   -4,
+	"DELSLOTSRANGE":   -4,
+	"SETSLOT":         -4,
+	"MEET":            -4,
+	"FORGET":          3,
+	"MYID":            2,
+	"INFO":            2,
+	"RESET":           -2,
+}
+
+func parseSlot(s string) (int, parser.Value) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, parser.Error("ERR Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// changeSlots assigns slots to this node or unassigns them, for ADDSLOTS,
+// DELSLOTS and their RANGE forms. Nothing changes unless every slot can.
+func (cs *clusterState) changeSlots(sub string, args []string) parser.Value {
+	var slots []int
+	if strings.HasSuffix(sub, "RANGE") {
+		if len(args)%2 != 0 {
+			return parser.Error("ERR wrong number of arguments for 'cluster|" + strings.ToLower(sub) + "' command")
+		}
+		for i := 0; i < len(args); i += 2 {
+			start, errReply := parseSlot(args[i])
+			if errReply != nil {
+				return errReply
+			}
+			end, errReply := parseSlot(args[i+1])
+			if errReply != nil {
+				return errReply
+			}
+			if start > end {
+				return parser.Error(fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", start, end))
+			}
+			for slot := start; slot <= end; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+	} else {
+		for _, arg := range args {
+			slot, errReply := parseSlot(arg)
+			if errReply != nil {
+				return errReply
+			}
+			slots = append(slots, slot)
+		}
+	}
+
+	add := strings.HasPrefix(sub, "ADD")
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if seen[slot] {
+			return parser.Error(fmt.Sprintf("ERR Slot %d specified multiple times", slot))
+		}
+		seen[slot] = true
+		if add && cs.slots[slot] != nil {
+			return parser.Error(fmt.Sprintf("ERR Slot %d is already busy", slot))
+		}
+		if !add && cs.slots[slot] == nil {
+			return parser.Error(fmt.Sprintf("ERR Slot %d is already unassigned", slot))
+		}
+	}
+	for _, slot := range slots {
+		if add {
+			cs.slots[slot] = cs.myself
+			// A slot being imported is ours now.
+			cs.importing[slot] = nil
+		} else {
+			cs.slots[slot] = nil
+		}
+	}
+	cs.todoSave = true
+	cs.updateStateLocked()
+	return parser.SimpleString("OK")
+}
+
+// setSlot handles CLUSTER SETSLOT <slot> IMPORTING|MIGRATING|NODE <id> and
+// CLUSTER SETSLOT <slot> STABLE.
+func (s *Store) setSlot(args []string) parser.Value {
+	slot, errReply := parseSlot(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	action := strings.ToUpper(args[1])
+	var n *clusterNode
+	cs := &s.cluster
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	switch action {
+	case "IMPORTING", "MIGRATING", "NODE":
+		if len(args) != 3 {
+			return parser.Error("ERR wrong number of arguments for 'cluster|setslot' command")
+		}
+		if n = cs.nodes[args[2]]; n == nil {
+			return parser.Error("ERR I don't know about node " + args[2])
+		}
+		if n.master != nil {
+			return parser.Error("ERR Target node is not a master")
+		}
+	case "STABLE":
+		if len(args) != 2 {
+			return parser.Error("ERR wrong number of arguments for 'cluster|setslot' command")
+		}
+	default:
+		return parser.Error("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+
+	switch action {
+	case "MIGRATING":
+		if cs.slots[slot] != cs.myself {
+			return parser.Error(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		if n == cs.myself {
+			return parser.Error("ERR I'm the owner of the slot, can't migrate it to myself")
+		}
+		cs.migrating[slot] = n
+	case "IMPORTING":
+		if cs.slots[slot] == cs.myself {
+			return parser.Error(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		if n == cs.myself {
+			return parser.Error("ERR I'm the target of the import, can't import from myself")
+		}
+		cs.importing[slot] = n
+	case "STABLE":
+		cs.migrating[slot], cs.importing[slot] = nil, nil
+	case "NODE":
+		if cs.slots[slot] == cs.myself && n != cs.myself && s.countKeysInSlot(slot) > 0 {
+			return parser.Error(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		// Once all its keys moved, the slot is handed over; once imported,
+		// it is ours, under a new config epoch so that the other nodes
+		// take our claim over that of the source.
+		if n != cs.myself {
+			cs.migrating[slot] = nil
+		} else if cs.importing[slot] != nil {
+			cs.importing[slot] = nil
+			cs.bumpConfigEpoch()
+		}
+		cs.slots[slot] = n
+		cs.updateStateLocked()
+	}
+	cs.todoSave = true
+	return parser.SimpleString("OK")
+}
+
+// bumpConfigEpoch gives this node a config epoch greater than any other
+// without agreement from the other masters, for slots taken over by hand.
+func (cs *clusterState) bumpConfigEpoch() {
+	var maxEpoch uint64
+	for _, n := range cs.nodes {
+		maxEpoch = max(maxEpoch, n.configEpoch)
+	}
+	maxEpoch = max(maxEpoch, cs.currentEpoch)
+	if cs.myself.configEpoch == 0 || cs.myself.configEpoch != maxEpoch {
+		cs.currentEpoch++
+		cs.myself.configEpoch = cs.currentEpoch
+		log.Printf("New configEpoch set to %d", cs.myself.configEpoch)
+	}
+}
+
+// meet handles CLUSTER MEET <ip> <port> [<cport>], starting a handshake
+// with the node at that address.
+func (cs *clusterState) meet(args []string) parser.Value {
+	if len(args) > 3 {
+		return parser.Error("ERR wrong number of arguments for 'cluster|meet' command")
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port < 0 || port > 65535 {
+		return parser.Error("ERR Invalid base port specified: " + args[1])
+	}
+	cport := port + clusterBusPortOffset
+	if len(args) == 3 {
+		if cport, err = strconv.Atoi(args[2]); err != nil || cport < 0 || cport > 65535 {
+			return parser.Error("ERR Invalid bus port specified: " + args[2])
+		}
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if net.ParseIP(args[0]) == nil || port == 0 || cport == 0 {
+		return parser.Error(fmt.Sprintf("ERR Invalid node address specified: %s:%s", args[0], args[1]))
+	}
+	cs.addHandshakeNode(args[0], port, cport, nodeMeet)
+	return parser.SimpleString("OK")
+}
+
+// addHandshakeNode adds the node at ip:port under a random ID until it
+// tells us its own, unless a handshake with that address is under way.
+// Caller must hold cs.mu.
+func (cs *clusterState) addHandshakeNode(ip string, port, cport, flags int) *clusterNode {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || port <= 0 || port > 65535 || cport <= 0 || cport > 65535 {
+		return nil
+	}
+	ip = parsed.String()
+	for _, n := range cs.nodes {
+		if n.flags&nodeHandshake != 0 && n.ip == ip && n.port == port && n.busPort == cport {
+			return nil
+		}
+	}
+	n := &clusterNode{
+		id:      newReplID(),
+		ip:      ip,
+		port:    port,
+		busPort: cport,
+		flags:   nodeHandshake | flags,
+		ctime:   time.Now(),
+	}
+	cs.nodes[n.id] = n
+	return n
+}
+
+// forgetNode handles CLUSTER FORGET <id>. The node is ignored for a minute,
+// long enough for every node to be sent the same command.
+func (s *Store) forgetNode(id string) parser.Value {
+	cs := &s.cluster
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	n := cs.nodes[id]
+	switch {
+	case n == nil:
+		return parser.Error("ERR Unknown node " + id)
+	case n == cs.myself:
+		return parser.Error("ERR I tried hard but I can't forget myself...")
+	case cs.myself.master == n:
+		return parser.Error("ERR Can't forget my master!")
+	}
+	cs.blacklist[id] = time.Now().Add(clusterBlacklistTTL)
+	s.delNodeLocked(n)
+	cs.updateStateLocked()
+	return parser.SimpleString("OK")
+}
+
+// delNodeLocked removes n from the cluster: its slots are unassigned and
+// its failure reports dropped. Caller must hold s.cluster.mu.
+func (s *Store) delNodeLocked(n *clusterNode) {
+	cs := &s.cluster
+	for slot := range clusterSlots {
+		if cs.slots[slot] == n {
+			cs.slots[slot] = nil
+		}
+		if cs.migrating[slot] == n {
+			cs.migrating[slot] = nil
+		}
+		if cs.importing[slot] == n {
+			cs.importing[slot] = nil
+		}
+	}
+	for _, other := range cs.nodes {
+		delete(other.failReports, n.id)
+		if other.master == n {
+			other.master = nil
+		}
+	}
+	if n.link != nil {
+		s.freeLinkLocked(n.link)
+	}
+	delete(cs.nodes, n.id)
+	cs.todoSave = true
+}
+
+// resetCluster handles CLUSTER RESET: every other node is forgotten and
+// every slot unassigned. A hard reset also gives this node a new ID and
+// starts the epochs over.
+func (s *Store) resetCluster(hard bool) parser.Value {
+	cs := &s.cluster
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.myself.master == nil && s.DBSize() > 0 {
+		return parser.Error("ERR CLUSTER RESET can't be called with master nodes containing keys")
+	}
+	for _, n := range cs.nodes {
+		if n != cs.myself {
+			s.delNodeLocked(n)
+		}
+	}
+	cs.slots = [clusterSlots]*clusterNode{}
+	cs.migrating = [clusterSlots]*clusterNode{}
+	cs.importing = [clusterSlots]*clusterNode{}
+	cs.myself.master = nil
+	if hard {
+		cs.currentEpoch = 0
+		cs.myself.configEpoch = 0
+		delete(cs.nodes, cs.myself.id)
+		cs.myself.id = newReplID()
+		cs.nodes[cs.myself.id] = cs.myself
+		log.Printf("Node hard reset, now I'm %s", cs.myself.id)
+	}
+	cs.updateStateLocked()
+	cs.todoSave = true
+	if err := s.saveClusterConfigLocked(); err != nil {
+		return parser.Error("ERR " + err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+// updateStateLocked works out whether the cluster is up. It is down when a
+// slot is unassigned or served by a failed master, unless
+// cluster-require-full-coverage is off, and when this node only reaches a
+// minority of the masters, so that the minority side of a partition stops
+// taking writes. Caller must hold cs.mu.
+func (cs *clusterState) updateStateLocked() {
+	state := clusterStateOK
+	if cs.requireFullCoverage {
+		for _, n := range cs.slots {
+			if n == nil || n.flags&nodeFail != 0 {
+				state = clusterStateFail
+				break
+			}
+		}
+	}
+	size, reachable := 0, 0
+	for _, n := range cs.nodes {
+		if n.master == nil && cs.countSlots(n) > 0 {
+			size++
+			if n.flags&(nodePFail|nodeFail) == 0 {
+				reachable++
+			}
+		}
+	}
+	if reachable < size/2+1 {
+		state = clusterStateFail
+	}
+	if state != cs.state && cs.state != "" {
+		log.Printf("Cluster state changed: %s", state)
+	}
+	cs.state = state
+}
+
+// size returns the number of masters serving slots.
+func (cs *clusterState) size() int {
+	size := 0
+	for _, n := range cs.nodes {
+		if n.master == nil && cs.countSlots(n) > 0 {
+			size++
+		}
+	}
+	return size
+}
+
+func (cs *clusterState) countSlots(n *clusterNode) int {
+	count := 0
+	for _, owner := range cs.slots {
+		if owner == n {
+			count++
+		}
+	}
+	return count
+}
+
+// randomNode returns a random node other than this one, or nil.
+func (cs *clusterState) randomNode() *clusterNode {
+	if len(cs.nodes) < 2 {
+		return nil
+	}
+	i := rand.Intn(len(cs.nodes) - 1)
+	for _, n := range cs.nodes {
+		if n == cs.myself {
+			continue
+		}
+		if i == 0 {
+			return n
+		}
+		i--
+	}
+	return nil
+}
+
+func (cs *clusterState) blacklisted(id string) bool {
+	until, ok := cs.blacklist[id]
+	return ok && time.Now().Before(until)
+}
+
+// clusterMsgNames are the names of the message types in CLUSTER INFO.
+var clusterMsgNames = [clusterMsgTypes]string{
+	"ping", "pong", "meet", "fail", "publish",
+	"auth-req", "auth-ack", "update",
+}
+
+// info is the reply to CLUSTER INFO.
+func (cs *clusterState) info() string {
+	assigned, pfail, fail := 0, 0, 0
+	for _, n := range cs.slots {
+		switch {
+		case n == nil:
+			continue
+		case n.flags&nodeFail != 0:
+			fail++
+		case n.flags&nodePFail != 0:
+			pfail++
+		}
+		assigned++
+	}
+	fields := []string{
+		"cluster_enabled:1",
+		"cluster_state:" + cs.state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail-fail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		fmt.Sprintf("cluster_slots_fail:%d", fail),
+		fmt.Sprintf("cluster_known_nodes:%d", len(cs.nodes)),
+		fmt.Sprintf("cluster_size:%d", cs.size()),
+		fmt.Sprintf("cluster_current_epoch:%d", cs.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", cs.myself.configEpoch),
+	}
+	for _, dir := range []struct {
+		name  string
+		stats *[clusterMsgTypes]uint64
+	}{{"sent", &cs.statsSent}, {"received", &cs.statsReceived}} {
+		var total uint64
+		for typ, count := range dir.stats {
+			if count > 0 {
+				fields = append(fields, fmt.Sprintf("cluster_stats_messages_%s_%s:%d", clusterMsgNames[typ], dir.name, count))
+			}
+			total += count
+		}
+		fields = append(fields, fmt.Sprintf("cluster_stats_messages_%s:%d", dir.name, total))
+	}
+	return strings.Join(fields, "\r\n") + "\r\n"
+}
+
+func (s *Store) countKeysInSlot(slot int) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.slotKeys[slot])
+}
+
+// slotRanges returns the ranges of consecutive slots served by n, as
+// start and end pairs.
+func (cs *clusterState) slotRanges(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cs.slots[slot] != n {
+			continue
+		}
+		start := slot
+		for slot+1 < clusterSlots && cs.slots[slot+1] == n {
+			slot++
+		}
+		ranges = append(ranges, [2]int{start, slot})
+	}
+	return ranges
+}
+
+// sortedNodes returns the known nodes ordered by ID, for stable replies.
+func (cs *clusterState) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cs.nodes))
+	for _, n := range cs.nodes {
+		nodes = append(nodes, n)
+	}
+	slices.SortFunc(nodes, func(a, b *clusterNode) int { return strings.Compare(a.id, b.id) })
+	return nodes
+}
+
+func (cs *clusterState) replicasOf(master *clusterNode) []*clusterNode {
+	var replicas []*clusterNode
+	for _, n := range cs.sortedNodes() {
+		if n.master == master {
+			replicas = append(replicas, n)
+		}
+	}
+	return replicas
+}
+
+// slotsReply is the reply to CLUSTER SLOTS: for each range of slots, the
+// master serving it and its replicas.
+func (cs *clusterState) slotsReply() parser.Value {
+	reply := parser.Array{}
+	for slot := 0; slot < clusterSlots; slot++ {
+		n := cs.slots[slot]
+		if n == nil {
+			continue
+		}
+		start := slot
+		for slot+1 < clusterSlots && cs.slots[slot+1] == n {
+			slot++
+		}
+		entry := parser.Array{parser.Integer(start), parser.Integer(slot)}
+		for _, node := range append([]*clusterNode{n}, cs.replicasOf(n)...) {
+			entry = append(entry, parser.Array{
+				parser.BulkString(node.ip),
+				parser.Integer(node.port),
+				parser.BulkString(node.id),
+				parser.Array{},
+			})
+		}
+		reply = append(reply, entry)
+	}
+	return reply
+}
+
+// shardsReply is the reply to CLUSTER SHARDS: for each master, the slots
+// it serves and its nodes, master first.
+func (cs *clusterState) shardsReply(s *Store) parser.Value {
+	reply := parser.Array{}
+	for _, master := range cs.sortedNodes() {
+		if master.master != nil {
+			continue
+		}
+		slots := parser.Array{}
+		for _, r := range cs.slotRanges(master) {
+			slots = append(slots, parser.Integer(r[0]), parser.Integer(r[1]))
+		}
+		nodes := parser.Array{}
+		for _, n := range append([]*clusterNode{master}, cs.replicasOf(master)...) {
+			role, offset := "master", int64(0)
+			if n.master != nil {
+				role = "replica"
+			}
+			if n == cs.myself {
+				offset = s.replOffset()
+			}
+			nodes = append(nodes, parser.Array{
+				parser.BulkString("id"), parser.BulkString(n.id),
+				parser.BulkString("port"), parser.Integer(n.port),
+				parser.BulkString("ip"), parser.BulkString(n.ip),
+				parser.BulkString("endpoint"), parser.BulkString(n.ip),
+				parser.BulkString("role"), parser.BulkString(role),
+				parser.BulkString("replication-offset"), parser.Integer(offset),
+				parser.BulkString("health"), parser.BulkString("online"),
+			})
+		}
+		reply = append(reply, parser.Array{
+			parser.BulkString("slots"), slots,
+			parser.BulkString("nodes"), nodes,
+		})
+	}
+	return reply
+}
+
+func (cs *clusterState) nodeFlags(n *clusterNode) string {
+	var flags []string
+	if n == cs.myself {
+		flags = append(flags, "myself")
+	}
+	if n.master != nil {
+		flags = append(flags, "slave")
+	} else {
+		flags = append(flags, "master")
+	}
+	for _, f := range []struct {
+		bit  int
+		name string
+	}{{nodePFail, "fail?"}, {nodeFail, "fail"}, {nodeHandshake, "handshake"}, {nodeNoAddr, "noaddr"}} {
+		if n.flags&f.bit != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// nodeFlagBits returns the flags of n as sent on the cluster bus.
+func (cs *clusterState) nodeFlagBits(n *clusterNode) int {
+	flags := n.flags &^ nodeMeet
+	if n == cs.myself {
+		flags |= nodeMyself
+	}
+	if n.master != nil {
+		flags |= nodeReplica
+	} else {
+		flags |= nodeMaster
+	}
+	return flags
+}
+
+// nodesDescription is the reply to CLUSTER NODES, one line per node:
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv>
+// <config-epoch> <link-state> <slot> ...
+// Nodes with any of the flags in filter are left out.
+func (cs *clusterState) nodesDescription(filter int) string {
+	var b strings.Builder
+	for _, n := range cs.sortedNodes() {
+		if n.flags&filter != 0 {
+			continue
+		}
+		master := "-"
+		if n.master != nil {
+			master = n.master.id
+		}
+		linkState := "disconnected"
+		if n == cs.myself || n.link != nil {
+			linkState = "connected"
+		}
+		fmt.Fprintf(&b, "%s %s@%d %s %s %d %d %d %s",
+			n.id, n.addr(), n.busPort, cs.nodeFlags(n), master,
+			unixMilli(n.pingSent), unixMilli(n.pongReceived), n.configEpoch, linkState)
+		for _, r := range cs.slotRanges(n) {
+			if r[0] == r[1] {
+				fmt.Fprintf(&b, " %d", r[0])
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+			}
+		}
+		if n == cs.myself {
+			for slot := 0; slot < clusterSlots; slot++ {
+				if to := cs.migrating[slot]; to != nil {
+					fmt.Fprintf(&b, " [%d->-%s]", slot, to.id)
+				}
+				if from := cs.importing[slot]; from != nil {
+					fmt.Fprintf(&b, " [%d-<-%s]", slot, from.id)
+				}
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// unixMilli returns t in Unix milliseconds, or 0 for the zero time.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
@@ -0,0 +1,281 @@
+package redis
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/haxip-com/go-redis/src/parser"
+	"pgregory.net/rapid"
+)
+
+// startClusterServer starts a test server in cluster mode.
+func startClusterServer(t *testing.T) *testServer {
+	t.Helper()
+	srv := startTestServer(t)
+	t.Cleanup(srv.Close)
+	srv.store.repl.port = srv.listener.Addr().(*net.TCPAddr).Port
+	srv.store.persistence.dir = t.TempDir()
+	if err := srv.store.enableCluster(); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// addClusterNode makes store know of a master serving slots first to last.
+func addClusterNode(store *Store, id string, port, first, last int) *clusterNode {
+	cs := &store.cluster
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	n := &clusterNode{id: id, ip: "127.0.0.1", port: port, busPort: port + clusterBusPortOffset}
+	cs.nodes[id] = n
+	for slot := first; slot <= last; slot++ {
+		cs.slots[slot] = n
+	}
+	cs.updateStateLocked()
+	return n
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31c3 {
+		t.Errorf("crc16 check value = %#x", crc)
+	}
+	for key, want := range map[string]int{
+		"foo":                  12182,
+		"somekey":              11058,
+		"{user1000}.following": keyHashSlot("user1000"),
+		"foo{}{bar}":           int(crc16("foo{}{bar}") % clusterSlots),
+		"foo{{bar}}zap":        keyHashSlot("{bar"),
+		"foo{bar}{zap}":        keyHashSlot("bar"),
+	} {
+		if got := keyHashSlot(key); got != want {
+			t.Errorf("keyHashSlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+	rapid.Check(t, func(t *rapid.T) {
+		tag := rapid.StringMatching(`[a-z0-9:]{1,10}`).Draw(t, "tag")
+		a := rapid.StringMatching(`[a-z]{0,5}`).Draw(t, "a")
+		b := rapid.StringMatching(`[a-z]{0,5}`).Draw(t, "b")
+		if keyHashSlot(a+"{"+tag+"}x") != keyHashSlot("{"+tag+"}"+b) {
+			t.Fatalf("keys tagged %q hash to different slots", tag)
+		}
+	})
+}
+
+func TestGetKeys(t *testing.T) {
+	for cmd, want := range map[string][]string{
+		"GET a":                           {"a"},
+		"MSET a 1 b 2":                    {"a", "b"},
+		"BLPOP a b 0":                     {"a", "b"},
+		"LMPOP 2 a b LEFT":                {"a", "b"},
+		"BLMPOP 0 1 a LEFT COUNT 2":       {"a"},
+		"SORT a BY w_* LIMIT 0 1 STORE b": {"a", "b"},
+		"CMS.MERGE d 2 a b WEIGHTS 1 2":   {"d", "a", "b"},
+		"OBJECT ENCODING a":               {"a"},
+		"BITOP AND d a b":                 {"d", "a", "b"},
+		"JSON.MGET a b $":                 {"a", "b"},
+		"PING":                            nil,
+		"OBJECT HELP":                     nil,
+		"LMPOP 4 a b LEFT":                nil,
+		"GEOSEARCHSTORE d s FROMMEMBER m BYRADIUS 1 km": {"d", "s"},
+	} {
+		args := strings.Fields(cmd)
+		if got := getKeys(args[0], commandArgs(args...)); !slices.Equal(got, want) {
+			t.Errorf("getKeys(%q) = %q, want %q", cmd, got, want)
+		}
+	}
+}
+
+func TestPatternHashSlot(t *testing.T) {
+	for pattern, want := range map[string]int{
+		"{user}:*": keyHashSlot("user"),
+		"a{user}*": keyHashSlot("user"),
+		"w_*":      -1,
+		"*{user}":  -1,
+		"{}x*":     -1,
+		"\\{a}*":   -1,
+		"{user":    -1,
+	} {
+		if got := patternHashSlot(pattern); got != want {
+			t.Errorf("patternHashSlot(%q) = %d, want %d", pattern, got, want)
+		}
+	}
+}
+
+func TestClusterSortPatterns(t *testing.T) {
+	srv := startClusterServer(t)
+	conn, reader := dial(t, srv)
+	defer conn.Close()
+	sendCmd(t, conn, reader, "CLUSTER ADDSLOTSRANGE 0 16383")
+	sendCmd(t, conn, reader, "RPUSH {u}list b a")
+	sendCmd(t, conn, reader, "SET {u}w_a 1")
+	sendCmd(t, conn, reader, "SET {u}w_b 2")
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"SORT {u}list BY w_*", "ERR BY option of SORT denied in Cluster mode when keys formed by the pattern may be in different slots."},
+		{"SORT {u}list GET w_*", "ERR GET option of SORT denied in Cluster mode when keys formed by the pattern may be in different slots."},
+		{"SORT {u}list BY {v}w_*", "ERR BY option of SORT denied in Cluster mode when keys formed by the pattern may be in different slots."},
+		{"SORT {u}list BY {u}w_* GET # GET {u}w_*", "[a 1 b 2]"},
+		{"SORT {u}list BY nosort", "[b a]"},
+	}
+	for _, tt := range tests {
+		resp := sendCmd(t, conn, reader, tt.cmd)
+		got := fmt.Sprint(resp)
+		if _, ok := resp.(parser.Array); ok {
+			got = fmt.Sprint(bulkStrings(resp))
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.cmd, tt.want, got)
+		}
+	}
+}
+
+func TestClusterRedirects(t *testing.T) {
+	srv := startClusterServer(t)
+	conn, reader := dial(t, srv)
+	defer conn.Close()
+	if resp := sendCmd(t, conn, reader, "GET a"); resp != parser.Error("CLUSTERDOWN Hash slot not served") {
+		t.Errorf("expected an unserved slot, got %v", resp)
+	}
+	sendCmd(t, conn, reader, "CLUSTER ADDSLOTSRANGE 0 8191")
+	other := addClusterNode(srv.store, strings.Repeat("b", 40), 7001, 8192, clusterSlots-1)
+
+	// "a" is in slot 15495, "b" in 3300.
+	if resp := sendCmd(t, conn, reader, "SET a 1"); resp != parser.Error("MOVED 15495 127.0.0.1:7001") {
+		t.Errorf("expected a MOVED redirect, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "SET b 1"); resp != parser.SimpleString("OK") {
+		t.Errorf("expected a key of ours to be served, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "MGET b c"); !strings.HasPrefix(string(resp.(parser.Error)), "CROSSSLOT") {
+		t.Errorf("expected a CROSSSLOT error, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "MSET {b}x 1 {b}y 2"); resp != parser.SimpleString("OK") {
+		t.Errorf("expected keys sharing a tag to be served, got %v", resp)
+	}
+
+	// While slot 3300 migrates, the keys still here are served and the
+	// others are asked of the target.
+	sendCmd(t, conn, reader, "CLUSTER SETSLOT 3300 MIGRATING "+other.id)
+	if resp := sendCmd(t, conn, reader, "GET b"); string(resp.(parser.BulkString)) != "1" {
+		t.Errorf("expected a key still here to be served, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "GET {b}z"); resp != parser.Error("ASK 3300 127.0.0.1:7001") {
+		t.Errorf("expected an ASK redirect, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "MGET {b}x {b}z"); !strings.HasPrefix(string(resp.(parser.Error)), "TRYAGAIN") {
+		t.Errorf("expected TRYAGAIN for keys split by the migration, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "CLUSTER SETSLOT 3300 NODE "+other.id); !strings.Contains(string(resp.(parser.Error)), "still hold keys") {
+		t.Errorf("expected the slot to be kept while it holds keys, got %v", resp)
+	}
+
+	// A slot being imported is only served after ASKING, for one command.
+	sendCmd(t, conn, reader, "CLUSTER SETSLOT 15495 IMPORTING "+other.id)
+	sendCmd(t, conn, reader, "ASKING")
+	if resp := sendCmd(t, conn, reader, "SET a 1"); resp != parser.SimpleString("OK") {
+		t.Errorf("expected an imported key to be served after ASKING, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "GET a"); resp != parser.Error("MOVED 15495 127.0.0.1:7001") {
+		t.Errorf("expected ASKING to cover one command, got %v", resp)
+	}
+	sendCmd(t, conn, reader, "CLUSTER SETSLOT 15495 NODE "+srv.store.cluster.myself.id)
+	if resp := sendCmd(t, conn, reader, "GET a"); string(resp.(parser.BulkString)) != "1" {
+		t.Errorf("expected the imported slot to be ours, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "REPLICAOF 127.0.0.1 7001"); !strings.Contains(string(resp.(parser.Error)), "cluster mode") {
+		t.Errorf("expected REPLICAOF to be refused, got %v", resp)
+	}
+}
+
+func TestClusterCommands(t *testing.T) {
+	srv := startClusterServer(t)
+	store := srv.store
+	myself := store.cluster.myself
+	if resp := run(store, "CLUSTER", "KEYSLOT", "{user1000}.following"); resp != parser.Integer(keyHashSlot("user1000")) {
+		t.Errorf("CLUSTER KEYSLOT = %v", resp)
+	}
+	run(store, "CLUSTER", "ADDSLOTS", "0", "1", "2")
+	if resp := run(store, "CLUSTER", "ADDSLOTS", "3", "2"); resp != parser.Error("ERR Slot 2 is already busy") {
+		t.Errorf("expected a busy slot to be refused, got %v", resp)
+	}
+	if resp := run(store, "CLUSTER", "ADDSLOTS", "16384"); resp != parser.Error("ERR Invalid or out of range slot") {
+		t.Errorf("expected an out of range slot to be refused, got %v", resp)
+	}
+	run(store, "CLUSTER", "ADDSLOTSRANGE", "5", "8191")
+	other := addClusterNode(store, strings.Repeat("b", 40), 7001, 8192, clusterSlots-1)
+
+	for i := range 3 {
+		run(store, "SET", "{b}"+strconv.Itoa(i), "v")
+	}
+	run(store, "DEL", "{b}0")
+	if resp := run(store, "CLUSTER", "COUNTKEYSINSLOT", "3300"); resp != parser.Integer(2) {
+		t.Errorf("CLUSTER COUNTKEYSINSLOT = %v", resp)
+	}
+	resp := run(store, "CLUSTER", "GETKEYSINSLOT", "3300", "10").(parser.Array)
+	var keys []string
+	for _, v := range resp {
+		keys = append(keys, string(v.(parser.BulkString)))
+	}
+	if slices.Sort(keys); !slices.Equal(keys, []string{"{b}1", "{b}2"}) {
+		t.Errorf("CLUSTER GETKEYSINSLOT = %v", keys)
+	}
+	if resp := run(store, "CLUSTER", "GETKEYSINSLOT", "3300", "1").(parser.Array); len(resp) != 1 {
+		t.Errorf("expected GETKEYSINSLOT to honour its count, got %v", resp)
+	}
+
+	slots := run(store, "CLUSTER", "SLOTS").(parser.Array)
+	if len(slots) != 3 {
+		t.Fatalf("expected 3 slot ranges, got %v", slots)
+	}
+	for i, want := range [][3]any{{0, 2, myself.id}, {5, 8191, myself.id}, {8192, 16383, other.id}} {
+		r := slots[i].(parser.Array)
+		if r[0] != parser.Integer(want[0].(int)) || r[1] != parser.Integer(want[1].(int)) ||
+			string(r[2].(parser.Array)[2].(parser.BulkString)) != want[2].(string) {
+			t.Errorf("unexpected CLUSTER SLOTS entry %v", r)
+		}
+	}
+
+	shards := run(store, "CLUSTER", "SHARDS").(parser.Array)
+	if len(shards) != 2 {
+		t.Fatalf("expected 2 shards, got %v", shards)
+	}
+	for _, s := range shards {
+		shard := s.(parser.Array)
+		node := shard[3].(parser.Array)[0].(parser.Array)
+		want := parser.Array{parser.Integer(8192), parser.Integer(16383)}
+		if string(node[1].(parser.BulkString)) == myself.id {
+			want = parser.Array{parser.Integer(0), parser.Integer(2), parser.Integer(5), parser.Integer(8191)}
+		}
+		if !slices.Equal(shard[1].(parser.Array), want) {
+			t.Errorf("unexpected slots for shard of %v: %v", node[1], shard[1])
+		}
+	}
+
+	run(store, "CLUSTER", "SETSLOT", "7", "MIGRATING", other.id)
+	nodes := string(run(store, "CLUSTER", "NODES").(parser.BulkString))
+	lines := strings.Split(strings.TrimSuffix(nodes, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 nodes, got:\n%s", nodes)
+	}
+	port := strconv.Itoa(store.repl.port)
+	for _, want := range []string{
+		myself.id + " :" + port + "@" + strconv.Itoa(store.repl.port+clusterBusPortOffset) + " myself,master - 0 0 0 connected 0-2 5-8191 [7->-" + other.id + "]",
+		other.id + " 127.0.0.1:7001@17001 master - 0 0 0 disconnected 8192-16383",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("expected the line %q in CLUSTER NODES:\n%s", want, nodes)
+		}
+	}
+
+	plain := startTestServer(t)
+	defer plain.Close()
+	if resp := run(plain.store, "CLUSTER", "NODES"); resp != parser.Error("ERR This instance has cluster support disabled") {
+		t.Errorf("expected cluster commands to need cluster mode, got %v", resp)
+	}
+}
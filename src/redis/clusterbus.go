@@ -0,0 +1,822 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// The cluster bus is a TCP port, by default the client port plus 10000,
+// that nodes use to talk to each other. Every node keeps a connection, or
+// link, to each node it knows and pings them in turn. A ping and its pong
+// carry the configuration of the sender, its epochs and the slots it
+// serves, and a gossip section about a few random nodes, which is how
+// nodes learn of one another and of failures.
+//
+// A node that does not answer a ping within cluster-node-timeout is
+// flagged PFAIL, possibly failing. Once the masters reporting it as
+// failing in their gossip are a majority, it is flagged FAIL and a FAIL
+// message tells every node at once.
+//
+// Each master has a config epoch, and the claim with the greatest one wins
+// when two masters claim a slot. A master whose claims are outdated is sent
+// an UPDATE message. Two masters with the same config epoch are told apart
+// by the one with the smaller node ID moving to a new epoch.
+const (
+	clusterMsgPing   = 0
+	clusterMsgPong   = 1
+	clusterMsgMeet   = 2
+	clusterMsgFail   = 3
+	clusterMsgUpdate = 7
+	clusterMsgTypes  = 8
+
+	clusterMsgVersion = 1
+	clusterMsgMaxLen  = 1 << 20
+
+	defaultClusterNodeTimeout = 15 * time.Second
+	clusterCronInterval       = 100 * time.Millisecond
+	clusterLinkQueueLen       = 64
+	// clusterFailReportValidity and clusterFailUndoTime are multiples of the
+	// node timeout: how long a failure report counts, and how long a master
+	// with slots stays FAIL once reachable again.
+	clusterFailReportValidity = 2
+	clusterFailUndoTime       = 2
+	clusterBlacklistTTL       = time.Minute
+)
+
+// Node flags, as in CLUSTER NODES and the gossip sections.
+const (
+	nodeMaster    = 1 << 0
+	nodeReplica   = 1 << 1
+	nodePFail     = 1 << 2
+	nodeFail      = 1 << 3
+	nodeMyself    = 1 << 4
+	nodeHandshake = 1 << 5
+	nodeNoAddr    = 1 << 6
+	nodeMeet      = 1 << 7
+)
+
+var clusterMsgSignature = [4]byte{'R', 'C', 'm', 'b'}
+
+// clusterMsgHeader starts every message, all integers big endian.
+type clusterMsgHeader struct {
+	Signature    [4]byte
+	TotLen       uint32
+	Version      uint16
+	Type         uint16
+	Count        uint16 // entries in the gossip section
+	Port         uint16
+	Cport        uint16
+	Flags        uint16
+	CurrentEpoch uint64
+	ConfigEpoch  uint64
+	Offset       uint64
+	Sender       [replIDLength]byte
+	Master       [replIDLength]byte // of a replica
+	Slots        [clusterSlots / 8]byte
+}
+
+// clusterMsgGossip is an entry of the gossip section of PING, PONG and
+// MEET, about a node other than the sender. Times are in seconds.
+type clusterMsgGossip struct {
+	Node         [replIDLength]byte
+	PingSent     uint32
+	PongReceived uint32
+	IP           [46]byte
+	Port         uint16
+	Cport        uint16
+	Flags        uint16
+}
+
+// clusterMsgFailBody names the node a FAIL message flags as failed.
+type clusterMsgFailBody struct {
+	Node [replIDLength]byte
+}
+
+// clusterMsgUpdateBody is the configuration of a node whose slots the
+// receiver has outdated.
+type clusterMsgUpdateBody struct {
+	ConfigEpoch uint64
+	Node        [replIDLength]byte
+	Slots       [clusterSlots / 8]byte
+}
+
+var (
+	clusterMsgHeaderLen = binary.Size(clusterMsgHeader{})
+	clusterMsgGossipLen = binary.Size(clusterMsgGossip{})
+)
+
+// clusterMsg is a decoded message. Only the body of its type is set.
+type clusterMsg struct {
+	clusterMsgHeader
+	gossip []clusterMsgGossip
+	fail   clusterMsgFailBody
+	update clusterMsgUpdateBody
+}
+
+func (m *clusterMsg) encode() []byte {
+	var body bytes.Buffer
+	switch m.Type {
+	case clusterMsgPing, clusterMsgPong, clusterMsgMeet:
+		m.Count = uint16(len(m.gossip))
+		binary.Write(&body, binary.BigEndian, m.gossip)
+	case clusterMsgFail:
+		binary.Write(&body, binary.BigEndian, &m.fail)
+	case clusterMsgUpdate:
+		binary.Write(&body, binary.BigEndian, &m.update)
+	}
+	m.Signature = clusterMsgSignature
+	m.Version = clusterMsgVersion
+	m.TotLen = uint32(clusterMsgHeaderLen + body.Len())
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &m.clusterMsgHeader)
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+// readClusterMsg reads a message, checking its length against its type.
+func readClusterMsg(r io.Reader) (*clusterMsg, error) {
+	var prefix [8]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if [4]byte(prefix[:4]) != clusterMsgSignature {
+		return nil, errors.New("bad signature")
+	}
+	totlen := int(binary.BigEndian.Uint32(prefix[4:]))
+	if totlen < clusterMsgHeaderLen || totlen > clusterMsgMaxLen {
+		return nil, fmt.Errorf("bad message length %d", totlen)
+	}
+	buf := make([]byte, totlen)
+	copy(buf, prefix[:])
+	if _, err := io.ReadFull(r, buf[len(prefix):]); err != nil {
+		return nil, err
+	}
+	m := &clusterMsg{}
+	br := bytes.NewReader(buf)
+	binary.Read(br, binary.BigEndian, &m.clusterMsgHeader)
+	if m.Version != clusterMsgVersion {
+		return nil, fmt.Errorf("unsupported version %d", m.Version)
+	}
+	want := clusterMsgHeaderLen
+	switch m.Type {
+	case clusterMsgPing, clusterMsgPong, clusterMsgMeet:
+		want += int(m.Count) * clusterMsgGossipLen
+		m.gossip = make([]clusterMsgGossip, m.Count)
+	case clusterMsgFail:
+		want += binary.Size(m.fail)
+	case clusterMsgUpdate:
+		want += binary.Size(m.update)
+	}
+	if totlen != want {
+		return nil, fmt.Errorf("bad length %d for a message of type %d", totlen, m.Type)
+	}
+	switch m.Type {
+	case clusterMsgPing, clusterMsgPong, clusterMsgMeet:
+		binary.Read(br, binary.BigEndian, m.gossip)
+	case clusterMsgFail:
+		binary.Read(br, binary.BigEndian, &m.fail)
+	case clusterMsgUpdate:
+		binary.Read(br, binary.BigEndian, &m.update)
+	}
+	return m, nil
+}
+
+// nameString returns a node ID field, empty when unset.
+func nameString(b [replIDLength]byte) string {
+	if b == [replIDLength]byte{} {
+		return ""
+	}
+	return string(b[:])
+}
+
+func nameBytes(id string) [replIDLength]byte {
+	var b [replIDLength]byte
+	copy(b[:], id)
+	return b
+}
+
+// clusterLink is a bus connection. An outbound link is the one this node
+// opened to node, and pings it through; an inbound link is opened by
+// another node, and replies are sent back on it. Messages are queued and
+// written by the link's own goroutine, so a slow peer never holds up the
+// cluster state.
+type clusterLink struct {
+	conn  net.Conn
+	node  *clusterNode // nil for inbound links
+	ctime time.Time
+	queue chan []byte
+	done  chan struct{}
+}
+
+func newClusterLink(conn net.Conn, node *clusterNode) *clusterLink {
+	return &clusterLink{
+		conn:  conn,
+		node:  node,
+		ctime: time.Now(),
+		queue: make(chan []byte, clusterLinkQueueLen),
+		done:  make(chan struct{}),
+	}
+}
+
+// send queues msg, dropping the link when its peer is too far behind.
+// Caller must hold s.cluster.mu.
+func (s *Store) sendClusterMsg(l *clusterLink, m *clusterMsg) {
+	select {
+	case l.queue <- m.encode():
+		s.cluster.statsSent[m.Type]++
+	default:
+		s.freeLinkLocked(l)
+	}
+}
+
+func (l *clusterLink) writeLoop(timeout time.Duration) {
+	for {
+		select {
+		case <-l.done:
+			return
+		case msg := <-l.queue:
+			l.conn.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := l.conn.Write(msg); err != nil {
+				l.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// freeLinkLocked closes l. Caller must hold s.cluster.mu.
+func (s *Store) freeLinkLocked(l *clusterLink) {
+	cs := &s.cluster
+	if !cs.links[l] {
+		return
+	}
+	delete(cs.links, l)
+	close(l.done)
+	l.conn.Close()
+	if l.node != nil && l.node.link == l {
+		l.node.link = nil
+	}
+}
+
+// startLink registers a connection and serves it until it fails.
+func (s *Store) startLink(conn net.Conn, node *clusterNode) *clusterLink {
+	cs := &s.cluster
+	l := newClusterLink(conn, node)
+	cs.links[l] = true
+	go l.writeLoop(cs.nodeTimeout)
+	go s.readLink(l)
+	return l
+}
+
+func (s *Store) readLink(l *clusterLink) {
+	r := bufio.NewReader(l.conn)
+	for {
+		m, err := readClusterMsg(r)
+		if err != nil {
+			break
+		}
+		s.cluster.mu.Lock()
+		if !s.cluster.links[l] {
+			s.cluster.mu.Unlock()
+			return
+		}
+		s.processClusterMsg(l, m)
+		s.cluster.mu.Unlock()
+	}
+	s.cluster.mu.Lock()
+	s.freeLinkLocked(l)
+	s.cluster.mu.Unlock()
+}
+
+// startClusterBus serves the cluster bus on listener and starts the cron
+// that pings the other nodes.
+func (s *Store) startClusterBus(listener net.Listener) {
+	cs := &s.cluster
+	cs.mu.Lock()
+	cs.listener = listener
+	cs.done = make(chan struct{})
+	if port := listener.Addr().(*net.TCPAddr).Port; port != cs.myself.busPort {
+		cs.myself.busPort = port
+		cs.todoSave = true
+	}
+	cs.mu.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			cs.mu.Lock()
+			s.startLink(conn, nil)
+			cs.mu.Unlock()
+		}
+	}()
+	go s.clusterCron(cs.done)
+}
+
+// stopClusterBus closes the listener and every link.
+func (s *Store) stopClusterBus() {
+	cs := &s.cluster
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.listener == nil {
+		return
+	}
+	cs.listener.Close()
+	close(cs.done)
+	cs.listener = nil
+	for l := range cs.links {
+		s.freeLinkLocked(l)
+	}
+}
+
+// buildClusterMsg returns a message of the given type with the header
+// describing this node. Caller must hold s.cluster.mu.
+func (s *Store) buildClusterMsg(typ uint16) *clusterMsg {
+	cs := &s.cluster
+	myself := cs.myself
+	m := &clusterMsg{}
+	m.Type = typ
+	m.Port = uint16(myself.port)
+	m.Cport = uint16(myself.busPort)
+	m.Flags = uint16(cs.nodeFlagBits(myself))
+	m.CurrentEpoch = cs.currentEpoch
+	m.ConfigEpoch = myself.configEpoch
+	m.Offset = uint64(s.replOffset())
+	m.Sender = nameBytes(myself.id)
+	for slot, n := range cs.slots {
+		if n == myself {
+			m.Slots[slot/8] |= 1 << (slot % 8)
+		}
+	}
+	return m
+}
+
+// buildPing returns a PING, PONG or MEET with a gossip section about a
+// tenth of the nodes, at least three, and about every node we suspect.
+func (s *Store) buildPing(typ uint16) *clusterMsg {
+	cs := &s.cluster
+	m := s.buildClusterMsg(typ)
+	var candidates, suspects []*clusterNode
+	for _, n := range cs.nodes {
+		switch {
+		case n == cs.myself || n.flags&(nodeHandshake|nodeNoAddr) != 0:
+		case n.flags&nodePFail != 0:
+			suspects = append(suspects, n)
+		default:
+			candidates = append(candidates, n)
+		}
+	}
+	wanted := max(3, len(cs.nodes)/10)
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	for _, n := range append(candidates[:min(wanted, len(candidates))], suspects...) {
+		g := clusterMsgGossip{
+			Node:         nameBytes(n.id),
+			PingSent:     uint32(unixMilli(n.pingSent) / 1000),
+			PongReceived: uint32(unixMilli(n.pongReceived) / 1000),
+			Port:         uint16(n.port),
+			Cport:        uint16(n.busPort),
+			Flags:        uint16(cs.nodeFlagBits(n)),
+		}
+		copy(g.IP[:], n.ip)
+		m.gossip = append(m.gossip, g)
+	}
+	return m
+}
+
+// sendPing sends a PING or MEET over the outbound link of n. Caller must
+// hold s.cluster.mu.
+func (s *Store) sendPing(n *clusterNode, typ uint16) {
+	if typ == clusterMsgPing && n.pingSent.IsZero() {
+		n.pingSent = time.Now()
+	}
+	s.sendClusterMsg(n.link, s.buildPing(typ))
+}
+
+// broadcastLocked sends m to every node we have a link to.
+func (s *Store) broadcastLocked(m *clusterMsg) {
+	for _, n := range s.cluster.nodes {
+		if n.link != nil && n.flags&nodeHandshake == 0 {
+			s.sendClusterMsg(n.link, m)
+		}
+	}
+}
+
+// processClusterMsg handles a message received on l. Caller must hold
+// s.cluster.mu.
+func (s *Store) processClusterMsg(l *clusterLink, m *clusterMsg) {
+	cs := &s.cluster
+	if m.Type < clusterMsgTypes {
+		cs.statsReceived[m.Type]++
+	}
+	sender := cs.nodes[nameString(m.Sender)]
+	if sender != nil && sender.flags&nodeHandshake != 0 {
+		sender = nil
+	}
+	if sender != nil {
+		if m.CurrentEpoch > cs.currentEpoch {
+			cs.currentEpoch = m.CurrentEpoch
+			cs.todoSave = true
+		}
+		if m.ConfigEpoch > sender.configEpoch {
+			sender.configEpoch = m.ConfigEpoch
+			cs.todoSave = true
+		}
+		sender.replOffset = int64(m.Offset)
+	}
+
+	switch m.Type {
+	case clusterMsgPing, clusterMsgPong, clusterMsgMeet:
+		s.processPing(l, m, sender)
+	case clusterMsgFail:
+		failing := cs.nodes[nameString(m.fail.Node)]
+		if sender != nil && failing != nil && failing != cs.myself && failing.flags&nodeFail == 0 {
+			log.Printf("FAIL message received from %s about %s", sender.id, failing.id)
+			failing.flags = failing.flags&^nodePFail | nodeFail
+			failing.failTime = time.Now()
+			cs.todoSave = true
+			cs.updateStateLocked()
+		}
+	case clusterMsgUpdate:
+		n := cs.nodes[nameString(m.update.Node)]
+		if sender == nil || n == nil || n.configEpoch >= m.update.ConfigEpoch {
+			return
+		}
+		n.configEpoch = m.update.ConfigEpoch
+		s.updateSlotsLocked(n, m.update.ConfigEpoch, m.update.Slots)
+	}
+}
+
+func (s *Store) processPing(l *clusterLink, m *clusterMsg, sender *clusterNode) {
+	cs := &s.cluster
+	if m.Type != clusterMsgPong {
+		// The address we are reached at is ours, as far as the cluster is
+		// concerned.
+		if cs.myself.ip == "" || m.Type == clusterMsgMeet {
+			if ip := connIP(l.conn.LocalAddr()); ip != "" && ip != cs.myself.ip {
+				cs.myself.ip = ip
+				cs.todoSave = true
+			}
+		}
+		if sender == nil && m.Type == clusterMsgMeet {
+			n := cs.addHandshakeNode(connIP(l.conn.RemoteAddr()), int(m.Port), int(m.Cport), 0)
+			if n != nil {
+				log.Printf("Meeting node %s:%d", n.ip, n.port)
+			}
+			s.processGossip(nil, m.gossip)
+		}
+		s.sendClusterMsg(l, s.buildPing(clusterMsgPong))
+	}
+
+	if n := l.node; n != nil {
+		if n.flags&nodeHandshake != 0 {
+			if sender != nil {
+				// We already know the node under its real ID.
+				s.delNodeLocked(n)
+				return
+			}
+			id := nameString(m.Sender)
+			if cs.blacklisted(id) {
+				s.delNodeLocked(n)
+				return
+			}
+			log.Printf("Handshake with node %s completed", id)
+			delete(cs.nodes, n.id)
+			n.id = id
+			n.flags &^= nodeHandshake
+			cs.nodes[id] = n
+			sender = n
+			cs.todoSave = true
+		} else if n.id != nameString(m.Sender) {
+			// The node at this address is another one now.
+			s.freeLinkLocked(l)
+			return
+		}
+	}
+	if m.Type == clusterMsgPong && l.node != nil && l.node == sender {
+		n := l.node
+		n.pongReceived = time.Now()
+		n.pingSent = time.Time{}
+		if n.flags&nodePFail != 0 {
+			n.flags &^= nodePFail
+			cs.todoSave = true
+			cs.updateStateLocked()
+		} else if n.flags&nodeFail != 0 {
+			s.clearFailureIfNeeded(n)
+		}
+	}
+	if sender == nil {
+		return
+	}
+	if sender.ip == "" {
+		sender.ip = connIP(l.conn.RemoteAddr())
+	}
+	sender.port, sender.busPort = int(m.Port), int(m.Cport)
+
+	if master := nameString(m.Master); master == "" {
+		sender.master = nil
+	} else if n := cs.nodes[master]; n != nil {
+		sender.master = n
+	}
+	if sender.master == nil {
+		s.checkSlotClaims(sender, m)
+		s.handleConfigEpochCollision(sender)
+	}
+	s.processGossip(sender, m.gossip)
+}
+
+// checkSlotClaims takes the slot claims of a master into account. When
+// some of them are outdated, the master is sent the configuration that
+// supersedes them.
+func (s *Store) checkSlotClaims(sender *clusterNode, m *clusterMsg) {
+	cs := &s.cluster
+	changed := false
+	for slot := range clusterSlots {
+		if m.Slots[slot/8]&(1<<(slot%8)) != 0 != (cs.slots[slot] == sender) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+	if sender != cs.myself {
+		s.updateSlotsLocked(sender, m.ConfigEpoch, m.Slots)
+	}
+	for slot := range clusterSlots {
+		if m.Slots[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		if owner := cs.slots[slot]; owner != nil && owner != sender && owner.configEpoch > m.ConfigEpoch {
+			log.Printf("Node %s has an old slots configuration, sending an UPDATE message about %s", sender.id, owner.id)
+			u := s.buildClusterMsg(clusterMsgUpdate)
+			u.update.ConfigEpoch = owner.configEpoch
+			u.update.Node = nameBytes(owner.id)
+			for j, n := range cs.slots {
+				if n == owner {
+					u.update.Slots[j/8] |= 1 << (j % 8)
+				}
+			}
+			if sender.link != nil {
+				s.sendClusterMsg(sender.link, u)
+			}
+			return
+		}
+	}
+}
+
+// updateSlotsLocked gives n the slots it claims with configEpoch, where our
+// view of them is older. Keys left here in slots we lost are deleted, as
+// they belong to their new owner now.
+func (s *Store) updateSlotsLocked(n *clusterNode, configEpoch uint64, slots [clusterSlots / 8]byte) {
+	cs := &s.cluster
+	var lost []int
+	for slot := range clusterSlots {
+		if slots[slot/8]&(1<<(slot%8)) == 0 || cs.slots[slot] == n || cs.importing[slot] != nil {
+			continue
+		}
+		if owner := cs.slots[slot]; owner == nil || owner.configEpoch < configEpoch {
+			if owner == cs.myself {
+				lost = append(lost, slot)
+				cs.migrating[slot] = nil
+			}
+			cs.slots[slot] = n
+			cs.todoSave = true
+		}
+	}
+	if len(lost) > 0 {
+		s.mu.Lock()
+		for _, slot := range lost {
+			for key := range s.slotKeys[slot] {
+				s.deleteKey(key)
+			}
+		}
+		s.mu.Unlock()
+	}
+	cs.updateStateLocked()
+}
+
+// handleConfigEpochCollision moves this node to a new config epoch when
+// another master has the same one and a greater node ID.
+func (s *Store) handleConfigEpochCollision(sender *clusterNode) {
+	cs := &s.cluster
+	myself := cs.myself
+	if sender.configEpoch != myself.configEpoch || myself.master != nil || sender.id <= myself.id {
+		return
+	}
+	cs.currentEpoch++
+	myself.configEpoch = cs.currentEpoch
+	cs.todoSave = true
+	log.Printf("configEpoch collision with node %s, configEpoch set to %d", sender.id, myself.configEpoch)
+}
+
+// processGossip takes in what sender says about other nodes: failure
+// reports from masters, and nodes we don't know yet, which we start a
+// handshake with.
+func (s *Store) processGossip(sender *clusterNode, gossip []clusterMsgGossip) {
+	cs := &s.cluster
+	for _, g := range gossip {
+		id := nameString(g.Node)
+		n := cs.nodes[id]
+		if n == nil {
+			if sender != nil && g.Flags&nodeNoAddr == 0 && !cs.blacklisted(id) {
+				cs.addHandshakeNode(string(bytes.TrimRight(g.IP[:], "\x00")), int(g.Port), int(g.Cport), 0)
+			}
+			continue
+		}
+		if sender == nil || sender.master != nil || n == cs.myself {
+			continue
+		}
+		if g.Flags&(nodePFail|nodeFail) != 0 {
+			if n.failReports == nil {
+				n.failReports = make(map[string]time.Time)
+			}
+			n.failReports[sender.id] = time.Now()
+			s.markFailingIfNeeded(n)
+		} else {
+			delete(n.failReports, sender.id)
+		}
+	}
+}
+
+// markFailingIfNeeded flags n FAIL once we and a majority of the masters
+// serving slots think it failing, and tells every node.
+func (s *Store) markFailingIfNeeded(n *clusterNode) {
+	cs := &s.cluster
+	if n.flags&nodePFail == 0 || n.flags&nodeFail != 0 {
+		return
+	}
+	failures := 0
+	validity := cs.nodeTimeout * clusterFailReportValidity
+	for id, t := range n.failReports {
+		if time.Since(t) > validity || cs.nodes[id] == nil {
+			delete(n.failReports, id)
+			continue
+		}
+		failures++
+	}
+	if cs.myself.master == nil {
+		failures++
+	}
+	if failures < cs.size()/2+1 {
+		return
+	}
+	log.Printf("Marking node %s as failing (quorum reached)", n.id)
+	n.flags = n.flags&^nodePFail | nodeFail
+	n.failTime = time.Now()
+	m := s.buildClusterMsg(clusterMsgFail)
+	m.fail.Node = nameBytes(n.id)
+	s.broadcastLocked(m)
+	cs.todoSave = true
+	cs.updateStateLocked()
+}
+
+// clearFailureIfNeeded clears the FAIL flag of a node that is reachable
+// again. A master serving slots stays FAIL a while, in case it comes back
+// only briefly.
+func (s *Store) clearFailureIfNeeded(n *clusterNode) {
+	cs := &s.cluster
+	if n.master == nil && cs.countSlots(n) > 0 && time.Since(n.failTime) < cs.nodeTimeout*clusterFailUndoTime {
+		return
+	}
+	log.Printf("Clear FAIL state for node %s: it is reachable again", n.id)
+	n.flags &^= nodeFail
+	cs.todoSave = true
+	cs.updateStateLocked()
+}
+
+// clusterCron connects to the nodes we have no link to, pings them, and
+// flags those that don't answer.
+func (s *Store) clusterCron(done <-chan struct{}) {
+	ticker := time.NewTicker(clusterCronInterval)
+	defer ticker.Stop()
+	for iteration := 0; ; iteration++ {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		s.clusterCronOnce(iteration)
+	}
+}
+
+func (s *Store) clusterCronOnce(iteration int) {
+	cs := &s.cluster
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	now := time.Now()
+	timeout := cs.nodeTimeout
+	for _, n := range cs.nodes {
+		if n == cs.myself || n.flags&nodeNoAddr != 0 {
+			continue
+		}
+		if n.flags&nodeHandshake != 0 && now.Sub(n.ctime) > max(timeout, time.Second) {
+			s.delNodeLocked(n)
+			continue
+		}
+		if n.link == nil && !n.connecting {
+			n.connecting = true
+			go s.connectNode(n)
+		}
+	}
+
+	// Every second, ping the node we heard from least recently among a
+	// few random ones.
+	if iteration%10 == 0 {
+		var oldest *clusterNode
+		for range 5 {
+			n := cs.randomNode()
+			if n == nil || n.link == nil || !n.pingSent.IsZero() || n.flags&nodeHandshake != 0 {
+				continue
+			}
+			if oldest == nil || n.pongReceived.Before(oldest.pongReceived) {
+				oldest = n
+			}
+		}
+		if oldest != nil {
+			s.sendPing(oldest, clusterMsgPing)
+		}
+	}
+
+	for _, n := range cs.nodes {
+		if n == cs.myself || n.flags&(nodeNoAddr|nodeHandshake) != 0 {
+			continue
+		}
+		l := n.link
+		// A link waiting too long for a pong is reconnected, in case the
+		// connection rather than the node is at fault.
+		if l != nil && !n.pingSent.IsZero() && now.Sub(l.ctime) > timeout/2 && now.Sub(n.pingSent) > timeout/2 {
+			s.freeLinkLocked(l)
+			continue
+		}
+		// Nodes not heard from for half the timeout are pinged now, so
+		// that a failure is noticed in time.
+		if l != nil && n.pingSent.IsZero() && now.Sub(n.pongReceived) > timeout/2 {
+			s.sendPing(n, clusterMsgPing)
+			continue
+		}
+		if !n.pingSent.IsZero() && now.Sub(n.pingSent) > timeout && n.flags&(nodePFail|nodeFail) == 0 {
+			log.Printf("*** NODE %s possibly failing", n.id)
+			n.flags |= nodePFail
+			cs.todoSave = true
+			cs.updateStateLocked()
+		}
+	}
+	for id, until := range cs.blacklist {
+		if now.After(until) {
+			delete(cs.blacklist, id)
+		}
+	}
+	if cs.todoSave {
+		s.saveClusterConfigLocked()
+	}
+}
+
+// connectNode opens the outbound link of n, and greets it with a MEET when
+// we were asked to meet it, or else a PING.
+func (s *Store) connectNode(n *clusterNode) {
+	cs := &s.cluster
+	cs.mu.RLock()
+	addr := net.JoinHostPort(n.ip, strconv.Itoa(n.busPort))
+	timeout := cs.nodeTimeout
+	cs.mu.RUnlock()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	n.connecting = false
+	if err != nil || cs.nodes[n.id] != n || cs.listener == nil {
+		if err == nil {
+			conn.Close()
+		}
+		// The node counts as pinged, so that it is flagged if it stays
+		// unreachable.
+		if n.pingSent.IsZero() {
+			n.pingSent = time.Now()
+		}
+		return
+	}
+	n.link = s.startLink(conn, n)
+	typ := uint16(clusterMsgPing)
+	if n.flags&nodeMeet != 0 {
+		typ = clusterMsgMeet
+		n.flags &^= nodeMeet
+	}
+	s.sendPing(n, typ)
+}
+
+func connIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return ""
+}
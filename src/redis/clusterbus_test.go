@@ -0,0 +1,305 @@
+package redis
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// startBusNode starts a cluster node with its bus on a free loopback port.
+func startBusNode(t *testing.T, timeout time.Duration) *Store {
+	t.Helper()
+	store := startClusterServer(t).store
+	store.cluster.nodeTimeout = timeout
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.startClusterBus(listener)
+	t.Cleanup(store.stopClusterBus)
+	return store
+}
+
+func meet(t *testing.T, store, other *Store) {
+	t.Helper()
+	other.cluster.mu.RLock()
+	port, cport := other.cluster.myself.port, other.cluster.myself.busPort
+	other.cluster.mu.RUnlock()
+	if resp := run(store, "CLUSTER", "MEET", "127.0.0.1", strconv.Itoa(port), strconv.Itoa(cport)); resp != parser.SimpleString("OK") {
+		t.Fatalf("CLUSTER MEET = %v", resp)
+	}
+}
+
+// clusterView returns what store knows of the node with the given ID:
+// its flags and the number of slots it serves.
+func clusterView(store *Store, id string) (flags, slots int, known bool) {
+	cs := &store.cluster
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	n := cs.nodes[id]
+	if n == nil {
+		return 0, 0, false
+	}
+	return n.flags, cs.countSlots(n), true
+}
+
+func configEpochOf(store *Store, id string) uint64 {
+	store.cluster.mu.RLock()
+	defer store.cluster.mu.RUnlock()
+	return store.cluster.nodes[id].configEpoch
+}
+
+func clusterInfoField(store *Store, field string) string {
+	info := string(run(store, "CLUSTER", "INFO").(parser.BulkString))
+	for _, line := range strings.Split(info, "\r\n") {
+		if name, val, ok := strings.Cut(line, ":"); ok && name == field {
+			return val
+		}
+	}
+	return ""
+}
+
+func TestClusterMsgEncoding(t *testing.T) {
+	ping := &clusterMsg{}
+	ping.Type = clusterMsgPing
+	ping.CurrentEpoch = 7
+	ping.Sender = nameBytes(strings.Repeat("a", 40))
+	ping.Slots[3] = 0x81
+	ping.gossip = []clusterMsgGossip{{Node: nameBytes(strings.Repeat("b", 40)), Port: 7001, Flags: nodeMaster | nodePFail}}
+	copy(ping.gossip[0].IP[:], "127.0.0.1")
+	fail := &clusterMsg{}
+	fail.Type = clusterMsgFail
+	fail.fail.Node = nameBytes(strings.Repeat("c", 40))
+	update := &clusterMsg{}
+	update.Type = clusterMsgUpdate
+	update.update.ConfigEpoch = 9
+	update.update.Slots[0] = 1
+
+	var b bytes.Buffer
+	for _, m := range []*clusterMsg{ping, fail, update} {
+		b.Write(m.encode())
+	}
+	for _, want := range []*clusterMsg{ping, fail, update} {
+		got, err := readClusterMsg(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.clusterMsgHeader != want.clusterMsgHeader || got.fail != want.fail || got.update != want.update ||
+			len(got.gossip) != len(want.gossip) || len(got.gossip) > 0 && got.gossip[0] != want.gossip[0] {
+			t.Errorf("message of type %d changed in transit: %+v", want.Type, got)
+		}
+	}
+
+	data := ping.encode()
+	if _, err := readClusterMsg(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Error("expected a truncated message to be refused")
+	}
+	data[13]++ // the count of gossip entries
+	if _, err := readClusterMsg(bytes.NewReader(data)); err == nil {
+		t.Error("expected a length not matching the gossip count to be refused")
+	}
+	data[0] = 'X'
+	if _, err := readClusterMsg(bytes.NewReader(data)); err == nil {
+		t.Error("expected a bad signature to be refused")
+	}
+}
+
+func TestClusterBus(t *testing.T) {
+	nodes := []*Store{startBusNode(t, time.Second), startBusNode(t, time.Second), startBusNode(t, time.Second)}
+	ids := make([]string, len(nodes))
+	for i, store := range nodes {
+		ids[i] = string(run(store, "CLUSTER", "MYID").(parser.BulkString))
+		first := i * clusterSlots / len(nodes)
+		last := (i+1)*clusterSlots/len(nodes) - 1
+		run(store, "CLUSTER", "ADDSLOTSRANGE", strconv.Itoa(first), strconv.Itoa(last))
+	}
+
+	// Meeting one node is enough: gossip introduces the others.
+	meet(t, nodes[0], nodes[1])
+	meet(t, nodes[2], nodes[1])
+	waitFor(t, "every node to know every other", func() bool {
+		for _, store := range nodes {
+			if clusterInfoField(store, "cluster_state") != "ok" {
+				return false
+			}
+			for _, id := range ids {
+				if flags, slots, known := clusterView(store, id); !known || flags&nodeHandshake != 0 || slots == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	// The masters all started in config epoch 0, and moved to distinct
+	// epochs to tell their claims apart.
+	waitFor(t, "distinct config epochs known to every node", func() bool {
+		seen := make(map[uint64]bool)
+		for i, id := range ids {
+			epoch := configEpochOf(nodes[i], id)
+			for _, store := range nodes {
+				if configEpochOf(store, id) != epoch {
+					return false
+				}
+			}
+			seen[epoch] = true
+		}
+		return len(seen) == len(nodes)
+	})
+
+	// A slot taken over by hand comes with a new config epoch, which wins
+	// over the claim of its former owner.
+	run(nodes[1], "CLUSTER", "SETSLOT", "0", "IMPORTING", ids[0])
+	run(nodes[1], "CLUSTER", "SETSLOT", "0", "NODE", ids[1])
+	waitFor(t, "the slot to change hands everywhere", func() bool {
+		for _, store := range nodes {
+			store.cluster.mu.RLock()
+			owner := store.cluster.slots[0]
+			store.cluster.mu.RUnlock()
+			if owner == nil || owner.id != ids[1] {
+				return false
+			}
+		}
+		return true
+	})
+
+	// A node that stops answering is flagged PFAIL, then FAIL once the
+	// other master reports it too.
+	nodes[2].stopClusterBus()
+	waitFor(t, "the stopped node to be flagged FAIL", func() bool {
+		for _, store := range nodes[:2] {
+			if flags, _, _ := clusterView(store, ids[2]); flags&nodeFail == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if state := clusterInfoField(nodes[0], "cluster_state"); state != "fail" {
+		t.Errorf("expected the cluster to be down with slots on a failed node, got %q", state)
+	}
+	if resp := run(nodes[0], "CLUSTER", "INFO"); !strings.Contains(string(resp.(parser.BulkString)), "cluster_stats_messages_fail_") {
+		t.Errorf("expected FAIL messages in the stats:\n%s", resp)
+	}
+
+	// A forgotten node is not brought back by gossip about it.
+	for _, store := range nodes[:2] {
+		if resp := run(store, "CLUSTER", "FORGET", ids[2]); resp != parser.SimpleString("OK") {
+			t.Fatalf("CLUSTER FORGET = %v", resp)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	for _, store := range nodes[:2] {
+		if _, _, known := clusterView(store, ids[2]); known {
+			t.Errorf("expected the forgotten node to stay forgotten")
+		}
+		if known := clusterInfoField(store, "cluster_known_nodes"); known != "2" {
+			t.Errorf("cluster_known_nodes = %s", known)
+		}
+	}
+}
+
+func TestClusterConfigFile(t *testing.T) {
+	srv := startClusterServer(t)
+	store := srv.store
+	myself := store.cluster.myself
+	run(store, "CLUSTER", "ADDSLOTSRANGE", "0", "100")
+	other := addClusterNode(store, strings.Repeat("b", 40), 7001, 101, 200)
+	other.configEpoch = 3
+	store.cluster.currentEpoch = 5
+	run(store, "CLUSTER", "SETSLOT", "7", "MIGRATING", other.id)
+	run(store, "CLUSTER", "SETSLOT", "300", "IMPORTING", other.id)
+
+	reloaded := newStore()
+	reloaded.repl.port = store.repl.port
+	reloaded.persistence.dir = store.persistence.dir
+	if err := reloaded.enableCluster(); err != nil {
+		t.Fatal(err)
+	}
+	cs := &reloaded.cluster
+	if cs.myself.id != myself.id || cs.currentEpoch != 5 || len(cs.nodes) != 2 {
+		t.Fatalf("configuration not restored: myself %s, epoch %d, %d nodes", cs.myself.id, cs.currentEpoch, len(cs.nodes))
+	}
+	n := cs.nodes[other.id]
+	if n == nil || n.configEpoch != 3 || n.addr() != "127.0.0.1:7001" || n.busPort != 17001 {
+		t.Fatalf("node not restored: %+v", n)
+	}
+	if cs.slots[100] != cs.myself || cs.slots[101] != n || cs.slots[201] != nil || cs.migrating[7] != n || cs.importing[300] != n {
+		t.Error("slots not restored")
+	}
+
+	os.WriteFile(filepath.Join(store.persistence.dir, "nodes.conf"), []byte("garbage\n"), 0o644)
+	corrupted := newStore()
+	corrupted.persistence.dir = store.persistence.dir
+	if err := corrupted.enableCluster(); err == nil {
+		t.Error("expected a corrupted nodes.conf to be refused")
+	}
+}
+
+func TestClusterNodeCommands(t *testing.T) {
+	store := startClusterServer(t).store
+	id := string(run(store, "CLUSTER", "MYID").(parser.BulkString))
+	if len(id) != 40 || id != store.cluster.myself.id {
+		t.Errorf("CLUSTER MYID = %q", id)
+	}
+	for _, args := range [][]string{
+		{"MEET", "not-an-ip", "7000"},
+		{"MEET", "127.0.0.1", "0"},
+		{"MEET", "127.0.0.1", "x"},
+		{"MEET", "127.0.0.1", "7000", "70000"},
+	} {
+		if _, ok := run(store, append([]string{"CLUSTER"}, args...)...).(parser.Error); !ok {
+			t.Errorf("expected CLUSTER %v to be refused", args)
+		}
+	}
+	run(store, "CLUSTER", "MEET", "127.0.0.1", "7000")
+	run(store, "CLUSTER", "MEET", "127.0.0.1", "7000")
+	if known := clusterInfoField(store, "cluster_known_nodes"); known != "2" {
+		t.Errorf("expected one handshake per address, got %s known nodes", known)
+	}
+	if !strings.Contains(string(run(store, "CLUSTER", "NODES").(parser.BulkString)), " master,handshake - ") {
+		t.Error("expected the node met to be in handshake")
+	}
+
+	if resp := run(store, "CLUSTER", "FORGET", strings.Repeat("f", 40)); !strings.HasPrefix(string(resp.(parser.Error)), "ERR Unknown node") {
+		t.Errorf("expected an unknown node to be refused, got %v", resp)
+	}
+	if resp := run(store, "CLUSTER", "FORGET", id); !strings.Contains(string(resp.(parser.Error)), "forget myself") {
+		t.Errorf("expected FORGET of myself to be refused, got %v", resp)
+	}
+
+	run(store, "CLUSTER", "ADDSLOTSRANGE", "0", "16383")
+	if state := clusterInfoField(store, "cluster_state"); state != "ok" {
+		t.Errorf("cluster_state = %q with every slot served", state)
+	}
+	if assigned := clusterInfoField(store, "cluster_slots_assigned"); assigned != "16384" {
+		t.Errorf("cluster_slots_assigned = %s", assigned)
+	}
+	run(store, "SET", "a", "1")
+	if resp := run(store, "CLUSTER", "RESET"); !strings.Contains(string(resp.(parser.Error)), "containing keys") {
+		t.Errorf("expected RESET of a master with keys to be refused, got %v", resp)
+	}
+	run(store, "DEL", "a")
+	if resp := run(store, "CLUSTER", "RESET", "SOFT"); resp != parser.SimpleString("OK") {
+		t.Fatalf("CLUSTER RESET SOFT = %v", resp)
+	}
+	if clusterInfoField(store, "cluster_known_nodes") != "1" || clusterInfoField(store, "cluster_slots_assigned") != "0" ||
+		string(run(store, "CLUSTER", "MYID").(parser.BulkString)) != id {
+		t.Error("expected a soft reset to forget the other nodes and slots, and keep the ID")
+	}
+	store.cluster.currentEpoch = 4
+	if resp := run(store, "CLUSTER", "RESET", "HARD"); resp != parser.SimpleString("OK") {
+		t.Fatalf("CLUSTER RESET HARD = %v", resp)
+	}
+	if string(run(store, "CLUSTER", "MYID").(parser.BulkString)) == id || clusterInfoField(store, "cluster_current_epoch") != "0" {
+		t.Error("expected a hard reset to change the ID and reset the epochs")
+	}
+	if resp := run(store, "INFO", "cluster"); !strings.Contains(string(resp.(parser.BulkString)), "cluster_enabled:1") {
+		t.Errorf("INFO cluster = %v", resp)
+	}
+}
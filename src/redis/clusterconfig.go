@@ -0,0 +1,226 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nodes.conf holds the cluster configuration in the format of CLUSTER
+// NODES, one line per node, followed by a line of variables:
+//
+//	vars currentEpoch <epoch> lastVoteEpoch <epoch>
+//
+// It is rewritten whenever the configuration changes, and is not meant to
+// be edited by hand.
+
+var errBadClusterConfig = errors.New("unrecoverable error: corrupted cluster config file")
+
+// loadConfig reads the configuration saved in path, reporting false when
+// there is none yet. Caller must hold cs.mu.
+func (cs *clusterState) loadConfig(path string) (bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	cs.nodes = make(map[string]*clusterNode)
+	cs.myself = nil
+	// A node may be named, as a master or migration peer, before its own
+	// line.
+	node := func(id string) *clusterNode {
+		n := cs.nodes[id]
+		if n == nil {
+			n = &clusterNode{id: id, ctime: time.Now()}
+			cs.nodes[id] = n
+		}
+		return n
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					if cs.currentEpoch, err = strconv.ParseUint(fields[i+1], 10, 64); err != nil {
+						return false, errBadClusterConfig
+					}
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 || len(fields[0]) != replIDLength {
+			return false, errBadClusterConfig
+		}
+		n := node(fields[0])
+		if err := parseNodeAddr(n, fields[1]); err != nil {
+			return false, err
+		}
+		for _, flag := range strings.Split(fields[2], ",") {
+			switch flag {
+			case "myself":
+				if cs.myself != nil {
+					return false, errBadClusterConfig
+				}
+				cs.myself = n
+			case "fail?":
+				n.flags |= nodePFail
+			case "fail":
+				n.flags |= nodeFail
+				n.failTime = time.Now()
+			case "noaddr":
+				n.flags |= nodeNoAddr
+			case "master", "slave", "handshake", "nofailover", "noflags":
+			default:
+				return false, fmt.Errorf("unknown flag %q in cluster config file", flag)
+			}
+		}
+		if fields[3] != "-" {
+			n.master = node(fields[3])
+		}
+		// Like Redis, only whether a ping or pong was ever seen is kept.
+		if fields[4] != "0" {
+			n.pingSent = time.Now()
+		}
+		if fields[5] != "0" {
+			n.pongReceived = time.Now()
+		}
+		if n.configEpoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+			return false, errBadClusterConfig
+		}
+		for _, field := range fields[8:] {
+			if err := cs.parseSlotField(n, field, node); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	if cs.myself == nil {
+		return false, errBadClusterConfig
+	}
+	log.Printf("Node configuration loaded, I'm %s", cs.myself.id)
+	return true, nil
+}
+
+// parseNodeAddr parses <ip>:<port>@<cport>, with Redis' optional
+// ,<hostname> suffix.
+func parseNodeAddr(n *clusterNode, addr string) error {
+	addr, _, _ = strings.Cut(addr, ",")
+	hostport, cport, ok := strings.Cut(addr, "@")
+	i := strings.LastIndexByte(hostport, ':')
+	if !ok || i < 0 {
+		return errBadClusterConfig
+	}
+	var err1, err2 error
+	n.ip = hostport[:i]
+	n.port, err1 = strconv.Atoi(hostport[i+1:])
+	n.busPort, err2 = strconv.Atoi(cport)
+	if err1 != nil || err2 != nil {
+		return errBadClusterConfig
+	}
+	return nil
+}
+
+// parseSlotField parses a slot, a range of slots served by n, or a
+// migration of n written as [<slot>->-<id>] or [<slot>-<-<id>].
+func (cs *clusterState) parseSlotField(n *clusterNode, field string, node func(string) *clusterNode) error {
+	if strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]") {
+		field = field[1 : len(field)-1]
+		if slot, id, ok := strings.Cut(field, "->-"); ok {
+			s, err := parseConfigSlot(slot)
+			if err != nil {
+				return err
+			}
+			cs.migrating[s] = node(id)
+			return nil
+		}
+		if slot, id, ok := strings.Cut(field, "-<-"); ok {
+			s, err := parseConfigSlot(slot)
+			if err != nil {
+				return err
+			}
+			cs.importing[s] = node(id)
+			return nil
+		}
+		return errBadClusterConfig
+	}
+	first, last, isRange := strings.Cut(field, "-")
+	if !isRange {
+		last = first
+	}
+	start, err := parseConfigSlot(first)
+	if err != nil {
+		return err
+	}
+	end, err := parseConfigSlot(last)
+	if err != nil || start > end {
+		return errBadClusterConfig
+	}
+	for slot := start; slot <= end; slot++ {
+		cs.slots[slot] = n
+	}
+	return nil
+}
+
+func parseConfigSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, errBadClusterConfig
+	}
+	return slot, nil
+}
+
+// saveClusterConfigLocked rewrites nodes.conf if the configuration changed
+// since it was last saved. The new file is renamed over the old one, so a
+// crash leaves one or the other. Caller must hold s.cluster.mu.
+func (s *Store) saveClusterConfigLocked() error {
+	cs := &s.cluster
+	if !cs.todoSave || cs.configPath == "" {
+		return nil
+	}
+	content := cs.nodesDescription(nodeHandshake) +
+		fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0\n", cs.currentEpoch)
+	f, err := os.CreateTemp(filepath.Dir(cs.configPath), "temp-"+filepath.Base(cs.configPath)+"-*")
+	if err != nil {
+		log.Printf("Could not save the cluster config: %v", err)
+		return err
+	}
+	_, err = f.WriteString(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), cs.configPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf("Could not save the cluster config: %v", err)
+		return err
+	}
+	cs.todoSave = false
+	return nil
+}
+
+func (s *Store) saveClusterConfig() {
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+	s.saveClusterConfigLocked()
+}
@@ -0,0 +1,373 @@
+package redis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// A Count-Min Sketch is depth rows of width counters. Each row hashes an
+// item to one counter with its own seed; an item's count is the minimum
+// over its counters, which can overestimate but never underestimate.
+// Errors use the RedisBloom wording.
+type countMinSketch struct {
+	width, depth uint32
+	counters     []uint32
+	count        uint64
+}
+
+var (
+	errCMSNoKey      = fmt.Errorf("CMS: key does not exist")
+	errCMSKeyExists  = fmt.Errorf("CMS: key already exists")
+	errCMSDimensions = fmt.Errorf("CMS: width/depth is not equal")
+	errCMSOverflow   = fmt.Errorf("CMS: INCRBY overflow")
+	errCMSTooLarge   = fmt.Errorf("CMS: sketch is too large")
+)
+
+func newCountMinSketch(width, depth uint32) (*countMinSketch, error) {
+	if uint64(width)*uint64(depth)*4 > maxStringSize {
+		return nil, errCMSTooLarge
+	}
+	return &countMinSketch{width: width, depth: depth, counters: make([]uint32, width*depth)}, nil
+}
+
+func (c *countMinSketch) index(item []byte, row uint32) uint32 {
+	return row*c.width + uint32(murmurHash64A(item, uint64(row))%uint64(c.width))
+}
+
+func (c *countMinSketch) query(item []byte) uint32 {
+	lowest := uint32(math.MaxUint32)
+	for row := uint32(0); row < c.depth; row++ {
+		lowest = min(lowest, c.counters[c.index(item, row)])
+	}
+	return lowest
+}
+
+// incrBy adds incr to each of the item's counters, refusing to overflow any
+// of them.
+func (c *countMinSketch) incrBy(item []byte, incr uint32) (uint32, error) {
+	for row := uint32(0); row < c.depth; row++ {
+		if c.counters[c.index(item, row)] > math.MaxUint32-incr {
+			return 0, errCMSOverflow
+		}
+	}
+	for row := uint32(0); row < c.depth; row++ {
+		c.counters[c.index(item, row)] += incr
+	}
+	c.count += uint64(incr)
+	return c.query(item), nil
+}
+
+// encode returns the persisted form of the sketch: its dimensions, total
+// count and counters.
+func (c *countMinSketch) encode() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, c.width)
+	b = binary.LittleEndian.AppendUint32(b, c.depth)
+	b = binary.LittleEndian.AppendUint64(b, c.count)
+	for _, n := range c.counters {
+		b = binary.LittleEndian.AppendUint32(b, n)
+	}
+	return b
+}
+
+func decodeCountMinSketch(data []byte) (*countMinSketch, error) {
+	r := &sketchReader{b: data}
+	width, depth, count := r.u32(), r.u32(), r.u64()
+	if r.err || width == 0 || depth == 0 || uint64(width)*uint64(depth)*4 != uint64(len(r.b)) {
+		return nil, errSketchCorrupt
+	}
+	c := &countMinSketch{width: width, depth: depth, count: count, counters: make([]uint32, width*depth)}
+	for i := range c.counters {
+		c.counters[i] = r.u32()
+	}
+	if err := r.done(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// getCMS returns the sketch stored at key. Caller must hold s.mu.
+func (s *Store) getCMS(key string) (*countMinSketch, bool, error) {
+	val, exists := s.lookupKeyRead(key)
+	if !exists {
+		return nil, false, nil
+	}
+	c, ok := val.(*countMinSketch)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return c, true, nil
+}
+
+// getCMSForWrite is getCMS for callers holding s.mu for writing.
+func (s *Store) getCMSForWrite(key string) (*countMinSketch, bool, error) {
+	val, exists := s.lookupKeyWrite(key)
+	if !exists {
+		return nil, false, nil
+	}
+	c, ok := val.(*countMinSketch)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return s.mutable(key, c).(*countMinSketch), true, nil
+}
+
+func (s *Store) CMSInit(key string, width, depth uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.lookupKeyWrite(key); exists {
+		return errCMSKeyExists
+	}
+	c, err := newCountMinSketch(width, depth)
+	if err != nil {
+		return err
+	}
+	s.setKey(key, c)
+	return nil
+}
+
+// CMSIncrBy increments each item by the matching amount and returns the
+// items' new estimated counts.
+func (s *Store) CMSIncrBy(key string, items [][]byte, incrs []uint32) ([]uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, exists, err := s.getCMSForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errCMSNoKey
+	}
+	counts := make([]uint32, len(items))
+	for i, item := range items {
+		if counts[i], err = c.incrBy(item, incrs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+func (s *Store) CMSQuery(key string, items ...[]byte) ([]uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, exists, err := s.getCMS(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errCMSNoKey
+	}
+	counts := make([]uint32, len(items))
+	for i, item := range items {
+		counts[i] = c.query(item)
+	}
+	return counts, nil
+}
+
+// CMSMerge overwrites dest with the weighted sum of the source sketches,
+// which must all have dest's dimensions.
+func (s *Store) CMSMerge(dest string, srcs []string, weights []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, exists, err := s.getCMSForWrite(dest)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errCMSNoKey
+	}
+	sketches := make([]*countMinSketch, len(srcs))
+	for i, src := range srcs {
+		c, exists, err := s.getCMSForWrite(src)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errCMSNoKey
+		}
+		if c.width != d.width || c.depth != d.depth {
+			return errCMSDimensions
+		}
+		sketches[i] = c
+	}
+	counters := make([]uint32, len(d.counters))
+	for i := range counters {
+		sum := int64(0)
+		for j, c := range sketches {
+			sum += int64(c.counters[i]) * weights[j]
+		}
+		if sum < 0 || sum > math.MaxUint32 {
+			return fmt.Errorf("CMS: MERGE overflow")
+		}
+		counters[i] = uint32(sum)
+	}
+	count := int64(0)
+	for j, c := range sketches {
+		count += int64(c.count) * weights[j]
+	}
+	d.counters, d.count = counters, uint64(count)
+	return nil
+}
+
+func (s *Store) CMSInfo(key string) (uint32, uint32, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, exists, err := s.getCMS(key)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if !exists {
+		return 0, 0, 0, errCMSNoKey
+	}
+	return c.width, c.depth, c.count, nil
+}
+
+func countsReply(counts []uint32) parser.Value {
+	reply := make(parser.Array, len(counts))
+	for i, n := range counts {
+		reply[i] = parser.Integer(n)
+	}
+	return reply
+}
+
+// positiveUint32 parses a counter dimension or increment.
+func positiveUint32(s string) (uint32, bool) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err == nil && n > 0
+}
+
+func handleCMSInitByDim(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	width, ok := positiveUint32(strs[1])
+	if !ok {
+		return parser.Error("CMS: invalid width")
+	}
+	depth, ok := positiveUint32(strs[2])
+	if !ok {
+		return parser.Error("CMS: invalid depth")
+	}
+	if err := store.CMSInit(strs[0], width, depth); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+// handleCMSInitByProb sizes the sketch for an overestimate of at most error
+// times the total count, holding with the given probability of failure.
+func handleCMSInitByProb(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	overEst, err := strconv.ParseFloat(strs[1], 64)
+	if err != nil || overEst <= 0 || overEst >= 1 {
+		return parser.Error("CMS: invalid overestimation value")
+	}
+	prob, err := strconv.ParseFloat(strs[2], 64)
+	if err != nil || prob <= 0 || prob >= 1 {
+		return parser.Error("CMS: invalid prob value")
+	}
+	width := math.Ceil(2 / overEst)
+	depth := math.Ceil(math.Log10(prob) / math.Log10(0.5))
+	if width > math.MaxUint32 {
+		return parser.Error(errCMSTooLarge.Error())
+	}
+	if err := store.CMSInit(strs[0], uint32(width), uint32(depth)); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleCMSIncrBy(store *Store, args []parser.Value) parser.Value {
+	if len(args)%2 != 0 {
+		return parser.Error("ERR wrong number of arguments for 'CMS.INCRBY' command")
+	}
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	n := (len(items) - 1) / 2
+	keys, incrs := make([][]byte, n), make([]uint32, n)
+	for i := 0; i < n; i++ {
+		keys[i] = items[1+2*i]
+		if incrs[i], ok = positiveUint32(string(items[2+2*i])); !ok {
+			return parser.Error("CMS: Cannot parse number")
+		}
+	}
+	counts, err := store.CMSIncrBy(string(items[0]), keys, incrs)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return countsReply(counts)
+}
+
+func handleCMSQuery(store *Store, args []parser.Value) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	counts, err := store.CMSQuery(string(items[0]), items[1:]...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return countsReply(counts)
+}
+
+// handleCMSMerge implements
+// CMS.MERGE destination numKeys source [source ...] [WEIGHTS weight [weight ...]].
+func handleCMSMerge(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	numKeys, err := strconv.Atoi(strs[1])
+	if err != nil || numKeys < 1 {
+		return parser.Error("CMS: invalid numkeys")
+	}
+	rest := strs[2:]
+	if len(rest) < numKeys {
+		return parser.Error("CMS: wrong number of keys")
+	}
+	srcs, weights := rest[:numKeys], make([]int64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	rest = rest[numKeys:]
+	if len(rest) > 0 {
+		if !strings.EqualFold(rest[0], "WEIGHTS") || len(rest)-1 != numKeys {
+			return parser.Error("CMS: wrong number of keys/weights")
+		}
+		for i, w := range rest[1:] {
+			if weights[i], err = strconv.ParseInt(w, 10, 64); err != nil {
+				return parser.Error("CMS: invalid weight value")
+			}
+		}
+	}
+	if err := store.CMSMerge(strs[0], srcs, weights); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleCMSInfo(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	width, depth, count, err := store.CMSInfo(string(key))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Array{
+		parser.SimpleString("width"), parser.Integer(width),
+		parser.SimpleString("depth"), parser.Integer(depth),
+		parser.SimpleString("count"), parser.Integer(count),
+	}
+}
@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	store := newStore()
+	if err := store.CMSInit("cms", 2000, 5); err != nil {
+		t.Fatalf("CMSInit: %v", err)
+	}
+	if err := store.CMSInit("cms", 10, 10); err != errCMSKeyExists {
+		t.Errorf("expected key exists error, got %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		store.CMSIncrBy("cms", [][]byte{[]byte(fmt.Sprintf("%d", i))}, []uint32{uint32(i + 1)})
+	}
+	counts, _ := store.CMSQuery("cms", []byte("0"), []byte("99"), []byte("missing"))
+	// Estimates never undercount.
+	if counts[0] < 1 || counts[1] < 100 || counts[0] > 10 || counts[1] > 110 {
+		t.Errorf("estimates too far off: %v", counts)
+	}
+	if _, _, n, _ := store.CMSInfo("cms"); n != 5050 {
+		t.Errorf("expected total count 5050, got %d", n)
+	}
+	if _, err := store.CMSIncrBy("cms", [][]byte{[]byte("0")}, []uint32{math.MaxUint32}); err != errCMSOverflow {
+		t.Errorf("expected overflow error, got %v", err)
+	}
+	if _, err := store.CMSQuery("missing", []byte("a")); err != errCMSNoKey {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+
+	data := store.data["cms"].(*countMinSketch).encode()
+	decoded, err := decodeCountMinSketch(data)
+	if err != nil || string(decoded.encode()) != string(data) {
+		t.Errorf("encoding does not round trip: %v", err)
+	}
+	if _, err := decodeCountMinSketch(data[:len(data)-2]); err != errSketchCorrupt {
+		t.Errorf("expected corrupt payload error, got %v", err)
+	}
+}
+
+func TestCountMinSketchMerge(t *testing.T) {
+	store := newStore()
+	store.CMSInit("a", 100, 4)
+	store.CMSInit("b", 100, 4)
+	store.CMSInit("dest", 100, 4)
+	store.CMSInit("other", 50, 4)
+	store.CMSIncrBy("a", [][]byte{[]byte("x")}, []uint32{3})
+	store.CMSIncrBy("b", [][]byte{[]byte("x"), []byte("y")}, []uint32{4, 1})
+
+	if err := store.CMSMerge("dest", []string{"a", "b"}, []int64{1, 2}); err != nil {
+		t.Fatalf("CMSMerge: %v", err)
+	}
+	if counts, _ := store.CMSQuery("dest", []byte("x"), []byte("y")); counts[0] != 11 || counts[1] != 2 {
+		t.Errorf("expected [11 2], got %v", counts)
+	}
+	if _, _, n, _ := store.CMSInfo("dest"); n != 13 {
+		t.Errorf("expected total count 13, got %d", n)
+	}
+	if err := store.CMSMerge("dest", []string{"a", "other"}, []int64{1, 1}); err != errCMSDimensions {
+		t.Errorf("expected dimension error, got %v", err)
+	}
+	if err := store.CMSMerge("dest", []string{"a", "missing"}, []int64{1, 1}); err != errCMSNoKey {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+}
+
+func TestCountMinSketchCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp := sendCmd(t, conn, reader, "CMS.INITBYPROB cms 0.001 0.01")
+	if str, ok := resp.(parser.SimpleString); !ok || str != "OK" {
+		t.Errorf("expected OK, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CMS.INFO cms")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 6 || arr[1] != parser.Integer(2000) || arr[3] != parser.Integer(7) {
+		t.Errorf("expected width 2000 and depth 7, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CMS.INCRBY cms a 5 b 2")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 2 || arr[0] != parser.Integer(5) || arr[1] != parser.Integer(2) {
+		t.Errorf("expected [5 2], got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CMS.INCRBY cms a x")
+	if err, ok := resp.(parser.Error); !ok || err != "CMS: Cannot parse number" {
+		t.Errorf("expected parse error, got %v", resp)
+	}
+	sendCmd(t, conn, reader, "CMS.INITBYDIM dest 2000 7")
+	resp = sendCmd(t, conn, reader, "CMS.MERGE dest 1 cms WEIGHTS 3")
+	if str, ok := resp.(parser.SimpleString); !ok || str != "OK" {
+		t.Errorf("expected OK, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CMS.QUERY dest a b c")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 3 || arr[0] != parser.Integer(15) || arr[1] != parser.Integer(6) || arr[2] != parser.Integer(0) {
+		t.Errorf("expected [15 6 0], got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CMS.QUERY missing a")
+	if err, ok := resp.(parser.Error); !ok || err != "CMS: key does not exist" {
+		t.Errorf("expected missing key error, got %v", resp)
+	}
+}
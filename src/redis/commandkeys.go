@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// keySpec locates the key arguments of a command the way the legacy Redis
+// command table does: the keys are at first, first+step, ... up to last,
+// a negative last counting back from the end of the arguments. numkeys,
+// when set, is the position of a key count followed by that many keys.
+// extra finds keys given by options, like SORT ... STORE.
+type keySpec struct {
+	first, last, step int
+	numkeys           int
+	extra             func(args []string) []int
+}
+
+var (
+	noKeys      = keySpec{}
+	oneKey      = keySpec{first: 1, last: 1, step: 1}
+	allKeys     = keySpec{first: 1, last: -1, step: 1}
+	twoKeys     = keySpec{first: 1, last: 2, step: 1}
+	keysBarLast = keySpec{first: 1, last: -2, step: 1}
+)
+
+// sortStoreKey finds the destination of SORT ... STORE, skipping over the
+// arguments of the other options.
+func sortStoreKey(args []string) []int {
+	var keys []int
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LIMIT":
+			i += 2
+		case "BY", "GET":
+			i++
+		case "STORE":
+			if i+1 < len(args) {
+				keys = append(keys, i+1)
+			}
+			i++
+		}
+	}
+	return keys
+}
+
+// getKeys returns the keys of a command, or nil for a command without
+// keys or with malformed key arguments, which the command itself rejects.
+func getKeys(cmd string, args parser.Array) []string {
+	var spec keySpec
+	if c, ok := commands[cmd]; ok {
+		spec = c.keys
+	} else if c, ok := clientCommands[cmd]; ok {
+		spec = c.keys
+	} else {
+		return nil
+	}
+	strs, ok := bulkStringArgs(args)
+	if !ok {
+		return nil
+	}
+	var pos []int
+	if spec.first > 0 {
+		last := spec.last
+		if last < 0 {
+			last += len(strs)
+		}
+		for i := spec.first; i <= last && i < len(strs); i += spec.step {
+			pos = append(pos, i)
+		}
+	}
+	if spec.numkeys > 0 && spec.numkeys < len(strs) {
+		n, err := strconv.Atoi(strs[spec.numkeys])
+		if err != nil || n < 1 || spec.numkeys+n >= len(strs) {
+			return nil
+		}
+		for i := spec.numkeys + 1; i <= spec.numkeys+n; i++ {
+			pos = append(pos, i)
+		}
+	}
+	if spec.extra != nil {
+		pos = append(pos, spec.extra(strs)...)
+	}
+	keys := make([]string, len(pos))
+	for i, p := range pos {
+		keys[i] = strs[p]
+	}
+	return keys
+}
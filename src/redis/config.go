@@ -0,0 +1,630 @@
+package redis
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// configParam is a parameter exposed through CONFIG GET/SET. A nil set makes
+// the parameter read-only.
+type configParam struct {
+	get func(store *Store) string
+	set func(store *Store, val string) error
+}
+
+var configParams = map[string]configParam{
+	"maxmemory": {get: func(*Store) string { return "0" }},
+	"save": {
+		get: func(store *Store) string {
+			store.persistence.mu.Lock()
+			defer store.persistence.mu.Unlock()
+			return formatSaveParams(store.persistence.saveParams)
+		},
+		set: func(store *Store, val string) error {
+			params, err := parseSaveParams(val)
+			if err != nil {
+				return err
+			}
+			store.persistence.mu.Lock()
+			store.persistence.saveParams = params
+			store.persistence.mu.Unlock()
+			return nil
+		},
+	},
+	"dir": {
+		get: func(store *Store) string {
+			store.persistence.mu.Lock()
+			defer store.persistence.mu.Unlock()
+			if abs, err := filepath.Abs(store.persistence.dir); err == nil {
+				return abs
+			}
+			return store.persistence.dir
+		},
+		set: func(store *Store, val string) error {
+			info, err := os.Stat(val)
+			if err != nil {
+				return fmt.Errorf("No such file or directory")
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("Not a directory")
+			}
+			store.persistence.mu.Lock()
+			store.persistence.dir = val
+			store.persistence.mu.Unlock()
+			return nil
+		},
+	},
+	"dbfilename": {
+		get: func(store *Store) string {
+			store.persistence.mu.Lock()
+			defer store.persistence.mu.Unlock()
+			return store.persistence.dbfilename
+		},
+		set: func(store *Store, val string) error {
+			if val == "" || filepath.Base(val) != val {
+				return fmt.Errorf("dbfilename can't be a path, just a filename")
+			}
+			store.persistence.mu.Lock()
+			store.persistence.dbfilename = val
+			store.persistence.mu.Unlock()
+			return nil
+		},
+	},
+	"rdb-skip-unsupported-types": {
+		get: func(store *Store) string {
+			return formatYesNo(store.persistence.skipUnsupported.Load())
+		},
+		set: func(store *Store, val string) error {
+			on, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+			store.persistence.skipUnsupported.Store(on)
+			return nil
+		},
+	},
+	"appendonly": {
+		get: func(store *Store) string {
+			store.aof.mu.Lock()
+			defer store.aof.mu.Unlock()
+			return formatYesNo(store.aof.enabled)
+		},
+		set: func(store *Store, val string) error {
+			on, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+			if on {
+				return store.StartAppendOnly()
+			}
+			return store.StopAppendOnly()
+		},
+	},
+	"appendfilename": {
+		get: func(store *Store) string {
+			store.aof.mu.Lock()
+			defer store.aof.mu.Unlock()
+			return store.aof.filename
+		},
+	},
+	"appenddirname": {
+		get: func(store *Store) string {
+			store.aof.mu.Lock()
+			defer store.aof.mu.Unlock()
+			return store.aof.dirname
+		},
+	},
+	"appendfsync": {
+		get: func(store *Store) string {
+			store.aof.mu.Lock()
+			defer store.aof.mu.Unlock()
+			return store.aof.fsync
+		},
+		set: func(store *Store, val string) error {
+			policy, err := parseAppendFsync(val)
+			if err != nil {
+				return err
+			}
+			store.aof.mu.Lock()
+			store.aof.fsync = policy
+			store.aof.mu.Unlock()
+			return nil
+		},
+	},
+	"aof-load-truncated": {
+		get: func(store *Store) string {
+			store.aof.mu.Lock()
+			defer store.aof.mu.Unlock()
+			return formatYesNo(store.aof.loadTruncated)
+		},
+		set: func(store *Store, val string) error {
+			on, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+			store.aof.mu.Lock()
+			store.aof.loadTruncated = on
+			store.aof.mu.Unlock()
+			return nil
+		},
+	},
+	"aof-use-rdb-preamble": {
+		get: func(store *Store) string {
+			store.aof.mu.Lock()
+			defer store.aof.mu.Unlock()
+			return formatYesNo(store.aof.useRDBPreamble)
+		},
+		set: func(store *Store, val string) error {
+			on, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+			store.aof.mu.Lock()
+			store.aof.useRDBPreamble = on
+			store.aof.mu.Unlock()
+			return nil
+		},
+	},
+	"auto-aof-rewrite-percentage": {
+		get: func(store *Store) string {
+			store.aof.mu.Lock()
+			defer store.aof.mu.Unlock()
+			return strconv.Itoa(store.aof.autoRewritePercentage)
+		},
+		set: func(store *Store, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < 0 {
+				return fmt.Errorf("argument must be between 0 and 2147483647 inclusive")
+			}
+			store.aof.mu.Lock()
+			store.aof.autoRewritePercentage = n
+			store.aof.mu.Unlock()
+			return nil
+		},
+	},
+	"auto-aof-rewrite-min-size": {
+		get: func(store *Store) string {
+			store.aof.mu.Lock()
+			defer store.aof.mu.Unlock()
+			return strconv.FormatInt(store.aof.autoRewriteMinSize, 10)
+		},
+		set: func(store *Store, val string) error {
+			n, err := parseMemory(val)
+			if err != nil {
+				return err
+			}
+			store.aof.mu.Lock()
+			store.aof.autoRewriteMinSize = n
+			store.aof.mu.Unlock()
+			return nil
+		},
+	},
+	"port": {
+		get: func(store *Store) string {
+			store.repl.mu.Lock()
+			defer store.repl.mu.Unlock()
+			return strconv.Itoa(store.repl.port)
+		},
+	},
+	"cluster-enabled": {
+		get: func(store *Store) string {
+			return formatYesNo(store.cluster.enabled)
+		},
+	},
+	"cluster-config-file": {
+		get: func(store *Store) string {
+			store.cluster.mu.RLock()
+			defer store.cluster.mu.RUnlock()
+			return store.cluster.configFile
+		},
+	},
+	"cluster-port": {
+		get: func(store *Store) string {
+			store.cluster.mu.RLock()
+			defer store.cluster.mu.RUnlock()
+			return strconv.Itoa(store.cluster.port)
+		},
+	},
+	"cluster-node-timeout": {
+		get: func(store *Store) string {
+			store.cluster.mu.RLock()
+			defer store.cluster.mu.RUnlock()
+			return strconv.FormatInt(store.cluster.nodeTimeout.Milliseconds(), 10)
+		},
+		set: func(store *Store, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < 1 {
+				return fmt.Errorf("argument must be between 1 and 2147483647 inclusive")
+			}
+			store.cluster.mu.Lock()
+			store.cluster.nodeTimeout = time.Duration(n) * time.Millisecond
+			store.cluster.mu.Unlock()
+			return nil
+		},
+	},
+	"cluster-require-full-coverage": {
+		get: func(store *Store) string {
+			store.cluster.mu.RLock()
+			defer store.cluster.mu.RUnlock()
+			return formatYesNo(store.cluster.requireFullCoverage)
+		},
+		set: func(store *Store, val string) error {
+			on, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+			store.cluster.mu.Lock()
+			store.cluster.requireFullCoverage = on
+			store.cluster.updateStateLocked()
+			store.cluster.mu.Unlock()
+			return nil
+		},
+	},
+	"repl-backlog-size": {
+		get: func(store *Store) string {
+			store.repl.mu.Lock()
+			defer store.repl.mu.Unlock()
+			return strconv.Itoa(store.repl.backlogSize)
+		},
+		set: func(store *Store, val string) error {
+			n, err := parseMemory(val)
+			if err != nil {
+				return err
+			}
+			if n > math.MaxInt32 {
+				return fmt.Errorf("argument must be between 1 and 2147483647 inclusive")
+			}
+			size := max(int(n), minReplBacklogSize)
+			store.repl.mu.Lock()
+			store.repl.backlogSize = size
+			if store.repl.backlog != nil {
+				store.repl.backlog = store.repl.backlog.resize(size)
+			}
+			store.repl.mu.Unlock()
+			return nil
+		},
+	},
+	"replica-read-only": {
+		get: func(store *Store) string {
+			store.repl.mu.Lock()
+			defer store.repl.mu.Unlock()
+			return formatYesNo(store.repl.readOnly)
+		},
+		set: func(store *Store, val string) error {
+			on, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+			store.repl.mu.Lock()
+			store.repl.readOnly = on
+			store.repl.mu.Unlock()
+			return nil
+		},
+	},
+	"repl-ping-replica-period": {
+		get: func(store *Store) string {
+			store.repl.mu.Lock()
+			defer store.repl.mu.Unlock()
+			return strconv.Itoa(int(store.repl.pingPeriod / time.Second))
+		},
+		set: func(store *Store, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < 1 {
+				return fmt.Errorf("argument must be between 1 and 2147483647 inclusive")
+			}
+			store.repl.mu.Lock()
+			store.repl.pingPeriod = time.Duration(n) * time.Second
+			store.repl.mu.Unlock()
+			return nil
+		},
+	},
+	"repl-timeout": {
+		get: func(store *Store) string {
+			store.repl.mu.Lock()
+			defer store.repl.mu.Unlock()
+			return strconv.Itoa(int(store.repl.timeout / time.Second))
+		},
+		set: func(store *Store, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < 1 {
+				return fmt.Errorf("argument must be between 1 and 2147483647 inclusive")
+			}
+			store.repl.mu.Lock()
+			store.repl.timeout = time.Duration(n) * time.Second
+			store.repl.mu.Unlock()
+			return nil
+		},
+	},
+	"repl-diskless-sync": {
+		get: func(store *Store) string {
+			store.repl.mu.Lock()
+			defer store.repl.mu.Unlock()
+			return formatYesNo(store.repl.disklessSync)
+		},
+		set: func(store *Store, val string) error {
+			on, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+			store.repl.mu.Lock()
+			store.repl.disklessSync = on
+			store.repl.mu.Unlock()
+			return nil
+		},
+	},
+	"repl-diskless-sync-delay": {
+		get: func(store *Store) string {
+			store.repl.mu.Lock()
+			defer store.repl.mu.Unlock()
+			return strconv.Itoa(int(store.repl.disklessSyncDelay / time.Second))
+		},
+		set: func(store *Store, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < 0 {
+				return fmt.Errorf("argument must be between 0 and 2147483647 inclusive")
+			}
+			store.repl.mu.Lock()
+			store.repl.disklessSyncDelay = time.Duration(n) * time.Second
+			store.repl.mu.Unlock()
+			return nil
+		},
+	},
+	"repl-diskless-sync-max-replicas": {
+		get: func(store *Store) string {
+			store.repl.mu.Lock()
+			defer store.repl.mu.Unlock()
+			return strconv.Itoa(store.repl.disklessSyncMaxReplicas)
+		},
+		set: func(store *Store, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < 0 {
+				return fmt.Errorf("argument must be between 0 and 2147483647 inclusive")
+			}
+			store.repl.mu.Lock()
+			store.repl.disklessSyncMaxReplicas = n
+			store.repl.mu.Unlock()
+			return nil
+		},
+	},
+	"repl-diskless-load": {
+		get: func(store *Store) string {
+			store.repl.mu.Lock()
+			defer store.repl.mu.Unlock()
+			return store.repl.disklessLoad
+		},
+		set: func(store *Store, val string) error {
+			mode, err := parseDisklessLoad(val)
+			if err != nil {
+				return err
+			}
+			store.repl.mu.Lock()
+			store.repl.disklessLoad = mode
+			store.repl.mu.Unlock()
+			return nil
+		},
+	},
+	"list-max-listpack-size": {
+		get: func(store *Store) string {
+			store.mu.RLock()
+			defer store.mu.RUnlock()
+			return strconv.Itoa(store.listMaxListpackSize)
+		},
+		set: func(store *Store, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			store.mu.Lock()
+			store.listMaxListpackSize = n
+			store.mu.Unlock()
+			return nil
+		},
+	},
+	"list-compress-depth": {
+		get: func(store *Store) string {
+			store.mu.RLock()
+			defer store.mu.RUnlock()
+			return strconv.Itoa(store.listCompressDepth)
+		},
+		set: func(store *Store, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < 0 {
+				return fmt.Errorf("argument must be between 0 and 2147483647 inclusive")
+			}
+			store.mu.Lock()
+			store.listCompressDepth = n
+			store.mu.Unlock()
+			return nil
+		},
+	},
+	"hll-sparse-max-bytes": {
+		get: func(store *Store) string {
+			store.mu.RLock()
+			defer store.mu.RUnlock()
+			return strconv.Itoa(store.hllSparseMaxBytes)
+		},
+		set: func(store *Store, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < 0 {
+				return fmt.Errorf("argument must be between 0 and 2147483647 inclusive")
+			}
+			store.mu.Lock()
+			store.hllSparseMaxBytes = n
+			store.mu.Unlock()
+			return nil
+		},
+	},
+}
+
+func parseYesNo(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseMemory parses a size in bytes with an optional unit: k, m and g are
+// powers of 1000, kb, mb and gb powers of 1024.
+func parseMemory(val string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1}}
+	lower := strings.ToLower(val)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mul = strings.TrimSuffix(lower, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// configAliases maps legacy parameter names to their current name.
+var configAliases = map[string]string{
+	"list-max-ziplist-size":  "list-max-listpack-size",
+	"slave-read-only":        "replica-read-only",
+	"repl-ping-slave-period": "repl-ping-replica-period",
+}
+
+func lookupConfig(name string) (string, configParam, bool) {
+	name = strings.ToLower(name)
+	if alias, ok := configAliases[name]; ok {
+		name = alias
+	}
+	p, ok := configParams[name]
+	return name, p, ok
+}
+
+func handleConfig(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	switch strings.ToUpper(strs[0]) {
+	case "GET":
+		if len(strs) < 2 {
+			return parser.Error("ERR wrong number of arguments for 'config|get' command")
+		}
+		return configGet(store, strs[1:])
+	case "SET":
+		if len(strs) < 3 || len(strs)%2 == 0 {
+			return parser.Error("ERR wrong number of arguments for 'config|set' command")
+		}
+		return configSet(store, strs[1:])
+	default:
+		return parser.Error("ERR unknown subcommand '" + strs[0] + "'. Try CONFIG HELP.")
+	}
+}
+
+// configGet accepts exact names, aliases and glob-style patterns. Patterns
+// match the current parameter names case-insensitively.
+func configGet(store *Store, names []string) parser.Value {
+	arr := []parser.Value{}
+	seen := make(map[string]bool)
+	add := func(name string, p configParam) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		arr = append(arr, parser.BulkString(name), parser.BulkString(p.get(store)))
+	}
+	for _, n := range names {
+		if name, p, ok := lookupConfig(n); ok {
+			add(name, p)
+			continue
+		}
+		if !strings.ContainsAny(n, "*?[") {
+			continue
+		}
+		all := make([]string, 0, len(configParams))
+		for name := range configParams {
+			all = append(all, name)
+		}
+		sort.Strings(all)
+		for _, name := range all {
+			if stringMatch(n, name, true) {
+				add(name, configParams[name])
+			}
+		}
+	}
+	return parser.Array(arr)
+}
+
+// configSet validates every pair before applying any of them, so a failed
+// CONFIG SET leaves the configuration unchanged.
+func configSet(store *Store, pairs []string) parser.Value {
+	params := make([]configParam, 0, len(pairs)/2)
+	seen := make(map[string]bool)
+	for i := 0; i < len(pairs); i += 2 {
+		name, p, ok := lookupConfig(pairs[i])
+		if !ok || p.set == nil {
+			return parser.Error(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", pairs[i]))
+		}
+		if seen[name] {
+			return parser.Error(fmt.Sprintf("ERR Duplicate parameter - '%s'", pairs[i]))
+		}
+		seen[name] = true
+		params = append(params, p)
+	}
+	old := make([]string, len(params))
+	for i, p := range params {
+		old[i] = p.get(store)
+	}
+	for i, p := range params {
+		if err := p.set(store, pairs[2*i+1]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				params[j].set(store, old[j])
+			}
+			return parser.Error(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", pairs[2*i], err))
+		}
+	}
+	return parser.SimpleString("OK")
+}
@@ -0,0 +1,65 @@
+package redis
+
+import "strings"
+
+// clusterSlots is the number of hash slots the key space is split into.
+const clusterSlots = 16384
+
+// crc16Table is the CRC-16/XMODEM table (polynomial 0x1021, no reflection)
+// that Redis Cluster hashes keys with.
+var crc16Table = func() [256]uint16 {
+	var t [256]uint16
+	for i := range t {
+		crc := uint16(i) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// keyHashSlot returns the hash slot of key. When the key holds a non-empty
+// hash tag, the part between the first { and the next }, only the tag is
+// hashed, so that keys sharing a tag land in the same slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (clusterSlots - 1))
+}
+
+// patternHashSlot returns the slot of every key matching a glob pattern, or
+// -1 if they may be in different slots. That is only known when the
+// pattern holds a hash tag before any wildcard or escape.
+func patternHashSlot(pattern string) int {
+	start := -1
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' || c == '?' || c == '[' || c == '\\':
+			return -1
+		case start < 0 && c == '{':
+			start = i
+		case start >= 0 && c == '}':
+			if i == start+1 {
+				return -1
+			}
+			return int(crc16(pattern[start+1:i]) & (clusterSlots - 1))
+		}
+	}
+	return -1
+}
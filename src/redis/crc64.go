@@ -0,0 +1,14 @@
+package redis
+
+import "hash/crc64"
+
+// crc64Jones is the reflected form of the Jones polynomial that Redis uses
+// to checksum DUMP payloads and RDB files.
+var crc64Jones = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// redisCRC64 continues the Redis CRC-64 crc over p. Redis starts from 0
+// without a final XOR, while hash/crc64 inverts the value on the way in and
+// out, so the inversions are undone here.
+func redisCRC64(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Jones, p)
+}
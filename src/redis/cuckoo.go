@@ -0,0 +1,589 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// Cuckoo filters follow RedisBloom: buckets of one-byte fingerprints, with
+// the alternate bucket derived from the fingerprint alone so that items can
+// be moved and deleted without knowing them. When an insert cannot find
+// room after maxIterations evictions the evictions are rolled back and a new
+// sub-filter, `expansion` times larger, is added.
+const (
+	cuckooDefaultCapacity   = 1024
+	cuckooDefaultBucketSize = 2
+	cuckooDefaultMaxIter    = 20
+	cuckooDefaultExpansion  = 1
+	cuckooMaxBucketSize     = 255
+	cuckooMaxIterations     = 65535
+	cuckooMaxExpansion      = 32768
+	cuckooAltHashMultiplier = 0x5bd1e995
+)
+
+var (
+	errCuckooFull     = fmt.Errorf("ERR Filter is full")
+	errCuckooTooLarge = fmt.Errorf("ERR filter is too large")
+)
+
+type cuckooLayer struct {
+	slots      []byte // numBuckets*bucketSize fingerprints, 0 is empty
+	numBuckets uint64
+}
+
+type cuckooFilter struct {
+	layers        []*cuckooLayer
+	bucketSize    int
+	maxIterations int
+	expansion     int64 // 0 for a non-scaling filter
+	items         int64
+	deleted       int64
+}
+
+func nextPow2(n uint64) uint64 {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len64(n-1)
+}
+
+func newCuckooFilter(capacity int64, bucketSize, maxIterations int, expansion int64) (*cuckooFilter, error) {
+	f := &cuckooFilter{
+		bucketSize:    bucketSize,
+		maxIterations: maxIterations,
+		expansion:     int64(nextPow2(uint64(expansion))),
+	}
+	if expansion == 0 {
+		f.expansion = 0
+	}
+	if err := f.grow(nextPow2(uint64(capacity) / uint64(bucketSize))); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *cuckooFilter) grow(numBuckets uint64) error {
+	if numBuckets*uint64(f.bucketSize) > maxStringSize {
+		return errCuckooTooLarge
+	}
+	f.layers = append(f.layers, &cuckooLayer{
+		slots:      make([]byte, numBuckets*uint64(f.bucketSize)),
+		numBuckets: numBuckets,
+	})
+	return nil
+}
+
+// cuckooHash returns the item's fingerprint, never 0, and its hash.
+func cuckooHash(item []byte) (byte, uint64) {
+	h := murmurHash64A(item, 0)
+	return byte(h%255 + 1), h
+}
+
+func cuckooAltIndex(fp byte, i uint64) uint64 {
+	return i ^ uint64(fp)*cuckooAltHashMultiplier
+}
+
+// bucket returns the slots of bucket i, wrapped to the layer size.
+func (f *cuckooFilter) bucket(l *cuckooLayer, i uint64) []byte {
+	i &= l.numBuckets - 1
+	return l.slots[i*uint64(f.bucketSize) : (i+1)*uint64(f.bucketSize)]
+}
+
+func (f *cuckooFilter) buckets(l *cuckooLayer, fp byte, h uint64) ([]byte, []byte) {
+	return f.bucket(l, h), f.bucket(l, cuckooAltIndex(fp, h))
+}
+
+func (f *cuckooFilter) count(item []byte) int64 {
+	fp, h := cuckooHash(item)
+	n := int64(0)
+	for _, l := range f.layers {
+		b1, b2 := f.buckets(l, fp, h)
+		n += int64(bytes.Count(b1, []byte{fp}))
+		if &b1[0] != &b2[0] {
+			n += int64(bytes.Count(b2, []byte{fp}))
+		}
+	}
+	return n
+}
+
+func (f *cuckooFilter) exists(item []byte) bool {
+	fp, h := cuckooHash(item)
+	for _, l := range f.layers {
+		b1, b2 := f.buckets(l, fp, h)
+		if bytes.IndexByte(b1, fp) >= 0 || bytes.IndexByte(b2, fp) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// placeFree stores fp in the first empty slot of b.
+func placeFree(b []byte, fp byte) bool {
+	for i, x := range b {
+		if x == 0 {
+			b[i] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// insert adds one copy of item, reporting false when the filter is full and
+// cannot grow.
+func (f *cuckooFilter) insert(item []byte) (bool, error) {
+	fp, h := cuckooHash(item)
+	for {
+		for _, l := range f.layers {
+			b1, b2 := f.buckets(l, fp, h)
+			if placeFree(b1, fp) || placeFree(b2, fp) {
+				f.items++
+				return true, nil
+			}
+		}
+		if f.kickInsert(f.layers[len(f.layers)-1], fp, h) {
+			f.items++
+			return true, nil
+		}
+		if f.expansion == 0 {
+			return false, nil
+		}
+		last := f.layers[len(f.layers)-1]
+		if err := f.grow(last.numBuckets * uint64(f.expansion)); err != nil {
+			return false, err
+		}
+	}
+}
+
+// kickInsert makes room for fp by relocating fingerprints to their
+// alternate buckets, undoing every move if no room is found. As in
+// RedisBloom, the slot evicted moves one along with each step rather than
+// being picked at random, so that replaying the same insertions, from the
+// AOF or on a replica, builds the same filter.
+func (f *cuckooFilter) kickInsert(l *cuckooLayer, fp byte, h uint64) bool {
+	type move struct {
+		bucket uint64
+		slot   int
+	}
+	moves := make([]move, 0, f.maxIterations)
+	i := h & (l.numBuckets - 1)
+	victim := fp
+	for n := 0; n < f.maxIterations; n++ {
+		slot := n % f.bucketSize
+		b := f.bucket(l, i)
+		victim, b[slot] = b[slot], victim
+		moves = append(moves, move{i, slot})
+		i = cuckooAltIndex(victim, i) & (l.numBuckets - 1)
+		if placeFree(f.bucket(l, i), victim) {
+			return true
+		}
+	}
+	for n := len(moves) - 1; n >= 0; n-- {
+		b := f.bucket(l, moves[n].bucket)
+		victim, b[moves[n].slot] = b[moves[n].slot], victim
+	}
+	return false
+}
+
+// remove deletes one copy of item, newest sub-filter first.
+func (f *cuckooFilter) remove(item []byte) bool {
+	fp, h := cuckooHash(item)
+	for n := len(f.layers) - 1; n >= 0; n-- {
+		b1, b2 := f.buckets(f.layers[n], fp, h)
+		for _, b := range [][]byte{b1, b2} {
+			for i, x := range b {
+				if x == fp {
+					b[i] = 0
+					f.items--
+					f.deleted++
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (f *cuckooFilter) size() int64 {
+	n := int64(0)
+	for _, l := range f.layers {
+		n += int64(len(l.slots))
+	}
+	return n
+}
+
+// encode returns the persisted form of the filter: its parameters and
+// counters, then each sub-filter's bucket count and slots.
+func (f *cuckooFilter) encode() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(f.bucketSize))
+	b = binary.LittleEndian.AppendUint32(b, uint32(f.maxIterations))
+	b = binary.LittleEndian.AppendUint64(b, uint64(f.expansion))
+	b = binary.LittleEndian.AppendUint64(b, uint64(f.items))
+	b = binary.LittleEndian.AppendUint64(b, uint64(f.deleted))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(f.layers)))
+	for _, l := range f.layers {
+		b = binary.LittleEndian.AppendUint64(b, l.numBuckets)
+		b = append(b, l.slots...)
+	}
+	return b
+}
+
+func decodeCuckooFilter(data []byte) (*cuckooFilter, error) {
+	r := &sketchReader{b: data}
+	f := &cuckooFilter{
+		bucketSize:    int(r.u32()),
+		maxIterations: int(r.u32()),
+		expansion:     int64(r.u64()),
+		items:         int64(r.u64()),
+		deleted:       int64(r.u64()),
+	}
+	n := r.u32()
+	if f.bucketSize < 1 || f.bucketSize > cuckooMaxBucketSize || f.maxIterations < 1 || f.expansion < 0 || n == 0 {
+		return nil, errSketchCorrupt
+	}
+	for i := uint32(0); i < n && !r.err; i++ {
+		numBuckets := r.u64()
+		if numBuckets == 0 || numBuckets&(numBuckets-1) != 0 || numBuckets > uint64(len(r.b)) {
+			return nil, errSketchCorrupt
+		}
+		slots := r.bytes(numBuckets * uint64(f.bucketSize))
+		f.layers = append(f.layers, &cuckooLayer{slots: append([]byte(nil), slots...), numBuckets: numBuckets})
+	}
+	if err := r.done(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// getCuckoo returns the cuckoo filter stored at key. Caller must hold s.mu.
+func (s *Store) getCuckoo(key string) (*cuckooFilter, bool, error) {
+	val, exists := s.lookupKeyRead(key)
+	if !exists {
+		return nil, false, nil
+	}
+	f, ok := val.(*cuckooFilter)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return f, true, nil
+}
+
+// getCuckooForWrite is getCuckoo for callers holding s.mu for writing.
+func (s *Store) getCuckooForWrite(key string) (*cuckooFilter, bool, error) {
+	val, exists := s.lookupKeyWrite(key)
+	if !exists {
+		return nil, false, nil
+	}
+	f, ok := val.(*cuckooFilter)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return s.mutable(key, f).(*cuckooFilter), true, nil
+}
+
+// CFReserve creates an empty filter at key. An expansion of 0 makes it
+// non-scaling.
+func (s *Store) CFReserve(key string, capacity int64, bucketSize, maxIterations int, expansion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.lookupKeyWrite(key); exists {
+		return errBloomExists
+	}
+	f, err := newCuckooFilter(capacity, bucketSize, maxIterations, expansion)
+	if err != nil {
+		return err
+	}
+	s.setKey(key, f)
+	return nil
+}
+
+// CFInsert adds items to the filter at key. A missing filter is created
+// with the given capacity unless noCreate is set. With nx, items that may
+// already be present are skipped. Each result is 1 when the item was added,
+// 0 when it was skipped and -1 when the filter is full.
+func (s *Store) CFInsert(key string, capacity int64, noCreate, nx bool, items ...[]byte) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists, err := s.getCuckooForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if noCreate {
+			return nil, errBloomNotFound
+		}
+		f, err = newCuckooFilter(capacity, cuckooDefaultBucketSize, cuckooDefaultMaxIter, cuckooDefaultExpansion)
+		if err != nil {
+			return nil, err
+		}
+		s.setKey(key, f)
+	}
+	results := make([]int64, len(items))
+	for i, item := range items {
+		if nx && f.exists(item) {
+			continue
+		}
+		added, err := f.insert(item)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = -1
+		if added {
+			results[i] = 1
+		}
+	}
+	return results, nil
+}
+
+// CFExists reports for each item whether it may be in the filter.
+func (s *Store) CFExists(key string, items ...[]byte) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, exists, err := s.getCuckoo(key)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(items))
+	if exists {
+		for i, item := range items {
+			found[i] = f.exists(item)
+		}
+	}
+	return found, nil
+}
+
+// CFDel removes one copy of item from the filter at key.
+func (s *Store) CFDel(key string, item []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists, err := s.getCuckooForWrite(key)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, errBloomNotFound
+	}
+	return f.remove(item), nil
+}
+
+// CFCount returns how many times item may have been added to the filter.
+func (s *Store) CFCount(key string, item []byte) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, exists, err := s.getCuckoo(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return f.count(item), nil
+}
+
+// CFInfo returns the filter's size in bytes, bucket count, number of
+// sub-filters, inserted and deleted item counts, bucket size, expansion
+// rate and maximum number of iterations.
+func (s *Store) CFInfo(key string) ([8]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, exists, err := s.getCuckoo(key)
+	if err != nil {
+		return [8]int64{}, err
+	}
+	if !exists {
+		return [8]int64{}, errBloomNotFound
+	}
+	buckets := uint64(0)
+	for _, l := range f.layers {
+		buckets += l.numBuckets
+	}
+	return [8]int64{f.size(), int64(buckets), int64(len(f.layers)), f.items, f.deleted,
+		int64(f.bucketSize), f.expansion, int64(f.maxIterations)}, nil
+}
+
+func handleCFReserve(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	capacity, err := strconv.ParseInt(strs[1], 10, 64)
+	if err != nil || capacity <= 0 {
+		return parser.Error("ERR Bad capacity")
+	}
+	bucketSize, maxIterations, expansion := cuckooDefaultBucketSize, cuckooDefaultMaxIter, int64(cuckooDefaultExpansion)
+	for i := 2; i < len(strs); i += 2 {
+		if i+1 == len(strs) {
+			return parser.Error("ERR syntax error")
+		}
+		n, err := strconv.ParseInt(strs[i+1], 10, 64)
+		switch strings.ToUpper(strs[i]) {
+		case "BUCKETSIZE":
+			if err != nil || n < 1 || n > cuckooMaxBucketSize {
+				return parser.Error("ERR Bad bucket size")
+			}
+			bucketSize = int(n)
+		case "MAXITERATIONS":
+			if err != nil || n < 1 || n > cuckooMaxIterations {
+				return parser.Error("ERR Bad maxIterations")
+			}
+			maxIterations = int(n)
+		case "EXPANSION":
+			if err != nil || n < 0 || n > cuckooMaxExpansion {
+				return parser.Error("ERR Bad expansion")
+			}
+			expansion = n
+		default:
+			return parser.Error("ERR syntax error")
+		}
+	}
+	if capacity < int64(bucketSize)*2 {
+		return parser.Error("ERR Capacity must be at least (BucketSize * 2)")
+	}
+	if err := store.CFReserve(strs[0], capacity, bucketSize, maxIterations, expansion); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleCFAdd(store *Store, args []parser.Value) parser.Value {
+	return cfAdd(store, args, false)
+}
+
+func handleCFAddNX(store *Store, args []parser.Value) parser.Value {
+	return cfAdd(store, args, true)
+}
+
+func cfAdd(store *Store, args []parser.Value, nx bool) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	results, err := store.CFInsert(string(items[0]), cuckooDefaultCapacity, false, nx, items[1])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if results[0] < 0 {
+		return parser.Error(errCuckooFull.Error())
+	}
+	return parser.Integer(results[0])
+}
+
+func handleCFInsert(store *Store, args []parser.Value) parser.Value {
+	return cfInsert(store, args, false)
+}
+
+func handleCFInsertNX(store *Store, args []parser.Value) parser.Value {
+	return cfInsert(store, args, true)
+}
+
+// cfInsert implements CF.INSERT and CF.INSERTNX:
+// key [CAPACITY capacity] [NOCREATE] ITEMS item [item ...].
+func cfInsert(store *Store, args []parser.Value, nx bool) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	capacity, noCreate := int64(cuckooDefaultCapacity), false
+	i := 1
+	for ; i < len(items); i++ {
+		switch strings.ToUpper(string(items[i])) {
+		case "CAPACITY":
+			if i+1 == len(items) {
+				return parser.Error("ERR syntax error")
+			}
+			i++
+			n, err := strconv.ParseInt(string(items[i]), 10, 64)
+			if err != nil || n < cuckooDefaultBucketSize*2 {
+				return parser.Error("ERR Bad capacity")
+			}
+			capacity = n
+			continue
+		case "NOCREATE":
+			noCreate = true
+			continue
+		case "ITEMS":
+		default:
+			return parser.Error("ERR syntax error")
+		}
+		break
+	}
+	if i >= len(items)-1 {
+		return parser.Error("ERR wrong number of arguments")
+	}
+	results, err := store.CFInsert(string(items[0]), capacity, noCreate, nx, items[i+1:]...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	reply := make(parser.Array, len(results))
+	for i, r := range results {
+		reply[i] = parser.Integer(r)
+	}
+	return reply
+}
+
+func handleCFExists(store *Store, args []parser.Value) parser.Value {
+	reply := handleCFMExists(store, args)
+	if arr, ok := reply.(parser.Array); ok {
+		return arr[0]
+	}
+	return reply
+}
+
+func handleCFMExists(store *Store, args []parser.Value) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	found, err := store.CFExists(string(items[0]), items[1:]...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return boolsReply(found)
+}
+
+func handleCFDel(store *Store, args []parser.Value) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	deleted, err := store.CFDel(string(items[0]), items[1])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !deleted {
+		return parser.Integer(0)
+	}
+	return parser.Integer(1)
+}
+
+func handleCFCount(store *Store, args []parser.Value) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	n, err := store.CFCount(string(items[0]), items[1])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleCFInfo(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	info, err := store.CFInfo(string(key))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	names := []string{"Size", "Number of buckets", "Number of filters", "Number of items inserted",
+		"Number of items deleted", "Bucket size", "Expansion rate", "Max iterations"}
+	reply := make(parser.Array, 0, 2*len(names))
+	for i, name := range names {
+		reply = append(reply, parser.SimpleString(name), parser.Integer(info[i]))
+	}
+	return reply
+}
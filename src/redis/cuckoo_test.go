@@ -0,0 +1,159 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestCuckooInsertDelete(t *testing.T) {
+	store := newStore()
+	if err := store.CFReserve("cf", 1000, 2, 20, 1); err != nil {
+		t.Fatalf("CFReserve: %v", err)
+	}
+	for i := 0; i < 900; i++ {
+		if res, err := store.CFInsert("cf", 0, true, false, []byte(fmt.Sprintf("item:%d", i))); err != nil || res[0] != 1 {
+			t.Fatalf("CFInsert(item:%d) = %v, %v", i, res, err)
+		}
+	}
+	for i := 0; i < 900; i++ {
+		if found, _ := store.CFExists("cf", []byte(fmt.Sprintf("item:%d", i))); !found[0] {
+			t.Fatalf("false negative for item:%d", i)
+		}
+	}
+	for i := 0; i < 900; i += 2 {
+		if ok, _ := store.CFDel("cf", []byte(fmt.Sprintf("item:%d", i))); !ok {
+			t.Fatalf("CFDel(item:%d) failed", i)
+		}
+	}
+	for i := 1; i < 900; i += 2 {
+		if found, _ := store.CFExists("cf", []byte(fmt.Sprintf("item:%d", i))); !found[0] {
+			t.Fatalf("deleting other items lost item:%d", i)
+		}
+	}
+	info, _ := store.CFInfo("cf")
+	if info[3] != 450 || info[4] != 450 {
+		t.Errorf("expected 450 inserted and 450 deleted, got %v", info)
+	}
+	if _, err := store.CFDel("missing", []byte("a")); err != errBloomNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestCuckooCountAndNX(t *testing.T) {
+	store := newStore()
+	res, _ := store.CFInsert("cf", cuckooDefaultCapacity, false, false, []byte("a"), []byte("a"), []byte("a"))
+	if len(res) != 3 || res[2] != 1 {
+		t.Errorf("expected duplicates to be added, got %v", res)
+	}
+	if n, _ := store.CFCount("cf", []byte("a")); n != 3 {
+		t.Errorf("expected count 3, got %d", n)
+	}
+	if res, _ := store.CFInsert("cf", cuckooDefaultCapacity, false, true, []byte("a"), []byte("b")); res[0] != 0 || res[1] != 1 {
+		t.Errorf("expected [0 1], got %v", res)
+	}
+	if n, _ := store.CFCount("missing", []byte("a")); n != 0 {
+		t.Errorf("expected 0 for a missing key, got %d", n)
+	}
+}
+
+func TestCuckooGrowth(t *testing.T) {
+	store := newStore()
+	store.CFReserve("fixed", 64, 2, 20, 0)
+	full := false
+	for i := 0; i < 200 && !full; i++ {
+		res, _ := store.CFInsert("fixed", 0, true, false, []byte(fmt.Sprintf("%d", i)))
+		full = res[0] == -1
+	}
+	if !full {
+		t.Fatalf("expected a non-scaling filter to fill up")
+	}
+	f := store.data["fixed"].(*cuckooFilter)
+	// A failed insert must leave every earlier item in place.
+	for i := int64(0); i < f.items; i++ {
+		if !f.exists([]byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("failed insert lost item %d", i)
+		}
+	}
+
+	store.CFReserve("grow", 64, 2, 20, 2)
+	for i := 0; i < 500; i++ {
+		store.CFInsert("grow", 0, true, false, []byte(fmt.Sprintf("%d", i)))
+	}
+	g := store.data["grow"].(*cuckooFilter)
+	if len(g.layers) < 2 || g.layers[1].numBuckets != 2*g.layers[0].numBuckets {
+		t.Errorf("expected the filter to grow by its expansion rate")
+	}
+	for i := 0; i < 500; i++ {
+		if !g.exists([]byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("false negative for %d after growing", i)
+		}
+	}
+
+	data := g.encode()
+	decoded, err := decodeCuckooFilter(data)
+	if err != nil || string(decoded.encode()) != string(data) {
+		t.Errorf("encoding does not round trip: %v", err)
+	}
+	if _, err := decodeCuckooFilter(data[:len(data)-1]); err != errSketchCorrupt {
+		t.Errorf("expected corrupt payload error, got %v", err)
+	}
+}
+
+func TestCuckooCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp := sendCmd(t, conn, reader, "CF.RESERVE cf 1000 BUCKETSIZE 4 EXPANSION 0")
+	if str, ok := resp.(parser.SimpleString); !ok || str != "OK" {
+		t.Errorf("expected OK, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CF.RESERVE small 2 BUCKETSIZE 4")
+	if err, ok := resp.(parser.Error); !ok || err != "ERR Capacity must be at least (BucketSize * 2)" {
+		t.Errorf("expected capacity error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CF.ADD cf a")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CF.ADDNX cf a")
+	if num, ok := resp.(parser.Integer); !ok || num != 0 {
+		t.Errorf("expected 0, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CF.INSERTNX cf ITEMS a b")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 2 || arr[0] != parser.Integer(0) || arr[1] != parser.Integer(1) {
+		t.Errorf("expected [0 1], got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CF.INSERT missing NOCREATE ITEMS a")
+	if err, ok := resp.(parser.Error); !ok || err != "ERR not found" {
+		t.Errorf("expected not found, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CF.MEXISTS cf a c")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 2 || arr[0] != parser.Integer(1) || arr[1] != parser.Integer(0) {
+		t.Errorf("expected [1 0], got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CF.DEL cf a")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CF.EXISTS cf a")
+	if num, ok := resp.(parser.Integer); !ok || num != 0 {
+		t.Errorf("expected 0, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "CF.INFO cf")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 16 || arr[11] != parser.Integer(4) || arr[13] != parser.Integer(0) {
+		t.Errorf("unexpected CF.INFO reply %v", resp)
+	}
+	sendCmd(t, conn, reader, "BF.ADD bf a")
+	resp = sendCmd(t, conn, reader, "CF.ADD bf a")
+	if err, ok := resp.(parser.Error); !ok || string(err) != errWrongType.Error() {
+		t.Errorf("expected WRONGTYPE, got %v", resp)
+	}
+}
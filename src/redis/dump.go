@@ -0,0 +1,187 @@
+package redis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+var (
+	errDumpPayload   = fmt.Errorf("ERR DUMP payload version or checksum are wrong")
+	errBadDataFormat = fmt.Errorf("ERR Bad data format")
+	errBusyKey       = fmt.Errorf("BUSYKEY Target key name already exists.")
+)
+
+// createDumpPayload serializes val as DUMP does: the RDB type and value,
+// then the RDB version and a CRC-64 of everything before it, both little
+// endian.
+func createDumpPayload(val interface{}) ([]byte, error) {
+	typ, err := rdbObjectType(val)
+	if err != nil {
+		return nil, err
+	}
+	b := rdbAppendValue([]byte{typ}, val)
+	b = binary.LittleEndian.AppendUint16(b, rdbVersion)
+	return binary.LittleEndian.AppendUint64(b, redisCRC64(0, b)), nil
+}
+
+func verifyDumpPayload(p []byte) bool {
+	if len(p) < 10 {
+		return false
+	}
+	footer := p[len(p)-10:]
+	if binary.LittleEndian.Uint16(footer) > rdbMaxVersion {
+		return false
+	}
+	return binary.LittleEndian.Uint64(footer[2:]) == redisCRC64(0, p[:len(p)-8])
+}
+
+// Dump returns the DUMP payload of the value at key.
+func (s *Store) Dump(key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, exists := s.lookupKeyRead(key)
+	if !exists {
+		return nil, false, nil
+	}
+	payload, err := createDumpPayload(val)
+	return payload, true, err
+}
+
+// restoreOptions holds the arguments of RESTORE. ttl is in milliseconds,
+// relative unless absTTL is set, and 0 for no expiry. idle is negative when
+// IDLETIME is not given.
+type restoreOptions struct {
+	ttl     int64
+	absTTL  bool
+	replace bool
+	idle    time.Duration
+}
+
+// Restore creates key from a DUMP payload. A TTL already in the past
+// deletes the key instead, which only matters with REPLACE.
+func (s *Store) Restore(key string, payload []byte, opts restoreOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.lookupKeyWrite(key)
+	if exists && !opts.replace {
+		return errBusyKey
+	}
+	if !verifyDumpPayload(payload) {
+		return errDumpPayload
+	}
+	r := &rdbReader{
+		b:     payload[:len(payload)-10],
+		fill:  s.listMaxListpackSize,
+		depth: s.listCompressDepth,
+	}
+	val, err := r.loadObject(r.readByte())
+	if err != nil || len(r.b) != 0 {
+		return errBadDataFormat
+	}
+
+	now := time.Now()
+	var expireAt time.Time
+	if opts.ttl > 0 {
+		if opts.absTTL {
+			expireAt = time.UnixMilli(opts.ttl)
+		} else {
+			expireAt = now.Add(time.Duration(opts.ttl) * time.Millisecond)
+		}
+	}
+	s.deleteKey(key)
+	if !expireAt.IsZero() && !expireAt.After(now) {
+		return nil
+	}
+	s.setKey(key, val)
+	if !expireAt.IsZero() {
+		s.volatileKeyMap.setExpiration(key, ExpirationTime{
+			expiryTime:  expireAt,
+			durationSet: expireAt.Sub(now),
+		})
+	}
+	if opts.idle >= 0 {
+		s.access.setIdle(key, opts.idle)
+	} else {
+		s.access.touch(key)
+	}
+	if _, isList := val.(*quicklist); isList {
+		s.signalKeyAsReady(key)
+		s.serveBlockedClients()
+	}
+	return nil
+}
+
+func handleDump(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	payload, exists, err := store.Dump(string(key))
+	if err != nil {
+		return parser.Error("ERR " + err.Error())
+	}
+	if !exists {
+		return parser.BulkString(nil)
+	}
+	return parser.BulkString(payload)
+}
+
+func handleRestore(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	opts := restoreOptions{idle: -1}
+	freq := false
+	for i := 3; i < len(strs); i++ {
+		left := len(strs) - i - 1
+		switch opt := strings.ToUpper(strs[i]); {
+		case opt == "REPLACE":
+			opts.replace = true
+		case opt == "ABSTTL":
+			opts.absTTL = true
+		case opt == "IDLETIME" && left >= 1 && !freq:
+			n, err := strconv.ParseInt(strs[i+1], 10, 64)
+			if err != nil {
+				return parser.Error("ERR value is not an integer or out of range")
+			}
+			if n < 0 {
+				return parser.Error("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			opts.idle = time.Duration(n) * time.Second
+			i++
+		case opt == "FREQ" && left >= 1 && opts.idle < 0:
+			// Access frequency is only kept under an LFU maxmemory
+			// policy, which this server does not have, so FREQ is
+			// validated and otherwise ignored.
+			n, err := strconv.ParseInt(strs[i+1], 10, 64)
+			if err != nil {
+				return parser.Error("ERR value is not an integer or out of range")
+			}
+			if n < 0 || n > 255 {
+				return parser.Error("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			freq = true
+			i++
+		default:
+			return parser.Error("ERR syntax error")
+		}
+	}
+	ttl, err := strconv.ParseInt(strs[1], 10, 64)
+	if err != nil {
+		return parser.Error("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return parser.Error("ERR Invalid TTL value, must be >= 0")
+	}
+	opts.ttl = ttl
+	if err := store.Restore(strs[0], []byte(strs[2]), opts); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
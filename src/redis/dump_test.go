@@ -0,0 +1,218 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+	"pgregory.net/rapid"
+)
+
+func TestVerifyDumpPayload(t *testing.T) {
+	// DUMP of the string "10" as printed in the Redis documentation.
+	payload := []byte("\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n")
+	if !verifyDumpPayload(payload) {
+		t.Fatalf("expected the documented payload to verify")
+	}
+	store := newStore()
+	if err := store.Restore("k", payload, restoreOptions{idle: -1}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if v, _ := store.Get("k"); string(v) != "10" {
+		t.Errorf("expected 10, got %q", v)
+	}
+
+	corrupt := bytes.Clone(payload)
+	corrupt[1] ^= 1
+	if verifyDumpPayload(corrupt) {
+		t.Errorf("expected a flipped bit to fail the checksum")
+	}
+	newer := bytes.Clone(payload)
+	newer[len(newer)-10] = rdbMaxVersion + 1
+	if verifyDumpPayload(newer) || verifyDumpPayload(payload[:9]) {
+		t.Errorf("expected newer versions and short payloads to be rejected")
+	}
+}
+
+func TestDumpRestoreAllTypes(t *testing.T) {
+	store := newStore()
+	store.Set("int", []byte("-123456"))
+	store.Set("short", []byte("hello"))
+	store.Set("long", bytes.Repeat([]byte("abcdefgh"), 100))
+	store.IncrBy("counter", 1<<40)
+	for i := 0; i < 1000; i++ {
+		store.RPush("list", []byte(strconv.Itoa(i*37-500)), []byte(fmt.Sprintf("element-%d", i)))
+	}
+	mustDo(t, store, "JSON.SET", "doc", "$", `{"a":[1,2.5,"x",null,true],"b":{}}`)
+	mustDo(t, store, "BF.ADD", "bf", "x")
+	mustDo(t, store, "CF.ADD", "cf", "x")
+	mustDo(t, store, "CMS.INITBYDIM", "cms", "10", "3")
+	mustDo(t, store, "TOPK.RESERVE", "topk", "3", "8", "7", "0.9")
+	mustDo(t, store, "GEOADD", "geo", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+
+	for _, key := range []string{"int", "short", "long", "counter", "list", "doc", "bf", "cf", "cms", "topk", "geo"} {
+		payload, exists, err := store.Dump(key)
+		if err != nil || !exists {
+			t.Fatalf("Dump %s: %v %v", key, exists, err)
+		}
+		if err := store.Restore(key+":copy", payload, restoreOptions{idle: -1}); err != nil {
+			t.Fatalf("Restore %s: %v", key, err)
+		}
+		again, _, _ := store.Dump(key + ":copy")
+		if !bytes.Equal(payload, again) {
+			t.Errorf("%s: restored value dumps differently", key)
+		}
+		if store.Type(key) != store.Type(key+":copy") {
+			t.Errorf("%s: restored type %s", key, store.Type(key+":copy"))
+		}
+	}
+	if n, _ := store.LLen("list:copy"); n != 2000 {
+		t.Errorf("expected 2000 elements, got %d", n)
+	}
+	if v, _ := store.Get("counter:copy"); string(v) != strconv.Itoa(1<<40) {
+		t.Errorf("unexpected counter %q", v)
+	}
+	if _, exists, _ := store.Dump("missing"); exists {
+		t.Errorf("expected no payload for a missing key")
+	}
+}
+
+func mustDo(t *testing.T, store *Store, args ...string) parser.Value {
+	t.Helper()
+	vals := make([]parser.Value, len(args))
+	for i, a := range args {
+		vals[i] = parser.BulkString(a)
+	}
+	resp := commands[args[0]].handler(store, vals)
+	if e, ok := resp.(parser.Error); ok {
+		t.Fatalf("%v: %s", args, e)
+	}
+	return resp
+}
+
+func TestDumpMissingKey(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if resp := sendCmd(t, conn, reader, "DUMP nokey"); resp != nil {
+		t.Errorf("expected a null reply, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "PING"); resp != parser.SimpleString("PONG") {
+		t.Errorf("expected PONG, got %v", resp)
+	}
+}
+
+func TestRestoreOptions(t *testing.T) {
+	store := newStore()
+	store.Set("src", []byte("v"))
+	payload, _, _ := store.Dump("src")
+	restore := func(args ...string) parser.Value {
+		vals := []parser.Value{parser.BulkString("RESTORE"), parser.BulkString(args[0]), parser.BulkString(args[1]), parser.BulkString(payload)}
+		for _, a := range args[2:] {
+			vals = append(vals, parser.BulkString(a))
+		}
+		return handleRestore(store, vals)
+	}
+
+	tests := []struct {
+		args []string
+		want parser.Value
+	}{
+		{[]string{"k", "0"}, parser.SimpleString("OK")},
+		{[]string{"k", "0"}, parser.Error(errBusyKey.Error())},
+		{[]string{"k", "5000", "REPLACE"}, parser.SimpleString("OK")},
+		{[]string{"k", "-1", "REPLACE"}, parser.Error("ERR Invalid TTL value, must be >= 0")},
+		{[]string{"k", "x", "REPLACE"}, parser.Error("ERR value is not an integer or out of range")},
+		{[]string{"k", "0", "IDLETIME", "-1"}, parser.Error("ERR Invalid IDLETIME value, must be >= 0")},
+		{[]string{"k", "0", "FREQ", "256"}, parser.Error("ERR Invalid FREQ value, must be >= 0 and <= 255")},
+		{[]string{"k", "0", "IDLETIME", "1", "FREQ", "1"}, parser.Error("ERR syntax error")},
+		{[]string{"k", "0", "NOPE"}, parser.Error("ERR syntax error")},
+		{[]string{"idle", "0", "IDLETIME", "100"}, parser.SimpleString("OK")},
+		{[]string{"freq", "0", "FREQ", "5"}, parser.SimpleString("OK")},
+		{[]string{"past", "1000", "ABSTTL"}, parser.SimpleString("OK")},
+		{[]string{"future", strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10), "ABSTTL"}, parser.SimpleString("OK")},
+	}
+	for _, tt := range tests {
+		if resp := restore(tt.args...); resp != tt.want {
+			t.Errorf("RESTORE %v: expected %v, got %v", tt.args, tt.want, resp)
+		}
+	}
+	if ttl, err := store.volatileKeyMap.GetTTL("k"); err != nil || ttl > 5*time.Second || ttl < 4*time.Second {
+		t.Errorf("expected a 5s TTL, got %v %v", ttl, err)
+	}
+	if idle := store.access.idle("idle"); idle < 100*time.Second {
+		t.Errorf("expected IDLETIME to set the idle time, got %v", idle)
+	}
+	if store.Exists("past") != 0 {
+		t.Errorf("expected an expired ABSTTL to skip the key")
+	}
+	if ttl, _ := store.volatileKeyMap.GetTTL("future"); ttl < 59*time.Minute {
+		t.Errorf("expected an absolute TTL about an hour away, got %v", ttl)
+	}
+
+	bad := append([]byte{rdbTypeListQuicklist2, 1, quicklistNodeContainerPacked, 3, 'x', 'y', 'z'}, 0, 0)
+	bad = appendDumpFooter(bad)
+	if err := store.Restore("bad", bad, restoreOptions{idle: -1}); err != errBadDataFormat {
+		t.Errorf("expected bad data format, got %v", err)
+	}
+	if err := store.Restore("bad", payload[:len(payload)-1], restoreOptions{idle: -1}); err != errDumpPayload {
+		t.Errorf("expected checksum error, got %v", err)
+	}
+}
+
+func appendDumpFooter(b []byte) []byte {
+	b = b[:len(b)-2]
+	b = append(b, rdbVersion, 0)
+	crc := redisCRC64(0, b)
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(crc>>(8*i)))
+	}
+	return b
+}
+
+func TestListpackRoundTrip(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		entries := rapid.SliceOf(rapid.OneOf(
+			rapid.Map(rapid.Int64(), func(n int64) []byte { return []byte(strconv.FormatInt(n, 10)) }),
+			rapid.Map(rapid.Int64Range(-70000, 70000), func(n int64) []byte { return []byte(strconv.FormatInt(n, 10)) }),
+			rapid.SliceOfN(rapid.Byte(), 0, 5000),
+		)).Draw(t, "entries")
+		got, err := decodeListpack(encodeListpack(entries))
+		if err != nil {
+			t.Fatalf("decodeListpack: %v", err)
+		}
+		if len(got) != len(entries) {
+			t.Fatalf("expected %d entries, got %d", len(entries), len(got))
+		}
+		for i := range entries {
+			if !bytes.Equal(got[i], entries[i]) {
+				t.Fatalf("entry %d: expected %q, got %q", i, entries[i], got[i])
+			}
+		}
+	})
+}
+
+func TestListpackEncoding(t *testing.T) {
+	// Bytes as produced by Redis' lpAppend for "a", 1, -1 and 1000.
+	want := []byte{
+		18, 0, 0, 0, 4, 0,
+		0x81, 'a', 2,
+		0x01, 1,
+		0xdf, 0xff, 2,
+		0xc3, 0xe8, 2,
+		0xff,
+	}
+	got := encodeListpack([][]byte{[]byte("a"), []byte("1"), []byte("-1"), []byte("1000")})
+	if !bytes.Equal(got, want) {
+		t.Errorf("expected % x, got % x", want, got)
+	}
+}
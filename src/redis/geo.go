@@ -0,0 +1,913 @@
+package redis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// Geo indexes are sorted sets whose scores are 52-bit geohashes: 26 bits of
+// longitude and 26 bits of latitude interleaved, longitude in the odd bits.
+// The encoding, neighbour search and distance math follow Redis' geohash.c
+// and geohash_helper.c so that scores and search results match Redis.
+const (
+	geoStepMax   = 26
+	geoLatMin    = -85.05112878
+	geoLatMax    = 85.05112878
+	geoLongMin   = -180.0
+	geoLongMax   = 180.0
+	earthRadiusM = 6372797.560856
+	mercatorMax  = 20037726.37
+	geoAlphabet  = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+type geoHashBits struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+type geoHashRange struct {
+	min, max float64
+}
+
+type geoHashArea struct {
+	longitude, latitude geoHashRange
+}
+
+var (
+	geoLongRange = geoHashRange{geoLongMin, geoLongMax}
+	geoLatRange  = geoHashRange{geoLatMin, geoLatMax}
+)
+
+func interleave64(xlo, ylo uint32) uint64 {
+	x, y := uint64(xlo), uint64(ylo)
+	for _, s := range []struct {
+		shift uint
+		mask  uint64
+	}{
+		{16, 0x0000FFFF0000FFFF},
+		{8, 0x00FF00FF00FF00FF},
+		{4, 0x0F0F0F0F0F0F0F0F},
+		{2, 0x3333333333333333},
+		{1, 0x5555555555555555},
+	} {
+		x = (x | x<<s.shift) & s.mask
+		y = (y | y<<s.shift) & s.mask
+	}
+	return x | y<<1
+}
+
+// deinterleave64 splits interleaved bits into the even bits (low word) and
+// the odd bits (high word).
+func deinterleave64(interleaved uint64) uint64 {
+	x, y := interleaved, interleaved>>1
+	for _, s := range []struct {
+		shift uint
+		mask  uint64
+	}{
+		{0, 0x5555555555555555},
+		{1, 0x3333333333333333},
+		{2, 0x0F0F0F0F0F0F0F0F},
+		{4, 0x00FF00FF00FF00FF},
+		{8, 0x0000FFFF0000FFFF},
+		{16, 0x00000000FFFFFFFF},
+	} {
+		x = (x | x>>s.shift) & s.mask
+		y = (y | y>>s.shift) & s.mask
+	}
+	return x | y<<32
+}
+
+func geohashEncode(longRange, latRange geoHashRange, longitude, latitude float64, step uint) (geoHashBits, bool) {
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHashBits{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return geoHashBits{}, false
+	}
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geoHashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+func geohashDecode(longRange, latRange geoHashRange, hash geoHashBits) geoHashArea {
+	sep := deinterleave64(hash.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	ilato := float64(uint32(sep))
+	ilono := float64(uint32(sep >> 32))
+	div := float64(uint64(1) << hash.step)
+	return geoHashArea{
+		latitude: geoHashRange{
+			min: latRange.min + (ilato*1.0/div)*latScale,
+			max: latRange.min + ((ilato+1)*1.0/div)*latScale,
+		},
+		longitude: geoHashRange{
+			min: longRange.min + (ilono*1.0/div)*longScale,
+			max: longRange.min + ((ilono+1)*1.0/div)*longScale,
+		},
+	}
+}
+
+func (a geoHashArea) center() (float64, float64) {
+	lon := (a.longitude.min + a.longitude.max) / 2
+	lon = math.Max(math.Min(lon, geoLongMax), geoLongMin)
+	lat := (a.latitude.min + a.latitude.max) / 2
+	lat = math.Max(math.Min(lat, geoLatMax), geoLatMin)
+	return lon, lat
+}
+
+// geoScore encodes a validated position as a sorted set score.
+func geoScore(longitude, latitude float64) float64 {
+	hash, _ := geohashEncode(geoLongRange, geoLatRange, longitude, latitude, geoStepMax)
+	return float64(geohashAlign52Bits(hash))
+}
+
+// geoDecodeScore returns the center of the cell a score encodes.
+func geoDecodeScore(score float64) (float64, float64) {
+	hash := geoHashBits{bits: uint64(score), step: geoStepMax}
+	return geohashDecode(geoLongRange, geoLatRange, hash).center()
+}
+
+func geohashAlign52Bits(hash geoHashBits) uint64 {
+	return hash.bits << (52 - hash.step*2)
+}
+
+func geohashMoveX(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashMoveY(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= 0x5555555555555555 >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+// geoNeighbors holds the cells around a center cell, in Redis' search
+// order: center, north, south, east, west, north-east, north-west,
+// south-east, south-west.
+type geoNeighbors [9]geoHashBits
+
+const (
+	geoCenter = iota
+	geoNorth
+	geoSouth
+	geoEast
+	geoWest
+	geoNorthEast
+	geoNorthWest
+	geoSouthEast
+	geoSouthWest
+)
+
+func geohashNeighbors(hash geoHashBits) geoNeighbors {
+	moves := [9][2]int{
+		geoNorth: {0, 1}, geoSouth: {0, -1}, geoEast: {1, 0}, geoWest: {-1, 0},
+		geoNorthEast: {1, 1}, geoNorthWest: {-1, 1}, geoSouthEast: {1, -1}, geoSouthWest: {-1, -1},
+	}
+	var n geoNeighbors
+	for i, m := range moves {
+		n[i] = hash
+		geohashMoveX(&n[i], m[0])
+		geohashMoveY(&n[i], m[1])
+	}
+	return n
+}
+
+func degRad(ang float64) float64 { return ang * (math.Pi / 180.0) }
+func radDeg(ang float64) float64 { return ang / (math.Pi / 180.0) }
+
+func geohashGetLatDistance(lat1d, lat2d float64) float64 {
+	return earthRadiusM * math.Abs(degRad(lat2d)-degRad(lat1d))
+}
+
+// geohashGetDistance is the haversine distance in meters.
+func geohashGetDistance(lon1d, lat1d, lon2d, lat2d float64) float64 {
+	lon1r, lon2r := degRad(lon1d), degRad(lon2d)
+	v := math.Sin((lon2r - lon1r) / 2)
+	if v == 0 {
+		return geohashGetLatDistance(lat1d, lat2d)
+	}
+	lat1r, lat2r := degRad(lat1d), degRad(lat2d)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * earthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+func geohashEstimateStepsByRadius(rangeMeters, lat float64) uint {
+	if rangeMeters == 0 {
+		return 26
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2
+	// Wider range towards the poles.
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return uint(max(1, min(26, step)))
+}
+
+// geoShape is a GEOSEARCH area: a circle of radius or a width x height box,
+// in the request unit, centered on lon/lat.
+type geoShape struct {
+	lon, lat      float64
+	box           bool
+	radius        float64
+	width, height float64
+	conversion    float64 // meters per unit
+}
+
+func (shape *geoShape) boundingBox() (minLon, minLat, maxLon, maxLat float64) {
+	height := shape.conversion * shape.radius
+	width := height
+	if shape.box {
+		height = shape.conversion * shape.height / 2
+		width = shape.conversion * shape.width / 2
+	}
+	latDelta := radDeg(height / earthRadiusM)
+	longDeltaTop := radDeg(width / earthRadiusM / math.Cos(degRad(shape.lat+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusM / math.Cos(degRad(shape.lat-latDelta)))
+	// The hemispheres bulge in opposite directions.
+	if shape.lat < 0 {
+		return shape.lon - longDeltaBottom, shape.lat - latDelta, shape.lon + longDeltaBottom, shape.lat + latDelta
+	}
+	return shape.lon - longDeltaTop, shape.lat - latDelta, shape.lon + longDeltaTop, shape.lat + latDelta
+}
+
+// searchAreas returns the cells covering shape, with useless neighbours
+// zeroed out.
+func (shape *geoShape) searchAreas() geoNeighbors {
+	minLon, minLat, maxLon, maxLat := shape.boundingBox()
+	radiusMeters := shape.radius
+	if shape.box {
+		radiusMeters = math.Sqrt((shape.width/2)*(shape.width/2) + (shape.height/2)*(shape.height/2))
+	}
+	radiusMeters *= shape.conversion
+
+	steps := geohashEstimateStepsByRadius(radiusMeters, shape.lat)
+	hash, _ := geohashEncode(geoLongRange, geoLatRange, shape.lon, shape.lat, steps)
+	neighbors := geohashNeighbors(hash)
+	area := geohashDecode(geoLongRange, geoLatRange, hash)
+
+	// The estimated step may be too coarse when the search area is near
+	// the edge of the center cell.
+	decreaseStep := false
+	if geohashDecode(geoLongRange, geoLatRange, neighbors[geoNorth]).latitude.max < maxLat ||
+		geohashDecode(geoLongRange, geoLatRange, neighbors[geoSouth]).latitude.min > minLat ||
+		geohashDecode(geoLongRange, geoLatRange, neighbors[geoEast]).longitude.max < maxLon ||
+		geohashDecode(geoLongRange, geoLatRange, neighbors[geoWest]).longitude.min > minLon {
+		decreaseStep = true
+	}
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = geohashEncode(geoLongRange, geoLatRange, shape.lon, shape.lat, steps)
+		neighbors = geohashNeighbors(hash)
+		area = geohashDecode(geoLongRange, geoLatRange, hash)
+	}
+
+	if steps >= 2 {
+		zero := func(dirs ...int) {
+			for _, d := range dirs {
+				neighbors[d] = geoHashBits{}
+			}
+		}
+		if area.latitude.min < minLat {
+			zero(geoSouth, geoSouthWest, geoSouthEast)
+		}
+		if area.latitude.max > maxLat {
+			zero(geoNorth, geoNorthEast, geoNorthWest)
+		}
+		if area.longitude.min < minLon {
+			zero(geoWest, geoSouthWest, geoNorthWest)
+		}
+		if area.longitude.max > maxLon {
+			zero(geoEast, geoSouthEast, geoNorthEast)
+		}
+	}
+	neighbors[geoCenter] = hash
+	return neighbors
+}
+
+// contains reports whether the point lies inside shape and its distance in
+// meters from the center.
+func (shape *geoShape) contains(lon, lat float64) (float64, bool) {
+	if !shape.box {
+		dist := geohashGetDistance(shape.lon, shape.lat, lon, lat)
+		return dist, dist <= shape.radius*shape.conversion
+	}
+	if geohashGetLatDistance(lat, shape.lat) > shape.height*shape.conversion/2 {
+		return 0, false
+	}
+	if geohashGetDistance(lon, lat, shape.lon, lat) > shape.width*shape.conversion/2 {
+		return 0, false
+	}
+	return geohashGetDistance(shape.lon, shape.lat, lon, lat), true
+}
+
+type geoPoint struct {
+	member   string
+	lon, lat float64
+	dist     float64 // meters until converted for the reply
+	score    float64
+}
+
+// geoSearch collects the members of z inside shape by scanning the score
+// ranges of the covering cells. A non-zero limit stops the scan once that
+// many matches were found (COUNT ... ANY).
+func geoSearch(z *zset, shape *geoShape, limit int) []geoPoint {
+	var points []geoPoint
+	cells := shape.searchAreas()
+	lastProcessed := 0
+	for i, cell := range cells {
+		if cell.isZero() {
+			continue
+		}
+		// Huge radii can make adjacent neighbours the same cell.
+		if lastProcessed != 0 && cell == cells[lastProcessed] {
+			continue
+		}
+		if len(points) > 0 && limit > 0 && len(points) >= limit {
+			break
+		}
+		min := geohashAlign52Bits(cell)
+		cell.bits++
+		max := geohashAlign52Bits(cell)
+		z.rangeByScore(zrangespec{min: float64(min), max: float64(max), maxex: true}, func(member string, score float64) bool {
+			lon, lat := geoDecodeScore(score)
+			if dist, ok := shape.contains(lon, lat); ok {
+				points = append(points, geoPoint{member: member, lon: lon, lat: lat, dist: dist, score: score})
+			}
+			return limit == 0 || len(points) < limit
+		})
+		lastProcessed = i
+	}
+	return points
+}
+
+// ---- store ----
+
+// geoAddEntry is one GEOADD triple.
+type geoAddEntry struct {
+	lon, lat float64
+	member   string
+}
+
+// GeoAdd adds or updates positions and returns the number of members added,
+// or added plus updated when ch is set.
+func (s *Store) GeoAdd(key string, flags zaddFlags, ch bool, entries []geoAddEntry) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, exists, err := s.getZsetForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		if flags.xx {
+			return 0, nil
+		}
+		z = newZset()
+		s.setKey(key, z)
+	}
+	var added, updated int64
+	for _, e := range entries {
+		a, u := z.add(e.member, geoScore(e.lon, e.lat), flags)
+		if a {
+			added++
+		}
+		if u {
+			updated++
+		}
+	}
+	if z.Len() == 0 {
+		s.deleteKey(key)
+	}
+	if ch {
+		return added + updated, nil
+	}
+	return added, nil
+}
+
+// GeoPos returns the position of each member, with ok false for members
+// that are missing.
+func (s *Store) GeoPos(key string, members []string) ([][2]float64, []bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	z, _, err := s.getZset(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	pos := make([][2]float64, len(members))
+	found := make([]bool, len(members))
+	for i, m := range members {
+		if z == nil {
+			continue
+		}
+		if score, ok := z.score(m); ok {
+			pos[i][0], pos[i][1] = geoDecodeScore(score)
+			found[i] = true
+		}
+	}
+	return pos, found, nil
+}
+
+// GeoDist returns the distance in meters between two members.
+func (s *Store) GeoDist(key, m1, m2 string) (float64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	z, exists, err := s.getZset(key)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+	s1, ok1 := z.score(m1)
+	s2, ok2 := z.score(m2)
+	if !ok1 || !ok2 {
+		return 0, false, nil
+	}
+	lon1, lat1 := geoDecodeScore(s1)
+	lon2, lat2 := geoDecodeScore(s2)
+	return geohashGetDistance(lon1, lat1, lon2, lat2), true, nil
+}
+
+// GeoHash returns the standard 11 character geohash of each member, or ""
+// for missing members.
+func (s *Store) GeoHash(key string, members []string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	z, _, err := s.getZset(key)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(members))
+	for i, m := range members {
+		if z == nil {
+			continue
+		}
+		score, ok := z.score(m)
+		if !ok {
+			continue
+		}
+		// Scores use a latitude range of +/-85.05 degrees; standard
+		// geohashes use +/-90, so re-encode the decoded position.
+		lon, lat := geoDecodeScore(score)
+		hash, _ := geohashEncode(geoHashRange{-180, 180}, geoHashRange{-90, 90}, lon, lat, geoStepMax)
+		var buf [11]byte
+		for j := range buf {
+			idx := 0
+			if j < 10 {
+				idx = int(hash.bits>>(52-(j+1)*5)) & 0x1f
+			}
+			buf[j] = geoAlphabet[idx]
+		}
+		hashes[i] = string(buf[:])
+	}
+	return hashes, nil
+}
+
+// geoSearchQuery is a parsed GEOSEARCH / GEOSEARCHSTORE request.
+type geoSearchQuery struct {
+	shape      geoShape
+	fromMember string // set for FROMMEMBER, resolved against the key
+	hasMember  bool
+	sort       int // 0 none, 1 ASC, -1 DESC
+	count      int
+	any        bool
+	storeDist  bool
+}
+
+// GeoSearch runs q against key. The results are sorted and truncated to
+// q.count, with distances converted to the query unit.
+func (s *Store) GeoSearch(key string, q *geoSearchQuery) ([]geoPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.geoSearch(key, q)
+}
+
+func (s *Store) geoSearch(key string, q *geoSearchQuery) ([]geoPoint, error) {
+	z, exists, err := s.getZset(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	shape := q.shape
+	if q.hasMember {
+		score, ok := z.score(q.fromMember)
+		if !ok {
+			return nil, fmt.Errorf("ERR could not decode requested zset member")
+		}
+		shape.lon, shape.lat = geoDecodeScore(score)
+	}
+	limit := 0
+	if q.any {
+		limit = q.count
+	}
+	points := geoSearch(z, &shape, limit)
+	switch q.sort {
+	case 1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case -1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+	if q.count > 0 && len(points) > q.count {
+		points = points[:q.count]
+	}
+	for i := range points {
+		points[i].dist /= shape.conversion
+	}
+	return points, nil
+}
+
+// GeoSearchStore stores the results of q against src in dest as a sorted set
+// scored by geohash, or by distance with q.storeDist. An empty result
+// deletes dest.
+func (s *Store) GeoSearchStore(dest, src string, q *geoSearchQuery) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	points, err := s.geoSearch(src, q)
+	if err != nil {
+		return 0, err
+	}
+	s.volatileKeyMap.Delete(dest)
+	if len(points) == 0 {
+		s.deleteKey(dest)
+		return 0, nil
+	}
+	z := newZset()
+	for _, p := range points {
+		score := p.score
+		if q.storeDist {
+			score = p.dist
+		}
+		z.add(p.member, score, zaddFlags{})
+	}
+	s.setKey(dest, z)
+	return int64(len(points)), nil
+}
+
+// ---- command handlers ----
+
+func parseGeoFloat(v parser.Value, msg string) (float64, parser.Value) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return 0, parser.Error("ERR wrong argument type")
+	}
+	f, err := strconv.ParseFloat(string(bs), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, parser.Error("ERR " + msg)
+	}
+	return f, nil
+}
+
+func parseLonLat(lonArg, latArg parser.Value) (float64, float64, parser.Value) {
+	lon, errReply := parseGeoFloat(lonArg, "value is not a valid float")
+	if errReply != nil {
+		return 0, 0, errReply
+	}
+	lat, errReply := parseGeoFloat(latArg, "value is not a valid float")
+	if errReply != nil {
+		return 0, 0, errReply
+	}
+	if lon < geoLongMin || lon > geoLongMax || lat < geoLatMin || lat > geoLatMax {
+		return 0, 0, parser.Error(fmt.Sprintf("ERR invalid longitude,latitude pair %f,%f", lon, lat))
+	}
+	return lon, lat, nil
+}
+
+func parseGeoUnit(v parser.Value) (float64, parser.Value) {
+	bs, _ := v.(parser.BulkString)
+	switch strings.ToLower(string(bs)) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, parser.Error("ERR unsupported unit provided. please use M, KM, FT, MI")
+}
+
+// formatGeoDistance formats a distance reply with four decimals.
+func formatGeoDistance(d float64) parser.Value {
+	return parser.BulkString(strconv.FormatFloat(d, 'f', 4, 64))
+}
+
+// formatGeoCoord formats a coordinate with 17 decimals, trailing zeros
+// trimmed, like Redis' human-readable long double replies.
+func formatGeoCoord(f float64) parser.Value {
+	str := strconv.FormatFloat(f, 'f', 17, 64)
+	str = strings.TrimRight(str, "0")
+	str = strings.TrimSuffix(str, ".")
+	if str == "-0" {
+		str = "0"
+	}
+	return parser.BulkString(str)
+}
+
+func handleGeoAdd(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	var flags zaddFlags
+	ch := false
+	i := 2
+options:
+	for ; i < len(args); i++ {
+		opt, _ := args[i].(parser.BulkString)
+		switch strings.ToUpper(string(opt)) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "CH":
+			ch = true
+		default:
+			break options
+		}
+	}
+	if (len(args)-i)%3 != 0 || i == len(args) || flags.nx && flags.xx {
+		return parser.Error("ERR syntax error")
+	}
+	entries := make([]geoAddEntry, 0, (len(args)-i)/3)
+	for ; i < len(args); i += 3 {
+		lon, lat, errReply := parseLonLat(args[i], args[i+1])
+		if errReply != nil {
+			return errReply
+		}
+		member, ok := args[i+2].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+		entries = append(entries, geoAddEntry{lon: lon, lat: lat, member: string(member)})
+	}
+	n, err := store.GeoAdd(string(key), flags, ch, entries)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleGeoPos(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	pos, found, err := store.GeoPos(strs[0], strs[1:])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	reply := make(parser.Array, len(pos))
+	for i := range pos {
+		if !found[i] {
+			reply[i] = parser.Array(nil)
+			continue
+		}
+		reply[i] = parser.Array{formatGeoCoord(pos[i][0]), formatGeoCoord(pos[i][1])}
+	}
+	return reply
+}
+
+func handleGeoDist(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	toMeters := 1.0
+	if len(strs) == 4 {
+		var errReply parser.Value
+		if toMeters, errReply = parseGeoUnit(args[4]); errReply != nil {
+			return errReply
+		}
+	} else if len(strs) > 4 {
+		return parser.Error("ERR syntax error")
+	}
+	dist, found, err := store.GeoDist(strs[0], strs[1], strs[2])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !found {
+		return parser.BulkString(nil)
+	}
+	return formatGeoDistance(dist / toMeters)
+}
+
+func handleGeoHash(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	hashes, err := store.GeoHash(strs[0], strs[1:])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	reply := make(parser.Array, len(hashes))
+	for i, h := range hashes {
+		if h == "" {
+			reply[i] = parser.BulkString(nil)
+		} else {
+			reply[i] = parser.BulkString(h)
+		}
+	}
+	return reply
+}
+
+// parseGeoSearch parses the options of GEOSEARCH (store false) or
+// GEOSEARCHSTORE (store true), which start at args[0].
+func parseGeoSearch(cmd string, args []parser.Value, store bool) (*geoSearchQuery, bool, bool, bool, parser.Value) {
+	q := &geoSearchQuery{}
+	var withDist, withHash, withCoord bool
+	var fromMember, fromLoc, byRadius, byBox bool
+	for i := 0; i < len(args); i++ {
+		opt, _ := args[i].(parser.BulkString)
+		remaining := len(args) - i - 1
+		switch arg := strings.ToUpper(string(opt)); {
+		case arg == "WITHDIST":
+			withDist = true
+		case arg == "WITHHASH":
+			withHash = true
+		case arg == "WITHCOORD":
+			withCoord = true
+		case arg == "ANY":
+			q.any = true
+		case arg == "ASC":
+			q.sort = 1
+		case arg == "DESC":
+			q.sort = -1
+		case arg == "COUNT" && remaining >= 1:
+			n, errReply := intArg(args[i+1])
+			if errReply != nil {
+				return nil, false, false, false, errReply
+			}
+			if n <= 0 {
+				return nil, false, false, false, parser.Error("ERR COUNT must be > 0")
+			}
+			q.count = n
+			i++
+		case arg == "STOREDIST" && store:
+			q.storeDist = true
+		case arg == "FROMMEMBER" && remaining >= 1 && !fromLoc:
+			member, ok := args[i+1].(parser.BulkString)
+			if !ok {
+				return nil, false, false, false, parser.Error("ERR wrong argument type")
+			}
+			q.fromMember, q.hasMember = string(member), true
+			fromMember = true
+			i++
+		case arg == "FROMLONLAT" && remaining >= 2 && !fromMember:
+			lon, lat, errReply := parseLonLat(args[i+1], args[i+2])
+			if errReply != nil {
+				return nil, false, false, false, errReply
+			}
+			q.shape.lon, q.shape.lat = lon, lat
+			fromLoc = true
+			i += 2
+		case arg == "BYRADIUS" && remaining >= 2 && !byBox:
+			radius, errReply := parseGeoFloat(args[i+1], "need numeric radius")
+			if errReply != nil {
+				return nil, false, false, false, errReply
+			}
+			if radius < 0 {
+				return nil, false, false, false, parser.Error("ERR radius cannot be negative")
+			}
+			conversion, errReply := parseGeoUnit(args[i+2])
+			if errReply != nil {
+				return nil, false, false, false, errReply
+			}
+			q.shape.radius, q.shape.conversion = radius, conversion
+			byRadius = true
+			i += 2
+		case arg == "BYBOX" && remaining >= 3 && !byRadius:
+			width, errReply := parseGeoFloat(args[i+1], "need numeric width")
+			if errReply != nil {
+				return nil, false, false, false, errReply
+			}
+			height, errReply := parseGeoFloat(args[i+2], "need numeric height")
+			if errReply != nil {
+				return nil, false, false, false, errReply
+			}
+			if width < 0 || height < 0 {
+				return nil, false, false, false, parser.Error("ERR height or width cannot be negative")
+			}
+			conversion, errReply := parseGeoUnit(args[i+3])
+			if errReply != nil {
+				return nil, false, false, false, errReply
+			}
+			q.shape.box, q.shape.width, q.shape.height, q.shape.conversion = true, width, height, conversion
+			byBox = true
+			i += 3
+		default:
+			return nil, false, false, false, parser.Error("ERR syntax error")
+		}
+	}
+	if store && (withDist || withHash || withCoord) {
+		return nil, false, false, false, parser.Error("ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	}
+	if !fromMember && !fromLoc {
+		return nil, false, false, false, parser.Error("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for " + cmd)
+	}
+	if !byRadius && !byBox {
+		return nil, false, false, false, parser.Error("ERR exactly one of BYRADIUS and BYBOX can be specified for " + cmd)
+	}
+	if q.any && q.count == 0 {
+		return nil, false, false, false, parser.Error("ERR the ANY argument requires COUNT argument")
+	}
+	// COUNT without ANY returns the closest matches.
+	if q.count != 0 && q.sort == 0 && !q.any {
+		q.sort = 1
+	}
+	return q, withDist, withHash, withCoord, nil
+}
+
+func handleGeoSearch(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	cmd, _ := args[0].(parser.BulkString)
+	q, withDist, withHash, withCoord, errReply := parseGeoSearch(string(cmd), args[2:], false)
+	if errReply != nil {
+		return errReply
+	}
+	points, err := store.GeoSearch(string(key), q)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	reply := make(parser.Array, len(points))
+	for i, p := range points {
+		if !withDist && !withHash && !withCoord {
+			reply[i] = parser.BulkString(p.member)
+			continue
+		}
+		item := parser.Array{parser.BulkString(p.member)}
+		if withDist {
+			item = append(item, formatGeoDistance(p.dist))
+		}
+		if withHash {
+			item = append(item, parser.Integer(int64(p.score)))
+		}
+		if withCoord {
+			item = append(item, parser.Array{formatGeoCoord(p.lon), formatGeoCoord(p.lat)})
+		}
+		reply[i] = item
+	}
+	return reply
+}
+
+func handleGeoSearchStore(store *Store, args []parser.Value) parser.Value {
+	dest, ok1 := args[1].(parser.BulkString)
+	src, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	cmd, _ := args[0].(parser.BulkString)
+	q, _, _, _, errReply := parseGeoSearch(string(cmd), args[3:], true)
+	if errReply != nil {
+		return errReply
+	}
+	n, err := store.GeoSearchStore(string(dest), string(src), q)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
@@ -0,0 +1,263 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// The expected values below are the outputs Redis documents for the same
+// commands.
+
+func sicily(t *testing.T, store *Store) {
+	t.Helper()
+	_, err := store.GeoAdd("Sicily", zaddFlags{}, false, []geoAddEntry{
+		{13.361389, 38.115556, "Palermo"},
+		{15.087269, 37.502669, "Catania"},
+		{12.758489, 38.788135, "edge1"},
+		{17.241510, 38.788135, "edge2"},
+	})
+	if err != nil {
+		t.Fatalf("GeoAdd: %v", err)
+	}
+}
+
+func TestGeoScores(t *testing.T) {
+	store := newStore()
+	sicily(t, store)
+	for member, want := range map[string]float64{"Palermo": 3479099956230698, "Catania": 3479447370796909} {
+		if score, _, _ := store.ZScore("Sicily", member); score != want {
+			t.Errorf("score of %s = %.0f, want %.0f", member, score, want)
+		}
+	}
+
+	hashes, _ := store.GeoHash("Sicily", []string{"Palermo", "Catania", "missing"})
+	if hashes[0] != "sqc8b49rny0" || hashes[1] != "sqdtr74hyu0" || hashes[2] != "" {
+		t.Errorf("unexpected geohashes %v", hashes)
+	}
+}
+
+func TestGeoAddFlags(t *testing.T) {
+	store := newStore()
+	sicily(t, store)
+	n, _ := store.GeoAdd("Sicily", zaddFlags{nx: true}, false, []geoAddEntry{{13, 38, "Palermo"}, {14, 38, "new"}})
+	if n != 1 {
+		t.Errorf("NX: expected 1 added, got %d", n)
+	}
+	n, _ = store.GeoAdd("Sicily", zaddFlags{xx: true}, true, []geoAddEntry{{13, 38, "Palermo"}, {14, 38, "other"}})
+	if n != 1 {
+		t.Errorf("XX CH: expected 1 changed, got %d", n)
+	}
+	if _, exists, _ := store.ZScore("Sicily", "other"); exists {
+		t.Errorf("XX added a new member")
+	}
+	if n, _ := store.GeoAdd("none", zaddFlags{xx: true}, false, []geoAddEntry{{13, 38, "a"}}); n != 0 {
+		t.Errorf("XX on a missing key added %d", n)
+	}
+	if _, exists := store.Get("none"); exists {
+		t.Errorf("XX on a missing key created it")
+	}
+}
+
+func TestGeoSearchBox(t *testing.T) {
+	store := newStore()
+	sicily(t, store)
+	q := &geoSearchQuery{
+		shape: geoShape{lon: 15, lat: 37, box: true, width: 400, height: 400, conversion: 1000},
+		sort:  1,
+	}
+	points, err := store.GeoSearch("Sicily", q)
+	if err != nil {
+		t.Fatalf("GeoSearch: %v", err)
+	}
+	want := []struct {
+		member, dist, lon, lat string
+	}{
+		{"Catania", "56.4413", "15.08726745843887329", "37.50266842333162032"},
+		{"Palermo", "190.4424", "13.36138933897018433", "38.11555639549629859"},
+		{"edge2", "279.7403", "17.24151045083999634", "38.78813451624225195"},
+		{"edge1", "279.7405", "12.7584877610206604", "38.78813451624225195"},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("expected %d results, got %d", len(want), len(points))
+	}
+	for i, w := range want {
+		p := points[i]
+		if p.member != w.member || string(formatGeoDistance(p.dist).(parser.BulkString)) != w.dist ||
+			string(formatGeoCoord(p.lon).(parser.BulkString)) != w.lon || string(formatGeoCoord(p.lat).(parser.BulkString)) != w.lat {
+			t.Errorf("result %d = %+v, want %+v", i, p, w)
+		}
+	}
+}
+
+func TestGeoSearchRadiusAndCount(t *testing.T) {
+	store := newStore()
+	sicily(t, store)
+	q := &geoSearchQuery{shape: geoShape{lon: 15, lat: 37, radius: 200, conversion: 1000}, sort: -1}
+	points, _ := store.GeoSearch("Sicily", q)
+	if len(points) != 2 || points[0].member != "Palermo" || points[1].member != "Catania" {
+		t.Errorf("unexpected DESC results %+v", points)
+	}
+
+	q = &geoSearchQuery{shape: geoShape{radius: 50, conversion: 1000}, fromMember: "Palermo", hasMember: true}
+	points, _ = store.GeoSearch("Sicily", q)
+	if len(points) != 1 || points[0].member != "Palermo" || points[0].dist != 0 {
+		t.Errorf("unexpected FROMMEMBER results %+v", points)
+	}
+	q.fromMember = "missing"
+	if _, err := store.GeoSearch("Sicily", q); err == nil || err.Error() != "ERR could not decode requested zset member" {
+		t.Errorf("expected missing member error, got %v", err)
+	}
+
+	q = &geoSearchQuery{shape: geoShape{lon: 15, lat: 37, radius: 500, conversion: 1000}, count: 1, any: true}
+	if points, _ := store.GeoSearch("Sicily", q); len(points) != 1 {
+		t.Errorf("expected COUNT 1 ANY to return one result, got %d", len(points))
+	}
+}
+
+func TestGeoSearchStore(t *testing.T) {
+	store := newStore()
+	sicily(t, store)
+	q := &geoSearchQuery{
+		shape:     geoShape{lon: 15, lat: 37, box: true, width: 400, height: 400, conversion: 1000},
+		sort:      1,
+		count:     3,
+		storeDist: true,
+	}
+	n, err := store.GeoSearchStore("key2", "Sicily", q)
+	if err != nil || n != 3 {
+		t.Fatalf("GeoSearchStore = %d, %v", n, err)
+	}
+	if score, _, _ := store.ZScore("key2", "Catania"); formatDouble(score) != "56.4412578701582" {
+		t.Errorf("unexpected stored distance %s", formatDouble(score))
+	}
+	if _, exists, _ := store.ZScore("key2", "edge1"); exists {
+		t.Errorf("COUNT 3 stored the fourth result")
+	}
+
+	q.shape.lon = -100
+	if n, _ := store.GeoSearchStore("key2", "Sicily", q); n != 0 {
+		t.Errorf("expected no results, got %d", n)
+	}
+	if n, _ := store.ZCard("key2"); n != 0 {
+		t.Errorf("expected an empty result to delete the destination")
+	}
+}
+
+func TestZSetSkiplistOrder(t *testing.T) {
+	z := newZset()
+	for i := 0; i < 200; i++ {
+		z.add(string(rune('a'+i%26))+string(rune('a'+i/26)), float64(i%7), zaddFlags{})
+	}
+	z.remove("aa")
+	z.add("ba", -1, zaddFlags{})
+	prevScore, prevMember, n := -2.0, "", 0
+	z.rangeByScore(zrangespec{min: -10, max: 10}, func(member string, score float64) bool {
+		if score < prevScore || score == prevScore && member <= prevMember {
+			t.Fatalf("out of order: (%v %s) after (%v %s)", score, member, prevScore, prevMember)
+		}
+		prevScore, prevMember = score, member
+		n++
+		return true
+	})
+	if n != z.Len() || z.zsl.length != z.Len() {
+		t.Errorf("iterated %d members, zset has %d, skiplist %d", n, z.Len(), z.zsl.length)
+	}
+	n = 0
+	z.rangeByScore(zrangespec{min: 2, max: 4, minex: true}, func(string, float64) bool { n++; return true })
+	if n == 0 {
+		t.Errorf("expected members with scores in (2, 4]")
+	}
+}
+
+func TestGeoCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp := sendCmd(t, conn, reader, "GEOADD Sicily 13.361389 38.115556 Palermo 15.087269 37.502669 Catania")
+	if num, ok := resp.(parser.Integer); !ok || num != 2 {
+		t.Errorf("expected 2, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEOADD Sicily 13 86 North")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR invalid longitude,latitude pair 13.000000,86.000000" {
+		t.Errorf("expected invalid pair error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEODIST Sicily Palermo Catania")
+	if bs, ok := resp.(parser.BulkString); !ok || string(bs) != "166274.1516" {
+		t.Errorf("expected 166274.1516, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEODIST Sicily Palermo Catania km")
+	if bs, ok := resp.(parser.BulkString); !ok || string(bs) != "166.2742" {
+		t.Errorf("expected 166.2742, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEODIST Sicily Palermo Catania mi")
+	if bs, ok := resp.(parser.BulkString); !ok || string(bs) != "103.3182" {
+		t.Errorf("expected 103.3182, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEODIST Sicily Palermo Catania yards")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR unsupported unit provided. please use M, KM, FT, MI" {
+		t.Errorf("expected unit error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEODIST Sicily Palermo Nowhere")
+	if resp != nil {
+		t.Errorf("expected nil, got %v", resp)
+	}
+
+	resp = sendCmd(t, conn, reader, "GEOPOS Sicily Palermo NonExisting")
+	arr, ok := resp.(parser.Array)
+	if !ok || len(arr) != 2 {
+		t.Fatalf("expected 2 entries, got %v", resp)
+	}
+	pos, ok := arr[0].(parser.Array)
+	if !ok || len(pos) != 2 || string(pos[0].(parser.BulkString)) != "13.36138933897018433" || string(pos[1].(parser.BulkString)) != "38.11555639549629859" {
+		t.Errorf("unexpected position %v", arr[0])
+	}
+	if arr[1] != nil {
+		t.Errorf("expected nil position, got %v", arr[1])
+	}
+
+	resp = sendCmd(t, conn, reader, "GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km ASC WITHDIST WITHHASH")
+	arr, ok = resp.(parser.Array)
+	if !ok || len(arr) != 2 {
+		t.Fatalf("expected 2 results, got %v", resp)
+	}
+	first, _ := arr[0].(parser.Array)
+	if len(first) != 3 || string(first[0].(parser.BulkString)) != "Catania" || string(first[1].(parser.BulkString)) != "56.4413" || first[2] != parser.Integer(3479447370796909) {
+		t.Errorf("unexpected first result %v", arr[0])
+	}
+
+	resp = sendCmd(t, conn, reader, "GEOSEARCH Sicily BYRADIUS 200 km WITHDIST ASC")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH" {
+		t.Errorf("expected FROM error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEOSEARCH Sicily FROMMEMBER Palermo BYRADIUS 200 km ANY")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR the ANY argument requires COUNT argument" {
+		t.Errorf("expected ANY error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEOSEARCHSTORE dest Sicily FROMMEMBER Palermo BYRADIUS 200 km WITHDIST")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options" {
+		t.Errorf("expected STORE option error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEOSEARCHSTORE dest Sicily FROMMEMBER Palermo BYRADIUS 200 km")
+	if num, ok := resp.(parser.Integer); !ok || num != 2 {
+		t.Errorf("expected 2, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "ZREM dest Palermo Nowhere")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "ZCARD dest")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "GEOSEARCH missing FROMLONLAT 15 37 BYRADIUS 200 km")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 0 {
+		t.Errorf("expected empty array, got %v", resp)
+	}
+}
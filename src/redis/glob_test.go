@@ -0,0 +1,53 @@
+package redis
+
+import "testing"
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		nocase       bool
+		want         bool
+	}{
+		{"*", "", false, false}, // as in Redis; KEYS and SCAN special-case "*"
+		{"*", "anything", false, true},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h*llo", "hllo", false, true},
+		{"h*llo", "heeeello", false, true},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hallo", false, true},
+		{"h[a-b]llo", "hcllo", false, false},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"[\\]]", "]", false, true},
+		{"[abc", "a", false, true},
+		{"[abc", "d", false, false},
+		{"a\\", "a\\", false, true},
+		{"HELLO", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"[A-C]x", "bx", true, true},
+		{"*a*b*c", "xaybzc", false, true},
+		{"*a*b*c", "xaybz", false, false},
+		{"a**", "a", false, true},
+		{"", "", false, true},
+		{"", "a", false, false},
+	}
+	for _, tt := range tests {
+		if got := stringMatch(tt.pattern, tt.str, tt.nocase); got != tt.want {
+			t.Errorf("stringMatch(%q, %q, %v) = %v, want %v", tt.pattern, tt.str, tt.nocase, got, tt.want)
+		}
+	}
+}
+
+func TestStringMatchAbusivePattern(t *testing.T) {
+	// Without skipping longer matches this takes exponential time.
+	pattern := "a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*b"
+	str := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	if stringMatch(pattern, str, false) {
+		t.Errorf("expected no match")
+	}
+}
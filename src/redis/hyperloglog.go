@@ -0,0 +1,828 @@
+package redis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// HyperLogLogs are plain strings using the Redis "HYLL" layout, so values can
+// be moved between servers with GET and SET:
+//
+//	+------+---+-----+----------+
+//	| HYLL | E | N/U | Cardin.  |
+//	+------+---+-----+----------+
+//
+// E is the encoding (0 dense, 1 sparse), followed by three unused bytes and
+// the cached cardinality as a little-endian uint64 whose top bit marks the
+// cache as stale. The dense encoding packs 16384 6-bit registers LSB first.
+// The sparse encoding is a run-length sequence of opcodes:
+//
+//	00xxxxxx          ZERO: xxxxxx+1 registers set to 0
+//	01xxxxxx yyyyyyyy XZERO: xxxxxxyyyyyyyy+1 registers set to 0
+//	1vvvvvxx          VAL: xx+1 registers set to vvvvv+1
+const (
+	hllP           = 14
+	hllQ           = 64 - hllP
+	hllRegisters   = 1 << hllP
+	hllPMask       = hllRegisters - 1
+	hllBits        = 6
+	hllRegisterMax = 1<<hllBits - 1
+	hllHdrSize     = 16
+	hllDenseSize   = hllHdrSize + (hllRegisters*hllBits+7)/8
+
+	hllDense       = 0
+	hllSparse      = 1
+	hllMaxEncoding = 1
+
+	hllSparseValMaxValue = 32
+	hllSparseValMaxLen   = 4
+	hllSparseZeroMaxLen  = 64
+	hllSparseXZeroMaxLen = 16384
+
+	hllAlphaInf              = 0.721347520444481703680
+	hllDefaultSparseMaxBytes = 3000
+	hllHashSeed              = 0xadc83b19
+)
+
+var (
+	errNotHLL     = fmt.Errorf("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	errCorruptHLL = fmt.Errorf("INVALIDOBJ Corrupted HLL object detected")
+)
+
+// murmurHash64A is MurmurHash2, 64-bit version, reading input little-endian
+// as Redis does on every platform.
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(data))*m
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register ele maps to and the length of the 000..1
+// pattern that follows the index bits, which is the register candidate.
+func hllPatLen(ele []byte) (int, uint8) {
+	hash := murmurHash64A(ele, hllHashSeed)
+	index := int(hash & hllPMask)
+	hash >>= hllP
+	hash |= 1 << hllQ
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	return index, count
+}
+
+// ---- header ----
+
+func newHLL() []byte {
+	hll := make([]byte, hllHdrSize, hllHdrSize+(hllRegisters+hllSparseXZeroMaxLen-1)/hllSparseXZeroMaxLen*2)
+	copy(hll, "HYLL")
+	hll[4] = hllSparse
+	for left := hllRegisters; left > 0; left -= hllSparseXZeroMaxLen {
+		n := min(left, hllSparseXZeroMaxLen)
+		hll = append(hll, xzeroOp(n)...)
+	}
+	return hll
+}
+
+func isValidHLL(b []byte) bool {
+	if len(b) < hllHdrSize || string(b[:4]) != "HYLL" || b[4] > hllMaxEncoding {
+		return false
+	}
+	return b[4] != hllDense || len(b) == hllDenseSize
+}
+
+func hllCachedCard(hll []byte) (uint64, bool) {
+	if hll[15]&0x80 != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(hll[8:16]), true
+}
+
+func hllSetCachedCard(hll []byte, card uint64) {
+	binary.LittleEndian.PutUint64(hll[8:16], card)
+}
+
+func hllInvalidateCache(hll []byte) {
+	hll[15] |= 0x80
+}
+
+// ---- dense registers ----
+
+func hllDenseGet(regs []byte, i int) uint8 {
+	b := i * hllBits / 8
+	fb := uint(i * hllBits & 7)
+	var b1 uint
+	if b+1 < len(regs) {
+		b1 = uint(regs[b+1])
+	}
+	return uint8((uint(regs[b])>>fb | b1<<(8-fb)) & hllRegisterMax)
+}
+
+func hllDenseSet(regs []byte, i int, val uint8) {
+	b := i * hllBits / 8
+	fb := uint(i * hllBits & 7)
+	fb8 := 8 - fb
+	regs[b] &^= byte(hllRegisterMax << fb)
+	regs[b] |= byte(uint(val) << fb)
+	if b+1 < len(regs) {
+		regs[b+1] &^= byte(hllRegisterMax >> fb8)
+		regs[b+1] |= byte(uint(val) >> fb8)
+	}
+}
+
+// hllDenseAdd raises register i to count, reporting whether it changed.
+func hllDenseAdd(regs []byte, i int, count uint8) bool {
+	if hllDenseGet(regs, i) >= count {
+		return false
+	}
+	hllDenseSet(regs, i, count)
+	return true
+}
+
+// ---- sparse opcodes ----
+
+func isZeroOp(b byte) bool  { return b&0xc0 == 0 }
+func isXZeroOp(b byte) bool { return b&0xc0 == 0x40 }
+func isValOp(b byte) bool   { return b&0x80 != 0 }
+
+func zeroOpLen(b byte) int       { return int(b&0x3f) + 1 }
+func xzeroOpLen(b0, b1 byte) int { return (int(b0&0x3f)<<8 | int(b1)) + 1 }
+func valOpValue(b byte) uint8    { return (b>>2)&0x1f + 1 }
+func valOpLen(b byte) int        { return int(b&0x3) + 1 }
+
+func zeroOp(n int) byte { return byte(n - 1) }
+
+func xzeroOp(n int) []byte {
+	n--
+	return []byte{byte(n>>8) | 0x40, byte(n)}
+}
+
+func valOp(val uint8, n int) byte {
+	return byte(int(val-1)<<2|(n-1)) | 0x80
+}
+
+// zeroRunOp encodes a run of n zero registers with the shortest opcode.
+func zeroRunOp(n int) []byte {
+	if n > hllSparseZeroMaxLen {
+		return xzeroOp(n)
+	}
+	return []byte{zeroOp(n)}
+}
+
+// hllSparseSet raises register index of a sparse HLL to count, following
+// Redis' hllSparseSet step for step so both produce the same bytes. The HLL
+// is promoted to dense when count does not fit a VAL opcode or the result
+// would exceed maxBytes. It returns the updated HLL and 1 if the register
+// changed, 0 if not, or -1 if the encoding is corrupt.
+func hllSparseSet(hll []byte, index int, count uint8, maxBytes int) ([]byte, int) {
+	promote := func() ([]byte, int) {
+		dense, err := hllSparseToDense(hll)
+		if err != nil {
+			return hll, -1
+		}
+		hllDenseSet(dense[hllHdrSize:], index, count)
+		return dense, 1
+	}
+	if count > hllSparseValMaxValue {
+		return promote()
+	}
+
+	// Find the opcode covering index.
+	p, prev, first, span := hllHdrSize, -1, 0, 0
+	for p < len(hll) {
+		oplen := 1
+		switch {
+		case isZeroOp(hll[p]):
+			span = zeroOpLen(hll[p])
+		case isValOp(hll[p]):
+			span = valOpLen(hll[p])
+		default:
+			if p+1 >= len(hll) {
+				return hll, -1
+			}
+			span = xzeroOpLen(hll[p], hll[p+1])
+			oplen = 2
+		}
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += oplen
+		first += span
+	}
+	if span == 0 || p >= len(hll) {
+		return hll, -1
+	}
+
+	op := hll[p]
+	runlen, oldlen := 0, 1
+	switch {
+	case isZeroOp(op):
+		runlen = zeroOpLen(op)
+	case isXZeroOp(op):
+		runlen, oldlen = xzeroOpLen(op, hll[p+1]), 2
+	default:
+		runlen = valOpLen(op)
+		if valOpValue(op) >= count {
+			return hll, 0
+		}
+	}
+
+	if runlen == 1 && !isXZeroOp(op) {
+		// A single ZERO or VAL register is updated in place.
+		hll[p] = valOp(count, 1)
+	} else {
+		// Split the run into up to three opcodes around index.
+		last := first + span - 1
+		seq := make([]byte, 0, 5)
+		if isValOp(op) {
+			cur := valOpValue(op)
+			if index != first {
+				seq = append(seq, valOp(cur, index-first))
+			}
+			seq = append(seq, valOp(count, 1))
+			if index != last {
+				seq = append(seq, valOp(cur, last-index))
+			}
+		} else {
+			if index != first {
+				seq = append(seq, zeroRunOp(index-first)...)
+			}
+			seq = append(seq, valOp(count, 1))
+			if index != last {
+				seq = append(seq, zeroRunOp(last-index)...)
+			}
+		}
+		delta := len(seq) - oldlen
+		if delta > 0 && len(hll)+delta > maxBytes {
+			return promote()
+		}
+		out := make([]byte, 0, len(hll)+delta)
+		out = append(out, hll[:p]...)
+		out = append(out, seq...)
+		out = append(out, hll[p+oldlen:]...)
+		hll = out
+	}
+
+	// Merge adjacent VAL opcodes with the same value, scanning up to five
+	// opcodes from the one before the change.
+	p = prev
+	if p < 0 {
+		p = hllHdrSize
+	}
+	for scan := 5; p < len(hll) && scan > 0; scan-- {
+		switch {
+		case isXZeroOp(hll[p]):
+			p += 2
+			continue
+		case isZeroOp(hll[p]):
+			p++
+			continue
+		}
+		if p+1 < len(hll) && isValOp(hll[p+1]) {
+			v1, v2 := valOpValue(hll[p]), valOpValue(hll[p+1])
+			if n := valOpLen(hll[p]) + valOpLen(hll[p+1]); v1 == v2 && n <= hllSparseValMaxLen {
+				hll[p+1] = valOp(v1, n)
+				hll = append(hll[:p], hll[p+1:]...)
+				continue
+			}
+		}
+		p++
+	}
+	return hll, 1
+}
+
+// hllSparseToDense returns the dense form of hll, keeping its header. A dense
+// HLL is returned as is.
+func hllSparseToDense(hll []byte) ([]byte, error) {
+	if hll[4] == hllDense {
+		return hll, nil
+	}
+	dense := make([]byte, hllDenseSize)
+	copy(dense, hll[:hllHdrSize])
+	dense[4] = hllDense
+	regs := dense[hllHdrSize:]
+	idx := 0
+	err := hllSparseRuns(hll, func(val uint8, runlen int) bool {
+		if idx+runlen > hllRegisters {
+			return false
+		}
+		if val != 0 {
+			for i := idx; i < idx+runlen; i++ {
+				hllDenseSet(regs, i, val)
+			}
+		}
+		idx += runlen
+		return true
+	})
+	if err != nil || idx != hllRegisters {
+		return nil, errCorruptHLL
+	}
+	return dense, nil
+}
+
+// hllSparseRuns calls fn with each run of a sparse HLL until it returns
+// false, which is reported as corruption.
+func hllSparseRuns(hll []byte, fn func(val uint8, runlen int) bool) error {
+	for p := hllHdrSize; p < len(hll); {
+		var ok bool
+		switch op := hll[p]; {
+		case isZeroOp(op):
+			ok = fn(0, zeroOpLen(op))
+			p++
+		case isXZeroOp(op):
+			if p+1 >= len(hll) {
+				return errCorruptHLL
+			}
+			ok = fn(0, xzeroOpLen(op, hll[p+1]))
+			p += 2
+		default:
+			ok = fn(valOpValue(op), valOpLen(op))
+			p++
+		}
+		if !ok {
+			return errCorruptHLL
+		}
+	}
+	return nil
+}
+
+// hllAdd adds ele to hll, returning the updated HLL and 1 if a register
+// changed, 0 if not, or -1 if the encoding is corrupt.
+func hllAdd(hll, ele []byte, maxBytes int) ([]byte, int) {
+	index, count := hllPatLen(ele)
+	if hll[4] == hllDense {
+		if hllDenseAdd(hll[hllHdrSize:], index, count) {
+			return hll, 1
+		}
+		return hll, 0
+	}
+	return hllSparseSet(hll, index, count, maxBytes)
+}
+
+// hllMerge raises each of max to the matching register of hll.
+func hllMerge(max []uint8, hll []byte) error {
+	if hll[4] == hllDense {
+		regs := hll[hllHdrSize:]
+		for i := range max {
+			if v := hllDenseGet(regs, i); v > max[i] {
+				max[i] = v
+			}
+		}
+		return nil
+	}
+	idx := 0
+	err := hllSparseRuns(hll, func(val uint8, runlen int) bool {
+		if idx+runlen > hllRegisters {
+			return false
+		}
+		for i := idx; i < idx+runlen; i++ {
+			if val > max[i] {
+				max[i] = val
+			}
+		}
+		idx += runlen
+		return true
+	})
+	if err != nil || idx != hllRegisters {
+		return errCorruptHLL
+	}
+	return nil
+}
+
+// ---- estimation ----
+
+// hllRegHisto counts registers by value.
+func hllRegHisto(hll []byte) ([64]int, error) {
+	var histo [64]int
+	if hll[4] == hllDense {
+		regs := hll[hllHdrSize:]
+		for i := 0; i < hllRegisters; i++ {
+			histo[hllDenseGet(regs, i)]++
+		}
+		return histo, nil
+	}
+	idx := 0
+	err := hllSparseRuns(hll, func(val uint8, runlen int) bool {
+		histo[val] += runlen
+		idx += runlen
+		return idx <= hllRegisters
+	})
+	if err != nil || idx != hllRegisters {
+		return histo, errCorruptHLL
+	}
+	return histo, nil
+}
+
+func hllRawHisto(regs []uint8) [64]int {
+	var histo [64]int
+	for _, v := range regs {
+		histo[v]++
+	}
+	return histo
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// hllCount estimates cardinality from a register histogram with the
+// improved estimator from Otmar Ertl's "New cardinality estimation
+// algorithms for HyperLogLog sketches", as Redis does.
+func hllCount(histo [64]int) uint64 {
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// ---- store ----
+
+// hllLookup returns the HyperLogLog stored at key, which the caller may
+// change in place. Caller must hold s.mu for writing, since expired keys are
+// removed.
+func (s *Store) hllLookup(key string) ([]byte, bool, error) {
+	val, exists := s.lookupKeyWrite(key)
+	if !exists {
+		return nil, false, nil
+	}
+	b, ok := WrapValue(val)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	if !isValidHLL(b) {
+		return nil, false, errNotHLL
+	}
+	return s.mutable(key, b).([]byte), true, nil
+}
+
+// PFAdd adds elements to the HyperLogLog at key, creating it if needed, and
+// reports whether the estimate may have changed.
+func (s *Store) PFAdd(key string, elements ...[]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hll, exists, err := s.hllLookup(key)
+	if err != nil {
+		return false, err
+	}
+	updated := false
+	if !exists {
+		hll = newHLL()
+		updated = true
+	}
+	for _, ele := range elements {
+		var r int
+		if hll, r = hllAdd(hll, ele, s.hllSparseMaxBytes); r < 0 {
+			return false, errCorruptHLL
+		}
+		if r == 1 {
+			updated = true
+		}
+	}
+	if updated {
+		hllInvalidateCache(hll)
+		s.setKey(key, hll)
+	}
+	return updated, nil
+}
+
+// PFCount estimates the cardinality of the union of the HyperLogLogs at
+// keys. For a single key the estimate is cached in the header.
+func (s *Store) PFCount(keys ...string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(keys) > 1 {
+		max := make([]uint8, hllRegisters)
+		for _, key := range keys {
+			hll, exists, err := s.hllLookup(key)
+			if err != nil {
+				return 0, err
+			}
+			if !exists {
+				continue
+			}
+			if err := hllMerge(max, hll); err != nil {
+				return 0, err
+			}
+		}
+		return int64(hllCount(hllRawHisto(max))), nil
+	}
+
+	hll, exists, err := s.hllLookup(keys[0])
+	if err != nil || !exists {
+		return 0, err
+	}
+	if card, ok := hllCachedCard(hll); ok {
+		return int64(card), nil
+	}
+	histo, err := hllRegHisto(hll)
+	if err != nil {
+		return 0, err
+	}
+	card := hllCount(histo)
+	hllSetCachedCard(hll, card)
+	return int64(card), nil
+}
+
+// PFMerge stores the union of dest and srcs in dest. The result is dense if
+// any input is.
+func (s *Store) PFMerge(dest string, srcs ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	max := make([]uint8, hllRegisters)
+	useDense := false
+	for _, key := range append([]string{dest}, srcs...) {
+		hll, exists, err := s.hllLookup(key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if hll[4] == hllDense {
+			useDense = true
+		}
+		if err := hllMerge(max, hll); err != nil {
+			return err
+		}
+	}
+
+	hll, exists, _ := s.hllLookup(dest)
+	if !exists {
+		hll = newHLL()
+	}
+	if useDense {
+		var err error
+		if hll, err = hllSparseToDense(hll); err != nil {
+			return err
+		}
+	}
+	for i, v := range max {
+		if v == 0 {
+			continue
+		}
+		if hll[4] == hllDense {
+			hllDenseAdd(hll[hllHdrSize:], i, v)
+			continue
+		}
+		var r int
+		if hll, r = hllSparseSet(hll, i, v, s.hllSparseMaxBytes); r < 0 {
+			return errCorruptHLL
+		}
+	}
+	hllInvalidateCache(hll)
+	s.setKey(dest, hll)
+	return nil
+}
+
+// PFDebug runs a PFDEBUG subcommand against the HyperLogLog at key.
+func (s *Store) PFDebug(sub, key string) (parser.Value, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hll, exists, err := s.hllLookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("ERR The specified key does not exist")
+	}
+	switch sub {
+	case "GETREG":
+		if hll[4] == hllSparse {
+			if hll, err = hllSparseToDense(hll); err != nil {
+				return nil, fmt.Errorf("ERR HLL sparse encoding is corrupted")
+			}
+			s.setKey(key, hll)
+		}
+		regs := make(parser.Array, hllRegisters)
+		for i := range regs {
+			regs[i] = parser.Integer(hllDenseGet(hll[hllHdrSize:], i))
+		}
+		return regs, nil
+	case "DECODE":
+		if hll[4] != hllSparse {
+			return nil, fmt.Errorf("ERR HLL encoding is not sparse")
+		}
+		var sb strings.Builder
+		for p := hllHdrSize; p < len(hll); p++ {
+			switch op := hll[p]; {
+			case isZeroOp(op):
+				fmt.Fprintf(&sb, "z:%d ", zeroOpLen(op))
+			case isXZeroOp(op):
+				if p+1 >= len(hll) {
+					return nil, errCorruptHLL
+				}
+				fmt.Fprintf(&sb, "Z:%d ", xzeroOpLen(op, hll[p+1]))
+				p++
+			default:
+				fmt.Fprintf(&sb, "v:%d,%d ", valOpValue(op), valOpLen(op))
+			}
+		}
+		return parser.SimpleString(strings.TrimRight(sb.String(), " ")), nil
+	case "ENCODING":
+		if hll[4] == hllDense {
+			return parser.SimpleString("dense"), nil
+		}
+		return parser.SimpleString("sparse"), nil
+	case "TODENSE":
+		if hll[4] == hllDense {
+			return parser.Integer(0), nil
+		}
+		if hll, err = hllSparseToDense(hll); err != nil {
+			return nil, fmt.Errorf("ERR HLL sparse encoding is corrupted")
+		}
+		s.setKey(key, hll)
+		return parser.Integer(1), nil
+	}
+	return nil, fmt.Errorf("ERR Unknown PFDEBUG subcommand '%s'", sub)
+}
+
+// hllSelfTest checks register packing and that the estimate stays within a
+// few standard errors for cardinalities up to ten million, with the sparse
+// and dense encodings agreeing along the way.
+func hllSelfTest(maxBytes int) error {
+	regs := make([]byte, hllDenseSize-hllHdrSize)
+	want := make([]uint8, hllRegisters)
+	for cycle := 0; cycle < 1000; cycle++ {
+		for i := range want {
+			want[i] = uint8(rand.Intn(hllRegisterMax + 1))
+			hllDenseSet(regs, i, want[i])
+		}
+		for i := range want {
+			if got := hllDenseGet(regs, i); got != want[i] {
+				return fmt.Errorf("TESTFAILED Register error, counter %d should be %d but is %d", i, want[i], got)
+			}
+		}
+	}
+
+	dense := make([]byte, hllDenseSize)
+	copy(dense, "HYLL")
+	sparse := newHLL()
+	relerr := 1.04 / math.Sqrt(hllRegisters)
+	seed := rand.Uint64()
+	ele := make([]byte, 8)
+	count := func(hll []byte) uint64 {
+		histo, _ := hllRegHisto(hll)
+		return hllCount(histo)
+	}
+	checkpoint := int64(1)
+	for j := int64(1); j <= 10000000; j++ {
+		binary.LittleEndian.PutUint64(ele, uint64(j)^seed)
+		hllAdd(dense, ele, maxBytes)
+		sparse, _ = hllAdd(sparse, ele, maxBytes)
+		if j != checkpoint {
+			continue
+		}
+		if j < int64(maxBytes/2) && sparse[4] != hllSparse {
+			return fmt.Errorf("TESTFAILED sparse encoding not used")
+		}
+		card := count(dense)
+		if card != count(sparse) {
+			return fmt.Errorf("TESTFAILED dense/sparse disagree")
+		}
+		maxErr := int64(math.Ceil(relerr * 6 * float64(checkpoint)))
+		// Collisions make a large error at cardinality 10 likely enough
+		// to cause false positives.
+		if j == 10 {
+			maxErr = 1
+		}
+		absErr := checkpoint - int64(card)
+		if absErr < 0 {
+			absErr = -absErr
+		}
+		if absErr > maxErr {
+			return fmt.Errorf("TESTFAILED Too big error. card:%d abserr:%d", checkpoint, absErr)
+		}
+		checkpoint *= 10
+	}
+	return nil
+}
+
+// ---- command handlers ----
+
+func handlePFAdd(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	elements := make([][]byte, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		bs, ok := arg.(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+		elements = append(elements, bs)
+	}
+	updated, err := store.PFAdd(string(key), elements...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if updated {
+		return parser.Integer(1)
+	}
+	return parser.Integer(0)
+}
+
+func handlePFCount(store *Store, args []parser.Value) parser.Value {
+	keys, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	n, err := store.PFCount(keys...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handlePFMerge(store *Store, args []parser.Value) parser.Value {
+	keys, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if err := store.PFMerge(keys[0], keys[1:]...); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func handlePFDebug(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if len(strs) != 2 {
+		return parser.Error("ERR syntax error")
+	}
+	reply, err := store.PFDebug(strings.ToUpper(strs[0]), strs[1])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return reply
+}
+
+func handlePFSelfTest(store *Store, args []parser.Value) parser.Value {
+	store.mu.RLock()
+	maxBytes := store.hllSparseMaxBytes
+	store.mu.RUnlock()
+	if err := hllSelfTest(maxBytes); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
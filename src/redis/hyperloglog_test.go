@@ -0,0 +1,260 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestMurmurHash64A(t *testing.T) {
+	// Reference values from the C implementation used by Redis.
+	cases := map[string]uint64{
+		"":                  15627466953755236146,
+		"a":                 6039968161137406375,
+		"hello":             1109414937308947456,
+		"foobarbazqux":      2903960665764756978,
+		"0123456789abcdefg": 17782515169093400297,
+	}
+	for in, want := range cases {
+		if got := murmurHash64A([]byte(in), hllHashSeed); got != want {
+			t.Errorf("murmurHash64A(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestPFAddPFCount(t *testing.T) {
+	store := newStore()
+	updated, err := store.PFAdd("hll", []byte("1"), []byte("2"), []byte("3"), []byte("4"), []byte("5"))
+	if err != nil || !updated {
+		t.Fatalf("PFAdd = %v, %v", updated, err)
+	}
+	if n, _ := store.PFCount("hll"); n != 5 {
+		t.Errorf("expected 5, got %d", n)
+	}
+	store.PFAdd("hll", []byte("6"), []byte("7"), []byte("8"), []byte("8"), []byte("9"), []byte("10"))
+	if n, _ := store.PFCount("hll"); n != 10 {
+		t.Errorf("expected 10, got %d", n)
+	}
+	if updated, _ := store.PFAdd("hll", []byte("1")); updated {
+		t.Errorf("expected re-adding an element to leave the HLL unchanged")
+	}
+
+	if updated, _ := store.PFAdd("empty"); !updated {
+		t.Errorf("expected PFADD without elements to create the key")
+	}
+	if updated, _ := store.PFAdd("empty"); updated {
+		t.Errorf("expected second PFADD without elements to report no change")
+	}
+	if n, _ := store.PFCount("missing"); n != 0 {
+		t.Errorf("expected 0 for missing key, got %d", n)
+	}
+}
+
+func TestHLLNewLayout(t *testing.T) {
+	hll := newHLL()
+	want := "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff"
+	if string(hll) != want {
+		t.Errorf("unexpected empty HLL %q", hll)
+	}
+}
+
+func TestHLLCardinalityCache(t *testing.T) {
+	store := newStore()
+	store.PFAdd("hll", []byte("a"), []byte("b"), []byte("c"))
+	raw, _ := store.Get("hll")
+	if _, ok := hllCachedCard(raw); ok {
+		t.Fatalf("expected PFADD to invalidate the cached cardinality")
+	}
+	store.PFCount("hll")
+	raw, _ = store.Get("hll")
+	if card, ok := hllCachedCard(raw); !ok || card != 3 {
+		t.Errorf("expected cached cardinality 3, got %d (valid=%v)", card, ok)
+	}
+}
+
+func TestHLLSparseMatchesDense(t *testing.T) {
+	sparse := newHLL()
+	dense, _ := hllSparseToDense(newHLL())
+	for i := 0; i < 2000; i++ {
+		ele := []byte(fmt.Sprintf("ele:%d", i))
+		var r int
+		if sparse, r = hllAdd(sparse, ele, 1<<20); r < 0 {
+			t.Fatalf("corrupt sparse HLL after %d adds", i)
+		}
+		hllAdd(dense, ele, 1<<20)
+	}
+	if sparse[4] != hllSparse {
+		t.Fatalf("expected sparse encoding to be kept")
+	}
+	converted, err := hllSparseToDense(sparse)
+	if err != nil {
+		t.Fatalf("hllSparseToDense: %v", err)
+	}
+	if string(converted[hllHdrSize:]) != string(dense[hllHdrSize:]) {
+		t.Errorf("sparse and dense registers differ")
+	}
+	sh, _ := hllRegHisto(sparse)
+	dh, _ := hllRegHisto(dense)
+	if hllCount(sh) != hllCount(dh) {
+		t.Errorf("sparse count %d != dense count %d", hllCount(sh), hllCount(dh))
+	}
+
+	// Adjacent VAL opcodes with the same value are merged as Redis does.
+	for p := hllHdrSize; p+1 < len(sparse); p++ {
+		if isXZeroOp(sparse[p]) {
+			p++
+			continue
+		}
+		a, b := sparse[p], sparse[p+1]
+		if isValOp(a) && isValOp(b) && valOpValue(a) == valOpValue(b) && valOpLen(a)+valOpLen(b) <= hllSparseValMaxLen {
+			t.Fatalf("unmerged VAL opcodes at %d", p)
+		}
+	}
+}
+
+func TestHLLPromotion(t *testing.T) {
+	store := newStore()
+	for i := 0; ; i++ {
+		store.PFAdd("hll", []byte(fmt.Sprintf("ele:%d", i)))
+		raw, _ := store.Get("hll")
+		if raw[4] == hllDense {
+			if len(raw) != hllDenseSize {
+				t.Fatalf("dense HLL has length %d", len(raw))
+			}
+			break
+		}
+		if len(raw) > hllDefaultSparseMaxBytes {
+			t.Fatalf("sparse HLL grew to %d bytes", len(raw))
+		}
+	}
+
+	// A register value above 32 cannot be stored sparse.
+	hll, r := hllSparseSet(newHLL(), 5, 33, hllDefaultSparseMaxBytes)
+	if r != 1 || hll[4] != hllDense || hllDenseGet(hll[hllHdrSize:], 5) != 33 {
+		t.Errorf("expected promotion for a register value of 33")
+	}
+}
+
+func TestHLLCorruption(t *testing.T) {
+	store := newStore()
+	store.Set("str", []byte("hello"))
+	if _, err := store.PFAdd("str", []byte("a")); err != errNotHLL {
+		t.Errorf("expected invalid HLL error, got %v", err)
+	}
+	store.LPush("list", []byte("a"))
+	if _, err := store.PFCount("list"); err != errWrongType {
+		t.Errorf("expected WRONGTYPE, got %v", err)
+	}
+
+	store.PFAdd("hll", []byte("a"))
+	raw, _ := store.Get("hll")
+	store.Set("hll", append(raw, 0x00))
+	if _, err := store.PFCount("hll"); err != errCorruptHLL {
+		t.Errorf("expected corrupt HLL error, got %v", err)
+	}
+	if err := store.PFMerge("dest", "hll"); err != errCorruptHLL {
+		t.Errorf("expected corrupt HLL error from merge, got %v", err)
+	}
+
+	dense, _ := hllSparseToDense(newHLL())
+	store.Set("short", dense[:len(dense)-1])
+	if _, err := store.PFCount("short"); err != errNotHLL {
+		t.Errorf("expected truncated dense HLL to be rejected, got %v", err)
+	}
+}
+
+func TestPFMerge(t *testing.T) {
+	store := newStore()
+	for i := 0; i < 1000; i++ {
+		store.PFAdd("a", []byte(fmt.Sprintf("%d", i)))
+		store.PFAdd("b", []byte(fmt.Sprintf("%d", i+500)))
+	}
+	union, _ := store.PFCount("a", "b")
+	if err := store.PFMerge("dest", "a", "b"); err != nil {
+		t.Fatalf("PFMerge: %v", err)
+	}
+	if n, _ := store.PFCount("dest"); n != union {
+		t.Errorf("merged count %d != union count %d", n, union)
+	}
+	if union < 1450 || union > 1550 {
+		t.Errorf("union estimate %d too far from 1500", union)
+	}
+
+	store.PFDebug("TODENSE", "a")
+	store.PFMerge("dest2", "a", "missing")
+	raw, _ := store.Get("dest2")
+	if raw[4] != hllDense {
+		t.Errorf("expected a dense result when merging a dense HLL")
+	}
+}
+
+func TestHyperLogLogCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp := sendCmd(t, conn, reader, "PFADD hll a b c")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "PFCOUNT hll")
+	if num, ok := resp.(parser.Integer); !ok || num != 3 {
+		t.Errorf("expected 3, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "PFDEBUG ENCODING hll")
+	if str, ok := resp.(parser.SimpleString); !ok || str != "sparse" {
+		t.Errorf("expected sparse, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "PFDEBUG DECODE hll")
+	if str, ok := resp.(parser.SimpleString); !ok || strings.Count(string(str), "v:") != 3 {
+		t.Errorf("expected three VAL opcodes, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "PFDEBUG TODENSE hll")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "PFDEBUG GETREG hll")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != hllRegisters {
+		t.Errorf("expected %d registers, got %v", hllRegisters, resp)
+	}
+	resp = sendCmd(t, conn, reader, "PFDEBUG DECODE hll")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR HLL encoding is not sparse" {
+		t.Errorf("expected not sparse error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "PFDEBUG FOO hll")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR Unknown PFDEBUG subcommand 'FOO'" {
+		t.Errorf("expected unknown subcommand error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "PFDEBUG ENCODING missing")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR The specified key does not exist" {
+		t.Errorf("expected missing key error, got %v", resp)
+	}
+
+	sendCmd(t, conn, reader, "SET str foo")
+	resp = sendCmd(t, conn, reader, "PFADD str a")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "WRONGTYPE Key is not a valid HyperLogLog string value." {
+		t.Errorf("expected invalid HLL error, got %v", resp)
+	}
+
+	resp = sendCmd(t, conn, reader, "PFMERGE dest hll")
+	if str, ok := resp.(parser.SimpleString); !ok || str != "OK" {
+		t.Errorf("expected OK, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "PFCOUNT dest hll")
+	if num, ok := resp.(parser.Integer); !ok || num != 3 {
+		t.Errorf("expected 3, got %v", resp)
+	}
+}
+
+func TestHLLSelfTest(t *testing.T) {
+	if err := hllSelfTest(hllDefaultSparseMaxBytes); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// infoSections are the sections of INFO, in the order they are printed.
+var infoSections = []struct {
+	name   string
+	title  string
+	fields func(store *Store) []string
+}{
+	{"persistence", "Persistence", (*Store).infoPersistence},
+	{"stats", "Stats", (*Store).infoStats},
+	{"replication", "Replication", (*Store).infoReplication},
+	{"cluster", "Cluster", (*Store).infoCluster},
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func statusString(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "err"
+}
+
+func (s *Store) infoPersistence() []string {
+	s.repl.mu.Lock()
+	asyncLoading := s.repl.asyncLoading
+	s.repl.mu.Unlock()
+	p := &s.persistence
+	p.mu.Lock()
+	fields := []string{
+		"loading:0",
+		fmt.Sprintf("async_loading:%d", boolInt(asyncLoading)),
+		fmt.Sprintf("rdb_changes_since_last_save:%d", p.dirty.Load()),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", boolInt(p.saving)),
+		fmt.Sprintf("rdb_last_save_time:%d", p.lastSave.Unix()),
+		"rdb_last_bgsave_status:" + statusString(p.lastBgsaveOK),
+	}
+	p.mu.Unlock()
+	a := &s.aof
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append(fields,
+		fmt.Sprintf("aof_enabled:%d", boolInt(a.enabled)),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", boolInt(a.rewriting)),
+		"aof_last_bgrewrite_status:"+statusString(a.lastRewriteOK),
+		"aof_last_write_status:"+statusString(a.writeErr == nil),
+	)
+}
+
+func (s *Store) infoStats() []string {
+	rs := &s.repl
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return []string{
+		fmt.Sprintf("sync_full:%d", rs.syncFull),
+		fmt.Sprintf("sync_partial_ok:%d", rs.syncPartialOK),
+		fmt.Sprintf("sync_partial_err:%d", rs.syncPartialErr),
+	}
+}
+
+func (s *Store) infoCluster() []string {
+	return []string{fmt.Sprintf("cluster_enabled:%d", boolInt(s.cluster.enabled))}
+}
+
+// handleInfo prints the sections named in args, or all of them.
+func handleInfo(store *Store, args []parser.Value) parser.Value {
+	names, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	all := len(names) == 0
+	want := make(map[string]bool, len(names))
+	for _, name := range names {
+		switch name = strings.ToLower(name); name {
+		case "all", "default", "everything":
+			all = true
+		default:
+			want[name] = true
+		}
+	}
+	var b strings.Builder
+	for _, sec := range infoSections {
+		if !all && !want[sec.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + sec.title + "\r\n")
+		for _, field := range sec.fields(store) {
+			b.WriteString(field + "\r\n")
+		}
+	}
+	return parser.BulkString(b.String())
+}
@@ -0,0 +1,1453 @@
+package redis
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// JSON documents are trees of nil, bool, int64, float64, string, *jsonArray
+// and *jsonObject. Integers and floats are kept apart so JSON.TYPE can tell
+// "integer" from "number" as RedisJSON does, and objects keep their key
+// order so a document reads back the way it was written.
+type jsonArray struct {
+	elems []interface{}
+}
+
+type jsonObject struct {
+	keys []string
+	vals map[string]interface{}
+}
+
+// jsonDoc is the value stored at a JSON key. The root lives behind a pointer
+// so a path of "$" can replace it in place.
+type jsonDoc struct {
+	root interface{}
+}
+
+// jsonMaxDepth bounds nesting while parsing, like serde_json in RedisJSON.
+const jsonMaxDepth = 128
+
+var (
+	errJSONNoKey       = fmt.Errorf("ERR could not perform this operation on a key that doesn't exist")
+	errJSONNewAtRoot   = fmt.Errorf("ERR new objects must be created at the root")
+	errJSONStaticPath  = fmt.Errorf("ERR Err: wrong static path")
+	errJSONIndexBounds = fmt.Errorf("ERR index out of bounds")
+	errJSONOverflow    = fmt.Errorf("ERR result of the increment is out of range")
+)
+
+func errJSONPathMissing(path *jsonPath) error {
+	return fmt.Errorf("ERR Path '%s' does not exist", path.text)
+}
+
+func errJSONPathType(expected string, found interface{}) error {
+	return fmt.Errorf("WRONGTYPE wrong type of path value - expected %s but found %s", expected, jsonTypeName(found))
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{vals: make(map[string]interface{})}
+}
+
+// set stores v under k, keeping the position of an existing key.
+func (o *jsonObject) set(k string, v interface{}) {
+	if _, exists := o.vals[k]; !exists {
+		o.keys = append(o.keys, k)
+	}
+	o.vals[k] = v
+}
+
+func (o *jsonObject) remove(k string) bool {
+	if _, exists := o.vals[k]; !exists {
+		return false
+	}
+	delete(o.vals, k)
+	for i, key := range o.keys {
+		if key == k {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *jsonArray:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func isJSONNumber(v interface{}) bool {
+	switch v.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+func isJSONString(v interface{}) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+func isJSONArray(v interface{}) bool {
+	_, ok := v.(*jsonArray)
+	return ok
+}
+
+func isJSONObject(v interface{}) bool {
+	_, ok := v.(*jsonObject)
+	return ok
+}
+
+// jsonClone deep-copies v so one parsed value can be stored at several paths.
+func jsonClone(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *jsonArray:
+		arr := &jsonArray{elems: make([]interface{}, len(v.elems))}
+		for i, e := range v.elems {
+			arr.elems[i] = jsonClone(e)
+		}
+		return arr
+	case *jsonObject:
+		obj := &jsonObject{keys: append([]string(nil), v.keys...), vals: make(map[string]interface{}, len(v.vals))}
+		for k, e := range v.vals {
+			obj.vals[k] = jsonClone(e)
+		}
+		return obj
+	}
+	return v
+}
+
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case int64, float64:
+		if !isJSONNumber(b) {
+			return false
+		}
+		if xi, ok := x.(int64); ok {
+			if yi, ok := b.(int64); ok {
+				return xi == yi
+			}
+		}
+		return jsonFloat(a) == jsonFloat(b)
+	case *jsonArray:
+		y, ok := b.(*jsonArray)
+		if !ok || len(x.elems) != len(y.elems) {
+			return false
+		}
+		for i := range x.elems {
+			if !jsonEqual(x.elems[i], y.elems[i]) {
+				return false
+			}
+		}
+		return true
+	case *jsonObject:
+		y, ok := b.(*jsonObject)
+		if !ok || len(x.vals) != len(y.vals) {
+			return false
+		}
+		for k, v := range x.vals {
+			w, exists := y.vals[k]
+			if !exists || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func jsonFloat(v interface{}) float64 {
+	if i, ok := v.(int64); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
+
+// jsonAdd adds two JSON numbers, staying an integer while both operands are
+// integers and the sum does not overflow.
+func jsonAdd(a, b interface{}) (interface{}, error) {
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			if sum := x + y; (y >= 0) == (sum >= x) {
+				return sum, nil
+			}
+		}
+	}
+	sum := jsonFloat(a) + jsonFloat(b)
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return nil, errJSONOverflow
+	}
+	return sum, nil
+}
+
+type jsonParser struct {
+	data  string
+	pos   int
+	depth int
+}
+
+// parseJSON parses a single JSON value. Error messages follow serde_json,
+// which RedisJSON replies with.
+func parseJSON(s string) (interface{}, error) {
+	p := &jsonParser{data: s}
+	p.skipSpace()
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.data) {
+		return nil, p.errorf("trailing characters")
+	}
+	return v, nil
+}
+
+func (p *jsonParser) errorf(msg string) error {
+	line := 1 + strings.Count(p.data[:p.pos], "\n")
+	col := p.pos - strings.LastIndexByte(p.data[:p.pos], '\n')
+	if p.pos == len(p.data) {
+		col--
+	}
+	return fmt.Errorf("ERR %s at line %d column %d", msg, line, col)
+}
+
+func (p *jsonParser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *jsonParser) value() (interface{}, error) {
+	if p.pos >= len(p.data) {
+		return nil, p.errorf("EOF while parsing a value")
+	}
+	switch c := p.data[p.pos]; {
+	case c == '{':
+		return p.object()
+	case c == '[':
+		return p.array()
+	case c == '"':
+		return p.string()
+	case c == 't':
+		return p.literal("true", true)
+	case c == 'f':
+		return p.literal("false", false)
+	case c == 'n':
+		return p.literal("null", nil)
+	case c == '-' || c >= '0' && c <= '9':
+		return p.number()
+	}
+	return nil, p.errorf("expected value")
+}
+
+func (p *jsonParser) literal(word string, v interface{}) (interface{}, error) {
+	if !strings.HasPrefix(p.data[p.pos:], word) {
+		return nil, p.errorf("expected ident")
+	}
+	p.pos += len(word)
+	return v, nil
+}
+
+func (p *jsonParser) enter() error {
+	p.depth++
+	if p.depth > jsonMaxDepth {
+		return p.errorf("recursion limit exceeded")
+	}
+	p.pos++
+	p.skipSpace()
+	return nil
+}
+
+func (p *jsonParser) object() (interface{}, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	obj := newJSONObject()
+	if p.pos < len(p.data) && p.data[p.pos] == '}' {
+		p.pos++
+		p.depth--
+		return obj, nil
+	}
+	for {
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("EOF while parsing an object")
+		}
+		if p.data[p.pos] != '"' {
+			return nil, p.errorf("key must be a string")
+		}
+		k, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.data) || p.data[p.pos] != ':' {
+			return nil, p.errorf("expected `:`")
+		}
+		p.pos++
+		p.skipSpace()
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		obj.set(k.(string), v)
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("EOF while parsing an object")
+		}
+		switch p.data[p.pos] {
+		case ',':
+			p.pos++
+			p.skipSpace()
+		case '}':
+			p.pos++
+			p.depth--
+			return obj, nil
+		default:
+			return nil, p.errorf("expected `,` or `}`")
+		}
+	}
+}
+
+func (p *jsonParser) array() (interface{}, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	arr := &jsonArray{}
+	if p.pos < len(p.data) && p.data[p.pos] == ']' {
+		p.pos++
+		p.depth--
+		return arr, nil
+	}
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		arr.elems = append(arr.elems, v)
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("EOF while parsing a list")
+		}
+		switch p.data[p.pos] {
+		case ',':
+			p.pos++
+			p.skipSpace()
+		case ']':
+			p.pos++
+			p.depth--
+			return arr, nil
+		default:
+			return nil, p.errorf("expected `,` or `]`")
+		}
+	}
+}
+
+func (p *jsonParser) string() (interface{}, error) {
+	p.pos++
+	var sb strings.Builder
+	for {
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("EOF while parsing a string")
+		}
+		c := p.data[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return sb.String(), nil
+		case c < 0x20:
+			return nil, p.errorf("control character (\\u0000-\\u001F) found while parsing a string")
+		case c != '\\':
+			sb.WriteByte(c)
+			p.pos++
+			continue
+		}
+		p.pos++
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("EOF while parsing a string")
+		}
+		esc := p.data[p.pos]
+		p.pos++
+		switch esc {
+		case '"', '\\', '/':
+			sb.WriteByte(esc)
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'u':
+			r, err := p.hexEscape()
+			if err != nil {
+				return nil, err
+			}
+			if utf16.IsSurrogate(r) {
+				if r >= 0xdc00 || !strings.HasPrefix(p.data[p.pos:], "\\u") {
+					return nil, p.errorf("lone leading surrogate in hex escape")
+				}
+				p.pos += 2
+				lo, err := p.hexEscape()
+				if err != nil {
+					return nil, err
+				}
+				if r = utf16.DecodeRune(r, lo); r == utf8.RuneError {
+					return nil, p.errorf("lone leading surrogate in hex escape")
+				}
+			}
+			sb.WriteRune(r)
+		default:
+			return nil, p.errorf("invalid escape")
+		}
+	}
+}
+
+func (p *jsonParser) hexEscape() (rune, error) {
+	if p.pos+4 > len(p.data) {
+		return 0, p.errorf("EOF while parsing a string")
+	}
+	n, err := strconv.ParseUint(p.data[p.pos:p.pos+4], 16, 16)
+	if err != nil {
+		return 0, p.errorf("invalid escape")
+	}
+	p.pos += 4
+	return rune(n), nil
+}
+
+func (p *jsonParser) digits() int {
+	start := p.pos
+	for p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '9' {
+		p.pos++
+	}
+	return p.pos - start
+}
+
+func (p *jsonParser) number() (interface{}, error) {
+	start := p.pos
+	if p.data[p.pos] == '-' {
+		p.pos++
+	}
+	if p.pos < len(p.data) && p.data[p.pos] == '0' {
+		p.pos++
+	} else if p.digits() == 0 {
+		return nil, p.errorf("invalid number")
+	}
+	isFloat := false
+	if p.pos < len(p.data) && p.data[p.pos] == '.' {
+		isFloat = true
+		p.pos++
+		if p.digits() == 0 {
+			return nil, p.errorf("invalid number")
+		}
+	}
+	if p.pos < len(p.data) && (p.data[p.pos] == 'e' || p.data[p.pos] == 'E') {
+		isFloat = true
+		p.pos++
+		if p.pos < len(p.data) && (p.data[p.pos] == '+' || p.data[p.pos] == '-') {
+			p.pos++
+		}
+		if p.digits() == 0 {
+			return nil, p.errorf("invalid number")
+		}
+	}
+	text := p.data[start:p.pos]
+	if !isFloat {
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, p.errorf("number out of range")
+	}
+	return f, nil
+}
+
+// jsonFormat holds the JSON.GET INDENT, NEWLINE and SPACE strings. The zero
+// value gives compact output.
+type jsonFormat struct {
+	indent, newline, space string
+}
+
+func (f jsonFormat) appendNewline(dst []byte, depth int) []byte {
+	dst = append(dst, f.newline...)
+	for i := 0; i < depth; i++ {
+		dst = append(dst, f.indent...)
+	}
+	return dst
+}
+
+func appendJSON(dst []byte, v interface{}, f jsonFormat, depth int) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(dst, "null"...)
+	case bool:
+		return strconv.AppendBool(dst, v)
+	case int64:
+		return strconv.AppendInt(dst, v, 10)
+	case float64:
+		return append(dst, formatJSONFloat(v)...)
+	case string:
+		return appendJSONString(dst, v)
+	case *jsonArray:
+		if len(v.elems) == 0 {
+			return append(dst, "[]"...)
+		}
+		dst = append(dst, '[')
+		for i, e := range v.elems {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = f.appendNewline(dst, depth+1)
+			dst = appendJSON(dst, e, f, depth+1)
+		}
+		dst = f.appendNewline(dst, depth)
+		return append(dst, ']')
+	case *jsonObject:
+		if len(v.keys) == 0 {
+			return append(dst, "{}"...)
+		}
+		dst = append(dst, '{')
+		for i, k := range v.keys {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = f.appendNewline(dst, depth+1)
+			dst = appendJSONString(dst, k)
+			dst = append(dst, ':')
+			dst = append(dst, f.space...)
+			dst = appendJSON(dst, v.vals[k], f, depth+1)
+		}
+		dst = f.appendNewline(dst, depth)
+		return append(dst, '}')
+	}
+	panic(fmt.Sprintf("unexpected JSON value %T", v))
+}
+
+func appendJSONString(dst []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			dst = append(dst, '\\', c)
+		case '\b':
+			dst = append(dst, '\\', 'b')
+		case '\f':
+			dst = append(dst, '\\', 'f')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		default:
+			if c < 0x20 {
+				dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			} else {
+				dst = append(dst, c)
+			}
+		}
+	}
+	return append(dst, '"')
+}
+
+// formatJSONFloat writes the shortest representation of f the way serde_json
+// does: plain decimals with a trailing ".0" for integral values up to 1e16,
+// and an exponent without a "+" sign beyond that.
+func formatJSONFloat(f float64) string {
+	sci := strconv.FormatFloat(f, 'e', -1, 64)
+	sign := ""
+	if sci[0] == '-' {
+		sign, sci = "-", sci[1:]
+	}
+	mantissa, exp, _ := strings.Cut(sci, "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	e, _ := strconv.Atoi(exp)
+	n, point := len(digits), e+1
+	switch {
+	case n <= point && point <= 16:
+		return sign + digits + strings.Repeat("0", point-n) + ".0"
+	case 0 < point && point <= 16:
+		return sign + digits[:point] + "." + digits[point:]
+	case -5 < point && point <= 0:
+		return sign + "0." + strings.Repeat("0", -point) + digits
+	case n == 1:
+		return sign + digits + "e" + strconv.Itoa(e)
+	}
+	return sign + digits[:1] + "." + digits[1:] + "e" + strconv.Itoa(e)
+}
+
+// getJSON returns the document stored at key. Caller must hold s.mu.
+func (s *Store) getJSON(key string) (*jsonDoc, bool, error) {
+	val, exists := s.lookupKeyRead(key)
+	if !exists {
+		return nil, false, nil
+	}
+	doc, ok := val.(*jsonDoc)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return doc, true, nil
+}
+
+// getJSONForWrite is getJSON for callers holding s.mu for writing.
+func (s *Store) getJSONForWrite(key string) (*jsonDoc, bool, error) {
+	val, exists := s.lookupKeyWrite(key)
+	if !exists {
+		return nil, false, nil
+	}
+	doc, ok := val.(*jsonDoc)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return s.mutable(key, doc).(*jsonDoc), true, nil
+}
+
+// replace stores v at the location of n.
+func (doc *jsonDoc) replace(n jsonNode, v interface{}) {
+	switch p := n.parent.(type) {
+	case nil:
+		doc.root = v
+	case *jsonArray:
+		p.elems[n.index] = v
+	case *jsonObject:
+		p.vals[n.key] = v
+	}
+}
+
+// jsonLegacyCheck returns the error a legacy path replies with when it
+// selects nothing or selects a value that is not of the expected kind.
+// JSONPath queries instead reply nil for the mismatched values.
+func jsonLegacyCheck(path *jsonPath, nodes []jsonNode, expected string, ok func(interface{}) bool) error {
+	if !path.legacy {
+		return nil
+	}
+	if len(nodes) == 0 {
+		return errJSONPathMissing(path)
+	}
+	for _, n := range nodes {
+		if !ok(n.value) {
+			return errJSONPathType(expected, n.value)
+		}
+	}
+	return nil
+}
+
+// JSONSet stores value at path. A missing key can only be created at the
+// root; a missing object member is added when its parent exists. The result
+// is false when the NX or XX condition is not met.
+func (s *Store) JSONSet(key string, path *jsonPath, value interface{}, nx, xx bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, exists, err := s.getJSONForWrite(key)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		if len(path.steps) != 0 {
+			return false, errJSONNewAtRoot
+		}
+		if xx {
+			return false, nil
+		}
+		s.setKey(key, &jsonDoc{root: value})
+		return true, nil
+	}
+
+	nodes := path.eval(doc.root)
+	if len(nodes) > 0 {
+		if nx {
+			return false, nil
+		}
+		for i, n := range nodes {
+			v := value
+			if i > 0 {
+				v = jsonClone(value)
+			}
+			doc.replace(n, v)
+		}
+		return true, nil
+	}
+	if xx {
+		return false, nil
+	}
+	last := path.steps[len(path.steps)-1]
+	if last.kind != selectName || last.recursive || len(last.names) != 1 {
+		if path.legacy {
+			return false, errJSONStaticPath
+		}
+		return false, nil
+	}
+	added := false
+	for _, n := range evalJSONSteps(doc.root, doc.root, path.steps[:len(path.steps)-1]) {
+		if obj, ok := n.value.(*jsonObject); ok {
+			v := value
+			if added {
+				v = jsonClone(value)
+			}
+			obj.set(last.names[0], v)
+			added = true
+		}
+	}
+	if !added && path.legacy {
+		return false, errJSONStaticPath
+	}
+	return added, nil
+}
+
+// JSONGet serializes the values at paths. With a single path the reply is
+// that path's result; with several it is an object keyed by path. Legacy
+// paths yield their first match, and once any path is a JSONPath every
+// result is an array of matches.
+func (s *Store) JSONGet(key string, paths []*jsonPath, f jsonFormat) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, exists, err := s.getJSON(key)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	legacy := true
+	for _, p := range paths {
+		legacy = legacy && p.legacy
+	}
+	get := func(p *jsonPath) (interface{}, error) {
+		nodes := p.eval(doc.root)
+		if legacy {
+			if len(nodes) == 0 {
+				return nil, errJSONPathMissing(p)
+			}
+			return nodes[0].value, nil
+		}
+		return jsonNodeValues(nodes), nil
+	}
+	if len(paths) == 1 {
+		v, err := get(paths[0])
+		if err != nil {
+			return nil, false, err
+		}
+		return appendJSON(nil, v, f, 0), true, nil
+	}
+	obj := newJSONObject()
+	for _, p := range paths {
+		v, err := get(p)
+		if err != nil {
+			return nil, false, err
+		}
+		obj.set(p.orig, v)
+	}
+	return appendJSON(nil, obj, f, 0), true, nil
+}
+
+func jsonNodeValues(nodes []jsonNode) *jsonArray {
+	arr := &jsonArray{elems: make([]interface{}, len(nodes))}
+	for i, n := range nodes {
+		arr.elems[i] = n.value
+	}
+	return arr
+}
+
+// JSONMGet serializes path in every key, with nil for keys that are missing
+// or not JSON, and for legacy paths that match nothing.
+func (s *Store) JSONMGet(keys []string, path *jsonPath) [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([][]byte, len(keys))
+	for i, key := range keys {
+		doc, exists, err := s.getJSON(key)
+		if err != nil || !exists {
+			continue
+		}
+		nodes := path.eval(doc.root)
+		switch {
+		case !path.legacy:
+			out[i] = appendJSON(nil, jsonNodeValues(nodes), jsonFormat{}, 0)
+		case len(nodes) > 0:
+			out[i] = appendJSON(nil, nodes[0].value, jsonFormat{}, 0)
+		}
+	}
+	return out
+}
+
+// JSONDel removes the values at path and returns how many were removed.
+// Deleting the root deletes the key.
+func (s *Store) JSONDel(key string, path *jsonPath) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, exists, err := s.getJSONForWrite(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	if len(path.steps) == 0 {
+		s.deleteKey(key)
+		return 1, nil
+	}
+	type location struct {
+		parent interface{}
+		key    string
+		index  int
+	}
+	nodes := path.eval(doc.root)
+	// Remove array elements from the highest index down so that earlier
+	// removals do not shift the ones still to come.
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].index > nodes[j].index })
+	seen := make(map[location]bool, len(nodes))
+	deleted := int64(0)
+	for _, n := range nodes {
+		loc := location{n.parent, n.key, n.index}
+		if seen[loc] {
+			continue
+		}
+		seen[loc] = true
+		switch p := n.parent.(type) {
+		case *jsonObject:
+			if p.remove(n.key) {
+				deleted++
+			}
+		case *jsonArray:
+			p.elems = append(p.elems[:n.index], p.elems[n.index+1:]...)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// JSONType returns the type name of every value at path.
+func (s *Store) JSONType(key string, path *jsonPath) ([]string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, exists, err := s.getJSON(key)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	nodes := path.eval(doc.root)
+	types := make([]string, len(nodes))
+	for i, n := range nodes {
+		types[i] = jsonTypeName(n.value)
+	}
+	return types, true, nil
+}
+
+// JSONNumIncrBy adds delta to every number at path and returns the new
+// values, with nil for matches that are not numbers.
+func (s *Store) JSONNumIncrBy(key string, path *jsonPath, delta interface{}) ([]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, exists, err := s.getJSONForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errJSONNoKey
+	}
+	nodes := path.eval(doc.root)
+	if err := jsonLegacyCheck(path, nodes, "a number", isJSONNumber); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, len(nodes))
+	for i, n := range nodes {
+		if isJSONNumber(n.value) {
+			if results[i], err = jsonAdd(n.value, delta); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, n := range nodes {
+		if results[i] != nil {
+			doc.replace(n, results[i])
+		}
+	}
+	return results, nil
+}
+
+// JSONStrAppend appends suffix to every string at path and returns the new
+// lengths, with nil for matches that are not strings.
+func (s *Store) JSONStrAppend(key string, path *jsonPath, suffix string) ([]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, exists, err := s.getJSONForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errJSONNoKey
+	}
+	nodes := path.eval(doc.root)
+	if err := jsonLegacyCheck(path, nodes, "a string", isJSONString); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, len(nodes))
+	for i, n := range nodes {
+		if str, ok := n.value.(string); ok {
+			doc.replace(n, str+suffix)
+			results[i] = int64(len(str) + len(suffix))
+		}
+	}
+	return results, nil
+}
+
+// JSONArrInsert inserts values before index in every array at path and
+// returns the new lengths, with nil for matches that are not arrays. A
+// negative index counts from the end, and an index equal to the length
+// appends.
+func (s *Store) JSONArrInsert(key string, path *jsonPath, index int, values []interface{}) ([]interface{}, error) {
+	return s.arrInsert(key, path, values, func(n int) int {
+		if index < 0 {
+			return index + n
+		}
+		return index
+	})
+}
+
+// JSONArrAppend appends values to every array at path.
+func (s *Store) JSONArrAppend(key string, path *jsonPath, values []interface{}) ([]interface{}, error) {
+	return s.arrInsert(key, path, values, func(n int) int { return n })
+}
+
+// arrInsert inserts values into every array at path at the position pos
+// picks for the array's length.
+func (s *Store) arrInsert(key string, path *jsonPath, values []interface{}, pos func(n int) int) ([]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, exists, err := s.getJSONForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errJSONNoKey
+	}
+	nodes := path.eval(doc.root)
+	if err := jsonLegacyCheck(path, nodes, "an array", isJSONArray); err != nil {
+		return nil, err
+	}
+	positions := make([]int, len(nodes))
+	for i, n := range nodes {
+		if arr, ok := n.value.(*jsonArray); ok {
+			positions[i] = pos(len(arr.elems))
+			if positions[i] < 0 || positions[i] > len(arr.elems) {
+				return nil, errJSONIndexBounds
+			}
+		}
+	}
+	results := make([]interface{}, len(nodes))
+	for i, n := range nodes {
+		arr, ok := n.value.(*jsonArray)
+		if !ok {
+			continue
+		}
+		ins := values
+		if i > 0 {
+			ins = make([]interface{}, len(values))
+			for j, v := range values {
+				ins[j] = jsonClone(v)
+			}
+		}
+		arr.elems = slices.Insert(arr.elems, positions[i], ins...)
+		results[i] = int64(len(arr.elems))
+	}
+	return results, nil
+}
+
+// JSONArrPop removes the element at index from every array at path and
+// returns it serialized. The index is clamped to the array bounds, and
+// matches that are not arrays or are empty give nil.
+func (s *Store) JSONArrPop(key string, path *jsonPath, index int) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, exists, err := s.getJSONForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errJSONNoKey
+	}
+	nodes := path.eval(doc.root)
+	if err := jsonLegacyCheck(path, nodes, "an array", isJSONArray); err != nil {
+		return nil, err
+	}
+	results := make([][]byte, len(nodes))
+	for i, n := range nodes {
+		arr, ok := n.value.(*jsonArray)
+		if !ok || len(arr.elems) == 0 {
+			continue
+		}
+		pos := index
+		if pos < 0 {
+			pos += len(arr.elems)
+		}
+		pos = max(0, min(pos, len(arr.elems)-1))
+		results[i] = appendJSON(nil, arr.elems[pos], jsonFormat{}, 0)
+		arr.elems = append(arr.elems[:pos], arr.elems[pos+1:]...)
+	}
+	return results, nil
+}
+
+// JSONArrLen returns the length of every array at path, with nil for
+// matches that are not arrays.
+func (s *Store) JSONArrLen(key string, path *jsonPath) ([]interface{}, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, exists, err := s.getJSON(key)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	nodes := path.eval(doc.root)
+	if err := jsonLegacyCheck(path, nodes, "an array", isJSONArray); err != nil {
+		return nil, false, err
+	}
+	results := make([]interface{}, len(nodes))
+	for i, n := range nodes {
+		if arr, ok := n.value.(*jsonArray); ok {
+			results[i] = int64(len(arr.elems))
+		}
+	}
+	return results, true, nil
+}
+
+// JSONObjKeys returns the keys of every object at path, with nil for
+// matches that are not objects.
+func (s *Store) JSONObjKeys(key string, path *jsonPath) ([][]string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, exists, err := s.getJSON(key)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	nodes := path.eval(doc.root)
+	if err := jsonLegacyCheck(path, nodes, "an object", isJSONObject); err != nil {
+		return nil, false, err
+	}
+	results := make([][]string, len(nodes))
+	for i, n := range nodes {
+		if obj, ok := n.value.(*jsonObject); ok {
+			results[i] = append([]string{}, obj.keys...)
+		}
+	}
+	return results, true, nil
+}
+
+func jsonPathArg(v parser.Value) (*jsonPath, parser.Value) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return nil, parser.Error("ERR wrong argument type")
+	}
+	path, err := parseJSONPath(string(bs))
+	if err != nil {
+		return nil, parser.Error(err.Error())
+	}
+	return path, nil
+}
+
+// jsonOptionalPathArg returns the path at args[i], or the legacy root path
+// when it was omitted.
+func jsonOptionalPathArg(args []parser.Value, i int) (*jsonPath, parser.Value) {
+	if i >= len(args) {
+		return parseJSONPath(".")
+	}
+	return jsonPathArg(args[i])
+}
+
+func jsonValueArg(v parser.Value) (interface{}, parser.Value) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return nil, parser.Error("ERR wrong argument type")
+	}
+	val, err := parseJSON(string(bs))
+	if err != nil {
+		return nil, parser.Error(err.Error())
+	}
+	return val, nil
+}
+
+// jsonIntegerReply replies with the integer for the last match of a legacy
+// path, or one integer or nil per match of a JSONPath.
+func jsonIntegerReply(path *jsonPath, results []interface{}) parser.Value {
+	if path.legacy {
+		return parser.Integer(results[len(results)-1].(int64))
+	}
+	reply := make(parser.Array, len(results))
+	for i, r := range results {
+		if n, ok := r.(int64); ok {
+			reply[i] = parser.Integer(n)
+		} else {
+			reply[i] = parser.BulkString(nil)
+		}
+	}
+	return reply
+}
+
+func handleJSONSet(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	path, errReply := jsonPathArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	value, errReply := jsonValueArg(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	nx, xx := false, false
+	for _, a := range args[4:] {
+		opt, _ := a.(parser.BulkString)
+		switch strings.ToUpper(string(opt)) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return parser.Error("ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return parser.Error("ERR syntax error")
+	}
+	set, err := store.JSONSet(string(key), path, value, nx, xx)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !set {
+		return parser.BulkString(nil)
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleJSONGet(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	var f jsonFormat
+	var paths []*jsonPath
+	for i := 1; i < len(strs); i++ {
+		var opt *string
+		switch strings.ToUpper(strs[i]) {
+		case "INDENT":
+			opt = &f.indent
+		case "NEWLINE":
+			opt = &f.newline
+		case "SPACE":
+			opt = &f.space
+		case "NOESCAPE":
+			continue
+		}
+		if opt != nil && i+1 < len(strs) {
+			i++
+			*opt = strs[i]
+			continue
+		}
+		path, err := parseJSONPath(strs[i])
+		if err != nil {
+			return parser.Error(err.Error())
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		root, _ := parseJSONPath(".")
+		paths = append(paths, root)
+	}
+	out, exists, err := store.JSONGet(strs[0], paths, f)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !exists {
+		return parser.BulkString(nil)
+	}
+	return parser.BulkString(out)
+}
+
+func handleJSONMGet(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	path, err := parseJSONPath(strs[len(strs)-1])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	values := store.JSONMGet(strs[:len(strs)-1], path)
+	reply := make(parser.Array, len(values))
+	for i, v := range values {
+		if v == nil {
+			reply[i] = parser.BulkString(nil)
+		} else {
+			reply[i] = parser.BulkString(v)
+		}
+	}
+	return reply
+}
+
+func handleJSONDel(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if len(args) > 3 {
+		return parser.Error("ERR syntax error")
+	}
+	path, errReply := jsonOptionalPathArg(args, 2)
+	if errReply != nil {
+		return errReply
+	}
+	n, err := store.JSONDel(string(key), path)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleJSONType(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if len(args) > 3 {
+		return parser.Error("ERR syntax error")
+	}
+	path, errReply := jsonOptionalPathArg(args, 2)
+	if errReply != nil {
+		return errReply
+	}
+	types, exists, err := store.JSONType(string(key), path)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if path.legacy {
+		if !exists || len(types) == 0 {
+			return parser.BulkString(nil)
+		}
+		return parser.SimpleString(types[0])
+	}
+	if !exists {
+		return parser.Array(nil)
+	}
+	reply := make(parser.Array, len(types))
+	for i, t := range types {
+		reply[i] = parser.BulkString(t)
+	}
+	return reply
+}
+
+func handleJSONNumIncrBy(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	path, errReply := jsonPathArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	delta, errReply := jsonValueArg(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	if !isJSONNumber(delta) {
+		return parser.Error("ERR expected value to be a number")
+	}
+	results, err := store.JSONNumIncrBy(string(key), path, delta)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if path.legacy {
+		return parser.BulkString(appendJSON(nil, results[len(results)-1], jsonFormat{}, 0))
+	}
+	return parser.BulkString(appendJSON(nil, &jsonArray{elems: results}, jsonFormat{}, 0))
+}
+
+func handleJSONStrAppend(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if len(args) > 4 {
+		return parser.Error("ERR syntax error")
+	}
+	path, errReply := jsonOptionalPathArg(args[:len(args)-1], 2)
+	if errReply != nil {
+		return errReply
+	}
+	value, errReply := jsonValueArg(args[len(args)-1])
+	if errReply != nil {
+		return errReply
+	}
+	suffix, ok := value.(string)
+	if !ok {
+		return parser.Error("ERR expected value to be a string")
+	}
+	results, err := store.JSONStrAppend(string(key), path, suffix)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return jsonIntegerReply(path, results)
+}
+
+func handleJSONArrAppend(store *Store, args []parser.Value) parser.Value {
+	return jsonArrInsert(store, args, 3, nil)
+}
+
+func handleJSONArrInsert(store *Store, args []parser.Value) parser.Value {
+	index, errReply := intArg(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	return jsonArrInsert(store, args, 4, &index)
+}
+
+// jsonArrInsert implements JSON.ARRAPPEND and JSON.ARRINSERT, whose values
+// start at args[first]. A nil index appends.
+func jsonArrInsert(store *Store, args []parser.Value, first int, index *int) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	path, errReply := jsonPathArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	values := make([]interface{}, 0, len(args)-first)
+	for _, a := range args[first:] {
+		v, errReply := jsonValueArg(a)
+		if errReply != nil {
+			return errReply
+		}
+		values = append(values, v)
+	}
+	var results []interface{}
+	var err error
+	if index == nil {
+		results, err = store.JSONArrAppend(string(key), path, values)
+	} else {
+		results, err = store.JSONArrInsert(string(key), path, *index, values)
+	}
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return jsonIntegerReply(path, results)
+}
+
+func handleJSONArrPop(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if len(args) > 4 {
+		return parser.Error("ERR syntax error")
+	}
+	path, errReply := jsonOptionalPathArg(args, 2)
+	if errReply != nil {
+		return errReply
+	}
+	index := -1
+	if len(args) == 4 {
+		if index, errReply = intArg(args[3]); errReply != nil {
+			return errReply
+		}
+	}
+	results, err := store.JSONArrPop(string(key), path, index)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if path.legacy {
+		return parser.BulkString(results[len(results)-1])
+	}
+	reply := make(parser.Array, len(results))
+	for i, r := range results {
+		reply[i] = parser.BulkString(r)
+	}
+	return reply
+}
+
+func handleJSONArrLen(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if len(args) > 3 {
+		return parser.Error("ERR syntax error")
+	}
+	path, errReply := jsonOptionalPathArg(args, 2)
+	if errReply != nil {
+		return errReply
+	}
+	results, exists, err := store.JSONArrLen(string(key), path)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !exists {
+		return parser.BulkString(nil)
+	}
+	if path.legacy {
+		results = results[:1]
+	}
+	return jsonIntegerReply(path, results)
+}
+
+func handleJSONObjKeys(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if len(args) > 3 {
+		return parser.Error("ERR syntax error")
+	}
+	path, errReply := jsonOptionalPathArg(args, 2)
+	if errReply != nil {
+		return errReply
+	}
+	results, exists, err := store.JSONObjKeys(string(key), path)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !exists {
+		return parser.Array(nil)
+	}
+	keysReply := func(keys []string) parser.Value {
+		if keys == nil {
+			return parser.Array(nil)
+		}
+		arr := make(parser.Array, len(keys))
+		for i, k := range keys {
+			arr[i] = parser.BulkString(k)
+		}
+		return arr
+	}
+	if path.legacy {
+		return keysReply(results[0])
+	}
+	reply := make(parser.Array, len(results))
+	for i, keys := range results {
+		reply[i] = keysReply(keys)
+	}
+	return reply
+}
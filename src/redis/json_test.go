@@ -0,0 +1,410 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func mustParseJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	v, err := parseJSON(s)
+	if err != nil {
+		t.Fatalf("parseJSON(%q): %v", s, err)
+	}
+	return v
+}
+
+func mustParseJSONPath(t *testing.T, s string) *jsonPath {
+	t.Helper()
+	p, err := parseJSONPath(s)
+	if err != nil {
+		t.Fatalf("parseJSONPath(%q): %v", s, err)
+	}
+	return p
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	cases := map[string]string{
+		`{"b":1,"a":[true,false,null],"c":{}}`: `{"b":1,"a":[true,false,null],"c":{}}`,
+		` [ 1 , -2.5 , 1e3 , 0.0001 , "x" ] `:  `[1,-2.5,1000.0,0.0001,"x"]`,
+		`"tab\tquote\"slash\/unié😀"`:           `"tab\tquote\"slash/uni` + "é\U0001F600" + `"`,
+		`"\u0001"`:                             `"\u0001"`,
+		`12345678901234567890`:                 `1.2345678901234567e19`,
+		`1.5e-7`:                               `1.5e-7`,
+		`{"a":1,"a":2}`:                        `{"a":2}`,
+	}
+	for in, want := range cases {
+		if got := string(appendJSON(nil, mustParseJSON(t, in), jsonFormat{}, 0)); got != want {
+			t.Errorf("round trip of %s = %s, want %s", in, got, want)
+		}
+	}
+
+	for _, bad := range []string{``, `{`, `[1,]`, `{"a" 1}`, `01`, `1.`, `tru`, `"\x"`, `1 2`, `"\ud83d"`, "\"\x01\""} {
+		if _, err := parseJSON(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+	if _, err := parseJSON(strings.Repeat("[", jsonMaxDepth+1)); err == nil || !strings.Contains(err.Error(), "recursion limit") {
+		t.Errorf("expected recursion limit error, got %v", err)
+	}
+	if _, err := parseJSON("[1,\n2,]"); err == nil || err.Error() != "ERR expected value at line 2 column 3" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	v := mustParseJSON(t, `{"a":[1,{"b":null}],"c":{}}`)
+	got := string(appendJSON(nil, v, jsonFormat{indent: "\t", newline: "\n", space: " "}, 0))
+	want := "{\n\t\"a\": [\n\t\t1,\n\t\t{\n\t\t\t\"b\": null\n\t\t}\n\t],\n\t\"c\": {}\n}"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	floats := map[float64]string{
+		3:       "3.0",
+		-0.5:    "-0.5",
+		1e16:    "1e16",
+		1e15:    "1000000000000000.0",
+		123.456: "123.456",
+		0.00001: "0.00001",
+		1e-6:    "1e-6",
+		-2.5e-8: "-2.5e-8",
+	}
+	for f, want := range floats {
+		if got := formatJSONFloat(f); got != want {
+			t.Errorf("formatJSONFloat(%v) = %s, want %s", f, got, want)
+		}
+	}
+}
+
+func TestJSONPathEval(t *testing.T) {
+	doc := mustParseJSON(t, `{
+		"store": {
+			"book": [
+				{"category": "reference", "author": "Nigel Rees", "price": 8.95},
+				{"category": "fiction", "author": "Evelyn Waugh", "price": 12.99},
+				{"category": "fiction", "author": "Herman Melville", "isbn": "0-553-21311-3", "price": 8.99},
+				{"category": "fiction", "author": "J. R. R. Tolkien", "isbn": "0-395-19395-8", "price": 22.99}
+			],
+			"bicycle": {"color": "red", "price": 19.95}
+		}
+	}`)
+	cases := map[string]string{
+		"$":                            `[{"store":{"book":[{"category":"reference","author":"Nigel Rees","price":8.95},{"category":"fiction","author":"Evelyn Waugh","price":12.99},{"category":"fiction","author":"Herman Melville","isbn":"0-553-21311-3","price":8.99},{"category":"fiction","author":"J. R. R. Tolkien","isbn":"0-395-19395-8","price":22.99}],"bicycle":{"color":"red","price":19.95}}}]`,
+		"$.store.book[*].author":       `["Nigel Rees","Evelyn Waugh","Herman Melville","J. R. R. Tolkien"]`,
+		"$..author":                    `["Nigel Rees","Evelyn Waugh","Herman Melville","J. R. R. Tolkien"]`,
+		"$.store.*":                    `[[{"category":"reference","author":"Nigel Rees","price":8.95},{"category":"fiction","author":"Evelyn Waugh","price":12.99},{"category":"fiction","author":"Herman Melville","isbn":"0-553-21311-3","price":8.99},{"category":"fiction","author":"J. R. R. Tolkien","isbn":"0-395-19395-8","price":22.99}],{"color":"red","price":19.95}]`,
+		"$.store..price":               `[8.95,12.99,8.99,22.99,19.95]`,
+		"$..book[2].author":            `["Herman Melville"]`,
+		"$..book[-1].author":           `["J. R. R. Tolkien"]`,
+		"$..book[0,1].price":           `[8.95,12.99]`,
+		"$..book[:2].price":            `[8.95,12.99]`,
+		"$..book[1:].price":            `[12.99,8.99,22.99]`,
+		"$..book[::-2].price":          `[22.99,12.99]`,
+		"$..book[?(@.isbn)].author":    `["Herman Melville","J. R. R. Tolkien"]`,
+		"$..book[?(@.price<10)].price": `[8.95,8.99]`,
+		"$..book[?(@.price > $.store.bicycle.price)].author":               `["J. R. R. Tolkien"]`,
+		`$..book[?(@.category == 'reference' || @.price >= 22.99)].author`: `["Nigel Rees","J. R. R. Tolkien"]`,
+		`$..book[?(!@.isbn && @.price < 10)].author`:                       `["Nigel Rees"]`,
+		`$..book[?(@.author =~ "^J")].price`:                               `[22.99]`,
+		`$.store["bicycle"]['color']`:                                      `["red"]`,
+		`$.store['bicycle','missing'].price`:                               `[19.95]`,
+		"$.missing":                                                        `[]`,
+		"$..book[9]":                                                       `[]`,
+	}
+	for path, want := range cases {
+		p := mustParseJSONPath(t, path)
+		if got := string(appendJSON(nil, jsonNodeValues(p.eval(doc)), jsonFormat{}, 0)); got != want {
+			t.Errorf("%s = %s, want %s", path, got, want)
+		}
+	}
+
+	for _, bad := range []string{"$.", "$[", "$['a'", "$[1:2", "$[?(@.a ==)]", "$..", "$a"} {
+		if _, err := parseJSONPath(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestJSONLegacyPath(t *testing.T) {
+	cases := map[string]string{
+		".":       "$",
+		"":        "$",
+		".a.b":    "$.a.b",
+		"a.b[0]":  "$.a.b[0]",
+		`["a b"]`: `$["a b"]`,
+	}
+	for in, want := range cases {
+		p := mustParseJSONPath(t, in)
+		if !p.legacy || p.text != want {
+			t.Errorf("parseJSONPath(%q) = %q (legacy %v), want %q", in, p.text, p.legacy, want)
+		}
+	}
+	if p := mustParseJSONPath(t, "$.a"); p.legacy {
+		t.Errorf("expected $.a to be a JSONPath")
+	}
+}
+
+func TestJSONSetGet(t *testing.T) {
+	store := newStore()
+	root := mustParseJSONPath(t, "$")
+	if _, err := store.JSONSet("doc", mustParseJSONPath(t, "$.a"), int64(1), false, false); err != errJSONNewAtRoot {
+		t.Errorf("expected new objects error, got %v", err)
+	}
+	if ok, _ := store.JSONSet("doc", root, mustParseJSON(t, `{"a":{"b":1},"c":[1,2]}`), false, true); ok {
+		t.Errorf("expected XX on a missing key to do nothing")
+	}
+	if ok, err := store.JSONSet("doc", root, mustParseJSON(t, `{"a":{"b":1},"c":[1,2]}`), false, false); !ok || err != nil {
+		t.Fatalf("JSONSet = %v, %v", ok, err)
+	}
+	if ok, _ := store.JSONSet("doc", mustParseJSONPath(t, "$.a.b"), int64(2), true, false); ok {
+		t.Errorf("expected NX on an existing path to do nothing")
+	}
+	if ok, _ := store.JSONSet("doc", mustParseJSONPath(t, "$.a.new"), "x", false, false); !ok {
+		t.Errorf("expected a new member to be added")
+	}
+	if ok, _ := store.JSONSet("doc", mustParseJSONPath(t, "$.missing.new"), "x", false, false); ok {
+		t.Errorf("expected a member under a missing parent to be skipped")
+	}
+	if _, err := store.JSONSet("doc", mustParseJSONPath(t, ".missing.new"), "x", false, false); err != errJSONStaticPath {
+		t.Errorf("expected wrong static path error, got %v", err)
+	}
+	store.JSONSet("doc", mustParseJSONPath(t, "$.c[*]"), mustParseJSON(t, `{"z":0}`), false, false)
+
+	out, _, _ := store.JSONGet("doc", []*jsonPath{root}, jsonFormat{})
+	if want := `[{"a":{"b":1,"new":"x"},"c":[{"z":0},{"z":0}]}]`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+	// Values written to several paths must not share storage.
+	store.JSONNumIncrBy("doc", mustParseJSONPath(t, "$.c[0].z"), int64(5))
+	out, _, _ = store.JSONGet("doc", []*jsonPath{mustParseJSONPath(t, ".c")}, jsonFormat{})
+	if want := `[{"z":5},{"z":0}]`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+
+	out, _, _ = store.JSONGet("doc", []*jsonPath{mustParseJSONPath(t, ".a.b"), mustParseJSONPath(t, "c[1]")}, jsonFormat{})
+	if want := `{".a.b":1,"c[1]":{"z":0}}`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+	out, _, _ = store.JSONGet("doc", []*jsonPath{mustParseJSONPath(t, ".a.b"), mustParseJSONPath(t, "$..z")}, jsonFormat{})
+	if want := `{".a.b":[1],"$..z":[5,0]}`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+	if _, _, err := store.JSONGet("doc", []*jsonPath{mustParseJSONPath(t, ".nope")}, jsonFormat{}); err == nil || err.Error() != "ERR Path '$.nope' does not exist" {
+		t.Errorf("expected missing path error, got %v", err)
+	}
+	if _, exists, _ := store.JSONGet("missing", []*jsonPath{root}, jsonFormat{}); exists {
+		t.Errorf("expected a missing key")
+	}
+
+	store.Set("str", []byte("x"))
+	if _, err := store.JSONSet("str", root, int64(1), false, false); err != errWrongType {
+		t.Errorf("expected WRONGTYPE, got %v", err)
+	}
+	if _, ok := store.Get("doc"); ok {
+		t.Errorf("expected GET on a JSON key to fail")
+	}
+}
+
+func TestJSONDel(t *testing.T) {
+	store := newStore()
+	root := mustParseJSONPath(t, "$")
+	store.JSONSet("doc", root, mustParseJSON(t, `{"a":[0,1,2,3,4],"b":{"a":1},"c":2}`), false, false)
+	if n, _ := store.JSONDel("doc", mustParseJSONPath(t, "$.a[1,3,3]")); n != 2 {
+		t.Errorf("expected 2 deletions, got %d", n)
+	}
+	if n, _ := store.JSONDel("doc", mustParseJSONPath(t, "$..a")); n != 2 {
+		t.Errorf("expected 2 deletions, got %d", n)
+	}
+	out, _, _ := store.JSONGet("doc", []*jsonPath{mustParseJSONPath(t, ".")}, jsonFormat{})
+	if want := `{"b":{},"c":2}`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+	if n, _ := store.JSONDel("doc", mustParseJSONPath(t, ".")); n != 1 {
+		t.Errorf("expected the root to be deleted, got %d", n)
+	}
+	if _, exists, _ := store.JSONGet("doc", []*jsonPath{root}, jsonFormat{}); exists {
+		t.Errorf("expected deleting the root to delete the key")
+	}
+}
+
+func TestJSONArrays(t *testing.T) {
+	store := newStore()
+	store.JSONSet("doc", mustParseJSONPath(t, "$"), mustParseJSON(t, `{"a":[1],"b":{"a":"x"},"c":[]}`), false, false)
+
+	res, err := store.JSONArrAppend("doc", mustParseJSONPath(t, "$..a"), []interface{}{int64(2), int64(3)})
+	if err != nil || len(res) != 2 || res[0] != int64(3) || res[1] != nil {
+		t.Errorf("JSONArrAppend = %v, %v", res, err)
+	}
+	if _, err := store.JSONArrAppend("doc", mustParseJSONPath(t, ".b.a"), []interface{}{int64(1)}); err == nil || err.Error() != "WRONGTYPE wrong type of path value - expected an array but found string" {
+		t.Errorf("expected wrong type error, got %v", err)
+	}
+	if res, _ := store.JSONArrInsert("doc", mustParseJSONPath(t, ".a"), -1, []interface{}{"m"}); res[0] != int64(4) {
+		t.Errorf("JSONArrInsert = %v", res)
+	}
+	if _, err := store.JSONArrInsert("doc", mustParseJSONPath(t, ".a"), 5, []interface{}{"m"}); err != errJSONIndexBounds {
+		t.Errorf("expected index out of bounds, got %v", err)
+	}
+	if res, _, _ := store.JSONArrLen("doc", mustParseJSONPath(t, "$.*")); len(res) != 3 || res[0] != int64(4) || res[1] != nil || res[2] != int64(0) {
+		t.Errorf("JSONArrLen = %v", res)
+	}
+
+	popped, _ := store.JSONArrPop("doc", mustParseJSONPath(t, "$.a"), 1)
+	if string(popped[0]) != "2" {
+		t.Errorf("expected 2, got %s", popped[0])
+	}
+	popped, _ = store.JSONArrPop("doc", mustParseJSONPath(t, "$.a"), 99)
+	if string(popped[0]) != "3" {
+		t.Errorf("expected the index to be clamped to the last element, got %s", popped[0])
+	}
+	popped, _ = store.JSONArrPop("doc", mustParseJSONPath(t, "$.c"), -1)
+	if popped[0] != nil {
+		t.Errorf("expected nil from an empty array, got %s", popped[0])
+	}
+	out, _, _ := store.JSONGet("doc", []*jsonPath{mustParseJSONPath(t, ".a")}, jsonFormat{})
+	if string(out) != `[1,"m"]` {
+		t.Errorf("got %s", out)
+	}
+	if _, err := store.JSONArrPop("missing", mustParseJSONPath(t, "."), -1); err != errJSONNoKey {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+}
+
+func TestJSONNumbersAndStrings(t *testing.T) {
+	store := newStore()
+	store.JSONSet("doc", mustParseJSONPath(t, "$"), mustParseJSON(t, `{"a":1,"b":{"a":"s","c":1.5},"big":9223372036854775807}`), false, false)
+
+	res, err := store.JSONNumIncrBy("doc", mustParseJSONPath(t, "$..a"), int64(2))
+	if err != nil || res[0] != int64(3) || res[1] != nil {
+		t.Errorf("JSONNumIncrBy = %v, %v", res, err)
+	}
+	if res, _ := store.JSONNumIncrBy("doc", mustParseJSONPath(t, ".b.c"), float64(1.5)); res[0] != float64(3) {
+		t.Errorf("expected 3.0, got %v", res)
+	}
+	if res, _ := store.JSONNumIncrBy("doc", mustParseJSONPath(t, ".big"), int64(1)); res[0] != float64(9223372036854775808) {
+		t.Errorf("expected integer overflow to give a float, got %v", res)
+	}
+	if _, err := store.JSONNumIncrBy("doc", mustParseJSONPath(t, ".b.a"), int64(1)); err == nil || err.Error() != "WRONGTYPE wrong type of path value - expected a number but found string" {
+		t.Errorf("expected wrong type error, got %v", err)
+	}
+	if _, err := jsonAdd(float64(1.7976931348623157e308), float64(1.7976931348623157e308)); err != errJSONOverflow {
+		t.Errorf("expected overflow error, got %v", err)
+	}
+
+	res, _ = store.JSONStrAppend("doc", mustParseJSONPath(t, "$..a"), "tring")
+	if res[0] != nil || res[1] != int64(6) {
+		t.Errorf("JSONStrAppend = %v", res)
+	}
+	types, _, _ := store.JSONType("doc", mustParseJSONPath(t, "$..*"))
+	if got := strings.Join(types, ","); got != "integer,object,number,string,number" {
+		t.Errorf("JSONType = %s", got)
+	}
+	keys, _, _ := store.JSONObjKeys("doc", mustParseJSONPath(t, "$.*"))
+	if len(keys) != 3 || keys[0] != nil || strings.Join(keys[1], ",") != "a,c" {
+		t.Errorf("JSONObjKeys = %v", keys)
+	}
+}
+
+func TestJSONCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(args ...string) parser.Value {
+		t.Helper()
+		arr := make(parser.Array, len(args))
+		for i, a := range args {
+			arr[i] = parser.BulkString(a)
+		}
+		msg, _ := parser.Serialize(arr)
+		conn.Write(msg)
+		resp, err := parser.Deserialize(reader)
+		if err != nil {
+			t.Fatalf("reading reply to %v: %v", args, err)
+		}
+		return resp
+	}
+	bulkEquals := func(v parser.Value, want string) bool {
+		bs, ok := v.(parser.BulkString)
+		return ok && string(bs) == want
+	}
+	expectBulk := func(resp parser.Value, want string) {
+		t.Helper()
+		if !bulkEquals(resp, want) {
+			t.Errorf("expected %q, got %v", want, resp)
+		}
+	}
+
+	if resp := send("JSON.SET", "doc", "$", `{"name":"Leonard Cohen","lastSeen":1478476800,"loggedOut":true,"tags":["music"]}`); resp != parser.SimpleString("OK") {
+		t.Fatalf("expected OK, got %v", resp)
+	}
+	expectBulk(send("JSON.GET", "doc", "$.name"), `["Leonard Cohen"]`)
+	expectBulk(send("JSON.GET", "doc", ".name"), `"Leonard Cohen"`)
+	expectBulk(send("JSON.GET", "doc", "INDENT", "  ", "NEWLINE", "\n", "SPACE", " ", ".tags"), "[\n  \"music\"\n]")
+	expectBulk(send("JSON.GET", "doc", "name", "loggedOut"), `{"name":"Leonard Cohen","loggedOut":true}`)
+	if resp := send("JSON.SET", "doc", "$.name", `"x"`, "NX"); resp != nil {
+		t.Errorf("expected nil, got %v", resp)
+	}
+
+	expectBulk(send("JSON.NUMINCRBY", "doc", "$.lastSeen", "100"), `[1478476900]`)
+	expectBulk(send("JSON.NUMINCRBY", "doc", ".lastSeen", "0.5"), `1478476900.5`)
+	if resp := send("JSON.STRAPPEND", "doc", ".name", `"!"`); resp != parser.Integer(14) {
+		t.Errorf("expected 14, got %v", resp)
+	}
+	if resp := send("JSON.ARRAPPEND", "doc", "$.tags", `"poetry"`, `"novels"`); len(resp.(parser.Array)) != 1 || resp.(parser.Array)[0] != parser.Integer(3) {
+		t.Errorf("expected [3], got %v", resp)
+	}
+	if resp := send("JSON.ARRINSERT", "doc", ".tags", "0", `"songs"`); resp != parser.Integer(4) {
+		t.Errorf("expected 4, got %v", resp)
+	}
+	if resp := send("JSON.ARRLEN", "doc", ".tags"); resp != parser.Integer(4) {
+		t.Errorf("expected 4, got %v", resp)
+	}
+	expectBulk(send("JSON.ARRPOP", "doc", ".tags"), `"novels"`)
+	if resp := send("JSON.TYPE", "doc", ".tags"); resp != parser.SimpleString("array") {
+		t.Errorf("expected array, got %v", resp)
+	}
+	if resp := send("JSON.TYPE", "doc", "$..loggedOut"); len(resp.(parser.Array)) != 1 || !bulkEquals(resp.(parser.Array)[0], "boolean") {
+		t.Errorf("expected [boolean], got %v", resp)
+	}
+	if resp := send("JSON.OBJKEYS", "doc"); len(resp.(parser.Array)) != 4 {
+		t.Errorf("expected 4 keys, got %v", resp)
+	}
+	if resp := send("JSON.DEL", "doc", "$.tags[0]"); resp != parser.Integer(1) {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	expectBulk(send("JSON.GET", "doc", "$.tags"), `[["music","poetry"]]`)
+
+	send("JSON.SET", "doc2", ".", `{"name":"Other"}`)
+	send("SET", "str", "x")
+	resp := send("JSON.MGET", "doc", "doc2", "str", "missing", "$.name")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 4 || !bulkEquals(arr[0], `["Leonard Cohen!"]`) || !bulkEquals(arr[1], `["Other"]`) || arr[2] != nil || arr[3] != nil {
+		t.Errorf("unexpected JSON.MGET reply %v", resp)
+	}
+
+	if resp := send("JSON.SET", "doc", "$", `{"a":`); resp != parser.Error("ERR EOF while parsing a value at line 1 column 5") {
+		t.Errorf("expected parse error, got %v", resp)
+	}
+	if resp := send("JSON.GET", "str"); resp != parser.Error(errWrongType.Error()) {
+		t.Errorf("expected WRONGTYPE, got %v", resp)
+	}
+	if resp := send("GET", "doc"); resp != parser.Error(errWrongType.Error()) {
+		t.Errorf("expected WRONGTYPE, got %v", resp)
+	}
+	if resp := send("JSON.NUMINCRBY", "missing", ".a", "1"); resp != parser.Error(errJSONNoKey.Error()) {
+		t.Errorf("expected missing key error, got %v", resp)
+	}
+	if resp := send("JSON.GET", "doc", "$["); resp != parser.Error("ERR invalid JSONPath '$[' at position 2") {
+		t.Errorf("expected path error, got %v", resp)
+	}
+	if resp := send("DEL", "doc"); resp != parser.Integer(1) {
+		t.Errorf("expected DEL to remove a JSON key, got %v", resp)
+	}
+}
@@ -0,0 +1,611 @@
+package redis
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// jsonPath is a compiled path into a JSON document. Both JSONPath ("$.a[0]")
+// and the legacy RedisJSON syntax (".a[0]", "a", ".") are accepted; legacy
+// paths are rewritten into JSONPath and differ only in how commands reply:
+// a single value instead of one result per match, and an error when nothing
+// matches.
+type jsonPath struct {
+	orig   string // as given by the client
+	text   string // as JSONPath, for error messages
+	legacy bool
+	steps  []jsonStep
+}
+
+type jsonSelector int
+
+const (
+	selectName jsonSelector = iota
+	selectIndex
+	selectWildcard
+	selectSlice
+	selectFilter
+)
+
+// jsonStep selects children of the current nodes, or of the current nodes
+// and all their descendants when recursive (the ".." operator).
+type jsonStep struct {
+	kind      jsonSelector
+	recursive bool
+	names     []string
+	indexes   []int
+
+	start, end, step int
+	hasStart, hasEnd bool
+
+	filter *jsonFilter
+}
+
+// jsonNode is a value matched by a path, along with where it lives so that
+// commands can replace or remove it. The root has a nil parent.
+type jsonNode struct {
+	value  interface{}
+	parent interface{} // *jsonArray or *jsonObject
+	key    string
+	index  int
+}
+
+// jsonFilter is a node of a filter expression such as
+// [?(@.price < 10 && @.tags)].
+type jsonFilter struct {
+	op          string // "||", "&&", "!", "exists", "=~" or a comparison
+	left, right *jsonFilter
+	lhs, rhs    jsonOperand
+	re          *regexp.Regexp
+}
+
+// jsonOperand is either a literal or a path relative to the current node
+// (@) or to the document root ($).
+type jsonOperand struct {
+	path     []jsonStep
+	isPath   bool
+	relative bool
+	literal  interface{}
+}
+
+func parseJSONPath(s string) (*jsonPath, error) {
+	text, legacy := s, false
+	if !strings.HasPrefix(s, "$") {
+		legacy = true
+		switch {
+		case s == "" || s == ".":
+			text = "$"
+		case s[0] == '.' || s[0] == '[':
+			text = "$" + s
+		default:
+			text = "$." + s
+		}
+	}
+	p := &jsonPathParser{s: text, pos: 1}
+	steps, err := p.steps()
+	if err == nil && p.pos < len(p.s) {
+		err = p.errorf()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &jsonPath{orig: s, text: text, legacy: legacy, steps: steps}, nil
+}
+
+type jsonPathParser struct {
+	s   string
+	pos int
+}
+
+func (p *jsonPathParser) errorf() error {
+	return fmt.Errorf("ERR invalid JSONPath '%s' at position %d", p.s, p.pos)
+}
+
+func (p *jsonPathParser) peek(c byte) bool {
+	return p.pos < len(p.s) && p.s[p.pos] == c
+}
+
+func (p *jsonPathParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// steps parses selectors for as long as the input continues with '.' or '['.
+func (p *jsonPathParser) steps() ([]jsonStep, error) {
+	var steps []jsonStep
+	for p.pos < len(p.s) {
+		var step jsonStep
+		var err error
+		switch p.s[p.pos] {
+		case '.':
+			p.pos++
+			recursive := false
+			if p.peek('.') {
+				recursive = true
+				p.pos++
+			}
+			switch {
+			case p.peek('['):
+				step, err = p.bracket()
+			case p.peek('*'):
+				p.pos++
+				step.kind = selectWildcard
+			default:
+				name := p.name()
+				if name == "" {
+					return nil, p.errorf()
+				}
+				step = jsonStep{kind: selectName, names: []string{name}}
+			}
+			step.recursive = recursive
+		case '[':
+			step, err = p.bracket()
+		default:
+			return steps, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func isJSONPathNameChar(r rune) bool {
+	return r == '_' || r == '-' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r) || r >= 0x80
+}
+
+func (p *jsonPathParser) name() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+		if !isJSONPathNameChar(r) {
+			break
+		}
+		p.pos += size
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *jsonPathParser) bracket() (jsonStep, error) {
+	var step jsonStep
+	p.pos++
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return step, p.errorf()
+	}
+	switch c := p.s[p.pos]; {
+	case c == '*':
+		p.pos++
+		step.kind = selectWildcard
+	case c == '?':
+		p.pos++
+		f, err := p.orExpr()
+		if err != nil {
+			return step, err
+		}
+		step = jsonStep{kind: selectFilter, filter: f}
+	case c == '\'' || c == '"':
+		step.kind = selectName
+		for {
+			name, err := p.quoted()
+			if err != nil {
+				return step, err
+			}
+			step.names = append(step.names, name)
+			p.skipSpace()
+			if !p.peek(',') {
+				break
+			}
+			p.pos++
+			p.skipSpace()
+		}
+	default:
+		n, ok := p.integer()
+		p.skipSpace()
+		if p.peek(':') {
+			step = jsonStep{kind: selectSlice, start: n, hasStart: ok, step: 1}
+			p.pos++
+			p.skipSpace()
+			step.end, step.hasEnd = p.integer()
+			p.skipSpace()
+			if p.peek(':') {
+				p.pos++
+				p.skipSpace()
+				if n, ok := p.integer(); ok {
+					step.step = n
+				}
+			}
+			break
+		}
+		if !ok {
+			return step, p.errorf()
+		}
+		step = jsonStep{kind: selectIndex, indexes: []int{n}}
+		for p.peek(',') {
+			p.pos++
+			p.skipSpace()
+			n, ok := p.integer()
+			if !ok {
+				return step, p.errorf()
+			}
+			step.indexes = append(step.indexes, n)
+			p.skipSpace()
+		}
+	}
+	p.skipSpace()
+	if !p.peek(']') {
+		return step, p.errorf()
+	}
+	p.pos++
+	return step, nil
+}
+
+func (p *jsonPathParser) integer() (int, bool) {
+	start := p.pos
+	if p.peek('-') {
+		p.pos++
+	}
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	n, err := strconv.Atoi(p.s[start:p.pos])
+	if err != nil {
+		p.pos = start
+		return 0, false
+	}
+	return n, true
+}
+
+func (p *jsonPathParser) quoted() (string, error) {
+	quote := p.s[p.pos]
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return sb.String(), nil
+		case c == '\\' && p.pos < len(p.s):
+			sb.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", p.errorf()
+}
+
+func (p *jsonPathParser) orExpr() (*jsonFilter, error) {
+	left, err := p.andExpr()
+	for err == nil {
+		p.skipSpace()
+		if !strings.HasPrefix(p.s[p.pos:], "||") {
+			return left, nil
+		}
+		p.pos += 2
+		var right *jsonFilter
+		right, err = p.andExpr()
+		left = &jsonFilter{op: "||", left: left, right: right}
+	}
+	return nil, err
+}
+
+func (p *jsonPathParser) andExpr() (*jsonFilter, error) {
+	left, err := p.unaryExpr()
+	for err == nil {
+		p.skipSpace()
+		if !strings.HasPrefix(p.s[p.pos:], "&&") {
+			return left, nil
+		}
+		p.pos += 2
+		var right *jsonFilter
+		right, err = p.unaryExpr()
+		left = &jsonFilter{op: "&&", left: left, right: right}
+	}
+	return nil, err
+}
+
+var jsonCompareOps = []string{"==", "!=", "<=", ">=", "=~", "<", ">"}
+
+func (p *jsonPathParser) unaryExpr() (*jsonFilter, error) {
+	p.skipSpace()
+	switch {
+	case p.peek('!') && !strings.HasPrefix(p.s[p.pos:], "!="):
+		p.pos++
+		x, err := p.unaryExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &jsonFilter{op: "!", left: x}, nil
+	case p.peek('('):
+		p.pos++
+		x, err := p.orExpr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.peek(')') {
+			return nil, p.errorf()
+		}
+		p.pos++
+		return x, nil
+	}
+	lhs, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	for _, op := range jsonCompareOps {
+		if !strings.HasPrefix(p.s[p.pos:], op) {
+			continue
+		}
+		p.pos += len(op)
+		p.skipSpace()
+		rhs, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		f := &jsonFilter{op: op, lhs: lhs, rhs: rhs}
+		if op == "=~" {
+			pattern, ok := rhs.literal.(string)
+			if rhs.isPath || !ok {
+				return nil, p.errorf()
+			}
+			if f.re, err = regexp.Compile(pattern); err != nil {
+				return nil, p.errorf()
+			}
+		}
+		return f, nil
+	}
+	return &jsonFilter{op: "exists", lhs: lhs}, nil
+}
+
+func (p *jsonPathParser) operand() (jsonOperand, error) {
+	if p.pos >= len(p.s) {
+		return jsonOperand{}, p.errorf()
+	}
+	switch c := p.s[p.pos]; c {
+	case '@', '$':
+		p.pos++
+		steps, err := p.steps()
+		return jsonOperand{path: steps, isPath: true, relative: c == '@'}, err
+	case '\'', '"':
+		s, err := p.quoted()
+		return jsonOperand{literal: s}, err
+	}
+	for _, lit := range []struct {
+		word string
+		v    interface{}
+	}{{"true", true}, {"false", false}, {"null", nil}} {
+		if strings.HasPrefix(p.s[p.pos:], lit.word) {
+			p.pos += len(lit.word)
+			return jsonOperand{literal: lit.v}, nil
+		}
+	}
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte("+-.0123456789eE", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+	v, err := parseJSON(p.s[start:p.pos])
+	if err != nil || !isJSONNumber(v) {
+		p.pos = start
+		return jsonOperand{}, p.errorf()
+	}
+	return jsonOperand{literal: v}, nil
+}
+
+func (path *jsonPath) eval(root interface{}) []jsonNode {
+	return evalJSONSteps(root, root, path.steps)
+}
+
+func evalJSONSteps(root, start interface{}, steps []jsonStep) []jsonNode {
+	nodes := []jsonNode{{value: start}}
+	for i := range steps {
+		step := &steps[i]
+		var next []jsonNode
+		for _, n := range nodes {
+			if step.recursive {
+				jsonDescendants(n, func(d jsonNode) {
+					next = step.apply(root, d, next)
+				})
+			} else {
+				next = step.apply(root, n, next)
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// jsonChildren calls fn for every element or member of n, in order.
+func jsonChildren(n jsonNode, fn func(jsonNode)) {
+	switch v := n.value.(type) {
+	case *jsonArray:
+		for i, e := range v.elems {
+			fn(jsonNode{value: e, parent: v, index: i})
+		}
+	case *jsonObject:
+		for _, k := range v.keys {
+			fn(jsonNode{value: v.vals[k], parent: v, key: k})
+		}
+	}
+}
+
+// jsonDescendants calls fn for n and everything below it, parents first.
+func jsonDescendants(n jsonNode, fn func(jsonNode)) {
+	fn(n)
+	jsonChildren(n, func(c jsonNode) {
+		jsonDescendants(c, fn)
+	})
+}
+
+func (step *jsonStep) apply(root interface{}, n jsonNode, out []jsonNode) []jsonNode {
+	switch step.kind {
+	case selectName:
+		if obj, ok := n.value.(*jsonObject); ok {
+			for _, name := range step.names {
+				if v, exists := obj.vals[name]; exists {
+					out = append(out, jsonNode{value: v, parent: obj, key: name})
+				}
+			}
+		}
+	case selectIndex:
+		if arr, ok := n.value.(*jsonArray); ok {
+			for _, i := range step.indexes {
+				if i < 0 {
+					i += len(arr.elems)
+				}
+				if i >= 0 && i < len(arr.elems) {
+					out = append(out, jsonNode{value: arr.elems[i], parent: arr, index: i})
+				}
+			}
+		}
+	case selectWildcard:
+		jsonChildren(n, func(c jsonNode) {
+			out = append(out, c)
+		})
+	case selectSlice:
+		if arr, ok := n.value.(*jsonArray); ok {
+			for _, i := range step.sliceIndexes(len(arr.elems)) {
+				out = append(out, jsonNode{value: arr.elems[i], parent: arr, index: i})
+			}
+		}
+	case selectFilter:
+		jsonChildren(n, func(c jsonNode) {
+			if step.filter.eval(root, c.value) {
+				out = append(out, c)
+			}
+		})
+	}
+	return out
+}
+
+// sliceIndexes returns the indexes [start:end:step] selects in an array of
+// length n, with Python semantics for negative and out of range bounds.
+func (step *jsonStep) sliceIndexes(n int) []int {
+	if step.step == 0 {
+		return nil
+	}
+	norm := func(i, lo, hi int) int {
+		if i < 0 {
+			i += n
+		}
+		return max(lo, min(i, hi))
+	}
+	var out []int
+	if step.step > 0 {
+		lo, hi := 0, n
+		if step.hasStart {
+			lo = norm(step.start, 0, n)
+		}
+		if step.hasEnd {
+			hi = norm(step.end, 0, n)
+		}
+		for i := lo; i < hi; i += step.step {
+			out = append(out, i)
+		}
+		return out
+	}
+	hi, lo := n-1, -1
+	if step.hasStart {
+		hi = norm(step.start, -1, n-1)
+	}
+	if step.hasEnd {
+		lo = norm(step.end, -1, n-1)
+	}
+	for i := hi; i > lo; i += step.step {
+		out = append(out, i)
+	}
+	return out
+}
+
+// value returns the operand's value, or false when it is a path that does
+// not select exactly one node.
+func (o *jsonOperand) value(root, cur interface{}) (interface{}, bool) {
+	if !o.isPath {
+		return o.literal, true
+	}
+	start := root
+	if o.relative {
+		start = cur
+	}
+	nodes := evalJSONSteps(root, start, o.path)
+	if len(nodes) != 1 {
+		return nil, false
+	}
+	return nodes[0].value, true
+}
+
+func (f *jsonFilter) eval(root, cur interface{}) bool {
+	switch f.op {
+	case "||":
+		return f.left.eval(root, cur) || f.right.eval(root, cur)
+	case "&&":
+		return f.left.eval(root, cur) && f.right.eval(root, cur)
+	case "!":
+		return !f.left.eval(root, cur)
+	case "exists":
+		if f.lhs.isPath {
+			start := root
+			if f.lhs.relative {
+				start = cur
+			}
+			return len(evalJSONSteps(root, start, f.lhs.path)) > 0
+		}
+		b, _ := f.lhs.literal.(bool)
+		return b
+	}
+	a, aok := f.lhs.value(root, cur)
+	if f.op == "=~" {
+		s, ok := a.(string)
+		return aok && ok && f.re.MatchString(s)
+	}
+	b, bok := f.rhs.value(root, cur)
+	if !aok || !bok {
+		// A path that selects nothing only equals another such path.
+		switch f.op {
+		case "==", "<=", ">=":
+			return !aok && !bok
+		case "!=":
+			return aok != bok
+		}
+		return false
+	}
+	switch f.op {
+	case "==":
+		return jsonEqual(a, b)
+	case "!=":
+		return !jsonEqual(a, b)
+	case "<":
+		return jsonLess(a, b)
+	case ">":
+		return jsonLess(b, a)
+	case "<=":
+		return jsonLess(a, b) || jsonEqual(a, b)
+	case ">=":
+		return jsonLess(b, a) || jsonEqual(a, b)
+	}
+	return false
+}
+
+// jsonLess orders numbers and strings; other values are not comparable.
+func jsonLess(a, b interface{}) bool {
+	if isJSONNumber(a) && isJSONNumber(b) {
+		x, xok := a.(int64)
+		y, yok := b.(int64)
+		if xok && yok {
+			return x < y
+		}
+		return jsonFloat(a) < jsonFloat(b)
+	}
+	x, xok := a.(string)
+	y, yok := b.(string)
+	return xok && yok && x < y
+}
@@ -0,0 +1,477 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// accessMap records when each key was last read or written, for OBJECT
+// IDLETIME.
+type accessMap struct {
+	mu   sync.Mutex
+	data map[string]time.Time
+}
+
+func (m *accessMap) touch(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		m.data = make(map[string]time.Time)
+	}
+	m.data[key] = time.Now()
+}
+
+// setIdle records key as last used idle ago, for RESTORE IDLETIME.
+func (m *accessMap) setIdle(key string, idle time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		m.data = make(map[string]time.Time)
+	}
+	m.data[key] = time.Now().Add(-idle)
+}
+
+func (m *accessMap) delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+}
+
+// idle returns how long ago key was last used, or zero if that was never
+// recorded.
+func (m *accessMap) idle(key string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last, ok := m.data[key]
+	if !ok {
+		return 0
+	}
+	return time.Since(last)
+}
+
+// rename moves the access time of src to dst.
+func (m *accessMap) rename(src, dst string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last, ok := m.data[src]; ok {
+		delete(m.data, src)
+		m.data[dst] = last
+	}
+}
+
+// copyTTL gives dst the TTL of src, or removes dst's TTL if src has none.
+func (m *TTLMap) copyTTL(src, dst string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if exp, ok := m.data[src]; ok {
+		m.data[dst] = exp
+	} else {
+		delete(m.data, dst)
+	}
+}
+
+var (
+	errNoSuchKey   = fmt.Errorf("ERR no such key")
+	errSameObject  = fmt.Errorf("ERR source and destination objects are the same")
+	errDBIndex     = fmt.Errorf("ERR DB index is out of range")
+	errLFUDisabled = fmt.Errorf("ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+)
+
+// typeName returns the name TYPE reports for a stored value. Module-style
+// types use the names registered by the corresponding Redis modules.
+func typeName(val interface{}) string {
+	switch val.(type) {
+	case []byte, int64:
+		return "string"
+	case *quicklist:
+		return "list"
+	case *zset:
+		return "zset"
+	case *jsonDoc:
+		return "ReJSON-RL"
+	case *bloomFilter:
+		return "MBbloom--"
+	case *cuckooFilter:
+		return "MBbloomCF"
+	case *countMinSketch:
+		return "CMSk-TYPE"
+	case *topK:
+		return "TopK-TYPE"
+	default:
+		return "none"
+	}
+}
+
+// knownTypeName reports whether name, in any case, is a type SCAN TYPE can
+// filter on: a Redis core type, even one this server cannot hold, or one of
+// the module types typeName reports.
+func knownTypeName(name string) bool {
+	for _, known := range []string{"string", "list", "set", "zset", "hash", "stream",
+		"ReJSON-RL", "MBbloom--", "MBbloomCF", "CMSk-TYPE", "TopK-TYPE"} {
+		if strings.EqualFold(name, known) {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneValue deep-copies a stored value for COPY. The probabilistic types
+// are copied through their serialized form.
+func cloneValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []byte:
+		return bytes.Clone(v)
+	case *quicklist:
+		return v.clone()
+	case *zset:
+		return v.clone()
+	case *jsonDoc:
+		return &jsonDoc{root: jsonClone(v.root)}
+	case *bloomFilter:
+		c, _ := decodeBloomFilter(v.encode())
+		return c
+	case *cuckooFilter:
+		c, _ := decodeCuckooFilter(v.encode())
+		return c
+	case *countMinSketch:
+		c, _ := decodeCountMinSketch(v.encode())
+		return c
+	case *topK:
+		c, _ := decodeTopK(v.encode())
+		return c
+	default:
+		return val
+	}
+}
+
+// sharedIntegers mirrors Redis' shared integer objects, which OBJECT
+// REFCOUNT reports with this refcount.
+const (
+	sharedIntegers       = 10000
+	sharedObjectRefcount = math.MaxInt32
+)
+
+// stringInt reports whether val is a string Redis would store with the int
+// encoding.
+func stringInt(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case int64:
+		return v, true
+	case []byte:
+		if len(v) > 20 {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil || strconv.FormatInt(n, 10) != string(v) {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// objectEncoding returns the encoding OBJECT ENCODING reports for val.
+func objectEncoding(val interface{}) string {
+	if _, ok := stringInt(val); ok {
+		return "int"
+	}
+	switch v := val.(type) {
+	case []byte:
+		if len(v) <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case *quicklist:
+		if v.nodes <= 1 {
+			return "listpack"
+		}
+		return "quicklist"
+	case *zset:
+		return "skiplist"
+	default:
+		return "raw"
+	}
+}
+
+func (s *Store) Type(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, exists := s.peekKey(key)
+	if !exists {
+		return "none"
+	}
+	return typeName(val)
+}
+
+// Rename moves the value at src, with its TTL, to dst. With nx it does
+// nothing if dst exists, reporting whether the key was renamed.
+func (s *Store) Rename(src, dst string, nx bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, exists := s.lookupKeyWrite(src)
+	if !exists {
+		return false, errNoSuchKey
+	}
+	if _, exists := s.lookupKeyWrite(dst); exists && nx {
+		return false, nil
+	}
+	if src == dst {
+		return true, nil
+	}
+	s.deleteKey(dst)
+	s.setKey(dst, val)
+	if _, lent := s.cow.lent.LoadAndDelete(src); lent {
+		s.cow.lent.Store(dst, struct{}{})
+	}
+	s.volatileKeyMap.copyTTL(src, dst)
+	s.access.rename(src, dst)
+	s.deleteKey(src)
+	if _, isList := val.(*quicklist); isList {
+		s.signalKeyAsReady(dst)
+		s.serveBlockedClients()
+	}
+	return true, nil
+}
+
+// Copy stores a deep copy of src, with its TTL, at dst. Without replace it
+// does nothing if dst exists, and reports whether the value was copied.
+func (s *Store) Copy(src, dst string, replace bool) (bool, error) {
+	if src == dst {
+		return false, errSameObject
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, exists := s.lookupKeyWrite(src)
+	if !exists {
+		return false, nil
+	}
+	if _, exists := s.lookupKeyWrite(dst); exists {
+		if !replace {
+			return false, nil
+		}
+		s.deleteKey(dst)
+	}
+	val = cloneValue(val)
+	s.setKey(dst, val)
+	s.volatileKeyMap.copyTTL(src, dst)
+	s.access.touch(dst)
+	if _, isList := val.(*quicklist); isList {
+		s.signalKeyAsReady(dst)
+		s.serveBlockedClients()
+	}
+	return true, nil
+}
+
+// Touch marks keys as accessed and returns how many of them exist.
+func (s *Store) Touch(keys ...string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, key := range keys {
+		if _, exists := s.peekKey(key); exists {
+			s.access.touch(key)
+			count++
+		}
+	}
+	return count
+}
+
+// RandomKey returns a random key, deleting expired keys it comes across.
+func (s *Store) RandomKey() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Go randomizes where map iteration starts.
+	for key := range s.data {
+		if _, exists := s.lookupKeyWrite(key); exists {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// DBSize returns the number of keys, including expired keys that have not
+// been reclaimed yet, like Redis.
+func (s *Store) DBSize() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.data)
+}
+
+// objectInfo is what OBJECT reports about a key.
+type objectInfo struct {
+	encoding string
+	refcount int64
+	idle     time.Duration
+}
+
+func (s *Store) Object(key string) (objectInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, exists := s.peekKey(key)
+	if !exists {
+		return objectInfo{}, false
+	}
+	info := objectInfo{encoding: objectEncoding(val), refcount: 1, idle: s.access.idle(key)}
+	if n, ok := stringInt(val); ok && n >= 0 && n < sharedIntegers {
+		info.refcount = sharedObjectRefcount
+	}
+	return info, true
+}
+
+func handleExists(store *Store, args []parser.Value) parser.Value {
+	keys, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	return parser.Integer(store.Exists(keys...))
+}
+
+func handleType(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	return parser.SimpleString(store.Type(string(key)))
+}
+
+func handleRename(store *Store, args []parser.Value) parser.Value {
+	keys, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if _, err := store.Rename(keys[0], keys[1], false); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleRenameNX(store *Store, args []parser.Value) parser.Value {
+	keys, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	renamed, err := store.Rename(keys[0], keys[1], true)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if renamed {
+		return parser.Integer(1)
+	}
+	return parser.Integer(0)
+}
+
+func handleCopy(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	replace := false
+	for i := 2; i < len(strs); i++ {
+		switch strings.ToUpper(strs[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(strs) {
+				return parser.Error("ERR syntax error")
+			}
+			db, errReply := intArg(args[i+2])
+			if errReply != nil {
+				return errReply
+			}
+			// There is a single database.
+			if db != 0 {
+				return parser.Error(errDBIndex.Error())
+			}
+			i++
+		default:
+			return parser.Error("ERR syntax error")
+		}
+	}
+	copied, err := store.Copy(strs[0], strs[1], replace)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if copied {
+		return parser.Integer(1)
+	}
+	return parser.Integer(0)
+}
+
+func handleTouch(store *Store, args []parser.Value) parser.Value {
+	keys, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	return parser.Integer(store.Touch(keys...))
+}
+
+func handleRandomKey(store *Store, args []parser.Value) parser.Value {
+	key, ok := store.RandomKey()
+	if !ok {
+		return parser.BulkString(nil)
+	}
+	return parser.BulkString(key)
+}
+
+func handleDBSize(store *Store, args []parser.Value) parser.Value {
+	return parser.Integer(store.DBSize())
+}
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+func handleObject(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	sub := strings.ToUpper(strs[0])
+	switch {
+	case sub == "HELP" && len(strs) == 1:
+		reply := make(parser.Array, len(objectHelp))
+		for i, line := range objectHelp {
+			reply[i] = parser.SimpleString(line)
+		}
+		return reply
+	case len(strs) != 2 || sub != "ENCODING" && sub != "REFCOUNT" && sub != "IDLETIME" && sub != "FREQ":
+		return parser.Error("ERR unknown subcommand or wrong number of arguments for '" + strs[0] + "'. Try OBJECT HELP.")
+	}
+	info, exists := store.Object(strs[1])
+	if !exists {
+		return parser.BulkString(nil)
+	}
+	switch sub {
+	case "ENCODING":
+		return parser.BulkString(info.encoding)
+	case "REFCOUNT":
+		return parser.Integer(info.refcount)
+	case "IDLETIME":
+		return parser.Integer(info.idle / time.Second)
+	default:
+		// Access frequency is only tracked under an LFU eviction policy,
+		// and there is no eviction.
+		return parser.Error(errLFUDisabled.Error())
+	}
+}
@@ -0,0 +1,189 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestRenameMovesTTL(t *testing.T) {
+	store := newStore()
+	store.SetWithOptions("src", []byte("v"), setOptions{expireAt: time.Now().Add(time.Minute)})
+	store.SetWithOptions("dst", []byte("old"), setOptions{expireAt: time.Now().Add(time.Hour)})
+	if _, err := store.Rename("src", "dst", false); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if store.isVolatile("src") || store.Exists("src") != 0 {
+		t.Errorf("expected src and its TTL to be gone")
+	}
+	ttl, err := store.volatileKeyMap.GetTTL("dst")
+	if err != nil || ttl > time.Minute {
+		t.Errorf("expected dst to take the TTL of src, got %v, %v", ttl, err)
+	}
+
+	store.Set("plain", []byte("v"))
+	store.Rename("plain", "dst", false)
+	if store.isVolatile("dst") {
+		t.Errorf("expected renaming a persistent key to clear the TTL of dst")
+	}
+	if _, err := store.Rename("missing", "x", false); err != errNoSuchKey {
+		t.Errorf("expected no such key, got %v", err)
+	}
+}
+
+func TestDelClearsTTL(t *testing.T) {
+	store := newStore()
+	store.SetWithOptions("k", []byte("v"), setOptions{expireAt: time.Now().Add(time.Minute)})
+	store.Del("k")
+	store.SetWithOptions("k", []byte("v"), setOptions{keepTTL: true})
+	if store.isVolatile("k") {
+		t.Errorf("expected DEL to remove the TTL with the key")
+	}
+
+	// Popping the last element deletes the list and its TTL.
+	store.LPush("list", []byte("a"))
+	store.volatileKeyMap.Set("list", time.Minute)
+	store.LPop("list", 1)
+	if store.isVolatile("list") {
+		t.Errorf("expected an emptied list to lose its TTL")
+	}
+	if n := store.Del("missing"); n != 0 {
+		t.Errorf("expected 0, got %d", n)
+	}
+}
+
+func TestCopyIsDeep(t *testing.T) {
+	store := newStore()
+	store.RPush("list", []byte("a"), []byte("b"))
+	store.volatileKeyMap.Set("list", time.Minute)
+	if copied, _ := store.Copy("list", "copy", false); !copied {
+		t.Fatalf("expected COPY to succeed")
+	}
+	store.RPush("copy", []byte("c"))
+	if n, _ := store.LLen("list"); n != 2 {
+		t.Errorf("expected the source to be unchanged, got length %d", n)
+	}
+	if !store.isVolatile("copy") {
+		t.Errorf("expected COPY to copy the TTL")
+	}
+	if copied, _ := store.Copy("list", "copy", false); copied {
+		t.Errorf("expected COPY without REPLACE to leave an existing key")
+	}
+	if _, err := store.Copy("list", "list", true); err != errSameObject {
+		t.Errorf("expected same object error, got %v", err)
+	}
+
+	store.BFAdd("bf", []byte("x"))
+	store.Copy("bf", "bf2", false)
+	store.BFAdd("bf2", []byte("y"))
+	if found, _ := store.BFExists("bf", []byte("y")); found[0] {
+		t.Errorf("expected the copied filter to be independent")
+	}
+}
+
+func TestObjectEncoding(t *testing.T) {
+	tests := []struct {
+		val  interface{}
+		want string
+	}{
+		{[]byte("123"), "int"},
+		{int64(-5), "int"},
+		{[]byte("0123"), "embstr"},
+		{[]byte("hello"), "embstr"},
+		{make([]byte, 45), "raw"},
+		{newQuicklist(listDefaultFill, 0), "listpack"},
+		{newZset(), "skiplist"},
+		{&jsonDoc{}, "raw"},
+	}
+	for _, tt := range tests {
+		if got := objectEncoding(tt.val); got != tt.want {
+			t.Errorf("objectEncoding(%T %v) = %s, want %s", tt.val, tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestKeyspaceCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		cmd  string
+		want parser.Value
+	}{
+		{"RANDOMKEY", nil},
+		{"MSET a 1 b 2", parser.SimpleString("OK")},
+		{"RPUSH list x", parser.Integer(1)},
+		{"JSON.SET doc $ 1", parser.SimpleString("OK")},
+		{"BF.ADD bf x", parser.Integer(1)},
+		{"EXISTS a b a missing", parser.Integer(3)},
+		{"TYPE a", parser.SimpleString("string")},
+		{"TYPE list", parser.SimpleString("list")},
+		{"TYPE doc", parser.SimpleString("ReJSON-RL")},
+		{"TYPE bf", parser.SimpleString("MBbloom--")},
+		{"TYPE missing", parser.SimpleString("none")},
+		{"DBSIZE", parser.Integer(5)},
+		{"RENAME missing x", parser.Error("ERR no such key")},
+		{"RENAME a c", parser.SimpleString("OK")},
+		{"EXISTS a", parser.Integer(0)},
+		{"RENAMENX c b", parser.Integer(0)},
+		{"RENAMENX c d", parser.Integer(1)},
+		{"RENAMENX d d", parser.Integer(0)},
+		{"COPY d e", parser.Integer(1)},
+		{"COPY d e", parser.Integer(0)},
+		{"COPY d e DB 0 REPLACE", parser.Integer(1)},
+		{"COPY d e DB 1", parser.Error("ERR DB index is out of range")},
+		{"COPY d d", parser.Error("ERR source and destination objects are the same")},
+		{"TOUCH d e missing", parser.Integer(2)},
+		{"UNLINK d e missing", parser.Integer(2)},
+		{"OBJECT ENCODING b", parser.BulkString("int")},
+		{"OBJECT ENCODING list", parser.BulkString("listpack")},
+		{"OBJECT ENCODING missing", nil},
+		{"OBJECT REFCOUNT b", parser.Integer(2147483647)},
+		{"OBJECT REFCOUNT list", parser.Integer(1)},
+		{"OBJECT IDLETIME b", parser.Integer(0)},
+		{"OBJECT FREQ b", parser.Error(errLFUDisabled.Error())},
+		{"OBJECT NOPE b", parser.Error("ERR unknown subcommand or wrong number of arguments for 'NOPE'. Try OBJECT HELP.")},
+	}
+	for _, tt := range tests {
+		resp := sendCmd(t, conn, reader, tt.cmd)
+		if bs, ok := resp.(parser.BulkString); ok {
+			if want, ok := tt.want.(parser.BulkString); !ok || string(bs) != string(want) {
+				t.Errorf("%s: expected %v, got %q", tt.cmd, tt.want, bs)
+			}
+		} else if resp != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.cmd, tt.want, resp)
+		}
+	}
+
+	srv.store.access.mu.Lock()
+	srv.store.access.data["b"] = time.Now().Add(-5 * time.Second)
+	srv.store.access.mu.Unlock()
+	if resp := sendCmd(t, conn, reader, "OBJECT IDLETIME b"); resp != parser.Integer(5) {
+		t.Errorf("expected idle time 5, got %v", resp)
+	}
+	sendCmd(t, conn, reader, "TOUCH b")
+	if resp := sendCmd(t, conn, reader, "OBJECT IDLETIME b"); resp != parser.Integer(0) {
+		t.Errorf("expected TOUCH to reset the idle time, got %v", resp)
+	}
+
+	// RANDOMKEY skips expired keys and removes them.
+	sendCmd(t, conn, reader, "DEL b c list doc bf")
+	sendCmd(t, conn, reader, "PSETEX gone 1 v")
+	sendCmd(t, conn, reader, "SET kept v")
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if resp := sendCmd(t, conn, reader, "RANDOMKEY"); string(resp.(parser.BulkString)) != "kept" {
+			t.Errorf("expected kept, got %v", resp)
+		}
+	}
+	if resp := sendCmd(t, conn, reader, "OBJECT HELP"); len(resp.(parser.Array)) != len(objectHelp) {
+		t.Errorf("unexpected OBJECT HELP reply %v", resp)
+	}
+}
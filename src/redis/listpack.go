@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Listpacks are the serialized form RDB uses for packed list nodes and small
+// sorted sets. Each entry is an encoding byte, the data and a backwards
+// length, after a header holding the total size and the entry count:
+//
+//	0xxxxxxx                      7 bit unsigned integer
+//	10LLLLLL <data>               string up to 63 bytes
+//	110xxxxx xxxxxxxx             13 bit signed integer
+//	1110LLLL LLLLLLLL <data>      string up to 4095 bytes
+//	11110000 <4 byte len> <data>  longer string
+//	11110001..11110100            16, 24, 32 and 64 bit signed integers
+//	11111111                      end of the listpack
+const (
+	lpHeaderSize  = 6
+	lpEOF         = 0xff
+	lpEncInt16    = 0xf1
+	lpEncInt24    = 0xf2
+	lpEncInt32    = 0xf3
+	lpEncInt64    = 0xf4
+	lpEncStr32    = 0xf0
+	lpUnknownSize = 65535
+)
+
+var errListpackCorrupt = errors.New("corrupt listpack")
+
+// lpAppendEntry appends v as one listpack entry. Strings that are canonical
+// integers are stored with the integer encodings, as Redis does.
+func lpAppendEntry(dst []byte, v []byte) []byte {
+	start := len(dst)
+	if n, ok := stringInt(v); ok {
+		dst = lpAppendInt(dst, n)
+	} else {
+		switch l := len(v); {
+		case l < 64:
+			dst = append(dst, 0x80|byte(l))
+		case l < 4096:
+			dst = append(dst, 0xe0|byte(l>>8), byte(l))
+		default:
+			dst = append(dst, lpEncStr32)
+			dst = binary.LittleEndian.AppendUint32(dst, uint32(l))
+		}
+		dst = append(dst, v...)
+	}
+	return lpAppendBacklen(dst, len(dst)-start)
+}
+
+func lpAppendInt(dst []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 127:
+		return append(dst, byte(n))
+	case n >= -4096 && n <= 4095:
+		u := uint64(n) & (1<<13 - 1)
+		return append(dst, 0xc0|byte(u>>8), byte(u))
+	case n >= -1<<15 && n < 1<<15:
+		return binary.LittleEndian.AppendUint16(append(dst, lpEncInt16), uint16(n))
+	case n >= -1<<23 && n < 1<<23:
+		u := uint32(n)
+		return append(dst, lpEncInt24, byte(u), byte(u>>8), byte(u>>16))
+	case n >= -1<<31 && n < 1<<31:
+		return binary.LittleEndian.AppendUint32(append(dst, lpEncInt32), uint32(n))
+	default:
+		return binary.LittleEndian.AppendUint64(append(dst, lpEncInt64), uint64(n))
+	}
+}
+
+// lpAppendBacklen appends the length of the preceding entry, most
+// significant 7 bit group first, with the high bit set on all but the first
+// byte so the length can be read backwards.
+func lpAppendBacklen(dst []byte, l int) []byte {
+	n := lpBacklenSize(l)
+	for i := n - 1; i >= 0; i-- {
+		b := byte(l>>(7*i)) & 127
+		if i != n-1 {
+			b |= 128
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+func lpBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// encodeListpack serializes entries into a listpack.
+func encodeListpack(entries [][]byte) []byte {
+	b := make([]byte, lpHeaderSize, lpHeaderSize+16*len(entries))
+	for _, e := range entries {
+		b = lpAppendEntry(b, e)
+	}
+	b = append(b, lpEOF)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	count := len(entries)
+	if count >= lpUnknownSize {
+		count = lpUnknownSize
+	}
+	binary.LittleEndian.PutUint16(b[4:], uint16(count))
+	return b
+}
+
+// decodeListpack returns the entries of a listpack, with integers in their
+// decimal form. It validates the whole structure, so it is safe to use on
+// untrusted payloads.
+func decodeListpack(b []byte) ([][]byte, error) {
+	if len(b) < lpHeaderSize+1 || int(binary.LittleEndian.Uint32(b)) != len(b) || b[len(b)-1] != lpEOF {
+		return nil, errListpackCorrupt
+	}
+	count := int(binary.LittleEndian.Uint16(b[4:]))
+	var entries [][]byte
+	p := lpHeaderSize
+	for b[p] != lpEOF {
+		v, size, err := lpDecodeEntry(b[p : len(b)-1])
+		if err != nil {
+			return nil, err
+		}
+		backlen := lpBacklenSize(size)
+		if p+size+backlen > len(b)-1 {
+			return nil, errListpackCorrupt
+		}
+		entries = append(entries, v)
+		p += size + backlen
+	}
+	if p != len(b)-1 || (count != lpUnknownSize && count != len(entries)) {
+		return nil, errListpackCorrupt
+	}
+	return entries, nil
+}
+
+// lpDecodeEntry decodes the entry at the start of b, returning its value and
+// the size of its encoding and data.
+func lpDecodeEntry(b []byte) ([]byte, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errListpackCorrupt
+	}
+	enc := b[0]
+	var n int64
+	var size int
+	switch {
+	case enc&0x80 == 0:
+		return []byte(strconv.Itoa(int(enc))), 1, nil
+	case enc&0xc0 == 0x80:
+		return lpString(b, 1, int(enc&0x3f))
+	case enc&0xe0 == 0xc0:
+		if len(b) < 2 {
+			return nil, 0, errListpackCorrupt
+		}
+		u := uint64(enc&0x1f)<<8 | uint64(b[1])
+		n, size = int64(u<<51)>>51, 2
+	case enc&0xf0 == 0xe0:
+		if len(b) < 2 {
+			return nil, 0, errListpackCorrupt
+		}
+		return lpString(b, 2, int(enc&0x0f)<<8|int(b[1]))
+	case enc == lpEncStr32:
+		if len(b) < 5 {
+			return nil, 0, errListpackCorrupt
+		}
+		l := binary.LittleEndian.Uint32(b[1:])
+		if uint64(l) > uint64(len(b)) {
+			return nil, 0, errListpackCorrupt
+		}
+		return lpString(b, 5, int(l))
+	case enc == lpEncInt16 && len(b) >= 3:
+		n, size = int64(int16(binary.LittleEndian.Uint16(b[1:]))), 3
+	case enc == lpEncInt24 && len(b) >= 4:
+		u := uint32(b[1]) | uint32(b[2])<<8 | uint32(b[3])<<16
+		n, size = int64(int32(u<<8)>>8), 4
+	case enc == lpEncInt32 && len(b) >= 5:
+		n, size = int64(int32(binary.LittleEndian.Uint32(b[1:]))), 5
+	case enc == lpEncInt64 && len(b) >= 9:
+		n, size = int64(binary.LittleEndian.Uint64(b[1:])), 9
+	default:
+		return nil, 0, errListpackCorrupt
+	}
+	return []byte(strconv.FormatInt(n, 10)), size, nil
+}
+
+func lpString(b []byte, hdr, l int) ([]byte, int, error) {
+	if hdr+l > len(b) {
+		return nil, 0, errListpackCorrupt
+	}
+	return b[hdr : hdr+l : hdr+l], hdr + l, nil
+}
@@ -0,0 +1,147 @@
+package redis
+
+import "fmt"
+
+// LZF as implemented by liblzf, which Redis uses for compressed quicklist
+// nodes and RDB strings. The stream is a sequence of chunks:
+//
+//	000LLLLL <L+1 literal bytes>
+//	LLLooooo oooooooo          back reference, length L+2 (L < 7)
+//	111ooooo LLLLLLLL oooooooo back reference, length L+9
+//
+// where the reference starts offset+1 bytes before the current output.
+const (
+	lzfHashLog = 14
+	lzfMaxLit  = 1 << 5
+	lzfMaxOff  = 1 << 13
+	lzfMaxRef  = (1 << 8) + (1 << 3)
+)
+
+func lzfHash(in []byte, i int) uint32 {
+	v := uint32(in[i])<<16 | uint32(in[i+1])<<8 | uint32(in[i+2])
+	return (v * 2654435761) >> (32 - lzfHashLog)
+}
+
+// lzfCompress compresses in. It returns nil when the output would not be
+// smaller than the input, in which case callers store the data raw.
+func lzfCompress(in []byte) []byte {
+	if len(in) < 4 {
+		return nil
+	}
+	var table [1 << lzfHashLog]int
+	out := make([]byte, 0, len(in))
+	litPos := len(out)
+	out = append(out, 0)
+	lit := 0
+
+	emitLiteral := func(b byte) {
+		out = append(out, b)
+		lit++
+		if lit == lzfMaxLit {
+			out[litPos] = byte(lit - 1)
+			litPos = len(out)
+			out = append(out, 0)
+			lit = 0
+		}
+	}
+
+	ip := 0
+	for ip+2 < len(in) {
+		h := lzfHash(in, ip)
+		ref := table[h] - 1
+		table[h] = ip + 1
+		off := ip - ref - 1
+		if ref < 0 || off >= lzfMaxOff || in[ref] != in[ip] || in[ref+1] != in[ip+1] || in[ref+2] != in[ip+2] {
+			emitLiteral(in[ip])
+			ip++
+			continue
+		}
+
+		maxLen := len(in) - ip
+		if maxLen > lzfMaxRef {
+			maxLen = lzfMaxRef
+		}
+		n := 3
+		for n < maxLen && in[ref+n] == in[ip+n] {
+			n++
+		}
+
+		if lit == 0 {
+			out = out[:litPos]
+		} else {
+			out[litPos] = byte(lit - 1)
+		}
+		l := n - 2
+		if l < 7 {
+			out = append(out, byte(l<<5|off>>8))
+		} else {
+			out = append(out, byte(7<<5|off>>8), byte(l-7))
+		}
+		out = append(out, byte(off))
+		if len(out) >= len(in) {
+			return nil
+		}
+
+		for i := ip + 1; i < ip+n && i+2 < len(in); i++ {
+			table[lzfHash(in, i)] = i + 1
+		}
+		ip += n
+		litPos = len(out)
+		out = append(out, 0)
+		lit = 0
+	}
+	for ; ip < len(in); ip++ {
+		emitLiteral(in[ip])
+	}
+	if lit == 0 {
+		out = out[:litPos]
+	} else {
+		out[litPos] = byte(lit - 1)
+	}
+	if len(out) >= len(in) {
+		return nil
+	}
+	return out
+}
+
+// lzfDecompress expands in, which must decode to exactly outLen bytes.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < lzfMaxLit {
+			n := ctrl + 1
+			if ip+n > len(in) || len(out)+n > outLen {
+				return nil, fmt.Errorf("lzf: literal run overflows")
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, fmt.Errorf("lzf: truncated input")
+			}
+			n += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, fmt.Errorf("lzf: truncated input")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		n += 2
+		if ref < 0 || len(out)+n > outLen {
+			return nil, fmt.Errorf("lzf: invalid back reference")
+		}
+		for i := 0; i < n; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != outLen {
+		return nil, fmt.Errorf("lzf: expected %d bytes, got %d", outLen, len(out))
+	}
+	return out, nil
+}
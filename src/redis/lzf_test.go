@@ -0,0 +1,75 @@
+package redis
+
+import (
+	"bytes"
+	"testing"
+
+	"pgregory.net/rapid"
+)
+
+func TestLZFDecompressBackReference(t *testing.T) {
+	// Literal "a", then a 9 byte back reference at offset 0 (a run of "a").
+	in := []byte{0x00, 'a', 0xe0, 0x00, 0x00}
+	out, err := lzfDecompress(in, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != "aaaaaaaaaa" {
+		t.Errorf("expected 10 a's, got %q", out)
+	}
+}
+
+func TestLZFDecompressCorrupt(t *testing.T) {
+	if _, err := lzfDecompress([]byte{0x05, 'a'}, 6); err == nil {
+		t.Error("expected error for truncated literal run")
+	}
+	if _, err := lzfDecompress([]byte{0x20, 0x05}, 3); err == nil {
+		t.Error("expected error for reference before start of output")
+	}
+	if _, err := lzfDecompress([]byte{0x00, 'a'}, 2); err == nil {
+		t.Error("expected error for length mismatch")
+	}
+}
+
+func TestLZFCompressRepetitive(t *testing.T) {
+	in := bytes.Repeat([]byte("hello world "), 100)
+	packed := lzfCompress(in)
+	if packed == nil || len(packed) >= len(in)/4 {
+		t.Fatalf("expected good compression, got %d bytes", len(packed))
+	}
+	out, err := lzfDecompress(packed, len(in))
+	if err != nil || !bytes.Equal(out, in) {
+		t.Fatalf("round trip mismatch: %v", err)
+	}
+}
+
+func TestLZFCompressIncompressible(t *testing.T) {
+	if packed := lzfCompress([]byte("abc")); packed != nil {
+		t.Errorf("expected nil for tiny input, got %v", packed)
+	}
+	if packed := lzfCompress([]byte("abcdefghijklmnop")); packed != nil {
+		t.Errorf("expected nil for incompressible input, got %v", packed)
+	}
+}
+
+func TestPropertyLZFRoundTrip(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		alphabet := rapid.SliceOfN(rapid.Byte(), 1, 4).Draw(t, "alphabet")
+		n := rapid.IntRange(0, 20000).Draw(t, "len")
+		in := make([]byte, n)
+		for i := range in {
+			in[i] = alphabet[rapid.IntRange(0, len(alphabet)-1).Draw(t, "i")%len(alphabet)]
+		}
+		packed := lzfCompress(in)
+		if packed == nil {
+			return
+		}
+		out, err := lzfDecompress(packed, len(in))
+		if err != nil {
+			t.Fatalf("decompress error: %v", err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatal("round trip mismatch")
+		}
+	})
+}
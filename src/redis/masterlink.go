@@ -0,0 +1,445 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+var errLinkStopped = errors.New("replication link stopped")
+
+// runCommand is dispatch. Calling it through a variable keeps the commands
+// table, which leads here through REPLICAOF, free of an initialization
+// cycle.
+var runCommand func(c *Client, store *Store, arr parser.Array) parser.Value
+
+func init() {
+	runCommand = dispatch
+}
+
+// masterLink is the connection of a replica to its master. It reconnects
+// until stopped by REPLICAOF.
+type masterLink struct {
+	host string
+	port int
+	done chan struct{}
+
+	mu      sync.Mutex
+	conn    net.Conn // nil between connections
+	stopped bool
+	wmu     sync.Mutex // serializes writes to conn
+}
+
+func (l *masterLink) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.stopped {
+		l.stopped = true
+		close(l.done)
+		if l.conn != nil {
+			l.conn.Close()
+		}
+	}
+}
+
+func (l *masterLink) setConn(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return false
+	}
+	l.conn = conn
+	return true
+}
+
+func (l *masterLink) send(timeout time.Duration, args ...string) error {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if conn == nil {
+		return errLinkStopped
+	}
+	b, _ := parser.Serialize(commandArgs(args...))
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := conn.Write(b)
+	return err
+}
+
+// sendAck tells the master how much of the stream has been processed, and
+// how much of it is synced to our AOF.
+func (l *masterLink) sendAck(s *Store) {
+	l.send(WRITE_TIMEOUT, "REPLCONF", "ACK", strconv.FormatInt(s.replOffset(), 10),
+		"FACK", strconv.FormatInt(s.aofFsyncedOffset(), 10))
+}
+
+func (s *Store) setReplState(l *masterLink, state string) {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+	if s.repl.link == l {
+		s.repl.state = state
+		s.repl.lastIO = time.Now()
+	}
+}
+
+func (s *Store) runReplication(l *masterLink) {
+	for {
+		err := s.syncWithMaster(l)
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		log.Printf("Connection with MASTER %s:%d lost: %v", l.host, l.port, err)
+		s.setReplState(l, replStateConnect)
+		select {
+		case <-l.done:
+			return
+		case <-time.After(replReconnectDelay):
+		}
+	}
+}
+
+// syncWithMaster connects to the master, synchronizes with it and applies
+// its stream until the connection fails.
+func (s *Store) syncWithMaster(l *masterLink) error {
+	s.repl.mu.Lock()
+	timeout, port := s.repl.timeout, s.repl.port
+	replid, offset := s.repl.replid, s.repl.offset
+	s.repl.mu.Unlock()
+
+	s.setReplState(l, replStateConnecting)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(l.host, strconv.Itoa(l.port)), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !l.setConn(conn) {
+		return errLinkStopped
+	}
+	r := bufio.NewReader(conn)
+
+	s.setReplState(l, replStateHandshake)
+	handshake := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"REPLCONF", "listening-port", strconv.Itoa(port)}, "OK"},
+		{[]string{"REPLCONF", "capa", "eof", "capa", "psync2"}, "OK"},
+	}
+	for _, step := range handshake {
+		if err := l.send(timeout, step.args...); err != nil {
+			return err
+		}
+		line, err := readLine(conn, r, timeout)
+		if err != nil {
+			return err
+		}
+		if line != "+"+step.want {
+			return fmt.Errorf("%s: unexpected reply %q", step.args[0], line)
+		}
+	}
+
+	if err := l.send(timeout, "PSYNC", replid, strconv.FormatInt(offset+1, 10)); err != nil {
+		return err
+	}
+	line, err := readLine(conn, r, timeout)
+	if err != nil {
+		return err
+	}
+	switch fields := strings.Fields(line); {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad FULLRESYNC reply %q", line)
+		}
+		s.setReplState(l, replStateSync)
+		log.Printf("Full resync from master: %s:%d", fields[1], offset)
+		data, err := readBulkPayload(conn, r, timeout)
+		if err != nil {
+			return err
+		}
+		if err := s.loadFromMaster(l, data, fields[1], offset); err != nil {
+			return err
+		}
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		var newID string
+		if len(fields) > 1 {
+			newID = fields[1]
+		}
+		if err := s.continueWithMaster(l, newID); err != nil {
+			return err
+		}
+		log.Println("Successful partial resynchronization with master")
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC: %q", line)
+	}
+
+	s.setReplState(l, replStateConnected)
+	stopAcks := make(chan struct{})
+	defer close(stopAcks)
+	go s.sendAcks(l, stopAcks)
+
+	master := &Client{id: nextClientID.Add(1), master: l}
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		v, err := parser.Deserialize(r)
+		if err != nil {
+			return err
+		}
+		arr, ok := v.(parser.Array)
+		if !ok || len(arr) == 0 {
+			return fmt.Errorf("protocol error in the stream from master")
+		}
+		if !s.applyFromMaster(master, arr) {
+			return errLinkStopped
+		}
+	}
+}
+
+func readLine(conn net.Conn, r *bufio.Reader, timeout time.Duration) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readBulkPayload reads the snapshot of a full resync: $<length>\r\n and
+// the RDB file, with no trailing CRLF, or from a diskless master
+// $EOF:<mark>\r\n and the RDB file followed by the mark. Newlines the
+// master sends to keep the connection alive before it are skipped.
+func readBulkPayload(conn net.Conn, r *bufio.Reader, timeout time.Duration) ([]byte, error) {
+	var line string
+	for line == "" {
+		var err error
+		if line, err = readLine(conn, r, timeout); err != nil {
+			return nil, err
+		}
+	}
+	if mark, ok := strings.CutPrefix(line, "$EOF:"); ok && len(mark) == replIDLength {
+		return readUntilMark(conn, r, []byte(mark), timeout)
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+	if line[0] != '$' || err != nil || n < 0 {
+		return nil, fmt.Errorf("bad bulk payload header %q", line)
+	}
+	data := make([]byte, n)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readUntilMark reads up to mark, leaving the stream that follows it in r.
+func readUntilMark(conn net.Conn, r *bufio.Reader, mark []byte, timeout time.Duration) ([]byte, error) {
+	var data []byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := r.Peek(1); err != nil {
+			return nil, err
+		}
+		chunk, _ := r.Peek(r.Buffered())
+		// The mark may start in what was read before.
+		from := max(len(data)-len(mark)+1, 0)
+		data = append(data, chunk...)
+		if i := bytes.Index(data[from:], mark); i >= 0 {
+			end := from + i + len(mark)
+			r.Discard(len(chunk) - (len(data) - end))
+			return data[:end-len(mark)], nil
+		}
+		r.Discard(len(chunk))
+	}
+}
+
+// loadFromMaster replaces the dataset with the snapshot of a full resync.
+func (s *Store) loadFromMaster(l *masterLink, data []byte, replid string, offset int64) error {
+	n, err := s.loadSnapshot(l, data, replid, offset)
+	if err != nil {
+		return err
+	}
+	log.Printf("MASTER <-> REPLICA sync: loaded %d keys", n)
+
+	// The AOF is rewritten from the new dataset.
+	s.aof.mu.Lock()
+	aofOn := s.aof.enabled
+	s.aof.mu.Unlock()
+	if aofOn {
+		s.StopAppendOnly()
+		if err := s.StartAppendOnly(); err != nil {
+			log.Println("Can't restart the append-only file after sync:", err)
+		}
+	}
+	return nil
+}
+
+// loadSnapshot loads the snapshot of a full resync as configured by
+// repl-diskless-load. Our own replicas are disconnected, as they follow the
+// history we had.
+//
+// With disabled the snapshot is first stored as our RDB file, and with
+// on-empty-db too unless the dataset is empty. With swapdb it is parsed
+// aside while the old dataset is still served, and swapped in once
+// complete; if it fails to load, the old dataset stays along with the
+// history it belongs to.
+func (s *Store) loadSnapshot(l *masterLink, data []byte, replid string, offset int64) (int, error) {
+	s.aof.propMu.Lock()
+	defer s.aof.propMu.Unlock()
+	rs := &s.repl
+	rs.mu.Lock()
+	if rs.link != l {
+		rs.mu.Unlock()
+		return 0, errLinkStopped
+	}
+	rs.disconnectReplicasLocked()
+	mode := rs.disklessLoad
+	rs.mu.Unlock()
+
+	var n int
+	var err error
+	if mode == replDisklessLoadSwapDB {
+		if n, err = s.swapInSnapshot(data); err != nil {
+			return 0, fmt.Errorf("failed loading the snapshot from master, keeping the old dataset: %w", err)
+		}
+	} else {
+		if mode == replDisklessLoadDisabled || s.DBSize() > 0 {
+			if err := s.storeSnapshot(data); err != nil {
+				return 0, fmt.Errorf("failed storing the snapshot from master: %w", err)
+			}
+		}
+		s.mu.Lock()
+		s.emptyLocked()
+		if n, err = s.loadRDBLocked(data, nil, rdbHooks{}); err != nil {
+			// Whatever was loaded matches no offset of the master.
+			s.emptyLocked()
+			replid, offset = newReplID(), 0
+		}
+		s.mu.Unlock()
+	}
+
+	rs.mu.Lock()
+	rs.replid, rs.offset = replid, offset
+	rs.replid2, rs.secondOffset = noReplID, -1
+	rs.backlog = newReplBacklog(rs.backlogSize, rs.offset+1)
+	rs.mu.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("failed loading the snapshot from master: %w", err)
+	}
+	return n, nil
+}
+
+// swapInSnapshot loads a snapshot into a new dataset and swaps it in.
+func (s *Store) swapInSnapshot(data []byte) (int, error) {
+	s.repl.mu.Lock()
+	s.repl.asyncLoading = true
+	s.repl.mu.Unlock()
+	defer func() {
+		s.repl.mu.Lock()
+		s.repl.asyncLoading = false
+		s.repl.mu.Unlock()
+	}()
+	dataset := s.newDataset()
+	n, err := dataset.loadRDBData(data, nil, rdbHooks{})
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.swapDatasetLocked(dataset)
+	s.mu.Unlock()
+	return n, nil
+}
+
+// storeSnapshot writes the snapshot of a full resync over our RDB file. As
+// it replaces the dataset, it covers every change made so far.
+func (s *Store) storeSnapshot(data []byte) error {
+	dir, dbfilename, dirty, err := s.beginSave(false)
+	for err == errSaveInProgress {
+		time.Sleep(saveCheckInterval)
+		dir, dbfilename, dirty, err = s.beginSave(false)
+	}
+	if err != nil {
+		return err
+	}
+	err = replaceRDBFile(dir, dbfilename, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	s.endSave(dirty, err)
+	return err
+}
+
+// continueWithMaster resumes the stream after a partial resync. A new
+// replication ID means the master was promoted from a replica: its history
+// continues ours, so our replicas can continue too.
+func (s *Store) continueWithMaster(l *masterLink, replid string) error {
+	rs := &s.repl
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.link != l {
+		return errLinkStopped
+	}
+	if replid != "" && replid != rs.replid {
+		rs.shiftReplIDLocked()
+		rs.replid = replid
+		rs.disconnectReplicasLocked()
+	}
+	if rs.backlog == nil {
+		rs.backlog = newReplBacklog(rs.backlogSize, rs.offset+1)
+	}
+	return nil
+}
+
+func (s *Store) sendAcks(l *masterLink, stop <-chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		l.sendAck(s)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyFromMaster runs a command of the stream and passes it on unchanged
+// to our backlog and replicas. It reports false once the link was stopped.
+func (s *Store) applyFromMaster(master *Client, arr parser.Array) bool {
+	raw, err := parser.Serialize(arr)
+	if err != nil {
+		return true
+	}
+	s.aof.propMu.Lock()
+	defer s.aof.propMu.Unlock()
+	s.repl.mu.Lock()
+	current := s.repl.link == master.master
+	s.repl.mu.Unlock()
+	if !current {
+		return false
+	}
+	// The command is fed first, so that what it appends to our AOF is
+	// recorded at the offset just past it.
+	rs := &s.repl
+	rs.mu.Lock()
+	rs.lastIO = time.Now()
+	rs.feedLocked(raw)
+	rs.mu.Unlock()
+	if reply, failed := runCommand(master, s, arr).(parser.Error); failed {
+		log.Printf("Command from master failed: %s", reply)
+	}
+	return true
+}
@@ -0,0 +1,378 @@
+package redis
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+const (
+	defaultSaveParams = "3600 1 300 100 60 10000"
+	defaultDBFilename = "dump.rdb"
+
+	// bgsaveRetryDelay is how long save rules wait after a failed
+	// background save before trying again.
+	bgsaveRetryDelay  = 5 * time.Second
+	saveCheckInterval = 100 * time.Millisecond
+)
+
+var errSaveInProgress = fmt.Errorf("ERR Background save already in progress")
+
+// saveParam is one `save <seconds> <changes>` rule: snapshot when at least
+// changes writes happened and seconds passed since the last save.
+type saveParam struct {
+	seconds int
+	changes int64
+}
+
+// persistenceState tracks RDB snapshots. dirty counts writes since the
+// last successful save. skipUnsupported makes loads drop keys of types this
+// server cannot hold instead of failing.
+type persistenceState struct {
+	dirty           atomic.Int64
+	skipUnsupported atomic.Bool
+
+	mu            sync.Mutex
+	dir           string
+	dbfilename    string
+	saveParams    []saveParam
+	saving        bool
+	lastSave      time.Time
+	lastBgsaveTry time.Time
+	lastBgsaveOK  bool
+}
+
+// countWrite adds a successful call of a write command to the dirty
+// counter and passes its reply through.
+func (s *Store) countWrite(write bool, reply parser.Value) parser.Value {
+	if _, failed := reply.(parser.Error); write && !failed {
+		s.persistence.dirty.Add(1)
+	}
+	return reply
+}
+
+func parseSaveParams(val string) ([]saveParam, error) {
+	fields := strings.Fields(val)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("Invalid save parameters")
+	}
+	params := make([]saveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("Invalid save parameters")
+		}
+		params = append(params, saveParam{seconds: seconds, changes: changes})
+	}
+	return params, nil
+}
+
+func formatSaveParams(params []saveParam) string {
+	fields := make([]string, 0, 2*len(params))
+	for _, p := range params {
+		fields = append(fields, strconv.Itoa(p.seconds), strconv.FormatInt(p.changes, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// cowState lets snapshots and readers share values with the live dataset
+// instead of copying them. While a snapshot is being written, a value is
+// copied before its first change in place; owned holds the keys whose value
+// was copied since the last snapshot was taken, and may be changed freely.
+// Guarded by Store.mu, except for lent.
+type cowState struct {
+	snapshots int
+	owned     map[string]struct{}
+	// lent holds the keys whose string a reader returned without copying
+	// it, to be copied before it is next changed in place. Readers add to
+	// it while holding s.mu for reading.
+	lent sync.Map
+}
+
+// snapshot returns the live keys and their expiry times. The values are
+// shared with the dataset, which copies a value before changing it, so
+// writers wait only for the keys to be listed. release must be called once
+// the entries are no longer read.
+func (s *Store) snapshot() ([]rdbEntry, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.volatileKeyMap.mu.RLock()
+	defer s.volatileKeyMap.mu.RUnlock()
+	now := time.Now()
+	entries := make([]rdbEntry, 0, len(s.data))
+	for key, val := range s.data {
+		e := rdbEntry{key: key, val: val}
+		if exp, ok := s.volatileKeyMap.data[key]; ok {
+			if !now.Before(exp.expiryTime) {
+				continue
+			}
+			e.expireAt = exp.expiryTime
+		}
+		entries = append(entries, e)
+	}
+	s.cow.snapshots++
+	s.cow.owned = make(map[string]struct{})
+	var once sync.Once
+	return entries, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.cow.snapshots--; s.cow.snapshots == 0 {
+				s.cow.owned = nil
+			}
+		})
+	}
+}
+
+// mutable returns val, the value at key, for the caller to change in place.
+// While a snapshot or a reader may share it, the value is first replaced by
+// a copy. Caller must hold s.mu for writing.
+func (s *Store) mutable(key string, val interface{}) interface{} {
+	if _, lent := s.cow.lent.LoadAndDelete(key); !lent {
+		if s.cow.snapshots == 0 {
+			return val
+		}
+		if _, ok := s.cow.owned[key]; ok {
+			return val
+		}
+	}
+	val = cloneValue(val)
+	s.data[key] = val
+	if s.cow.snapshots > 0 {
+		s.cow.owned[key] = struct{}{}
+	}
+	return val
+}
+
+// lend records that the string at key is returned to a caller that reads
+// it after s.mu is released. Caller must hold s.mu.
+func (s *Store) lend(key string, val interface{}) {
+	if _, ok := val.([]byte); ok {
+		s.cow.lent.Store(key, struct{}{})
+	}
+}
+
+// writeRDBFile writes entries to a temporary file in dir and renames it over
+// dir/dbfilename, so the previous snapshot stays intact until the new one is
+// complete.
+func writeRDBFile(dir, dbfilename string, entries []rdbEntry) error {
+	return replaceRDBFile(dir, dbfilename, func(w io.Writer) error {
+		return writeRDB(w, entries, false)
+	})
+}
+
+// replaceRDBFile is writeRDBFile for an RDB file produced by write.
+func replaceRDBFile(dir, dbfilename string, write func(io.Writer) error) error {
+	f, err := os.CreateTemp(dir, "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, dbfilename))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// beginSave marks a save as running and returns the file to write and the
+// dirty count the snapshot will cover.
+func (s *Store) beginSave(background bool) (string, string, int64, error) {
+	p := &s.persistence
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.saving {
+		return "", "", 0, errSaveInProgress
+	}
+	p.saving = true
+	if background {
+		p.lastBgsaveTry = time.Now()
+	}
+	return p.dir, p.dbfilename, p.dirty.Load(), nil
+}
+
+func (s *Store) endSave(dirtyBefore int64, err error) {
+	p := &s.persistence
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.saving = false
+	if err != nil {
+		p.lastBgsaveOK = false
+		log.Println("Error saving DB on disk:", err)
+		return
+	}
+	p.dirty.Add(-dirtyBefore)
+	p.lastSave = time.Now()
+	p.lastBgsaveOK = true
+}
+
+// Save writes a snapshot and returns once it is on disk.
+func (s *Store) Save() error {
+	dir, dbfilename, dirty, err := s.beginSave(false)
+	if err != nil {
+		return err
+	}
+	entries, release := s.snapshot()
+	err = writeRDBFile(dir, dbfilename, entries)
+	release()
+	s.endSave(dirty, err)
+	return err
+}
+
+// BGSave takes a snapshot and writes it from a separate goroutine.
+func (s *Store) BGSave() error {
+	dir, dbfilename, dirty, err := s.beginSave(true)
+	if err != nil {
+		return err
+	}
+	entries, release := s.snapshot()
+	go func() {
+		err := writeRDBFile(dir, dbfilename, entries)
+		release()
+		s.endSave(dirty, err)
+		if err == nil {
+			log.Println("Background saving terminated with success")
+		}
+	}()
+	return nil
+}
+
+// LastSave returns the time of the last successful save, or of startup.
+func (s *Store) LastSave() time.Time {
+	s.persistence.mu.Lock()
+	defer s.persistence.mu.Unlock()
+	return s.persistence.lastSave
+}
+
+// LoadRDB replaces the dataset with the snapshot at path, skipping keys
+// that expired while the server was down. A missing file is not an error.
+func (s *Store) LoadRDB(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return s.loadRDBData(data, nil, rdbHooks{})
+}
+
+// loadRDBData loads an RDB file read into memory. seen, if set, is called
+// for every key in the file, including those that expired.
+func (s *Store) loadRDBData(data []byte, seen func(rdbEntry), hooks rdbHooks) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadRDBLocked(data, seen, hooks)
+}
+
+// loadRDBLocked is loadRDBData for a caller holding s.mu for writing.
+func (s *Store) loadRDBLocked(data []byte, seen func(rdbEntry), hooks rdbHooks) (int, error) {
+	if s.persistence.skipUnsupported.Load() {
+		hooks.skipUnsupported = true
+	}
+	now := time.Now()
+	loaded := 0
+	err := readRDBHooks(data, s.listMaxListpackSize, s.listCompressDepth, func(e rdbEntry) {
+		if seen != nil {
+			seen(e)
+		}
+		if !e.expireAt.IsZero() && !e.expireAt.After(now) {
+			return
+		}
+		s.deleteKey(e.key)
+		s.setKey(e.key, e.val)
+		s.access.touch(e.key)
+		if !e.expireAt.IsZero() {
+			s.volatileKeyMap.setExpiration(e.key, ExpirationTime{
+				expiryTime:  e.expireAt,
+				durationSet: e.expireAt.Sub(now),
+			})
+		}
+		loaded++
+	}, hooks)
+	return loaded, err
+}
+
+func (s *Store) persistenceCron() {
+	ticker := time.NewTicker(saveCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.checkSaveParams(now)
+		s.aofCron(now)
+	}
+}
+
+// checkSaveParams starts a background save when a save rule is satisfied.
+// After a failed save it waits bgsaveRetryDelay before trying again.
+func (s *Store) checkSaveParams(now time.Time) {
+	p := &s.persistence
+	p.mu.Lock()
+	var due saveParam
+	found := false
+	if !p.saving {
+		dirty := p.dirty.Load()
+		for _, sp := range p.saveParams {
+			if dirty >= sp.changes &&
+				now.Sub(p.lastSave) > time.Duration(sp.seconds)*time.Second &&
+				(p.lastBgsaveOK || now.Sub(p.lastBgsaveTry) > bgsaveRetryDelay) {
+				due, found = sp, true
+				break
+			}
+		}
+	}
+	p.mu.Unlock()
+	if found {
+		log.Printf("%d changes in %d seconds. Saving...", due.changes, due.seconds)
+		s.BGSave()
+	}
+}
+
+func handleSave(store *Store, args []parser.Value) parser.Value {
+	if err := store.Save(); err != nil {
+		if err == errSaveInProgress {
+			return parser.Error(err.Error())
+		}
+		return parser.Error("ERR " + err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleBGSave(store *Store, args []parser.Value) parser.Value {
+	if len(args) > 2 {
+		return parser.Error("ERR syntax error")
+	}
+	if len(args) == 2 {
+		// SCHEDULE defers a save that would collide with other background
+		// work; BGSAVE is the only such work here, so it changes nothing.
+		if opt, ok := args[1].(parser.BulkString); !ok || !strings.EqualFold(string(opt), "SCHEDULE") {
+			return parser.Error("ERR syntax error")
+		}
+	}
+	if err := store.BGSave(); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("Background saving started")
+}
+
+func handleLastSave(store *Store, args []parser.Value) parser.Value {
+	return parser.Integer(store.LastSave().Unix())
+}
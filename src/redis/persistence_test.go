@@ -0,0 +1,287 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func newPersistentStore(t *testing.T) *Store {
+	store := newStore()
+	store.persistence.dir = t.TempDir()
+	return store
+}
+
+func waitForSave(t *testing.T, store *Store) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		store.persistence.mu.Lock()
+		saving := store.persistence.saving
+		store.persistence.mu.Unlock()
+		if !saving {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("background save did not finish")
+}
+
+func TestSaveAndLoadAllTypes(t *testing.T) {
+	store := newPersistentStore(t)
+	store.Set("str", []byte("hello"))
+	store.IncrBy("counter", 42)
+	store.SetWithOptions("volatile", []byte("v"), setOptions{expireAt: time.Now().Add(time.Hour)})
+	store.SetWithOptions("expiring", []byte("v"), setOptions{expireAt: time.Now().Add(20 * time.Millisecond)})
+	for i := 0; i < 500; i++ {
+		store.RPush("list", bytes.Repeat([]byte{byte('a' + i%26)}, i%70))
+	}
+	mustDo(t, store, "GEOADD", "geo", "13.361389", "38.115556", "Palermo")
+	mustDo(t, store, "JSON.SET", "doc", "$", `{"a":[1,"x"]}`)
+	mustDo(t, store, "BF.ADD", "bf", "x")
+	mustDo(t, store, "CF.ADD", "cf", "x")
+	mustDo(t, store, "CMS.INITBYDIM", "cms", "10", "3")
+	mustDo(t, store, "TOPK.RESERVE", "topk", "3")
+	mustDo(t, store, "PFADD", "hll", "a", "b", "c")
+
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	loaded := newStore()
+	n, err := loaded.LoadRDB(filepath.Join(store.persistence.dir, defaultDBFilename))
+	if err != nil {
+		t.Fatalf("LoadRDB: %v", err)
+	}
+	keys := []string{"str", "counter", "volatile", "list", "geo", "doc", "bf", "cf", "cms", "topk", "hll"}
+	if n != len(keys) {
+		t.Errorf("expected %d keys, loaded %d", len(keys), n)
+	}
+	for _, key := range keys {
+		want, _, _ := store.Dump(key)
+		got, exists, _ := loaded.Dump(key)
+		if !exists || !bytes.Equal(got, want) {
+			t.Errorf("%s: loaded value differs", key)
+		}
+	}
+	if ttl, err := loaded.volatileKeyMap.GetTTL("volatile"); err != nil || ttl < 59*time.Minute {
+		t.Errorf("expected the TTL to survive, got %v %v", ttl, err)
+	}
+	if loaded.Exists("expiring") != 0 {
+		t.Errorf("expected a key that expired on disk to be skipped")
+	}
+}
+
+func TestLoadRDBErrors(t *testing.T) {
+	dir := t.TempDir()
+	store := newStore()
+	if n, err := store.LoadRDB(filepath.Join(dir, "missing.rdb")); n != 0 || err != nil {
+		t.Errorf("expected a missing file to load nothing, got %d %v", n, err)
+	}
+
+	var buf bytes.Buffer
+	writeRDB(&buf, []rdbEntry{{key: "k", val: []byte("v")}}, false)
+	data := buf.Bytes()
+	data[len(data)-12] ^= 0xff
+	path := filepath.Join(dir, "corrupt.rdb")
+	os.WriteFile(path, data, 0o644)
+	if _, err := store.LoadRDB(path); err == nil {
+		t.Errorf("expected a checksum error")
+	}
+
+	os.WriteFile(path, []byte("REDIS0099"), 0o644)
+	if _, err := store.LoadRDB(path); err == nil {
+		t.Errorf("expected an unsupported version error")
+	}
+}
+
+func TestBGSaveIsPointInTime(t *testing.T) {
+	store := newPersistentStore(t)
+	store.Set("before", []byte("1"))
+	if err := store.BGSave(); err != nil {
+		t.Fatalf("BGSave: %v", err)
+	}
+	store.Set("after", []byte("2"))
+	store.Set("before", []byte("changed"))
+	waitForSave(t, store)
+
+	loaded := newStore()
+	loaded.LoadRDB(filepath.Join(store.persistence.dir, defaultDBFilename))
+	if v, _ := loaded.Get("before"); string(v) != "1" {
+		t.Errorf("expected the value at BGSAVE time, got %q", v)
+	}
+	if loaded.Exists("after") != 0 {
+		t.Errorf("expected writes after BGSAVE to be excluded")
+	}
+	entries, _ := os.ReadDir(store.persistence.dir)
+	if len(entries) != 1 {
+		t.Errorf("expected only the RDB file to remain, got %v", entries)
+	}
+}
+
+// TestSnapshotCopyOnWrite checks that values changed in place while a
+// snapshot is held are copied first, so the snapshot keeps the values it
+// was taken with.
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	store := newStore()
+	store.RPush("list", []byte("a"))
+	store.Set("str", []byte("hello"))
+	mustDo(t, store, "GEOADD", "geo", "13.361389", "38.115556", "Palermo")
+	mustDo(t, store, "JSON.SET", "doc", "$", `{"a":1}`)
+	mustDo(t, store, "BF.ADD", "bf", "x")
+	mustDo(t, store, "CF.ADD", "cf", "x")
+	mustDo(t, store, "CMS.INITBYDIM", "cms", "10", "3")
+	mustDo(t, store, "TOPK.RESERVE", "topk", "3")
+	mustDo(t, store, "PFADD", "hll", "a")
+
+	entries, release := store.snapshot()
+	defer release()
+	before := map[string][]byte{}
+	for _, e := range entries {
+		before[e.key], _ = createDumpPayload(e.val)
+	}
+
+	for _, cmd := range [][]string{
+		{"RPUSH", "list", "b"}, {"SETRANGE", "str", "0", "J"}, {"SETBIT", "str", "0", "1"},
+		{"GEOADD", "geo", "15.087269", "37.502669", "Catania"}, {"JSON.SET", "doc", "$.a", "2"},
+		{"BF.ADD", "bf", "y"}, {"CF.ADD", "cf", "y"}, {"CMS.INCRBY", "cms", "x", "1"},
+		{"TOPK.ADD", "topk", "x"}, {"PFADD", "hll", "b"},
+	} {
+		mustDo(t, store, cmd...)
+	}
+	for _, e := range entries {
+		after, _ := createDumpPayload(e.val)
+		if !bytes.Equal(after, before[e.key]) {
+			t.Errorf("%s: snapshot value changed by a later write", e.key)
+		}
+		if live, _, _ := store.Dump(e.key); bytes.Equal(live, before[e.key]) {
+			t.Errorf("%s: expected the write to change the live value", e.key)
+		}
+	}
+}
+
+func TestConcurrentRDBWriters(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, name := range []string{"a.rdb", "b.rdb"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- replaceRDBFile(dir, name, func(w io.Writer) error {
+				time.Sleep(20 * time.Millisecond)
+				return writeRDB(w, []rdbEntry{{key: name, val: []byte("v")}}, false)
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("replaceRDBFile: %v", err)
+		}
+	}
+	for _, name := range []string{"a.rdb", "b.rdb"} {
+		store := newStore()
+		if n, err := store.LoadRDB(filepath.Join(dir, name)); n != 1 || err != nil || store.Exists(name) != 1 {
+			t.Errorf("%s: expected its own key, got %d %v", name, n, err)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("expected no temporary files to remain, got %v", files)
+	}
+}
+
+func TestSaveParams(t *testing.T) {
+	store := newPersistentStore(t)
+	store.persistence.mu.Lock()
+	store.persistence.saveParams, _ = parseSaveParams("60 2")
+	store.persistence.lastSave = time.Now().Add(-2 * time.Minute)
+	store.persistence.mu.Unlock()
+	store.persistence.dirty.Store(1)
+	store.checkSaveParams(time.Now())
+	waitForSave(t, store)
+	if _, err := os.Stat(filepath.Join(store.persistence.dir, defaultDBFilename)); err == nil {
+		t.Fatalf("expected no save below the change threshold")
+	}
+
+	store.persistence.dirty.Store(2)
+	store.checkSaveParams(time.Now())
+	waitForSave(t, store)
+	if _, err := os.Stat(filepath.Join(store.persistence.dir, defaultDBFilename)); err != nil {
+		t.Fatalf("expected the save rule to trigger a snapshot: %v", err)
+	}
+	if d := store.persistence.dirty.Load(); d != 0 {
+		t.Errorf("expected the dirty counter to reset, got %d", d)
+	}
+
+	for _, bad := range []string{"60", "0 1", "60 -1", "x 1"} {
+		if _, err := parseSaveParams(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+	if params, _ := parseSaveParams(defaultSaveParams); formatSaveParams(params) != defaultSaveParams {
+		t.Errorf("unexpected round trip %v", params)
+	}
+}
+
+func TestPersistenceCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+	srv.store.persistence.dir = t.TempDir()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	before := time.Now().Unix()
+	tests := []struct {
+		cmd  string
+		want parser.Value
+	}{
+		{"SET a 1", parser.SimpleString("OK")},
+		{"GET a", parser.BulkString("1")},
+		{"INCR nope nope", parser.Error("ERR wrong number of arguments for 'INCR' command")},
+		{"RPUSH l x y", parser.Integer(2)},
+		{"SAVE", parser.SimpleString("OK")},
+		{"BGSAVE NOW", parser.Error("ERR syntax error")},
+		{"BGSAVE SCHEDULE", parser.SimpleString("Background saving started")},
+		{"CONFIG SET save 1", parser.Error("ERR CONFIG SET failed (possibly related to argument 'save') - Invalid save parameters")},
+		{"CONFIG SET dbfilename a/b.rdb", parser.Error("ERR CONFIG SET failed (possibly related to argument 'dbfilename') - dbfilename can't be a path, just a filename")},
+		{"CONFIG SET dbfilename other.rdb", parser.SimpleString("OK")},
+	}
+	for _, tt := range tests {
+		resp := sendCmd(t, conn, reader, tt.cmd)
+		if bs, ok := resp.(parser.BulkString); ok {
+			if want, ok := tt.want.(parser.BulkString); !ok || string(bs) != string(want) {
+				t.Errorf("%s: expected %v, got %q", tt.cmd, tt.want, bs)
+			}
+		} else if resp != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.cmd, tt.want, resp)
+		}
+	}
+	waitForSave(t, srv.store)
+	if resp := sendCmd(t, conn, reader, "LASTSAVE").(parser.Integer); int64(resp) < before {
+		t.Errorf("expected LASTSAVE to advance, got %d", resp)
+	}
+	if _, err := os.Stat(filepath.Join(srv.store.persistence.dir, defaultDBFilename)); err != nil {
+		t.Errorf("expected SAVE to write %s: %v", defaultDBFilename, err)
+	}
+
+	sendCmd(t, conn, reader, "SET b 2")
+	sendCmd(t, conn, reader, "GET b")
+	sendCmd(t, conn, reader, "EXISTS b")
+	sendCmd(t, conn, reader, "SORT nolist")
+	if d := srv.store.persistence.dirty.Load(); d != 1 {
+		t.Errorf("expected one change since the save, got %d", d)
+	}
+}
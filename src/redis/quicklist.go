@@ -0,0 +1,475 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// quicklist is the list representation: a doubly linked list of nodes that
+// each hold a bounded run of elements, as in Redis. Pushes and pops at either
+// end touch a single node, so they are O(1) amortized, and indexed access
+// skips whole nodes. Interior nodes further than depth nodes from both ends
+// are kept LZF-compressed when depth > 0.
+type quicklist struct {
+	head, tail *quicklistNode
+	count      int
+	nodes      int
+	fill       int // list-max-listpack-size
+	depth      int // list-compress-depth
+}
+
+type quicklistNode struct {
+	prev, next *quicklistNode
+
+	// Elements live in buf[lo:hi], leaving room to grow at both ends.
+	buf    [][]byte
+	lo, hi int
+	count  int
+	size   int
+
+	// packed holds the LZF-compressed elements while the node is compressed,
+	// in which case buf is nil.
+	packed []byte
+	rawLen int
+}
+
+const (
+	listDefaultFill         = -2
+	listMaxFill             = 1 << 15
+	listEntryOverhead       = 2
+	listSizeSafetyLimit     = 8192
+	listMinCompressBytes    = 48
+	listMinCompressImprove  = 8
+	quicklistNodeInitialCap = 8
+)
+
+// listpackSizeLimits are the per-node byte budgets selected by negative fill
+// values -1 through -5.
+var listpackSizeLimits = [...]int{4096, 8192, 16384, 32768, 65536}
+
+func newQuicklist(fill, depth int) *quicklist {
+	if fill > listMaxFill {
+		fill = listMaxFill
+	} else if fill < -len(listpackSizeLimits) {
+		fill = -len(listpackSizeLimits)
+	}
+	return &quicklist{fill: fill, depth: depth}
+}
+
+// clone returns a deep copy of ql with the same fill and compress depth.
+func (ql *quicklist) clone() *quicklist {
+	c := newQuicklist(ql.fill, ql.depth)
+	ql.forEach(listLeft, func(_ int, v []byte) bool {
+		c.push(listRight, bytes.Clone(v))
+		return true
+	})
+	return c
+}
+
+func (ql *quicklist) Len() int {
+	return ql.count
+}
+
+// ---- nodes ----
+
+func (n *quicklistNode) compressed() bool {
+	return n.packed != nil
+}
+
+// entries returns the node's elements. For a compressed node it decodes a
+// temporary copy, leaving the node untouched so it is safe under a read lock.
+func (n *quicklistNode) entries() [][]byte {
+	if n.compressed() {
+		return n.unpack()
+	}
+	return n.buf[n.lo:n.hi]
+}
+
+func (n *quicklistNode) unpack() [][]byte {
+	raw, err := lzfDecompress(n.packed, n.rawLen)
+	if err != nil {
+		panic("quicklist: corrupt compressed node: " + err.Error())
+	}
+	out := make([][]byte, 0, n.count)
+	for len(raw) > 0 {
+		l, w := binary.Uvarint(raw)
+		raw = raw[w:]
+		out = append(out, raw[:l:l])
+		raw = raw[l:]
+	}
+	return out
+}
+
+func (n *quicklistNode) compress() {
+	if n.compressed() || n.size < listMinCompressBytes {
+		return
+	}
+	raw := make([]byte, 0, n.size+n.count*binary.MaxVarintLen32)
+	for _, v := range n.buf[n.lo:n.hi] {
+		raw = binary.AppendUvarint(raw, uint64(len(v)))
+		raw = append(raw, v...)
+	}
+	packed := lzfCompress(raw)
+	if packed == nil || len(raw)-len(packed) < listMinCompressImprove {
+		return
+	}
+	n.packed, n.rawLen = packed, len(raw)
+	n.buf, n.lo, n.hi = nil, 0, 0
+}
+
+func (n *quicklistNode) decompress() {
+	if !n.compressed() {
+		return
+	}
+	n.buf = n.unpack()
+	n.lo, n.hi = 0, len(n.buf)
+	n.packed, n.rawLen = nil, 0
+}
+
+// grow makes room for at least one more element before lo (front) or at hi.
+func (n *quicklistNode) grow(front bool) {
+	if front && n.lo > 0 || !front && n.hi < len(n.buf) {
+		return
+	}
+	live := n.hi - n.lo
+	newCap := 2 * live
+	if newCap < quicklistNodeInitialCap {
+		newCap = quicklistNodeInitialCap
+	}
+	buf := make([][]byte, newCap+live)
+	lo := 0
+	if front {
+		lo = newCap
+	}
+	copy(buf[lo:], n.buf[n.lo:n.hi])
+	n.buf, n.lo, n.hi = buf, lo, lo+live
+}
+
+func (n *quicklistNode) pushFront(v []byte) {
+	n.grow(true)
+	n.lo--
+	n.buf[n.lo] = v
+	n.count++
+	n.size += len(v) + listEntryOverhead
+}
+
+func (n *quicklistNode) pushBack(v []byte) {
+	n.grow(false)
+	n.buf[n.hi] = v
+	n.hi++
+	n.count++
+	n.size += len(v) + listEntryOverhead
+}
+
+func (n *quicklistNode) popFront() []byte {
+	v := n.buf[n.lo]
+	n.buf[n.lo] = nil
+	n.lo++
+	n.count--
+	n.size -= len(v) + listEntryOverhead
+	return v
+}
+
+func (n *quicklistNode) popBack() []byte {
+	n.hi--
+	v := n.buf[n.hi]
+	n.buf[n.hi] = nil
+	n.count--
+	n.size -= len(v) + listEntryOverhead
+	return v
+}
+
+// allowInsert reports whether v fits in n under the fill policy. Oversized
+// elements always get a node of their own.
+func (ql *quicklist) allowInsert(n *quicklistNode, v []byte) bool {
+	if n == nil {
+		return false
+	}
+	if n.count == 0 {
+		return true
+	}
+	newSize := n.size + len(v) + listEntryOverhead
+	if ql.fill > 0 {
+		return n.count < ql.fill && newSize <= listSizeSafetyLimit
+	}
+	return newSize <= listpackSizeLimits[-ql.fill-1]
+}
+
+func (ql *quicklist) linkAfter(at, n *quicklistNode) {
+	n.prev = at
+	if at == nil {
+		n.next = ql.head
+		ql.head = n
+	} else {
+		n.next = at.next
+		at.next = n
+	}
+	if n.next != nil {
+		n.next.prev = n
+	} else {
+		ql.tail = n
+	}
+	ql.nodes++
+}
+
+func (ql *quicklist) unlink(n *quicklistNode) {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		ql.head = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		ql.tail = n.prev
+	}
+	n.prev, n.next = nil, nil
+	ql.nodes--
+}
+
+// ---- compression ----
+
+// compressEnds keeps the depth nodes at each end uncompressed and compresses
+// the first interior node next to them, which is the only node whose state
+// can change after an operation at the ends.
+func (ql *quicklist) compressEnds() {
+	if ql.depth <= 0 || ql.nodes < ql.depth*2+1 {
+		if ql.depth > 0 {
+			for n := ql.head; n != nil; n = n.next {
+				n.decompress()
+			}
+		}
+		return
+	}
+	fwd, rev := ql.head, ql.tail
+	for i := 0; i < ql.depth; i++ {
+		fwd.decompress()
+		rev.decompress()
+		fwd, rev = fwd.next, rev.prev
+	}
+	fwd.compress()
+	rev.compress()
+}
+
+// recompress compresses n again after it was expanded for modification, if
+// it lies in the compressed interior.
+func (ql *quicklist) recompress(n *quicklistNode) {
+	if ql.depth <= 0 {
+		return
+	}
+	fwd, rev := ql.head, ql.tail
+	for i := 0; i < ql.depth && fwd != nil; i++ {
+		if fwd == n || rev == n {
+			return
+		}
+		fwd, rev = fwd.next, rev.prev
+	}
+	n.compress()
+}
+
+// ---- list operations ----
+
+func (ql *quicklist) push(where listWhere, v []byte) {
+	if where == listLeft {
+		if ql.allowInsert(ql.head, v) {
+			ql.head.decompress()
+			ql.head.pushFront(v)
+		} else {
+			n := &quicklistNode{}
+			n.pushFront(v)
+			ql.linkAfter(nil, n)
+		}
+	} else {
+		if ql.allowInsert(ql.tail, v) {
+			ql.tail.decompress()
+			ql.tail.pushBack(v)
+		} else {
+			n := &quicklistNode{}
+			n.pushBack(v)
+			ql.linkAfter(ql.tail, n)
+		}
+	}
+	ql.count++
+	ql.compressEnds()
+}
+
+func (ql *quicklist) pop(where listWhere) []byte {
+	if ql.count == 0 {
+		return nil
+	}
+	var v []byte
+	n := ql.head
+	if where == listLeft {
+		n.decompress()
+		v = n.popFront()
+	} else {
+		n = ql.tail
+		n.decompress()
+		v = n.popBack()
+	}
+	if n.count == 0 {
+		ql.unlink(n)
+	}
+	ql.count--
+	ql.compressEnds()
+	return v
+}
+
+// locate returns the node holding element i and i's offset inside it,
+// walking from whichever end is closer.
+func (ql *quicklist) locate(i int) (*quicklistNode, int) {
+	if i < ql.count/2 {
+		for n := ql.head; n != nil; n = n.next {
+			if i < n.count {
+				return n, i
+			}
+			i -= n.count
+		}
+		return nil, 0
+	}
+	i = ql.count - 1 - i
+	for n := ql.tail; n != nil; n = n.prev {
+		if i < n.count {
+			return n, n.count - 1 - i
+		}
+		i -= n.count
+	}
+	return nil, 0
+}
+
+// index returns element i, which must be in range.
+func (ql *quicklist) index(i int) []byte {
+	n, off := ql.locate(i)
+	if n.compressed() {
+		return n.entries()[off]
+	}
+	return n.buf[n.lo+off]
+}
+
+// slice returns a copy of elements start through stop inclusive, which must
+// be in range.
+func (ql *quicklist) slice(start, stop int) [][]byte {
+	result := make([][]byte, 0, stop-start+1)
+	n, off := ql.locate(start)
+	for ; n != nil && len(result) < cap(result); n, off = n.next, 0 {
+		entries := n.entries()[off:]
+		if rest := cap(result) - len(result); len(entries) > rest {
+			entries = entries[:rest]
+		}
+		result = append(result, entries...)
+	}
+	return result
+}
+
+// replace overwrites element i, which must be in range.
+func (ql *quicklist) replace(i int, v []byte) {
+	n, off := ql.locate(i)
+	n.decompress()
+	old := n.buf[n.lo+off]
+	n.buf[n.lo+off] = v
+	n.size += len(v) - len(old)
+	ql.recompress(n)
+}
+
+// insert places v so that it becomes element i, for 0 <= i <= Len(). A full
+// node is split at the insertion point.
+func (ql *quicklist) insert(i int, v []byte) {
+	if i == 0 {
+		ql.push(listLeft, v)
+		return
+	}
+	if i == ql.count {
+		ql.push(listRight, v)
+		return
+	}
+	n, off := ql.locate(i)
+	n.decompress()
+	if ql.allowInsert(n, v) {
+		n.grow(false)
+		copy(n.buf[n.lo+off+1:n.hi+1], n.buf[n.lo+off:n.hi])
+		n.buf[n.lo+off] = v
+		n.hi++
+		n.count++
+		n.size += len(v) + listEntryOverhead
+		ql.count++
+		ql.recompress(n)
+		return
+	}
+
+	right := &quicklistNode{}
+	for _, e := range n.buf[n.lo+off : n.hi] {
+		right.pushBack(e)
+	}
+	for n.count > off {
+		n.popBack()
+	}
+	ql.linkAfter(n, right)
+	switch {
+	case ql.allowInsert(n, v):
+		n.pushBack(v)
+	case ql.allowInsert(right, v):
+		right.pushFront(v)
+	default:
+		mid := &quicklistNode{}
+		mid.pushBack(v)
+		ql.linkAfter(n, mid)
+	}
+	ql.count++
+	ql.compressEnds()
+	ql.recompress(n)
+	ql.recompress(right)
+}
+
+// trim removes count elements from one end, dropping whole nodes where
+// possible.
+func (ql *quicklist) trim(where listWhere, count int) {
+	for count > 0 && ql.count > 0 {
+		n := ql.head
+		if where == listRight {
+			n = ql.tail
+		}
+		if n.count <= count {
+			count -= n.count
+			ql.count -= n.count
+			ql.unlink(n)
+			continue
+		}
+		n.decompress()
+		for ; count > 0; count-- {
+			if where == listLeft {
+				n.popFront()
+			} else {
+				n.popBack()
+			}
+			ql.count--
+		}
+	}
+	ql.compressEnds()
+}
+
+// forEach calls fn with each element and its index, from the head or, for
+// listRight, from the tail, until fn returns false.
+func (ql *quicklist) forEach(from listWhere, fn func(i int, v []byte) bool) {
+	if from == listLeft {
+		i := 0
+		for n := ql.head; n != nil; n = n.next {
+			for _, v := range n.entries() {
+				if !fn(i, v) {
+					return
+				}
+				i++
+			}
+		}
+		return
+	}
+	i := ql.count - 1
+	for n := ql.tail; n != nil; n = n.prev {
+		entries := n.entries()
+		for j := len(entries) - 1; j >= 0; j-- {
+			if !fn(i, entries[j]) {
+				return
+			}
+			i--
+		}
+	}
+}
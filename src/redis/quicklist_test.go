@@ -0,0 +1,304 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"pgregory.net/rapid"
+)
+
+func quicklistElems(ql *quicklist) []string {
+	out := []string{}
+	ql.forEach(listLeft, func(_ int, v []byte) bool {
+		out = append(out, string(v))
+		return true
+	})
+	return out
+}
+
+// checkQuicklist verifies the node links, counts and compression invariant.
+func checkQuicklist(t interface{ Fatalf(string, ...any) }, ql *quicklist) {
+	count, nodes := 0, 0
+	var prev *quicklistNode
+	for n := ql.head; n != nil; n = n.next {
+		if n.prev != prev {
+			t.Fatalf("broken prev link at node %d", nodes)
+		}
+		if n.count == 0 {
+			t.Fatalf("empty node %d left in list", nodes)
+		}
+		if len(n.entries()) != n.count {
+			t.Fatalf("node %d count %d, has %d entries", nodes, n.count, len(n.entries()))
+		}
+		count += n.count
+		nodes++
+		prev = n
+	}
+	if prev != ql.tail {
+		t.Fatalf("tail does not match last node")
+	}
+	if count != ql.count || nodes != ql.nodes {
+		t.Fatalf("expected %d elements in %d nodes, counted %d in %d", ql.count, ql.nodes, count, nodes)
+	}
+	i := 0
+	for n := ql.head; n != nil; n, i = n.next, i+1 {
+		if (i < ql.depth || i >= nodes-ql.depth) && n.compressed() {
+			t.Fatalf("node %d within compress depth %d is compressed", i, ql.depth)
+		}
+	}
+}
+
+func TestQuicklistPushPopBothEnds(t *testing.T) {
+	ql := newQuicklist(4, 0)
+	for i := 0; i < 10; i++ {
+		ql.push(listRight, []byte(strconv.Itoa(i)))
+	}
+	ql.push(listLeft, []byte("L"))
+	checkQuicklist(t, ql)
+	if ql.nodes < 3 {
+		t.Errorf("expected fill 4 to split 11 elements over several nodes, got %d", ql.nodes)
+	}
+	if v := ql.pop(listLeft); string(v) != "L" {
+		t.Errorf("expected 'L', got %q", v)
+	}
+	if v := ql.pop(listRight); string(v) != "9" {
+		t.Errorf("expected '9', got %q", v)
+	}
+	checkQuicklist(t, ql)
+	if got := strings.Join(quicklistElems(ql), ","); got != "0,1,2,3,4,5,6,7,8" {
+		t.Errorf("unexpected contents %s", got)
+	}
+}
+
+func TestQuicklistSizeBasedFill(t *testing.T) {
+	ql := newQuicklist(-1, 0)
+	elem := bytes.Repeat([]byte("x"), 1000)
+	for i := 0; i < 10; i++ {
+		ql.push(listRight, elem)
+	}
+	checkQuicklist(t, ql)
+	for n := ql.head; n != nil; n = n.next {
+		if n.count > 1 && n.size > listpackSizeLimits[0] {
+			t.Errorf("node of %d bytes exceeds the 4kb limit", n.size)
+		}
+	}
+
+	big := bytes.Repeat([]byte("y"), 10000)
+	ql.push(listLeft, big)
+	if ql.head.count != 1 {
+		t.Errorf("expected oversized element in its own node, node has %d", ql.head.count)
+	}
+}
+
+func TestQuicklistCompressesInteriorNodes(t *testing.T) {
+	ql := newQuicklist(4, 1)
+	for i := 0; i < 40; i++ {
+		ql.push(listRight, []byte(fmt.Sprintf("element-%04d-padding-padding", i)))
+	}
+	checkQuicklist(t, ql)
+	compressed := 0
+	for n := ql.head; n != nil; n = n.next {
+		if n.compressed() {
+			compressed++
+		}
+	}
+	if compressed == 0 {
+		t.Fatal("expected interior nodes to be compressed")
+	}
+	if v := ql.index(20); string(v) != "element-0020-padding-padding" {
+		t.Errorf("unexpected element %q", v)
+	}
+	got := ql.slice(5, 30)
+	for i, v := range got {
+		if want := fmt.Sprintf("element-%04d-padding-padding", i+5); string(v) != want {
+			t.Fatalf("index %d: expected %q, got %q", i+5, want, v)
+		}
+	}
+}
+
+func TestQuicklistInsertSplitsFullNode(t *testing.T) {
+	ql := newQuicklist(3, 0)
+	for _, v := range []string{"a", "b", "c", "d", "e", "f"} {
+		ql.push(listRight, []byte(v))
+	}
+	ql.insert(1, []byte("X"))
+	ql.insert(5, []byte("Y"))
+	checkQuicklist(t, ql)
+	if got := strings.Join(quicklistElems(ql), ""); got != "aXbcdYef" {
+		t.Errorf("unexpected contents %s", got)
+	}
+}
+
+func TestQuicklistTrim(t *testing.T) {
+	ql := newQuicklist(2, 1)
+	for i := 0; i < 11; i++ {
+		ql.push(listRight, []byte(strconv.Itoa(i)))
+	}
+	ql.trim(listLeft, 3)
+	ql.trim(listRight, 4)
+	checkQuicklist(t, ql)
+	if got := strings.Join(quicklistElems(ql), ","); got != "3,4,5,6" {
+		t.Errorf("unexpected contents %s", got)
+	}
+}
+
+func TestStoreListCompressDepthConfig(t *testing.T) {
+	store := newStore()
+	store.listMaxListpackSize = 2
+	store.listCompressDepth = 1
+	for i := 0; i < 20; i++ {
+		store.RPush("mylist", []byte(fmt.Sprintf("value-%02d-with-enough-bytes-to-compress", i)))
+	}
+	list := store.data["mylist"].(*quicklist)
+	if list.fill != 2 || list.depth != 1 {
+		t.Fatalf("expected list to pick up fill 2 depth 1, got %d %d", list.fill, list.depth)
+	}
+	checkQuicklist(t, list)
+	result, _ := store.LRange("mylist", 0, -1)
+	if len(result) != 20 || string(result[19]) != "value-19-with-enough-bytes-to-compress" {
+		t.Errorf("unexpected LRANGE result %q", result)
+	}
+}
+
+// Feature: quicklist, Property: every operation matches a plain slice model
+func TestPropertyQuicklistMatchesSliceModel(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		fill := rapid.SampledFrom([]int{1, 2, 3, 5, -1}).Draw(t, "fill")
+		depth := rapid.IntRange(0, 2).Draw(t, "depth")
+		ql := newQuicklist(fill, depth)
+		var model [][]byte
+
+		elem := rapid.Custom(func(t *rapid.T) []byte {
+			n := rapid.IntRange(1, 60).Draw(t, "n")
+			return bytes.Repeat([]byte(rapid.StringN(1, 1, 1).Draw(t, "c")), n)
+		})
+
+		steps := rapid.IntRange(1, 200).Draw(t, "steps")
+		for s := 0; s < steps; s++ {
+			switch op := rapid.IntRange(0, 6).Draw(t, "op"); op {
+			case 0:
+				v := elem.Draw(t, "v")
+				ql.push(listLeft, v)
+				model = append([][]byte{v}, model...)
+			case 1:
+				v := elem.Draw(t, "v")
+				ql.push(listRight, v)
+				model = append(model, v)
+			case 2:
+				if len(model) == 0 {
+					continue
+				}
+				if v := ql.pop(listLeft); !bytes.Equal(v, model[0]) {
+					t.Fatalf("pop left: expected %q, got %q", model[0], v)
+				}
+				model = model[1:]
+			case 3:
+				if len(model) == 0 {
+					continue
+				}
+				if v := ql.pop(listRight); !bytes.Equal(v, model[len(model)-1]) {
+					t.Fatalf("pop right: expected %q, got %q", model[len(model)-1], v)
+				}
+				model = model[:len(model)-1]
+			case 4:
+				i := rapid.IntRange(0, len(model)).Draw(t, "i")
+				v := elem.Draw(t, "v")
+				ql.insert(i, v)
+				model = append(model[:i], append([][]byte{v}, model[i:]...)...)
+			case 5:
+				if len(model) == 0 {
+					continue
+				}
+				i := rapid.IntRange(0, len(model)-1).Draw(t, "i")
+				v := elem.Draw(t, "v")
+				ql.replace(i, v)
+				model[i] = v
+			case 6:
+				n := rapid.IntRange(0, len(model)).Draw(t, "n")
+				if rapid.Bool().Draw(t, "left") {
+					ql.trim(listLeft, n)
+					model = model[n:]
+				} else {
+					ql.trim(listRight, n)
+					model = model[:len(model)-n]
+				}
+			}
+			checkQuicklist(t, ql)
+		}
+
+		if ql.Len() != len(model) {
+			t.Fatalf("expected length %d, got %d", len(model), ql.Len())
+		}
+		for i := range model {
+			if !bytes.Equal(ql.index(i), model[i]) {
+				t.Fatalf("index %d mismatch", i)
+			}
+		}
+		if len(model) > 0 {
+			start := rapid.IntRange(0, len(model)-1).Draw(t, "start")
+			stop := rapid.IntRange(start, len(model)-1).Draw(t, "stop")
+			got := ql.slice(start, stop)
+			for i := range got {
+				if !bytes.Equal(got[i], model[start+i]) {
+					t.Fatalf("slice mismatch at %d", start+i)
+				}
+			}
+		}
+	})
+}
+
+// ==================== Benchmarks ====================
+
+func BenchmarkStoreLPush(b *testing.B) {
+	store := newStore()
+	elem := []byte("element")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		store.LPush("list", elem)
+	}
+}
+
+func BenchmarkStoreRPush(b *testing.B) {
+	store := newStore()
+	elem := []byte("element")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		store.RPush("list", elem)
+	}
+}
+
+func benchmarkStoreWithList(b *testing.B, n int) *Store {
+	store := newStore()
+	for i := 0; i < n; i++ {
+		store.RPush("list", []byte(strconv.Itoa(i)))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	return store
+}
+
+func BenchmarkStoreLPushLPop(b *testing.B) {
+	store := benchmarkStoreWithList(b, 100000)
+	elem := []byte("element")
+	for i := 0; i < b.N; i++ {
+		store.LPush("list", elem)
+		store.LPop("list", 1)
+	}
+}
+
+func BenchmarkStoreLIndexMiddle(b *testing.B) {
+	store := benchmarkStoreWithList(b, 100000)
+	for i := 0; i < b.N; i++ {
+		store.LIndex("list", 50000)
+	}
+}
+
+func BenchmarkStoreLRange100(b *testing.B) {
+	store := benchmarkStoreWithList(b, 100000)
+	for i := 0; i < b.N; i++ {
+		store.LRange("list", 50000, 50099)
+	}
+}
@@ -0,0 +1,927 @@
+package redis
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"runtime/metrics"
+	"strconv"
+	"time"
+)
+
+// RDB serialization of single values, shared by DUMP/RESTORE and snapshot
+// files. Values are written the way Redis 7.2 writes them; module types use
+// the names of the Redis modules they emulate. Reading also accepts the
+// encodings of older Redis versions and of Redis 7.4, whose format version
+// is 12. Types this server has no equivalent for, such as sets, hashes and
+// streams, are parsed and skipped.
+const (
+	rdbVersion    = 11
+	rdbMaxVersion = 12
+
+	// rdbRedisVersion is the Redis version whose files are written, as
+	// reported in their redis-ver aux field.
+	rdbRedisVersion = "7.2.0"
+
+	rdbTypeString              = 0
+	rdbTypeList                = 1
+	rdbTypeSet                 = 2
+	rdbTypeZset                = 3
+	rdbTypeHash                = 4
+	rdbTypeZset2               = 5
+	rdbTypeModule2             = 7
+	rdbTypeHashZipmap          = 9
+	rdbTypeListZiplist         = 10
+	rdbTypeSetIntset           = 11
+	rdbTypeZsetZiplist         = 12
+	rdbTypeHashZiplist         = 13
+	rdbTypeListQuicklist       = 14
+	rdbTypeStreamListpacks     = 15
+	rdbTypeHashListpack        = 16
+	rdbTypeZsetListpack        = 17
+	rdbTypeListQuicklist2      = 18
+	rdbTypeStreamListpacks2    = 19
+	rdbTypeSetListpack         = 20
+	rdbTypeStreamListpacks3    = 21
+	rdbTypeHashMetadataPreGA   = 22
+	rdbTypeHashListpackExPreGA = 23
+	rdbTypeHashMetadata        = 24
+	rdbTypeHashListpackEx      = 25
+
+	// Special string encodings, flagged by the top two bits of the length.
+	rdbEncVal   = 3
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSInt   = 1
+	rdbModuleOpcodeUInt   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+
+	quicklistNodeContainerPlain  = 1
+	quicklistNodeContainerPacked = 2
+)
+
+var (
+	errRDBCorrupt  = errors.New("corrupt RDB value")
+	errRDBEmptyKey = errors.New("empty keys are not allowed in RDB values")
+)
+
+// rdbUnsupportedError reports a value of a type this server cannot hold.
+// The value has been read in full, so a load that skips such keys can
+// continue with the next one.
+type rdbUnsupportedError struct {
+	what string
+}
+
+func (e *rdbUnsupportedError) Error() string {
+	return "unsupported value type " + e.what
+}
+
+// Module type names for the probabilistic types. Their payload is this
+// server's own encoding of the structure, not RedisBloom's, so they are
+// written under names of their own: Redis with RedisBloom refuses these
+// values rather than misreading them, and RedisBloom values are not taken
+// for these.
+const (
+	rdbModuleBloom  = "goredisBF"
+	rdbModuleCuckoo = "goredisCF"
+	rdbModuleCMS    = "goredisCM"
+	rdbModuleTopK   = "goredisTK"
+)
+
+// rdbModuleTypes are the module type names and encoding versions written for
+// module values. JSON documents are stored as their text, as RedisJSON does.
+var rdbModuleTypes = map[string]uint64{
+	"ReJSON-RL":     3,
+	rdbModuleBloom:  0,
+	rdbModuleCuckoo: 0,
+	rdbModuleCMS:    0,
+	rdbModuleTopK:   1,
+}
+
+// moduleTypeCharset is the alphabet of the 9 character module type names
+// packed, 6 bits each, into the top 54 bits of a module id.
+const moduleTypeCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+func moduleTypeID(name string, encver uint64) uint64 {
+	var id uint64
+	for i := 0; i < len(name); i++ {
+		for j := 0; j < len(moduleTypeCharset); j++ {
+			if moduleTypeCharset[j] == name[i] {
+				id = id<<6 | uint64(j)
+				break
+			}
+		}
+	}
+	return id<<10 | encver
+}
+
+func moduleTypeName(id uint64) string {
+	name := make([]byte, 9)
+	id >>= 10
+	for i := 8; i >= 0; i-- {
+		name[i] = moduleTypeCharset[id&63]
+		id >>= 6
+	}
+	return string(name)
+}
+
+func rdbAppendLen(dst []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(dst, byte(n))
+	case n < 1<<14:
+		return append(dst, 1<<6|byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, 0x80), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, 0x81), n)
+	}
+}
+
+// rdbAppendString writes s as an integer when it is a short canonical
+// number that fits 32 bits, LZF-compressed when that saves space, and raw
+// otherwise.
+func rdbAppendString(dst []byte, s []byte) []byte {
+	if len(s) <= 11 {
+		if n, ok := stringInt(s); ok && n >= math.MinInt32 && n <= math.MaxInt32 {
+			return rdbAppendInt(dst, n)
+		}
+	}
+	if len(s) > 20 {
+		if packed := lzfCompress(s); packed != nil && len(packed) <= len(s)-4 {
+			dst = append(dst, rdbEncVal<<6|rdbEncLZF)
+			dst = rdbAppendLen(dst, uint64(len(packed)))
+			dst = rdbAppendLen(dst, uint64(len(s)))
+			return append(dst, packed...)
+		}
+	}
+	dst = rdbAppendLen(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func rdbAppendInt(dst []byte, n int64) []byte {
+	switch {
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(dst, rdbEncVal<<6|rdbEncInt8, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return binary.LittleEndian.AppendUint16(append(dst, rdbEncVal<<6|rdbEncInt16), uint16(n))
+	default:
+		return binary.LittleEndian.AppendUint32(append(dst, rdbEncVal<<6|rdbEncInt32), uint32(n))
+	}
+}
+
+// rdbObjectType returns the RDB type byte that val is written with.
+func rdbObjectType(val interface{}) (byte, error) {
+	switch val.(type) {
+	case []byte, int64:
+		return rdbTypeString, nil
+	case *quicklist:
+		return rdbTypeListQuicklist2, nil
+	case *zset:
+		return rdbTypeZset2, nil
+	case *jsonDoc, *bloomFilter, *cuckooFilter, *countMinSketch, *topK:
+		return rdbTypeModule2, nil
+	default:
+		return 0, fmt.Errorf("cannot serialize value of type %T", val)
+	}
+}
+
+// rdbAppendValue writes the serialized form of val, which must be of a type
+// rdbObjectType accepts.
+func rdbAppendValue(dst []byte, val interface{}) []byte {
+	switch v := val.(type) {
+	case []byte:
+		return rdbAppendString(dst, v)
+	case int64:
+		return rdbAppendString(dst, []byte(strconv.FormatInt(v, 10)))
+	case *quicklist:
+		dst = rdbAppendLen(dst, uint64(v.nodes))
+		for n := v.head; n != nil; n = n.next {
+			dst = rdbAppendLen(dst, quicklistNodeContainerPacked)
+			dst = rdbAppendString(dst, encodeListpack(n.entries()))
+		}
+		return dst
+	case *zset:
+		// Written from the highest score down, like Redis, so that loading
+		// inserts each member at the head of the skiplist.
+		dst = rdbAppendLen(dst, uint64(v.Len()))
+		for x := v.zsl.tail; x != nil; x = x.backward {
+			dst = rdbAppendString(dst, []byte(x.member))
+			dst = binary.LittleEndian.AppendUint64(dst, math.Float64bits(x.score))
+		}
+		return dst
+	case *jsonDoc:
+		return rdbAppendModule(dst, "ReJSON-RL", appendJSON(nil, v.root, jsonFormat{}, 0))
+	case *bloomFilter:
+		return rdbAppendModule(dst, rdbModuleBloom, v.encode())
+	case *cuckooFilter:
+		return rdbAppendModule(dst, rdbModuleCuckoo, v.encode())
+	case *countMinSketch:
+		return rdbAppendModule(dst, rdbModuleCMS, v.encode())
+	case *topK:
+		return rdbAppendModule(dst, rdbModuleTopK, v.encode())
+	default:
+		panic(fmt.Sprintf("rdbAppendValue: unsupported type %T", val))
+	}
+}
+
+func rdbAppendModule(dst []byte, name string, payload []byte) []byte {
+	dst = rdbAppendLen(dst, moduleTypeID(name, rdbModuleTypes[name]))
+	dst = rdbAppendLen(dst, rdbModuleOpcodeString)
+	dst = rdbAppendString(dst, payload)
+	return rdbAppendLen(dst, rdbModuleOpcodeEOF)
+}
+
+// rdbReader decodes RDB data from memory. The first error sticks; later
+// reads return zero values.
+type rdbReader struct {
+	b   []byte
+	err error
+
+	// List settings for the lists being loaded.
+	fill, depth int
+}
+
+func (r *rdbReader) fail() {
+	if r.err == nil {
+		r.err = errRDBCorrupt
+	}
+}
+
+func (r *rdbReader) readByte() byte {
+	if r.err != nil || len(r.b) < 1 {
+		r.fail()
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *rdbReader) read(n uint64) []byte {
+	if r.err != nil || uint64(len(r.b)) < n {
+		r.fail()
+		return nil
+	}
+	v := r.b[:n:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// loadLen reads a length, reporting whether it is instead one of the
+// special string encodings.
+func (r *rdbReader) loadLen() (uint64, bool) {
+	c := r.readByte()
+	switch c >> 6 {
+	case 0:
+		return uint64(c & 0x3f), false
+	case 1:
+		return uint64(c&0x3f)<<8 | uint64(r.readByte()), false
+	case 2:
+		switch c {
+		case 0x80:
+			if b := r.read(4); b != nil {
+				return uint64(binary.BigEndian.Uint32(b)), false
+			}
+		case 0x81:
+			if b := r.read(8); b != nil {
+				return binary.BigEndian.Uint64(b), false
+			}
+		default:
+			r.fail()
+		}
+		return 0, false
+	default:
+		return uint64(c & 0x3f), true
+	}
+}
+
+func (r *rdbReader) loadString() []byte {
+	n, encoded := r.loadLen()
+	if !encoded {
+		return r.read(n)
+	}
+	switch n {
+	case rdbEncInt8:
+		return []byte(strconv.Itoa(int(int8(r.readByte()))))
+	case rdbEncInt16:
+		if b := r.read(2); b != nil {
+			return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))))
+		}
+	case rdbEncInt32:
+		if b := r.read(4); b != nil {
+			return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))))
+		}
+	case rdbEncLZF:
+		clen, _ := r.loadLen()
+		ulen, _ := r.loadLen()
+		packed := r.read(clen)
+		// A 3 byte back reference expands to at most lzfMaxRef bytes, which
+		// bounds the allocation for a corrupt length.
+		if r.err != nil || ulen > clen*lzfMaxRef {
+			r.fail()
+			return nil
+		}
+		s, err := lzfDecompress(packed, int(ulen))
+		if err != nil {
+			r.fail()
+			return nil
+		}
+		return s
+	default:
+		r.fail()
+	}
+	return nil
+}
+
+func (r *rdbReader) loadBinaryDouble() float64 {
+	if b := r.read(8); b != nil {
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+// loadTextDouble reads the length-prefixed decimal scores of the original
+// zset encoding.
+func (r *rdbReader) loadTextDouble() float64 {
+	switch n := r.readByte(); n {
+	case 253:
+		return math.NaN()
+	case 254:
+		return math.Inf(1)
+	case 255:
+		return math.Inf(-1)
+	default:
+		f, err := strconv.ParseFloat(string(r.read(uint64(n))), 64)
+		if err != nil {
+			r.fail()
+		}
+		return f
+	}
+}
+
+// loadObject reads a value of the given RDB type. Values of types without
+// an equivalent here are read past and reported with an
+// *rdbUnsupportedError.
+func (r *rdbReader) loadObject(typ byte) (interface{}, error) {
+	var val interface{}
+	switch typ {
+	case rdbTypeString:
+		s := r.loadString()
+		if s == nil {
+			s = []byte{}
+		}
+		val = s
+	case rdbTypeList:
+		ql := newQuicklist(r.fill, r.depth)
+		n, _ := r.loadLen()
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			ql.push(listRight, r.loadString())
+		}
+		val = ql
+	case rdbTypeListZiplist:
+		ql := newQuicklist(r.fill, r.depth)
+		r.pushPacked(ql, decodeZiplist)
+		val = ql
+	case rdbTypeListQuicklist:
+		ql := newQuicklist(r.fill, r.depth)
+		n, _ := r.loadLen()
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			r.pushPacked(ql, decodeZiplist)
+		}
+		val = ql
+	case rdbTypeListQuicklist2:
+		ql := newQuicklist(r.fill, r.depth)
+		n, _ := r.loadLen()
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			switch container, _ := r.loadLen(); container {
+			case quicklistNodeContainerPlain:
+				if data := r.loadString(); r.err == nil {
+					ql.push(listRight, data)
+				}
+			case quicklistNodeContainerPacked:
+				r.pushPacked(ql, decodeListpack)
+			default:
+				r.fail()
+			}
+		}
+		val = ql
+	case rdbTypeZset, rdbTypeZset2:
+		z := newZset()
+		n, _ := r.loadLen()
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			member := string(r.loadString())
+			var score float64
+			if typ == rdbTypeZset2 {
+				score = r.loadBinaryDouble()
+			} else {
+				score = r.loadTextDouble()
+			}
+			if math.IsNaN(score) {
+				r.fail()
+			}
+			if added, _ := z.add(member, score, zaddFlags{}); !added {
+				r.fail()
+			}
+		}
+		val = z
+	case rdbTypeZsetZiplist:
+		val = r.loadPackedZset(decodeZiplist)
+	case rdbTypeZsetListpack:
+		val = r.loadPackedZset(decodeListpack)
+	case rdbTypeModule2:
+		return r.loadModule()
+	case rdbTypeSet, rdbTypeHash, rdbTypeHashMetadata, rdbTypeHashMetadataPreGA:
+		r.skipCollection(typ)
+		return nil, r.unsupported(typ)
+	case rdbTypeHashListpackEx:
+		r.read(8) // minimum field expiry time
+		fallthrough
+	case rdbTypeHashZipmap, rdbTypeSetIntset, rdbTypeHashZiplist, rdbTypeHashListpack,
+		rdbTypeSetListpack, rdbTypeHashListpackExPreGA:
+		r.loadString()
+		return nil, r.unsupported(typ)
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		r.skipStream(typ)
+		return nil, r.unsupported(typ)
+	default:
+		return nil, fmt.Errorf("unknown RDB value type %d", typ)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	switch v := val.(type) {
+	case *quicklist:
+		if v.Len() == 0 {
+			return nil, errRDBEmptyKey
+		}
+	case *zset:
+		if v.Len() == 0 {
+			return nil, errRDBEmptyKey
+		}
+	}
+	return val, nil
+}
+
+// pushPacked reads a ziplist or listpack string and appends its entries to
+// ql.
+func (r *rdbReader) pushPacked(ql *quicklist, decode func([]byte) ([][]byte, error)) {
+	data := r.loadString()
+	if r.err != nil {
+		return
+	}
+	entries, err := decode(data)
+	if err != nil {
+		r.fail()
+		return
+	}
+	for _, e := range entries {
+		ql.push(listRight, e)
+	}
+}
+
+// loadPackedZset reads a ziplist or listpack string of alternating members
+// and scores.
+func (r *rdbReader) loadPackedZset(decode func([]byte) ([][]byte, error)) *zset {
+	data := r.loadString()
+	if r.err != nil {
+		return nil
+	}
+	entries, err := decode(data)
+	if err != nil || len(entries)%2 != 0 {
+		r.fail()
+		return nil
+	}
+	z := newZset()
+	for i := 0; i < len(entries); i += 2 {
+		score, err := strconv.ParseFloat(string(entries[i+1]), 64)
+		if err != nil || math.IsNaN(score) {
+			r.fail()
+			return nil
+		}
+		if added, _ := z.add(string(entries[i]), score, zaddFlags{}); !added {
+			r.fail()
+			return nil
+		}
+	}
+	return z
+}
+
+func (r *rdbReader) unsupported(typ byte) error {
+	if r.err != nil {
+		return r.err
+	}
+	switch typ {
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack:
+		return &rdbUnsupportedError{what: "set"}
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return &rdbUnsupportedError{what: "stream"}
+	default:
+		return &rdbUnsupportedError{what: "hash"}
+	}
+}
+
+// skipCollection reads past a set or a hash in their unpacked encodings.
+func (r *rdbReader) skipCollection(typ byte) {
+	if typ == rdbTypeHashMetadata {
+		r.read(8) // minimum field expiry time
+	}
+	n, _ := r.loadLen()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		switch typ {
+		case rdbTypeHashMetadata:
+			r.loadLen() // field expiry time, relative to the minimum
+		case rdbTypeHashMetadataPreGA:
+			r.read(8)
+		}
+		r.loadString()
+		if typ != rdbTypeSet {
+			r.loadString()
+		}
+	}
+}
+
+// skipStream reads past a stream: its listpacks, metadata, consumer groups
+// and pending entries.
+func (r *rdbReader) skipStream(typ byte) {
+	loadID := func() { r.loadLen(); r.loadLen() }
+	n, _ := r.loadLen()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		if nodekey := r.loadString(); r.err == nil && len(nodekey) != 16 {
+			r.fail()
+		}
+		r.loadString()
+	}
+	r.loadLen() // number of entries
+	loadID()    // last id
+	if typ >= rdbTypeStreamListpacks2 {
+		loadID()    // first id
+		loadID()    // max deleted entry id
+		r.loadLen() // entries added
+	}
+	groups, _ := r.loadLen()
+	for i := uint64(0); i < groups && r.err == nil; i++ {
+		r.loadString()
+		loadID()
+		if typ >= rdbTypeStreamListpacks2 {
+			r.loadLen() // entries read
+		}
+		pending, _ := r.loadLen()
+		for j := uint64(0); j < pending && r.err == nil; j++ {
+			r.read(16 + 8) // id and delivery time
+			r.loadLen()    // delivery count
+		}
+		consumers, _ := r.loadLen()
+		for j := uint64(0); j < consumers && r.err == nil; j++ {
+			r.loadString()
+			r.read(8) // seen time
+			if typ >= rdbTypeStreamListpacks3 {
+				r.read(8) // active time
+			}
+			owned, _ := r.loadLen()
+			if owned > uint64(len(r.b))/16 {
+				r.fail()
+			}
+			r.read(16 * owned)
+		}
+	}
+}
+
+// skipModuleValue reads past module data serialized with the typed opcodes
+// of RDB_TYPE_MODULE_2, up to and including the EOF opcode.
+func (r *rdbReader) skipModuleValue() {
+	for r.err == nil {
+		switch op, _ := r.loadLen(); op {
+		case rdbModuleOpcodeEOF:
+			return
+		case rdbModuleOpcodeSInt, rdbModuleOpcodeUInt:
+			r.loadLen()
+		case rdbModuleOpcodeFloat:
+			r.read(4)
+		case rdbModuleOpcodeDouble:
+			r.read(8)
+		case rdbModuleOpcodeString:
+			r.loadString()
+		default:
+			r.fail()
+		}
+	}
+}
+
+// loadModule reads a module value. Values of other modules, or written by
+// other versions of the emulated ones, are skipped.
+func (r *rdbReader) loadModule() (interface{}, error) {
+	id, _ := r.loadLen()
+	name := moduleTypeName(id)
+	encver, known := rdbModuleTypes[name]
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !known || id&1023 != encver {
+		r.skipModuleValue()
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, &rdbUnsupportedError{what: fmt.Sprintf("%s version %d", name, id&1023)}
+	}
+	if op, _ := r.loadLen(); op != rdbModuleOpcodeString {
+		r.fail()
+	}
+	payload := r.loadString()
+	if op, _ := r.loadLen(); op != rdbModuleOpcodeEOF {
+		r.fail()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	var val interface{}
+	var err error
+	switch name {
+	case "ReJSON-RL":
+		var root interface{}
+		root, err = parseJSON(string(payload))
+		val = &jsonDoc{root: root}
+	case rdbModuleBloom:
+		val, err = decodeBloomFilter(payload)
+	case rdbModuleCuckoo:
+		val, err = decodeCuckooFilter(payload)
+	case rdbModuleCMS:
+		val, err = decodeCountMinSketch(payload)
+	case rdbModuleTopK:
+		val, err = decodeTopK(payload)
+	}
+	if err != nil {
+		return nil, errRDBCorrupt
+	}
+	return val, nil
+}
+
+// RDB file opcodes, which share the byte space with value types.
+const (
+	rdbOpcodeSlotInfo      = 244
+	rdbOpcodeFunction2     = 245
+	rdbOpcodeFunctionPreGA = 246
+	rdbOpcodeModuleAux     = 247
+	rdbOpcodeIdle          = 248
+	rdbOpcodeFreq          = 249
+	rdbOpcodeAux           = 250
+	rdbOpcodeResizeDB      = 251
+	rdbOpcodeExpireTimeMS  = 252
+	rdbOpcodeExpireTime    = 253
+	rdbOpcodeSelectDB      = 254
+	rdbOpcodeEOF           = 255
+)
+
+// rdbEntry is one key of a snapshot. expireAt is zero for keys without a
+// TTL.
+type rdbEntry struct {
+	key      string
+	val      interface{}
+	expireAt time.Time
+}
+
+func rdbAppendAux(dst []byte, key, val string) []byte {
+	dst = append(dst, rdbOpcodeAux)
+	dst = rdbAppendString(dst, []byte(key))
+	return rdbAppendString(dst, []byte(val))
+}
+
+// usedMemory returns the bytes held by live heap objects, the counterpart of
+// the memory Redis reports as allocated.
+func usedMemory() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// writeRDB writes entries as an RDB file holding database 0, followed by
+// the CRC-64 of the whole file. aofBase marks the base file of an AOF.
+func writeRDB(w io.Writer, entries []rdbEntry, aofBase bool) error {
+	bw := bufio.NewWriter(w)
+	var crc uint64
+	write := func(b []byte) error {
+		crc = redisCRC64(crc, b)
+		_, err := bw.Write(b)
+		return err
+	}
+
+	expires := 0
+	for _, e := range entries {
+		if !e.expireAt.IsZero() {
+			expires++
+		}
+	}
+	b := fmt.Appendf(nil, "REDIS%04d", rdbVersion)
+	b = rdbAppendAux(b, "redis-ver", rdbRedisVersion)
+	b = rdbAppendAux(b, "redis-bits", strconv.Itoa(strconv.IntSize))
+	b = rdbAppendAux(b, "ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	b = rdbAppendAux(b, "used-mem", strconv.FormatUint(usedMemory(), 10))
+	if aofBase {
+		b = rdbAppendAux(b, "aof-base", "1")
+	} else {
+		b = rdbAppendAux(b, "aof-base", "0")
+	}
+	b = append(b, rdbOpcodeSelectDB, 0, rdbOpcodeResizeDB)
+	b = rdbAppendLen(b, uint64(len(entries)))
+	b = rdbAppendLen(b, uint64(expires))
+	if err := write(b); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		typ, err := rdbObjectType(e.val)
+		if err != nil {
+			return err
+		}
+		b = b[:0]
+		if !e.expireAt.IsZero() {
+			b = append(b, rdbOpcodeExpireTimeMS)
+			b = binary.LittleEndian.AppendUint64(b, uint64(e.expireAt.UnixMilli()))
+		}
+		b = append(b, typ)
+		b = rdbAppendString(b, []byte(e.key))
+		b = rdbAppendValue(b, e.val)
+		if err := write(b); err != nil {
+			return err
+		}
+	}
+	if err := write([]byte{rdbOpcodeEOF}); err != nil {
+		return err
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint64(nil, crc)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// rdbHooks let check-rdb follow a load. Nil hooks are not called.
+type rdbHooks struct {
+	aux func(offset int, key, val []byte)
+	// skipped replaces the log of skipped entries.
+	skipped func(key []byte, what string)
+	// skipUnsupported skips keys of types this server cannot hold. Without
+	// it, such a key fails the load rather than being lost.
+	skipUnsupported bool
+}
+
+// rdbLoadError is an error at an offset of an RDB file, with the key being
+// loaded if there was one.
+type rdbLoadError struct {
+	offset int
+	key    []byte
+	err    error
+}
+
+func (e *rdbLoadError) Error() string {
+	if e.key != nil {
+		return fmt.Sprintf("loading key %q at offset %d: %v", e.key, e.offset, e.err)
+	}
+	return fmt.Sprintf("%v at offset %d", e.err, e.offset)
+}
+
+func (e *rdbLoadError) Unwrap() error {
+	return e.err
+}
+
+// readRDB parses an RDB file and calls fn for each key, including keys whose
+// expiry time has passed. Empty collections, which Redis may have written
+// in older versions, are skipped. So are module auxiliary data and
+// functions; the number of those is logged. A key of a type this server
+// cannot hold, such as a set, fails the load.
+func readRDB(data []byte, fill, depth int, fn func(rdbEntry)) error {
+	return readRDBHooks(data, fill, depth, fn, rdbHooks{})
+}
+
+// readRDBHooks is readRDB with hooks. Errors are *rdbLoadError.
+func readRDBHooks(data []byte, fill, depth int, fn func(rdbEntry), hooks rdbHooks) error {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return &rdbLoadError{err: errors.New("wrong signature trying to load DB from file")}
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return &rdbLoadError{offset: 5, err: fmt.Errorf("can't handle RDB format version %s", data[5:9])}
+	}
+	// The checksum is verified once the file has been read, so that an
+	// error points to where the data goes wrong.
+	body := data[9:]
+	if version >= 5 {
+		if len(body) < 8 {
+			return &rdbLoadError{offset: len(data), err: errRDBCorrupt}
+		}
+		body = body[:len(body)-8]
+	}
+
+	r := &rdbReader{b: body, fill: fill, depth: depth}
+	offset := func() int { return 9 + len(body) - len(r.b) }
+	fail := func(key []byte, err error) error {
+		return &rdbLoadError{offset: offset(), key: key, err: err}
+	}
+	var expireAt time.Time
+	skipped := map[string]int{}
+	skip := func(key []byte, what string) {
+		if hooks.skipped != nil {
+			hooks.skipped(key, what)
+			return
+		}
+		skipped[what]++
+	}
+	for {
+		typ := r.readByte()
+		if r.err != nil {
+			return fail(nil, r.err)
+		}
+		switch typ {
+		case rdbOpcodeEOF:
+			if len(r.b) != 0 {
+				return fail(nil, errRDBCorrupt)
+			}
+			// A zero checksum means the file was written with rdbchecksum
+			// off.
+			if version >= 5 {
+				sum := binary.LittleEndian.Uint64(data[len(data)-8:])
+				if sum != 0 && sum != redisCRC64(0, data[:len(data)-8]) {
+					return &rdbLoadError{offset: len(data) - 8, err: errors.New("wrong RDB checksum")}
+				}
+			}
+			for what, n := range skipped {
+				log.Printf("Skipped %d RDB entries: %s", n, what)
+			}
+			return nil
+		case rdbOpcodeExpireTimeMS:
+			if b := r.read(8); b != nil {
+				expireAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(b)))
+			}
+		case rdbOpcodeExpireTime:
+			if b := r.read(4); b != nil {
+				expireAt = time.Unix(int64(int32(binary.LittleEndian.Uint32(b))), 0)
+			}
+		case rdbOpcodeIdle:
+			r.loadLen()
+		case rdbOpcodeFreq:
+			r.readByte()
+		case rdbOpcodeAux:
+			at := offset() - 1
+			key := r.loadString()
+			val := r.loadString()
+			if hooks.aux != nil && r.err == nil {
+				hooks.aux(at, key, val)
+			}
+		case rdbOpcodeResizeDB:
+			r.loadLen()
+			r.loadLen()
+		case rdbOpcodeSelectDB:
+			if db, _ := r.loadLen(); db != 0 && r.err == nil {
+				return fail(nil, fmt.Errorf("data file has keys in database %d, but only database 0 is supported", db))
+			}
+		case rdbOpcodeSlotInfo:
+			r.loadLen() // slot
+			r.loadLen() // keys in the slot
+			r.loadLen() // keys with a TTL in the slot
+		case rdbOpcodeFunction2:
+			r.loadString()
+			skip(nil, "function library")
+		case rdbOpcodeModuleAux:
+			r.loadLen() // module id
+			if when, _ := r.loadLen(); when != rdbModuleOpcodeUInt && r.err == nil {
+				return fail(nil, errRDBCorrupt)
+			}
+			r.loadLen()
+			r.skipModuleValue()
+			skip(nil, "module auxiliary data")
+		case rdbOpcodeFunctionPreGA:
+			return fail(nil, fmt.Errorf("unsupported RDB opcode %d", typ))
+		default:
+			key := r.loadString()
+			if r.err != nil {
+				return fail(nil, r.err)
+			}
+			val, err := r.loadObject(typ)
+			var unsupported *rdbUnsupportedError
+			if errors.As(err, &unsupported) {
+				if !hooks.skipUnsupported {
+					return fail(key, err)
+				}
+				skip(key, unsupported.what)
+			}
+			if err == errRDBEmptyKey || unsupported != nil {
+				expireAt = time.Time{}
+				continue
+			}
+			if err != nil {
+				return fail(key, err)
+			}
+			fn(rdbEntry{key: string(key), val: val, expireAt: expireAt})
+			expireAt = time.Time{}
+		}
+	}
+}
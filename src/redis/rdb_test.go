@@ -0,0 +1,305 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// goldenExpireAt is the expiry time of the "ttl" keys in testdata,
+// 2100-01-01.
+var goldenExpireAt = time.UnixMilli(4102444800000)
+
+func bulkStrings(v parser.Value) []string {
+	var out []string
+	for _, e := range v.(parser.Array) {
+		out = append(out, string(e.(parser.BulkString)))
+	}
+	return out
+}
+
+func TestLoadGoldenRDB(t *testing.T) {
+	zsetScores := map[string]string{"neg": "-inf", "one": "1", "pi": "3.14"}
+	zipList := []string{"a", "7", "-5", "hello world", "300", "70000", "5000000000"}
+	tests := []struct {
+		file  string
+		keys  map[string]string // key to TYPE
+		lists map[string][]string
+		zsets map[string]map[string]string
+		check func(t *testing.T, store *Store)
+	}{
+		{
+			file:  "redis-3.0.rdb",
+			keys:  map[string]string{"list": "list", "zset": "zset", "bigzset": "zset", "ttl": "string"},
+			lists: map[string][]string{"list": zipList},
+			zsets: map[string]map[string]string{
+				"zset":    zsetScores,
+				"bigzset": {"m1": "1", "m2": "inf", "m3": "2.5"},
+			},
+		},
+		{
+			file: "redis-6.2.rdb",
+			keys: map[string]string{
+				"str": "string", "int8": "string", "int16": "string", "int32": "string",
+				"lzf": "string", "ttl": "string", "list": "list", "zset": "zset",
+			},
+			lists: map[string][]string{"list": append(zipList, string(bytes.Repeat([]byte("b"), 300)), "after", "-100000")},
+			zsets: map[string]map[string]string{"zset": zsetScores},
+			check: func(t *testing.T, store *Store) {
+				for key, want := range map[string]string{
+					"int8": "-12", "int16": "1000", "int32": "100000",
+					"lzf": string(bytes.Repeat([]byte("a"), 100)),
+				} {
+					if v, _ := store.Get(key); string(v) != want {
+						t.Errorf("%s: expected %q, got %q", key, want, v)
+					}
+				}
+			},
+		},
+		{
+			file: "redis-7.2.rdb",
+			keys: map[string]string{
+				"str": "string", "ttl": "string", "list": "list", "biglist": "list",
+				"zset": "zset", "bigzset": "zset", "json": "ReJSON-RL",
+			},
+			lists: map[string][]string{
+				"list":    {"a", "1", "-1", "1000", "hello"},
+				"biglist": {string(bytes.Repeat([]byte("z"), 9000)), "x"},
+			},
+			zsets: map[string]map[string]string{
+				"zset":    {"a": "1", "b": "2.5"},
+				"bigzset": {"hi": "2.5", "lo": "-1"},
+			},
+			check: func(t *testing.T, store *Store) {
+				if v := mustDo(t, store, "JSON.GET", "json"); string(v.(parser.BulkString)) != `{"a":[1,true,"x"]}` {
+					t.Errorf("unexpected document %q", v)
+				}
+			},
+		},
+		{
+			file:  "redis-7.4.rdb",
+			keys:  map[string]string{"str": "string", "list": "list"},
+			lists: map[string][]string{"list": {"a", "b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			store := newStore()
+			path := filepath.Join("testdata", tt.file)
+			if _, err := store.LoadRDB(path); err == nil {
+				t.Fatalf("expected keys of unsupported types to fail the load")
+			}
+			store.persistence.skipUnsupported.Store(true)
+			n, err := store.LoadRDB(path)
+			if err != nil {
+				t.Fatalf("LoadRDB: %v", err)
+			}
+			if n != len(tt.keys) {
+				t.Errorf("expected %d keys, loaded %d", len(tt.keys), n)
+			}
+			for key, typ := range tt.keys {
+				if got := store.Type(key); got != typ {
+					t.Errorf("%s: expected type %s, got %s", key, typ, got)
+				}
+			}
+			if _, ok := tt.keys["str"]; ok {
+				if v, _ := store.Get("str"); string(v) != "hello" {
+					t.Errorf("unexpected str %q", v)
+				}
+			}
+			if _, ok := tt.keys["ttl"]; ok {
+				exp, err := store.volatileKeyMap.GetSetExpiry("ttl")
+				if err != nil || !exp.Equal(goldenExpireAt) {
+					t.Errorf("expected ttl to expire at %v, got %v %v", goldenExpireAt, exp, err)
+				}
+			}
+			for key, want := range tt.lists {
+				got := bulkStrings(mustDo(t, store, "LRANGE", key, "0", "-1"))
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: expected %q, got %q", key, want, got)
+				}
+			}
+			for key, scores := range tt.zsets {
+				if v := mustDo(t, store, "ZCARD", key); v != parser.Integer(len(scores)) {
+					t.Errorf("%s: expected %d members, got %v", key, len(scores), v)
+				}
+				for member, want := range scores {
+					if v := mustDo(t, store, "ZSCORE", key, member); string(v.(parser.BulkString)) != want {
+						t.Errorf("%s %s: expected score %s, got %v", key, member, want, v)
+					}
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, store)
+			}
+		})
+	}
+}
+
+// TestWriteRDBMatchesGolden checks that values are written byte for byte
+// the way Redis 7.2 writes them.
+func TestWriteRDBMatchesGolden(t *testing.T) {
+	golden, err := os.ReadFile(filepath.Join("testdata", "redis-7.2.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newStore()
+	store.Set("str", []byte("hello"))
+	store.SetWithOptions("ttl", []byte("later"), setOptions{expireAt: goldenExpireAt})
+	store.RPush("list", []byte("a"), []byte("1"), []byte("-1"), []byte("1000"), []byte("hello"))
+	mustDo(t, store, "JSON.SET", "json", "$", `{"a":[1,true,"x"]}`)
+
+	entries, release := store.snapshot()
+	defer release()
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, entries, false); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.Bytes()
+	if !bytes.HasPrefix(out, []byte("REDIS0011")) || !bytes.Equal(out[len(out)-8:], binary.LittleEndian.AppendUint64(nil, redisCRC64(0, out[:len(out)-8]))) {
+		t.Fatalf("unexpected header or checksum")
+	}
+	for _, e := range entries {
+		typ, err := rdbObjectType(e.val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var record []byte
+		if !e.expireAt.IsZero() {
+			record = binary.LittleEndian.AppendUint64([]byte{rdbOpcodeExpireTimeMS}, uint64(e.expireAt.UnixMilli()))
+		}
+		record = rdbAppendValue(rdbAppendString(append(record, typ), []byte(e.key)), e.val)
+		if !bytes.Contains(out, record) {
+			t.Errorf("%s: record missing from the written file", e.key)
+		}
+		if !bytes.Contains(golden, record) {
+			t.Errorf("%s: record %x differs from Redis", e.key, record)
+		}
+	}
+}
+
+func TestWriteRDBAuxFields(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	var aux []string
+	err := readRDBHooks(buf.Bytes(), 0, 0, func(rdbEntry) {}, rdbHooks{
+		aux: func(offset int, key, val []byte) {
+			aux = append(aux, string(key))
+			switch string(key) {
+			case "redis-ver":
+				if string(val) != rdbRedisVersion {
+					t.Errorf("expected redis-ver %s, got %s", rdbRedisVersion, val)
+				}
+			case "ctime", "used-mem":
+				if n, err := strconv.ParseInt(string(val), 10, 64); err != nil || n <= 0 {
+					t.Errorf("expected a positive %s, got %s", key, val)
+				}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(aux, " "); got != "redis-ver redis-bits ctime used-mem aof-base" {
+		t.Errorf("expected the aux fields Redis writes, got %s", got)
+	}
+}
+
+func TestLoadTruncatedGoldenRDB(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "*.rdb"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Zero the checksum so truncated files reach the parser.
+		for n := 9; n < len(data)-8; n++ {
+			cut := append(bytes.Clone(data[:n]), make([]byte, 8)...)
+			if err := readRDBHooks(cut, -2, 0, func(rdbEntry) {}, rdbHooks{skipUnsupported: true}); err == nil {
+				t.Errorf("%s: expected an error when truncated to %d bytes", file, n)
+			}
+		}
+	}
+}
+
+func TestDecodeZiplist(t *testing.T) {
+	// A ziplist of "a", 7, -5 and a 300 byte string followed by "after",
+	// whose previous entry length needs the 5 byte form.
+	zl := []byte{0, 0, 0, 0, 0, 0, 0, 0, 5, 0,
+		0x00, 0x01, 'a',
+		0x03, 0xf8,
+		0x02, 0xfe, 0xfb,
+		0x03, 0x41, 0x2c}
+	zl = append(zl, bytes.Repeat([]byte("b"), 300)...)
+	tail := len(zl)
+	zl = append(zl, 0xfe, 0x2f, 0x01, 0, 0, 0x05, 'a', 'f', 't', 'e', 'r', 0xff)
+	binary.LittleEndian.PutUint32(zl, uint32(len(zl)))
+	binary.LittleEndian.PutUint32(zl[4:], uint32(tail))
+
+	entries, err := decodeZiplist(zl)
+	if err != nil {
+		t.Fatalf("decodeZiplist: %v", err)
+	}
+	want := []string{"a", "7", "-5", string(bytes.Repeat([]byte("b"), 300)), "after"}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, e := range entries {
+		if string(e) != want[i] {
+			t.Errorf("entry %d: expected %q, got %q", i, want[i], e)
+		}
+	}
+
+	badPrevlen := bytes.Clone(zl)
+	badPrevlen[13] = 0x02
+	badCount := bytes.Clone(zl)
+	badCount[8] = 4
+	for _, bad := range [][]byte{badPrevlen, badCount, zl[:len(zl)-1]} {
+		if _, err := decodeZiplist(bad); err == nil {
+			t.Errorf("expected an error for %x", bad)
+		}
+	}
+}
+
+// TestRedisBloomModuleIDs checks that the probabilistic types are not
+// written under RedisBloom's module ids, whose encoding they do not follow,
+// and that values written by RedisBloom are not read as theirs.
+func TestRedisBloomModuleIDs(t *testing.T) {
+	store := newStore()
+	mustDo(t, store, "BF.ADD", "bf", "x")
+	mustDo(t, store, "CF.ADD", "cf", "x")
+	mustDo(t, store, "CMS.INITBYDIM", "cms", "10", "3")
+	mustDo(t, store, "TOPK.RESERVE", "topk", "3")
+	entries, release := store.snapshot()
+	defer release()
+	for _, e := range entries {
+		r := &rdbReader{b: rdbAppendValue(nil, e.val)}
+		id, _ := r.loadLen()
+		if name := moduleTypeName(id); name == typeName(e.val) {
+			t.Errorf("%s: written under the RedisBloom module %s", e.key, name)
+		}
+	}
+
+	for _, name := range []string{"MBbloom--", "MBbloomCF", "CMSk-TYPE", "TopK-TYPE"} {
+		data := rdbAppendLen(nil, moduleTypeID(name, 0))
+		data = rdbAppendLen(data, rdbModuleOpcodeUInt)
+		data = rdbAppendLen(data, 1)
+		data = rdbAppendLen(data, rdbModuleOpcodeEOF)
+		r := &rdbReader{b: data}
+		var unsupported *rdbUnsupportedError
+		if _, err := r.loadObject(rdbTypeModule2); !errors.As(err, &unsupported) {
+			t.Errorf("%s: expected the value to be unsupported, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,583 @@
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// Replication works as in Redis. A master feeds every command it propagates
+// to a ring buffer, the backlog, and to the connected replicas. The
+// replication offset counts the bytes fed so far, and together with the
+// replication ID names a point in the history of the dataset. A replica
+// asks for the stream past the offset it has with PSYNC <replid> <offset>.
+// The master answers +CONTINUE and sends the missing bytes from the backlog
+// when it still holds them, or +FULLRESYNC <replid> <offset> followed by an
+// RDB snapshot of the dataset as of that offset.
+//
+// A replica passes the stream it receives on to its own backlog and
+// replicas unchanged, so that its offsets stay those of its master.
+const (
+	defaultReplBacklogSize = 1 << 20
+	minReplBacklogSize     = 16 << 10
+	defaultReplPingPeriod  = 10 * time.Second
+	defaultReplTimeout     = 60 * time.Second
+
+	// replicaOutputLimit is how much of the stream a replica may fall
+	// behind before it is disconnected.
+	replicaOutputLimit   = 256 << 20
+	replCronInterval     = 100 * time.Millisecond
+	replAckPeriod        = time.Second
+	replReconnectDelay   = time.Second
+	replIDLength         = 40
+	replicaStateWait     = "wait_bgsave"
+	replicaStateSendBulk = "send_bulk"
+	replicaStateOnline   = "online"
+	replStateConnect     = "connect"
+	replStateConnecting  = "connecting"
+	replStateHandshake   = "handshake"
+	replStateSync        = "sync"
+	replStateConnected   = "connected"
+)
+
+// replicationState holds the replication ID and offset, the backlog and
+// the replicas of a master, and the link to the master of a replica.
+type replicationState struct {
+	mu           sync.Mutex
+	replid       string
+	replid2      string // the ID this server had before its last one
+	offset       int64  // bytes of the stream fed so far
+	secondOffset int64  // first offset not valid for replid2, or -1
+	backlog      *replBacklog
+	backlogSize  int
+	replicas     []*replica
+
+	port       int // announced to masters as our listening port
+	readOnly   bool
+	pingPeriod time.Duration
+	timeout    time.Duration
+	lastPing   time.Time
+
+	disklessSync            bool
+	disklessSyncDelay       time.Duration
+	disklessSyncMaxReplicas int
+	disklessLoad            string
+	pendingSync             *rdbTransfer // diskless, waiting for more replicas
+	diskSync                *rdbTransfer // disk-based, writing the RDB file
+	asyncLoading            bool         // loading a snapshot with swapdb
+
+	syncFull       int64
+	syncPartialOK  int64
+	syncPartialErr int64
+
+	// acked wakes clients in WAIT and WAITAOF when a replica acknowledges
+	// an offset or the AOF is synced.
+	acked offsetNotifier
+
+	// Set while this server is a replica.
+	masterHost string
+	masterPort int
+	link       *masterLink
+	state      string
+	lastIO     time.Time
+}
+
+// noReplID stands for no replication ID in replid2.
+var noReplID = strings.Repeat("0", replIDLength)
+
+func newReplID() string {
+	b := make([]byte, replIDLength/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// shiftReplIDLocked starts a new history, remembering the current one so
+// that replicas of the same master can still continue from it.
+func (rs *replicationState) shiftReplIDLocked() {
+	rs.replid2 = rs.replid
+	rs.secondOffset = rs.offset + 1
+	rs.replid = newReplID()
+}
+
+// replBacklog keeps the last bytes of the replication stream in a ring
+// buffer. offset is the replication offset of its first byte, the first
+// byte of the stream being at offset 1.
+type replBacklog struct {
+	buf     []byte
+	idx     int // where the next byte goes
+	histlen int
+	offset  int64
+}
+
+func newReplBacklog(size int, offset int64) *replBacklog {
+	return &replBacklog{buf: make([]byte, size), offset: offset}
+}
+
+func (b *replBacklog) feed(p []byte) {
+	end := b.offset + int64(b.histlen) + int64(len(p))
+	b.histlen = min(b.histlen+len(p), len(b.buf))
+	b.offset = end - int64(b.histlen)
+	if len(p) > len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % len(b.buf)
+		p = p[n:]
+	}
+}
+
+// readFrom returns the stream from offset on, or false when the backlog
+// no longer holds it.
+func (b *replBacklog) readFrom(offset int64) ([]byte, bool) {
+	if offset < b.offset || offset > b.offset+int64(b.histlen) {
+		return nil, false
+	}
+	skip := int(offset - b.offset)
+	start := (b.idx - b.histlen + skip + len(b.buf)) % len(b.buf)
+	out := make([]byte, b.histlen-skip)
+	n := copy(out, b.buf[start:])
+	copy(out[n:], b.buf)
+	return out, true
+}
+
+// resize returns a backlog of size bytes holding as much of the stream as
+// fits.
+func (b *replBacklog) resize(size int) *replBacklog {
+	end := b.offset + int64(b.histlen)
+	data, _ := b.readFrom(end - int64(min(b.histlen, size)))
+	nb := newReplBacklog(size, end-int64(len(data)))
+	nb.feed(data)
+	return nb
+}
+
+// replica is a replica connected to this server. The stream is queued in
+// buf and written to the connection by its own goroutine, so a slow
+// replica never holds up writers.
+type replica struct {
+	store   *Store
+	client  *Client
+	addr    string
+	port    int
+	timeout time.Duration
+
+	mu        sync.Mutex
+	state     string
+	buf       []byte
+	ready     chan struct{}
+	closed    bool
+	ackOffset int64
+	aofOffset int64 // the offset the replica has synced to its AOF, or -1
+	ackTime   time.Time
+}
+
+// write queues p for the replica, disconnecting it once it falls too far
+// behind. Until its snapshot is taken the replica has no use for the
+// stream.
+func (r *replica) write(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.state == replicaStateWait {
+		return
+	}
+	if len(r.buf)+len(p) > replicaOutputLimit {
+		log.Printf("Replica %s:%d is too far behind, disconnecting it", r.addr, r.port)
+		r.closeLocked()
+		return
+	}
+	r.buf = append(r.buf, p...)
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (r *replica) closeLocked() {
+	if !r.closed {
+		r.closed = true
+		close(r.ready)
+		r.client.conn.Close()
+	}
+}
+
+func (r *replica) writeLoop() {
+	for range r.ready {
+		r.mu.Lock()
+		buf := r.buf
+		r.buf = nil
+		r.mu.Unlock()
+		r.client.conn.SetWriteDeadline(time.Now().Add(r.timeout))
+		if _, err := r.client.conn.Write(buf); err != nil {
+			r.mu.Lock()
+			r.closeLocked()
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
+// replicationFeed passes propagated commands, serialized, to the backlog
+// and the replicas, and returns the replication offset just past them. The
+// offset advances even with no replicas, for WAITAOF. A replica passes on
+// the stream of its master instead. Caller must hold s.aof.propMu.
+func (s *Store) replicationFeed(cmds []byte) int64 {
+	rs := &s.repl
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.masterHost == "" {
+		rs.feedLocked(cmds)
+	}
+	return rs.offset
+}
+
+func (rs *replicationState) feedLocked(p []byte) {
+	rs.offset += int64(len(p))
+	if rs.backlog == nil {
+		return
+	}
+	rs.backlog.feed(p)
+	for _, r := range rs.replicas {
+		r.write(p)
+	}
+}
+
+// partialResyncLocked reports whether the stream past offset in the
+// history named replid can be sent from the backlog.
+func (rs *replicationState) partialResyncLocked(replid string, offset int64) bool {
+	if replid != rs.replid && (replid != rs.replid2 || offset > rs.secondOffset) {
+		return false
+	}
+	b := rs.backlog
+	return b != nil && offset >= b.offset && offset <= b.offset+int64(b.histlen)
+}
+
+// syncReplica turns c into a replica, continuing from offset when
+// possible.
+func (s *Store) syncReplica(c *Client, replid string, offset int64) parser.Value {
+	// Holding propMu keeps writes out until the replica is registered, so
+	// it is sent every write after the snapshot or the backlog.
+	s.aof.propMu.Lock()
+	defer s.aof.propMu.Unlock()
+	rs := &s.repl
+	rs.mu.Lock()
+	if rs.masterHost != "" && rs.state != replStateConnected {
+		rs.mu.Unlock()
+		return parser.Error("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+	r := &replica{
+		store:     s,
+		client:    c,
+		addr:      c.replAddr,
+		port:      c.replPort,
+		timeout:   rs.timeout,
+		ready:     make(chan struct{}, 1),
+		aofOffset: -1,
+	}
+	if r.addr == "" {
+		r.addr, _, _ = net.SplitHostPort(c.conn.RemoteAddr().String())
+	}
+	c.replica = r
+	if rs.partialResyncLocked(replid, offset) {
+		data, _ := rs.backlog.readFrom(offset)
+		r.state = replicaStateOnline
+		r.buf = append([]byte("+CONTINUE "+rs.replid+"\r\n"), data...)
+		r.ready <- struct{}{}
+		rs.replicas = append(rs.replicas, r)
+		rs.syncPartialOK++
+		rs.mu.Unlock()
+		log.Printf("Partial resynchronization request from %s:%d accepted, sending %d bytes of backlog", r.addr, r.port, len(data))
+		go r.writeLoop()
+		return nil
+	}
+	if replid != "?" {
+		rs.syncPartialErr++
+	}
+	rs.syncFull++
+	if rs.backlog == nil {
+		rs.backlog = newReplBacklog(rs.backlogSize, rs.offset+1)
+	}
+	rs.replicas = append(rs.replicas, r)
+	t := s.queueFullSyncLocked(r)
+	rs.mu.Unlock()
+	log.Printf("Full resynchronization requested by replica %s:%d", r.addr, r.port)
+	if t != nil {
+		s.startTransfer(t)
+	}
+	return nil
+}
+
+func (s *Store) removeReplica(r *replica) {
+	rs := &s.repl
+	rs.mu.Lock()
+	for i, other := range rs.replicas {
+		if other == r {
+			rs.replicas = append(rs.replicas[:i:i], rs.replicas[i+1:]...)
+			break
+		}
+	}
+	rs.mu.Unlock()
+	r.mu.Lock()
+	r.closeLocked()
+	r.mu.Unlock()
+}
+
+// disconnectReplicasLocked drops the replicas, which reconnect and resync.
+func (rs *replicationState) disconnectReplicasLocked() {
+	for _, r := range rs.replicas {
+		r.mu.Lock()
+		r.closeLocked()
+		r.mu.Unlock()
+	}
+}
+
+// replicationCron pings the replicas every repl-ping-replica-period, so
+// that they can tell an idle master from a lost one.
+func (s *Store) replicationCron() {
+	ticker := time.NewTicker(replCronInterval)
+	defer ticker.Stop()
+	ping, _ := parser.Serialize(commandArgs("PING"))
+	for now := range ticker.C {
+		s.aof.propMu.Lock()
+		rs := &s.repl
+		rs.mu.Lock()
+		if rs.masterHost == "" && len(rs.replicas) > 0 && now.Sub(rs.lastPing) >= rs.pingPeriod {
+			rs.lastPing = now
+			rs.feedLocked(ping)
+		}
+		rs.mu.Unlock()
+		s.aof.propMu.Unlock()
+	}
+}
+
+func (s *Store) isReplica() bool {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+	return s.repl.masterHost != ""
+}
+
+// readOnlyReplica reports whether write commands are refused.
+func (s *Store) readOnlyReplica() bool {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+	return s.repl.masterHost != "" && s.repl.readOnly
+}
+
+// ReplicaOf makes the store a replica of host:port, or a master again when
+// host is empty. It reports false when already replicating host:port.
+func (s *Store) ReplicaOf(host string, port int) bool {
+	s.aof.propMu.Lock()
+	defer s.aof.propMu.Unlock()
+	rs := &s.repl
+	rs.mu.Lock()
+	if host != "" && rs.masterHost == host && rs.masterPort == port {
+		rs.mu.Unlock()
+		return false
+	}
+	if rs.link != nil {
+		rs.link.stop()
+		rs.link = nil
+	}
+	if host == "" {
+		if rs.masterHost != "" {
+			// Our replicas share the history of the old master, and can
+			// continue from it.
+			rs.shiftReplIDLocked()
+			rs.masterHost, rs.masterPort, rs.state = "", 0, ""
+			log.Println("MASTER MODE enabled")
+		}
+		rs.mu.Unlock()
+		return true
+	}
+	rs.masterHost, rs.masterPort, rs.state = host, port, replStateConnect
+	rs.disconnectReplicasLocked()
+	rs.link = &masterLink{host: host, port: port, done: make(chan struct{})}
+	go s.runReplication(rs.link)
+	rs.mu.Unlock()
+	log.Printf("Connecting to MASTER %s:%d", host, port)
+
+	// Blocked clients would pop elements the master's stream also pops.
+	s.mu.Lock()
+	s.unblockAll(unblockRoleChange)
+	s.mu.Unlock()
+	return true
+}
+
+func handleReplicaOf(store *Store, args []parser.Value) parser.Value {
+	if store.cluster.enabled {
+		return parser.Error("ERR REPLICAOF not allowed in cluster mode.")
+	}
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if strings.EqualFold(strs[0], "NO") && strings.EqualFold(strs[1], "ONE") {
+		store.ReplicaOf("", 0)
+		return parser.SimpleString("OK")
+	}
+	port, err := strconv.Atoi(strs[1])
+	if err != nil || port < 0 || port > 65535 {
+		return parser.Error("ERR Invalid master port")
+	}
+	if !store.ReplicaOf(strs[0], port) {
+		return parser.SimpleString("OK Already connected to specified master")
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleReplConf(c *Client, store *Store, args []parser.Value) parser.Value {
+	if len(args)%2 == 0 {
+		return parser.Error("ERR syntax error")
+	}
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	reply := parser.Value(parser.SimpleString("OK"))
+	for i := 0; i < len(strs); i += 2 {
+		val := strs[i+1]
+		switch strings.ToLower(strs[i]) {
+		case "listening-port":
+			port, err := strconv.Atoi(val)
+			if err != nil || port < 0 || port > 65535 {
+				return parser.Error("ERR value is not an integer or out of range")
+			}
+			c.replPort = port
+		case "ip-address":
+			c.replAddr = val
+		case "capa":
+			// The stream is always PSYNC2 and the snapshot always sent
+			// with its length.
+		case "ack", "fack":
+			// ACK <offset> [FACK <aofoffset>] gets no reply.
+			reply = nil
+			offset, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || c.replica == nil {
+				continue
+			}
+			c.replica.mu.Lock()
+			if strings.EqualFold(strs[i], "ack") {
+				c.replica.ackOffset = max(c.replica.ackOffset, offset)
+				c.replica.ackTime = time.Now()
+			} else {
+				c.replica.aofOffset = max(c.replica.aofOffset, offset)
+			}
+			c.replica.mu.Unlock()
+			store.repl.acked.notify()
+		case "getack":
+			if c.master != nil {
+				c.master.sendAck(store)
+			}
+			return nil
+		default:
+			return parser.Error("ERR Unrecognized REPLCONF option: " + strs[i])
+		}
+	}
+	return reply
+}
+
+func handlePSync(c *Client, store *Store, args []parser.Value) parser.Value {
+	if c.replica != nil || c.master != nil {
+		return nil
+	}
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	offset, err := strconv.ParseInt(strs[1], 10, 64)
+	if err != nil {
+		return parser.Error("ERR value is not an integer or out of range")
+	}
+	return store.syncReplica(c, strs[0], offset)
+}
+
+func (s *Store) replOffset() int64 {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+	return s.repl.offset
+}
+
+func handleRole(store *Store, args []parser.Value) parser.Value {
+	rs := &store.repl
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.masterHost != "" {
+		return parser.Array{
+			parser.BulkString("slave"),
+			parser.BulkString(rs.masterHost),
+			parser.Integer(rs.masterPort),
+			parser.BulkString(rs.state),
+			parser.Integer(rs.offset),
+		}
+	}
+	replicas := parser.Array{}
+	for _, r := range rs.replicas {
+		r.mu.Lock()
+		if r.state == replicaStateOnline {
+			replicas = append(replicas, parser.Array{
+				parser.BulkString(r.addr),
+				parser.BulkString(strconv.Itoa(r.port)),
+				parser.BulkString(strconv.FormatInt(r.ackOffset, 10)),
+			})
+		}
+		r.mu.Unlock()
+	}
+	return parser.Array{parser.BulkString("master"), parser.Integer(rs.offset), replicas}
+}
+
+// infoReplication returns the fields of INFO replication.
+func (s *Store) infoReplication() []string {
+	rs := &s.repl
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := time.Now()
+	var fields []string
+	if rs.masterHost == "" {
+		fields = append(fields, "role:master")
+	} else {
+		linkStatus, lastIO := "down", int64(-1)
+		if rs.state == replStateConnected {
+			linkStatus, lastIO = "up", int64(now.Sub(rs.lastIO).Seconds())
+		}
+		fields = append(fields,
+			"role:slave",
+			"master_host:"+rs.masterHost,
+			fmt.Sprintf("master_port:%d", rs.masterPort),
+			"master_link_status:"+linkStatus,
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", boolInt(rs.state == replStateSync)),
+			fmt.Sprintf("slave_repl_offset:%d", rs.offset),
+			fmt.Sprintf("slave_read_only:%d", boolInt(rs.readOnly)),
+		)
+	}
+	fields = append(fields, fmt.Sprintf("connected_slaves:%d", len(rs.replicas)))
+	for i, r := range rs.replicas {
+		r.mu.Lock()
+		fields = append(fields, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, r.addr, r.port, r.state, r.ackOffset, int64(now.Sub(r.ackTime).Seconds())))
+		r.mu.Unlock()
+	}
+	fields = append(fields,
+		"master_replid:"+rs.replid,
+		"master_replid2:"+rs.replid2,
+		fmt.Sprintf("master_repl_offset:%d", rs.offset),
+		fmt.Sprintf("second_repl_offset:%d", rs.secondOffset),
+		fmt.Sprintf("repl_backlog_active:%d", boolInt(rs.backlog != nil)),
+		fmt.Sprintf("repl_backlog_size:%d", rs.backlogSize),
+	)
+	if b := rs.backlog; b != nil {
+		fields = append(fields,
+			fmt.Sprintf("repl_backlog_first_byte_offset:%d", b.offset),
+			fmt.Sprintf("repl_backlog_histlen:%d", b.histlen))
+	} else {
+		fields = append(fields, "repl_backlog_first_byte_offset:0", "repl_backlog_histlen:0")
+	}
+	return fields
+}
@@ -0,0 +1,347 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// startReplServer starts a test server that announces its own port to
+// masters, starts diskless transfers at once, and stops replicating when
+// the test ends.
+func startReplServer(t *testing.T) *testServer {
+	t.Helper()
+	srv := startTestServer(t)
+	srv.store.repl.port = srv.listener.Addr().(*net.TCPAddr).Port
+	srv.store.repl.disklessSyncDelay = 0
+	srv.store.persistence.dir = t.TempDir()
+	t.Cleanup(func() {
+		srv.store.ReplicaOf("", 0)
+		srv.Close()
+	})
+	return srv
+}
+
+func replicate(t *testing.T, replica, master *testServer) {
+	t.Helper()
+	port := master.listener.Addr().(*net.TCPAddr).Port
+	replica.store.ReplicaOf("127.0.0.1", port)
+	waitForSync(t, replica, master)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// waitForSync waits until the replica is connected and has processed the
+// whole stream of the master.
+func waitForSync(t *testing.T, replica, master *testServer) {
+	t.Helper()
+	waitFor(t, "the replica to catch up", func() bool {
+		rs := &replica.store.repl
+		rs.mu.Lock()
+		state, offset := rs.state, rs.offset
+		rs.mu.Unlock()
+		return state == replStateConnected && offset == master.store.replOffset()
+	})
+}
+
+func syncCounts(store *Store) (full, partialOK int64) {
+	store.repl.mu.Lock()
+	defer store.repl.mu.Unlock()
+	return store.repl.syncFull, store.repl.syncPartialOK
+}
+
+func TestReplBacklog(t *testing.T) {
+	b := newReplBacklog(8, 1)
+	if _, ok := b.readFrom(1); !ok {
+		t.Errorf("expected an empty backlog to continue from its start")
+	}
+	b.feed([]byte("abcdef"))
+	if data, ok := b.readFrom(3); !ok || string(data) != "cdef" {
+		t.Errorf("readFrom(3) = %q, %v", data, ok)
+	}
+	b.feed([]byte("ghij"))
+	if b.offset != 3 || b.histlen != 8 {
+		t.Errorf("expected offset 3 and 8 bytes, got %d and %d", b.offset, b.histlen)
+	}
+	if data, ok := b.readFrom(3); !ok || string(data) != "cdefghij" {
+		t.Errorf("readFrom(3) = %q, %v", data, ok)
+	}
+	if data, ok := b.readFrom(11); !ok || len(data) != 0 {
+		t.Errorf("readFrom(11) = %q, %v", data, ok)
+	}
+	for _, off := range []int64{2, 12} {
+		if _, ok := b.readFrom(off); ok {
+			t.Errorf("expected offset %d to be out of the backlog", off)
+		}
+	}
+	b.feed([]byte("0123456789"))
+	if data, ok := b.readFrom(b.offset); !ok || string(data) != "23456789" || b.offset != 13 {
+		t.Errorf("after a large feed got %q at offset %d", data, b.offset)
+	}
+	b = b.resize(4)
+	if data, ok := b.readFrom(17); !ok || string(data) != "6789" {
+		t.Errorf("after resizing got %q, %v", data, ok)
+	}
+}
+
+func TestReplicationFullSync(t *testing.T) {
+	master := startReplServer(t)
+	replica := startReplServer(t)
+	run(master.store, "SET", "a", "1")
+	run(master.store, "RPUSH", "list", "x", "y")
+	run(master.store, "SET", "volatile", "v", "EX", "100")
+	run(replica.store, "SET", "stale", "1")
+
+	bconn, breader := dial(t, replica)
+	defer bconn.Close()
+	sendOnly(t, bconn, "BLPOP list 0")
+	waitBlockedOn(t, replica.store, "list", 1)
+
+	replicate(t, replica, master)
+	if resp := readReply(t, bconn, breader); !strings.HasPrefix(string(resp.(parser.Error)), "UNBLOCKED") {
+		t.Errorf("expected the blocked client to be unblocked, got %v", resp)
+	}
+	if replica.store.Exists("stale") != 0 {
+		t.Errorf("expected the replica dataset to be replaced")
+	}
+	if resp := run(replica.store, "LRANGE", "list", "0", "-1"); len(resp.(parser.Array)) != 2 {
+		t.Errorf("expected the list to be synced, got %v", resp)
+	}
+	if ttl := run(replica.store, "TTL", "volatile").(parser.Integer); ttl < 90 {
+		t.Errorf("expected the TTL to be synced, got %d", ttl)
+	}
+
+	mconn, mreader := dial(t, master)
+	defer mconn.Close()
+	sendCmd(t, mconn, mreader, "INCR a")
+	sendCmd(t, mconn, mreader, "LPOP list")
+	waitForSync(t, replica, master)
+	if resp := run(replica.store, "GET", "a"); string(resp.(parser.BulkString)) != "2" {
+		t.Errorf("expected INCR to be replicated, got %v", resp)
+	}
+	if resp := run(replica.store, "LLEN", "list"); resp != parser.Integer(1) {
+		t.Errorf("expected LPOP to be replicated, got %v", resp)
+	}
+
+	rconn, rreader := dial(t, replica)
+	defer rconn.Close()
+	if resp := sendCmd(t, rconn, rreader, "SET b 1"); !strings.HasPrefix(string(resp.(parser.Error)), "READONLY") {
+		t.Errorf("expected a READONLY error, got %v", resp)
+	}
+	if resp, ok := sendCmd(t, rconn, rreader, "SORT list ALPHA").(parser.Array); !ok || len(resp) != 1 {
+		t.Errorf("expected SORT without STORE to run on a replica, got %v", resp)
+	}
+	if resp, ok := sendCmd(t, rconn, rreader, "SORT list ALPHA STORE dst").(parser.Error); !ok || !strings.HasPrefix(string(resp), "READONLY") {
+		t.Errorf("expected a READONLY error for SORT with STORE, got %v", resp)
+	}
+
+	waitFor(t, "the replica to acknowledge", func() bool {
+		role := sendCmd(t, mconn, mreader, "ROLE").(parser.Array)
+		replicas := role[2].(parser.Array)
+		return len(replicas) == 1 &&
+			string(replicas[0].(parser.Array)[2].(parser.BulkString)) == strconv.FormatInt(master.store.replOffset(), 10)
+	})
+	role := sendCmd(t, mconn, mreader, "ROLE").(parser.Array)
+	entry := role[2].(parser.Array)[0].(parser.Array)
+	if string(entry[1].(parser.BulkString)) != strconv.Itoa(replica.store.repl.port) {
+		t.Errorf("expected the replica listening port in ROLE, got %v", entry)
+	}
+	role = sendCmd(t, rconn, rreader, "ROLE").(parser.Array)
+	if string(role[0].(parser.BulkString)) != "slave" || string(role[3].(parser.BulkString)) != "connected" {
+		t.Errorf("unexpected ROLE on the replica: %v", role)
+	}
+	info := string(sendCmd(t, rconn, rreader, "INFO replication").(parser.BulkString))
+	for _, want := range []string{"role:slave\r\n", "master_link_status:up\r\n", "master_replid:" + master.store.repl.replid} {
+		if !strings.Contains(info, want) {
+			t.Errorf("expected %q in INFO:\n%s", want, info)
+		}
+	}
+	if full, _ := syncCounts(master.store); full != 1 {
+		t.Errorf("expected 1 full sync, got %d", full)
+	}
+}
+
+// breakLink closes the connection of a replica to its master, as a network
+// failure would.
+func breakLink(replica *testServer) {
+	l := replica.store.repl.link
+	l.mu.Lock()
+	l.conn.Close()
+	l.mu.Unlock()
+}
+
+func TestReplicationPartialResync(t *testing.T) {
+	master := startReplServer(t)
+	replica := startReplServer(t)
+	run(master.store, "SET", "a", "1")
+	replicate(t, replica, master)
+
+	breakLink(replica)
+	run(master.store, "SET", "b", "2")
+	run(master.store, "RPUSH", "list", "x")
+	waitForSync(t, replica, master)
+	if full, partial := syncCounts(master.store); full != 1 || partial != 1 {
+		t.Errorf("expected 1 full and 1 partial sync, got %d and %d", full, partial)
+	}
+	if resp := run(replica.store, "GET", "b"); string(resp.(parser.BulkString)) != "2" {
+		t.Errorf("expected the write made while disconnected, got %v", resp)
+	}
+
+	// Once the backlog no longer holds the offset of the replica, it is
+	// sent a new snapshot.
+	run(master.store, "CONFIG", "SET", "repl-backlog-size", "16kb")
+	breakLink(replica)
+	run(master.store, "SET", "big", strings.Repeat("x", 20<<10))
+	waitForSync(t, replica, master)
+	if full, _ := syncCounts(master.store); full != 2 {
+		t.Errorf("expected a second full sync, got %d", full)
+	}
+	if resp := run(replica.store, "STRLEN", "big"); resp != parser.Integer(20<<10) {
+		t.Errorf("expected the big value, got %v", resp)
+	}
+}
+
+func TestReplicaPromotion(t *testing.T) {
+	master := startReplServer(t)
+	replica := startReplServer(t)
+	run(master.store, "SET", "a", "1")
+	replicate(t, replica, master)
+	oldID := master.store.repl.replid
+	offset := master.store.replOffset()
+
+	replica.store.ReplicaOf("", 0)
+	rs := &replica.store.repl
+	rs.mu.Lock()
+	replid, replid2, second := rs.replid, rs.replid2, rs.secondOffset
+	rs.mu.Unlock()
+	if replid == oldID || replid2 != oldID || second != offset+1 {
+		t.Errorf("expected a new ID continuing %s at %d, got %s, %s, %d", oldID, offset+1, replid, replid2, second)
+	}
+	if resp := run(replica.store, "SET", "b", "2"); resp != parser.SimpleString("OK") {
+		t.Errorf("expected the promoted replica to accept writes, got %v", resp)
+	}
+
+	// The old master has the history the promoted replica started from, so
+	// it only needs the writes made since.
+	replicate(t, master, replica)
+	if _, partial := syncCounts(replica.store); partial != 1 {
+		t.Errorf("expected the old master to resync partially")
+	}
+	if resp := run(master.store, "GET", "b"); string(resp.(parser.BulkString)) != "2" {
+		t.Errorf("expected the write on the new master, got %v", resp)
+	}
+	if master.store.repl.replid != replid {
+		t.Errorf("expected the old master to take the new replication ID")
+	}
+}
+
+func TestReadUntilMark(t *testing.T) {
+	mark := []byte(newReplID())
+	payload := bytes.Repeat([]byte("0123456789"), 10)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write(append(append(payload, mark...), "*1\r\n"...))
+		server.Close()
+	}()
+	// A small buffer makes the mark span reads.
+	r := bufio.NewReaderSize(client, 16)
+	data, err := readUntilMark(client, r, mark, time.Second)
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("readUntilMark = %q, %v", data, err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "*1\r\n" {
+		t.Errorf("expected the stream after the mark to be left, got %q", rest)
+	}
+}
+
+func TestDisklessSyncSharesSnapshot(t *testing.T) {
+	master := startReplServer(t)
+	run(master.store, "SET", "a", "1")
+	// The transfer waits for both replicas, however long the delay.
+	master.store.repl.disklessSyncDelay = time.Hour
+	run(master.store, "CONFIG", "SET", "repl-diskless-sync-max-replicas", "2")
+	port := master.listener.Addr().(*net.TCPAddr).Port
+	var replicas []*testServer
+	for range 2 {
+		replica := startReplServer(t)
+		replica.store.ReplicaOf("127.0.0.1", port)
+		replicas = append(replicas, replica)
+	}
+	for _, replica := range replicas {
+		waitForSync(t, replica, master)
+		if resp := run(replica.store, "GET", "a"); string(resp.(parser.BulkString)) != "1" {
+			t.Errorf("expected the snapshot to be loaded, got %v", resp)
+		}
+	}
+	if full, _ := syncCounts(master.store); full != 2 {
+		t.Errorf("expected 2 full syncs, got %d", full)
+	}
+}
+
+func TestDiskBasedSync(t *testing.T) {
+	master := startReplServer(t)
+	replica := startReplServer(t)
+	run(master.store, "CONFIG", "SET", "repl-diskless-sync", "no")
+	run(master.store, "SET", "a", "1")
+	replicate(t, replica, master)
+	if resp := run(replica.store, "GET", "a"); string(resp.(parser.BulkString)) != "1" {
+		t.Errorf("expected the snapshot to be loaded, got %v", resp)
+	}
+	for _, srv := range []*testServer{master, replica} {
+		if _, err := os.Stat(filepath.Join(srv.store.persistence.dir, defaultDBFilename)); err != nil {
+			t.Errorf("expected the snapshot on disk: %v", err)
+		}
+	}
+}
+
+func TestSwapDBLoad(t *testing.T) {
+	store := newStore()
+	run(store, "SET", "old", "1")
+	if _, err := store.swapInSnapshot([]byte("REDIS0011garbage")); err == nil {
+		t.Errorf("expected a bad snapshot to fail")
+	}
+	if store.Exists("old") != 1 {
+		t.Errorf("expected the old dataset to stay after a failed load")
+	}
+
+	master := startReplServer(t)
+	replica := startReplServer(t)
+	run(master.store, "SET", "a", "1", "EX", "100")
+	run(replica.store, "SET", "stale", "1")
+	if resp := run(replica.store, "CONFIG", "SET", "repl-diskless-load", "swapdb"); resp != parser.SimpleString("OK") {
+		t.Fatalf("CONFIG SET repl-diskless-load: %v", resp)
+	}
+	replicate(t, replica, master)
+	if replica.store.Exists("stale") != 0 {
+		t.Errorf("expected the old dataset to be swapped out")
+	}
+	if ttl := run(replica.store, "TTL", "a").(parser.Integer); ttl < 90 {
+		t.Errorf("expected the TTL to be loaded, got %d", ttl)
+	}
+	if _, err := os.Stat(filepath.Join(replica.store.persistence.dir, defaultDBFilename)); err == nil {
+		t.Errorf("expected swapdb to leave the RDB file alone")
+	}
+	if resp := run(replica.store, "SCAN", "0"); len(resp.(parser.Array)[1].(parser.Array)) != 1 {
+		t.Errorf("expected SCAN to walk the new dataset, got %v", resp)
+	}
+}
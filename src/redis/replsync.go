@@ -0,0 +1,249 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReplDisklessSyncDelay = 5 * time.Second
+	replDisklessLoadDisabled     = "disabled"
+	replDisklessLoadOnEmptyDB    = "on-empty-db"
+	replDisklessLoadSwapDB       = "swapdb"
+)
+
+func parseDisklessLoad(val string) (string, error) {
+	switch v := strings.ToLower(val); v {
+	case replDisklessLoadDisabled, replDisklessLoadOnEmptyDB, replDisklessLoadSwapDB:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument(s) must be one of the following: disabled, on-empty-db, swapdb")
+}
+
+var errNoReplicasLeft = errors.New("no replicas left to send the snapshot to")
+
+// rdbTransfer is a snapshot sent to one or more replicas for a full resync.
+//
+// A disk-based transfer writes the snapshot to the RDB file like BGSAVE,
+// then sends the file with its length. Replicas asking for a full resync
+// while the file is written share it, starting from the stream the
+// backlog holds since the snapshot.
+//
+// A diskless transfer streams the snapshot straight to the sockets of its
+// replicas, framed by $EOF:<mark> and the mark as the length is not known
+// up front. It starts repl-diskless-sync-delay after the first replica
+// asked, so that replicas arriving meanwhile share the same snapshot.
+type rdbTransfer struct {
+	diskless bool
+	replid   string
+	offset   int64
+	dirty    int64
+	replicas []*replica
+	written  bool // the RDB file of a disk-based transfer is complete
+}
+
+// queueFullSyncLocked adds r to a transfer. It returns the transfer when
+// it should start now. Caller must hold s.aof.propMu and s.repl.mu.
+func (s *Store) queueFullSyncLocked(r *replica) *rdbTransfer {
+	rs := &s.repl
+	r.state = replicaStateWait
+	if !rs.disklessSync {
+		if t := rs.diskSync; t != nil && !t.written {
+			if data, ok := rs.backlog.readFrom(t.offset + 1); ok {
+				r.state, r.buf = replicaStateSendBulk, data
+				t.replicas = append(t.replicas, r)
+				return nil
+			}
+		}
+		return &rdbTransfer{replicas: []*replica{r}}
+	}
+	t := rs.pendingSync
+	if t == nil {
+		t = &rdbTransfer{diskless: true}
+		rs.pendingSync = t
+		time.AfterFunc(rs.disklessSyncDelay, func() { s.startPendingSync(t) })
+	}
+	t.replicas = append(t.replicas, r)
+	if rs.disklessSyncMaxReplicas > 0 && len(t.replicas) >= rs.disklessSyncMaxReplicas {
+		rs.pendingSync = nil
+		return t
+	}
+	return nil
+}
+
+func (s *Store) startPendingSync(t *rdbTransfer) {
+	s.aof.propMu.Lock()
+	defer s.aof.propMu.Unlock()
+	rs := &s.repl
+	rs.mu.Lock()
+	if rs.pendingSync != t {
+		// Started early by repl-diskless-sync-max-replicas.
+		rs.mu.Unlock()
+		return
+	}
+	rs.pendingSync = nil
+	rs.mu.Unlock()
+	s.startTransfer(t)
+}
+
+// startTransfer takes the snapshot of t. From then on its replicas are
+// queued the stream. Caller must hold s.aof.propMu.
+func (s *Store) startTransfer(t *rdbTransfer) {
+	rs := &s.repl
+	rs.mu.Lock()
+	t.replid, t.offset = rs.replid, rs.offset
+	for _, r := range t.replicas {
+		r.mu.Lock()
+		r.state = replicaStateSendBulk
+		r.mu.Unlock()
+	}
+	if !t.diskless {
+		rs.diskSync = t
+	}
+	rs.mu.Unlock()
+	t.dirty = s.persistence.dirty.Load()
+	log.Printf("Starting %s full resynchronization of %d replicas", transferKind(t), len(t.replicas))
+	entries, release := s.snapshot()
+	go func() {
+		s.runTransfer(t, entries)
+		release()
+	}()
+}
+
+func transferKind(t *rdbTransfer) string {
+	if t.diskless {
+		return "diskless"
+	}
+	return "disk-based"
+}
+
+func (s *Store) runTransfer(t *rdbTransfer, entries []rdbEntry) {
+	if t.diskless {
+		s.streamRDB(t, entries)
+		return
+	}
+	data, err := s.saveForReplication(t, entries)
+	rs := &s.repl
+	rs.mu.Lock()
+	t.written = true
+	if rs.diskSync == t {
+		rs.diskSync = nil
+	}
+	replicas := t.replicas
+	rs.mu.Unlock()
+	for _, r := range replicas {
+		if err != nil {
+			r.fail(err)
+			continue
+		}
+		go r.sendRDBFile(t, data)
+	}
+}
+
+// saveForReplication writes the snapshot of t to the RDB file as BGSAVE
+// would, once any save in progress is done, and returns the file.
+func (s *Store) saveForReplication(t *rdbTransfer, entries []rdbEntry) ([]byte, error) {
+	dir, dbfilename, _, err := s.beginSave(true)
+	for err == errSaveInProgress {
+		time.Sleep(saveCheckInterval)
+		dir, dbfilename, _, err = s.beginSave(true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = writeRDBFile(dir, dbfilename, entries)
+	s.endSave(t.dirty, err)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, dbfilename))
+}
+
+func (r *replica) sendRDBFile(t *rdbTransfer, data []byte) {
+	conn := r.client.conn
+	conn.SetWriteDeadline(time.Now().Add(r.timeout))
+	_, err := fmt.Fprintf(conn, "+FULLRESYNC %s %d\r\n$%d\r\n", t.replid, t.offset, len(data))
+	if err == nil {
+		_, err = conn.Write(data)
+	}
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	r.goOnline()
+}
+
+// streamRDB writes the snapshot of a diskless transfer to all its
+// replicas at once.
+func (s *Store) streamRDB(t *rdbTransfer, entries []rdbEntry) {
+	s.repl.mu.Lock()
+	fanout := &replicaFanout{replicas: append([]*replica(nil), t.replicas...)}
+	s.repl.mu.Unlock()
+	mark := newReplID()
+	w := bufio.NewWriterSize(fanout, 64<<10)
+	fmt.Fprintf(w, "+FULLRESYNC %s %d\r\n$EOF:%s\r\n", t.replid, t.offset, mark)
+	err := writeRDB(w, entries, false)
+	if err == nil {
+		w.WriteString(mark)
+		err = w.Flush()
+	}
+	for _, r := range fanout.replicas {
+		if err != nil {
+			r.fail(err)
+			continue
+		}
+		go r.goOnline()
+	}
+}
+
+// replicaFanout writes to the connections of several replicas, dropping
+// those that fail.
+type replicaFanout struct {
+	replicas []*replica
+}
+
+func (f *replicaFanout) Write(p []byte) (int, error) {
+	live := f.replicas[:0]
+	for _, r := range f.replicas {
+		r.client.conn.SetWriteDeadline(time.Now().Add(r.timeout))
+		if _, err := r.client.conn.Write(p); err != nil {
+			r.fail(err)
+			continue
+		}
+		live = append(live, r)
+	}
+	f.replicas = live
+	if len(live) == 0 {
+		return 0, errNoReplicasLeft
+	}
+	return len(p), nil
+}
+
+func (r *replica) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		log.Printf("Full resync of replica %s:%d failed: %v", r.addr, r.port, err)
+		r.closeLocked()
+	}
+}
+
+// goOnline sends the replica the stream queued since the snapshot, and
+// from then on the live stream.
+func (r *replica) goOnline() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.state = replicaStateOnline
+	r.mu.Unlock()
+	log.Printf("Synchronization with replica %s:%d succeeded", r.addr, r.port)
+	r.writeLoop()
+}
@@ -0,0 +1,199 @@
+package redis
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// keyIndex is a chained hash table of key names with a power of two number
+// of buckets. SCAN walks it with Redis' reverse binary cursor, which visits
+// every bucket of the current table exactly once, and all keys that stayed
+// in the table for the whole iteration at least once, even when the table
+// doubles or halves between calls. The zero value is an empty index.
+type keyIndex struct {
+	seed    maphash.Seed
+	buckets [][]string
+	count   int
+}
+
+const keyIndexMinSize = 4
+
+func (ix *keyIndex) bucketOf(key string) int {
+	return int(maphash.String(ix.seed, key) & uint64(len(ix.buckets)-1))
+}
+
+// add inserts key, which must not already be present.
+func (ix *keyIndex) add(key string) {
+	if ix.buckets == nil {
+		ix.seed = maphash.MakeSeed()
+		ix.buckets = make([][]string, keyIndexMinSize)
+	}
+	if ix.count >= len(ix.buckets) {
+		ix.resize(len(ix.buckets) * 2)
+	}
+	b := ix.bucketOf(key)
+	ix.buckets[b] = append(ix.buckets[b], key)
+	ix.count++
+}
+
+func (ix *keyIndex) remove(key string) {
+	if ix.buckets == nil {
+		return
+	}
+	b := ix.bucketOf(key)
+	bucket := ix.buckets[b]
+	for i, k := range bucket {
+		if k == key {
+			last := len(bucket) - 1
+			bucket[i] = bucket[last]
+			bucket[last] = ""
+			ix.buckets[b] = bucket[:last]
+			ix.count--
+			break
+		}
+	}
+	// Shrink below 10% fill, like Redis' dictionaries.
+	if len(ix.buckets) > keyIndexMinSize && ix.count*10 < len(ix.buckets) {
+		ix.resize(len(ix.buckets) / 2)
+	}
+}
+
+func (ix *keyIndex) resize(size int) {
+	old := ix.buckets
+	ix.buckets = make([][]string, size)
+	for _, bucket := range old {
+		for _, key := range bucket {
+			b := ix.bucketOf(key)
+			ix.buckets[b] = append(ix.buckets[b], key)
+		}
+	}
+}
+
+// scan calls fn for each key in the bucket at cursor and returns the next
+// cursor, or 0 when the iteration is complete. The cursor is incremented in
+// its reversed bits, so the buckets still to visit are the same set whether
+// the table has since grown or shrunk.
+func (ix *keyIndex) scan(cursor uint64, fn func(key string)) uint64 {
+	if ix.count == 0 {
+		return 0
+	}
+	mask := uint64(len(ix.buckets) - 1)
+	for _, key := range ix.buckets[cursor&mask] {
+		fn(key)
+	}
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// Keys returns the keys matching the glob-style pattern.
+func (s *Store) Keys(pattern string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := pattern == "*"
+	keys := []string{}
+	for key := range s.data {
+		if s.volatileKeyMap.isExpired(key) {
+			continue
+		}
+		if all || stringMatch(pattern, key, false) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Scan continues a SCAN from cursor, visiting buckets until about count keys
+// were seen. Matching and type filtering happen after, so fewer keys than
+// count may be returned. typ is empty for no type filter.
+func (s *Store) Scan(cursor uint64, count int, pattern, typ string) (uint64, []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var seen []string
+	for maxIterations := count * 10; ; {
+		cursor = s.index.scan(cursor, func(key string) {
+			seen = append(seen, key)
+		})
+		maxIterations--
+		if cursor == 0 || maxIterations <= 0 || len(seen) >= count {
+			break
+		}
+	}
+	keys := seen[:0]
+	for _, key := range seen {
+		val, exists := s.peekKey(key)
+		if !exists {
+			continue
+		}
+		if pattern != "*" && !stringMatch(pattern, key, false) {
+			continue
+		}
+		if typ != "" && !strings.EqualFold(typ, typeName(val)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return cursor, keys
+}
+
+func handleKeys(store *Store, args []parser.Value) parser.Value {
+	pattern, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	keys := store.Keys(string(pattern))
+	reply := make(parser.Array, len(keys))
+	for i, key := range keys {
+		reply[i] = parser.BulkString(key)
+	}
+	return reply
+}
+
+func handleScan(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	cursor, err := strconv.ParseUint(strs[0], 10, 64)
+	if err != nil {
+		return parser.Error("ERR invalid cursor")
+	}
+	count, pattern, typ := 10, "*", ""
+	for i := 1; i < len(strs); i += 2 {
+		if i+1 >= len(strs) {
+			return parser.Error("ERR syntax error")
+		}
+		switch strings.ToUpper(strs[i]) {
+		case "MATCH":
+			pattern = strs[i+1]
+		case "COUNT":
+			n, errReply := intArg(args[i+2])
+			if errReply != nil {
+				return errReply
+			}
+			if n < 1 {
+				return parser.Error("ERR syntax error")
+			}
+			count = n
+		case "TYPE":
+			typ = strs[i+1]
+			if !knownTypeName(typ) {
+				return parser.Error(fmt.Sprintf("ERR unknown type name '%s'", typ))
+			}
+		default:
+			return parser.Error("ERR syntax error")
+		}
+	}
+	next, keys := store.Scan(cursor, count, pattern, typ)
+	reply := make(parser.Array, len(keys))
+	for i, key := range keys {
+		reply[i] = parser.BulkString(key)
+	}
+	return parser.Array{parser.BulkString(strconv.FormatUint(next, 10)), reply}
+}
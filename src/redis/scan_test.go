@@ -0,0 +1,134 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+	"pgregory.net/rapid"
+)
+
+func TestScanStableAcrossResize(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		store := newStore()
+		initial := rapid.IntRange(0, 300).Draw(t, "initial")
+		for i := 0; i < initial; i++ {
+			store.Set(fmt.Sprintf("stable:%d", i), []byte("v"))
+		}
+		seen := make(map[string]bool)
+		next := 0
+		var cursor uint64
+		for {
+			var keys []string
+			cursor, keys = store.Scan(cursor, rapid.IntRange(1, 20).Draw(t, "count"), "*", "")
+			for _, k := range keys {
+				seen[k] = true
+			}
+			if cursor == 0 {
+				break
+			}
+			// Grow or shrink the table between calls.
+			if rapid.Bool().Draw(t, "grow") {
+				for n := rapid.IntRange(0, 200).Draw(t, "add"); n > 0; n-- {
+					store.Set(fmt.Sprintf("tmp:%d", next), []byte("v"))
+					next++
+				}
+			} else {
+				for i := 0; i < next; i++ {
+					store.Del(fmt.Sprintf("tmp:%d", i))
+				}
+			}
+		}
+		for i := 0; i < initial; i++ {
+			if key := fmt.Sprintf("stable:%d", i); !seen[key] {
+				t.Fatalf("SCAN missed %s", key)
+			}
+		}
+	})
+}
+
+func TestKeysAndScan(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	sendCmd(t, conn, reader, "MSET user:1 a user:2 b other c")
+	sendCmd(t, conn, reader, "RPUSH user:list x")
+	sendCmd(t, conn, reader, "PSETEX user:gone 1 v")
+
+	sorted := func(v parser.Value) []string {
+		var out []string
+		for _, k := range v.(parser.Array) {
+			out = append(out, string(k.(parser.BulkString)))
+		}
+		sort.Strings(out)
+		return out
+	}
+	scanAll := func(args string) []string {
+		var keys []string
+		cursor := "0"
+		for {
+			resp := sendCmd(t, conn, reader, "SCAN "+cursor+args).(parser.Array)
+			cursor = string(resp[0].(parser.BulkString))
+			keys = append(keys, sorted(resp[1])...)
+			if cursor == "0" {
+				break
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	tests := []struct {
+		name string
+		got  []string
+		want string
+	}{
+		{"KEYS *", sorted(sendCmd(t, conn, reader, "KEYS *")), "[other user:1 user:2 user:list]"},
+		{"KEYS user:?", sorted(sendCmd(t, conn, reader, "KEYS user:?")), "[user:1 user:2]"},
+		{"KEYS user:[^1]*", sorted(sendCmd(t, conn, reader, "KEYS user:[^1]*")), "[user:2 user:list]"},
+		{"SCAN", scanAll(""), "[other user:1 user:2 user:list]"},
+		{"SCAN MATCH", scanAll(" MATCH user:* COUNT 1"), "[user:1 user:2 user:list]"},
+		{"SCAN TYPE", scanAll(" TYPE LIST"), "[user:list]"},
+		{"SCAN MATCH TYPE", scanAll(" MATCH o* TYPE string"), "[other]"},
+		{"SCAN TYPE hash", scanAll(" TYPE hash"), "[]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.got); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	errs := []struct {
+		cmd  string
+		want parser.Value
+	}{
+		{"SCAN x", parser.Error("ERR invalid cursor")},
+		{"SCAN 0 COUNT 0", parser.Error("ERR syntax error")},
+		{"SCAN 0 COUNT x", parser.Error("ERR value is not an integer or out of range")},
+		{"SCAN 0 MATCH", parser.Error("ERR syntax error")},
+		{"SCAN 0 NOPE x", parser.Error("ERR syntax error")},
+		{"SCAN 0 TYPE bogus", parser.Error("ERR unknown type name 'bogus'")},
+	}
+	for _, tt := range errs {
+		if resp := sendCmd(t, conn, reader, tt.cmd); resp != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.cmd, tt.want, resp)
+		}
+	}
+
+	resp := sendCmd(t, conn, reader, "CONFIG GET list-*").(parser.Array)
+	if len(resp) != 4 || string(resp[0].(parser.BulkString)) != "list-compress-depth" {
+		t.Errorf("unexpected CONFIG GET reply %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "CONFIG GET MAXMEM*").(parser.Array); len(resp) != 2 {
+		t.Errorf("expected CONFIG GET patterns to ignore case, got %v", resp)
+	}
+}
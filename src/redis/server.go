@@ -0,0 +1,1052 @@
+package redis
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+const (
+	SERVER_PORT   = "6379"
+	READ_TIMEOUT  = 5 * time.Minute
+	WRITE_TIMEOUT = 10 * time.Second
+)
+
+type CommandHandler func(store *Store, args []parser.Value) parser.Value
+
+type CommandSpec struct {
+	handler CommandHandler
+	arity   int     // positive = exact, negative = minimum (abs(arity)-1)
+	keys    keySpec // noKeys for a command without key arguments
+}
+
+// ClientCommandHandler is a CommandHandler that also needs the calling
+// connection, e.g. to block it or to look up other clients.
+type ClientCommandHandler func(client *Client, store *Store, args []parser.Value) parser.Value
+
+type ClientCommandSpec struct {
+	handler ClientCommandHandler
+	arity   int
+	keys    keySpec // noKeys for a command without key arguments
+}
+
+var commands = map[string]CommandSpec{
+	"PING": {handlePing, 1, noKeys},
+	"ECHO": {handleEcho, 2, noKeys},
+	"GET":  {handleGet, 2, oneKey},
+	"SET":  {handleSet, -3, oneKey},
+	"SETNX":  {handleSetNX, 3, oneKey},
+	"SETEX":  {handleSetEX, 4, oneKey},
+	"PSETEX": {handlePSetEX, 4, oneKey},
+	"GETSET": {handleGetSet, 3, oneKey},
+	"GETDEL": {handleGetDel, 2, oneKey},
+	"GETEX":  {handleGetEx, -2, oneKey},
+	"MGET":     {handleMGet, -2, allKeys},
+	"MSET":     {handleMSet, -3, keySpec{first: 1, last: -1, step: 2}},
+	"MSETNX":   {handleMSetNX, -3, keySpec{first: 1, last: -1, step: 2}},
+	"APPEND":   {handleAppend, 3, oneKey},
+	"STRLEN":   {handleStrLen, 2, oneKey},
+	"GETRANGE": {handleGetRange, 4, oneKey},
+	"SUBSTR":   {handleGetRange, 4, oneKey},
+	"SETRANGE": {handleSetRange, 4, oneKey},
+	"LCS":      {handleLCS, -3, twoKeys},
+	"DEL":  {handleDel, -2, allKeys},
+	"UNLINK":    {handleDel, -2, allKeys},
+	"EXISTS":    {handleExists, -2, allKeys},
+	"TYPE":      {handleType, 2, oneKey},
+	"RENAME":    {handleRename, 3, twoKeys},
+	"RENAMENX":  {handleRenameNX, 3, twoKeys},
+	"COPY":      {handleCopy, -3, twoKeys},
+	"TOUCH":     {handleTouch, -2, allKeys},
+	"RANDOMKEY": {handleRandomKey, 1, noKeys},
+	"DBSIZE":    {handleDBSize, 1, noKeys},
+	"OBJECT":    {handleObject, -2, keySpec{first: 2, last: 2, step: 1}},
+	"KEYS":      {handleKeys, 2, noKeys},
+	"SCAN":      {handleScan, -2, noKeys},
+	"SORT":      {handleSort, -2, keySpec{first: 1, last: 1, step: 1, extra: sortStoreKey}},
+	"SORT_RO":   {handleSortRO, -2, oneKey},
+	"DUMP":      {handleDump, 2, oneKey},
+	"RESTORE":   {handleRestore, -4, oneKey},
+	"SAVE":      {handleSave, 1, noKeys},
+	"BGSAVE":    {handleBGSave, -1, noKeys},
+	"LASTSAVE":  {handleLastSave, 1, noKeys},
+	"BGREWRITEAOF": {handleBGRewriteAOF, 1, noKeys},
+	"REPLICAOF": {handleReplicaOf, 3, noKeys},
+	"SLAVEOF":   {handleReplicaOf, 3, noKeys},
+	"ROLE":      {handleRole, 1, noKeys},
+	"INFO":      {handleInfo, -1, noKeys},
+	"CLUSTER":   {handleCluster, -2, noKeys},
+	"INCR": {handleIncr, 2, oneKey},
+	"DECR": {handleDecr, 2, oneKey},
+	"INCRBY":      {handleIncrBy, 3, oneKey},
+	"DECRBY":      {handleDecrBy, 3, oneKey},
+	"INCRBYFLOAT": {handleIncrByFloat, 3, oneKey},
+	"CONFIG": {handleConfig,-2, noKeys},
+	"EXPIRE": {handleExpire, -3, oneKey},
+	"EXPIREAT":{handleExpire, -3, oneKey},
+	"PEXPIRE":     {handleExpire, -3, oneKey},
+	"PEXPIREAT":   {handleExpire, -3, oneKey},
+	"TTL":     {handleTTL, 2, oneKey},
+	"PTTL":        {handlePTTL, 2, oneKey},
+	"EXPIRETIME":  {handleExpireTime, 2, oneKey},
+	"PEXPIRETIME": {handlePExpireTime, 2, oneKey},
+	"PERSIST": {handlePersist, 2, oneKey},
+	"LPUSH":  {handleLPush, -3, oneKey},
+	"RPUSH":  {handleRPush, -3, oneKey},
+	"LPOP":   {handleLPop, -2, oneKey},
+	"RPOP":   {handleRPop, -2, oneKey},
+	"LRANGE": {handleLRange, 4, oneKey},
+	"LLEN":   {handleLLen, 2, oneKey},
+	"LINDEX": {handleLIndex, 3, oneKey},
+	"LSET":   {handleLSet, 4, oneKey},
+	"LINSERT": {handleLInsert, 5, oneKey},
+	"LREM":   {handleLRem, 4, oneKey},
+	"LTRIM":  {handleLTrim, 4, oneKey},
+	"LPOS":   {handleLPos, -3, oneKey},
+	"LMOVE":  {handleLMove, 5, twoKeys},
+	"LMPOP":  {handleLMPop, -4, keySpec{numkeys: 1}},
+	"LPUSHX": {handleLPushX, -3, oneKey},
+	"RPUSHX": {handleRPushX, -3, oneKey},
+	"SETBIT":      {handleSetBit, 4, oneKey},
+	"GETBIT":      {handleGetBit, 3, oneKey},
+	"BITCOUNT":    {handleBitCount, -2, oneKey},
+	"BITPOS":      {handleBitPos, -3, oneKey},
+	"BITOP":       {handleBitOp, -4, keySpec{first: 2, last: -1, step: 1}},
+	"BITFIELD":    {handleBitField, -2, oneKey},
+	"BITFIELD_RO": {handleBitFieldRO, -2, oneKey},
+	"PFADD":      {handlePFAdd, -2, oneKey},
+	"PFCOUNT":    {handlePFCount, -2, allKeys},
+	"PFMERGE":    {handlePFMerge, -2, allKeys},
+	"PFDEBUG":    {handlePFDebug, -3, keySpec{first: 2, last: 2, step: 1}},
+	"PFSELFTEST": {handlePFSelfTest, 1, noKeys},
+	"ZSCORE":         {handleZScore, 3, oneKey},
+	"ZCARD":          {handleZCard, 2, oneKey},
+	"ZREM":           {handleZRem, -3, oneKey},
+	"GEOADD":         {handleGeoAdd, -5, oneKey},
+	"GEOPOS":         {handleGeoPos, -2, oneKey},
+	"GEODIST":        {handleGeoDist, -4, oneKey},
+	"GEOHASH":        {handleGeoHash, -2, oneKey},
+	"GEOSEARCH":      {handleGeoSearch, -7, oneKey},
+	"GEOSEARCHSTORE": {handleGeoSearchStore, -8, twoKeys},
+	"JSON.SET":       {handleJSONSet, -4, oneKey},
+	"JSON.GET":       {handleJSONGet, -2, oneKey},
+	"JSON.MGET":      {handleJSONMGet, -3, keysBarLast},
+	"JSON.DEL":       {handleJSONDel, -2, oneKey},
+	"JSON.FORGET":    {handleJSONDel, -2, oneKey},
+	"JSON.TYPE":      {handleJSONType, -2, oneKey},
+	"JSON.NUMINCRBY": {handleJSONNumIncrBy, 4, oneKey},
+	"JSON.STRAPPEND": {handleJSONStrAppend, -3, oneKey},
+	"JSON.ARRAPPEND": {handleJSONArrAppend, -4, oneKey},
+	"JSON.ARRINSERT": {handleJSONArrInsert, -5, oneKey},
+	"JSON.ARRPOP":    {handleJSONArrPop, -2, oneKey},
+	"JSON.ARRLEN":    {handleJSONArrLen, -2, oneKey},
+	"JSON.OBJKEYS":   {handleJSONObjKeys, -2, oneKey},
+	"BF.RESERVE":     {handleBFReserve, -4, oneKey},
+	"BF.ADD":         {handleBFAdd, 3, oneKey},
+	"BF.MADD":        {handleBFMAdd, -3, oneKey},
+	"BF.EXISTS":      {handleBFExists, 3, oneKey},
+	"BF.MEXISTS":     {handleBFMExists, -3, oneKey},
+	"BF.INFO":        {handleBFInfo, -2, oneKey},
+	"CF.RESERVE":     {handleCFReserve, -3, oneKey},
+	"CF.ADD":         {handleCFAdd, 3, oneKey},
+	"CF.ADDNX":       {handleCFAddNX, 3, oneKey},
+	"CF.INSERT":      {handleCFInsert, -4, oneKey},
+	"CF.INSERTNX":    {handleCFInsertNX, -4, oneKey},
+	"CF.EXISTS":      {handleCFExists, 3, oneKey},
+	"CF.MEXISTS":     {handleCFMExists, -3, oneKey},
+	"CF.DEL":         {handleCFDel, 3, oneKey},
+	"CF.COUNT":       {handleCFCount, 3, oneKey},
+	"CF.INFO":        {handleCFInfo, 2, oneKey},
+	"CMS.INITBYDIM":  {handleCMSInitByDim, 4, oneKey},
+	"CMS.INITBYPROB": {handleCMSInitByProb, 4, oneKey},
+	"CMS.INCRBY":     {handleCMSIncrBy, -4, oneKey},
+	"CMS.QUERY":      {handleCMSQuery, -3, oneKey},
+	"CMS.MERGE":      {handleCMSMerge, -4, keySpec{first: 1, last: 1, step: 1, numkeys: 2}},
+	"CMS.INFO":       {handleCMSInfo, 2, oneKey},
+	"TOPK.RESERVE":   {handleTopKReserve, -3, oneKey},
+	"TOPK.ADD":       {handleTopKAdd, -3, oneKey},
+	"TOPK.INCRBY":    {handleTopKIncrBy, -4, oneKey},
+	"TOPK.QUERY":     {handleTopKQuery, -3, oneKey},
+	"TOPK.LIST":      {handleTopKList, -2, oneKey},
+	"TOPK.INFO":      {handleTopKInfo, 2, oneKey},
+}
+
+var clientCommands = map[string]ClientCommandSpec{
+	"CLIENT": {handleClient, -2, noKeys},
+	"BLPOP":  {handleBLPop, -3, keysBarLast},
+	"BRPOP":  {handleBRPop, -3, keysBarLast},
+	"BLMOVE": {handleBLMove, 6, twoKeys},
+	"BLMPOP": {handleBLMPop, -5, keySpec{numkeys: 2}},
+	"REPLCONF": {handleReplConf, -1, noKeys},
+	"PSYNC":  {handlePSync, 3, noKeys},
+	"WAIT":   {handleWait, 3, noKeys},
+	"WAITAOF": {handleWaitAOF, 4, noKeys},
+	"ASKING":  {handleAsking, 1, noKeys},
+}
+
+// writeCommands are the commands that may modify the dataset. Each call
+// that does not fail counts as one change towards the save rules. SORT is
+// a write only with STORE; see isWriteCommand.
+var writeCommands = map[string]bool{
+	"SET": true, "SETNX": true, "SETEX": true, "PSETEX": true, "GETSET": true,
+	"GETDEL": true, "GETEX": true, "MSET": true, "MSETNX": true, "APPEND": true,
+	"SETRANGE": true, "INCR": true, "DECR": true, "INCRBY": true, "DECRBY": true,
+	"INCRBYFLOAT": true,
+	"DEL": true, "UNLINK": true, "RENAME": true, "RENAMENX": true, "COPY": true,
+	"RESTORE": true, "EXPIRE": true, "EXPIREAT": true,
+	"PEXPIRE": true, "PEXPIREAT": true, "PERSIST": true,
+	"LPUSH": true, "RPUSH": true, "LPOP": true, "RPOP": true, "LSET": true,
+	"LINSERT": true, "LREM": true, "LTRIM": true, "LMOVE": true, "LMPOP": true,
+	"LPUSHX": true, "RPUSHX": true, "BLPOP": true, "BRPOP": true,
+	"BLMOVE": true, "BLMPOP": true,
+	"SETBIT": true, "BITOP": true, "BITFIELD": true,
+	"PFADD": true, "PFMERGE": true,
+	"ZREM": true, "GEOADD": true, "GEOSEARCHSTORE": true,
+	"JSON.SET": true, "JSON.DEL": true, "JSON.FORGET": true,
+	"JSON.NUMINCRBY": true, "JSON.STRAPPEND": true, "JSON.ARRAPPEND": true,
+	"JSON.ARRINSERT": true, "JSON.ARRPOP": true,
+	"BF.RESERVE": true, "BF.ADD": true, "BF.MADD": true,
+	"CF.RESERVE": true, "CF.ADD": true, "CF.ADDNX": true, "CF.INSERT": true,
+	"CF.INSERTNX": true, "CF.DEL": true,
+	"CMS.INITBYDIM": true, "CMS.INITBYPROB": true, "CMS.INCRBY": true,
+	"CMS.MERGE": true,
+	"TOPK.RESERVE": true, "TOPK.ADD": true, "TOPK.INCRBY": true,
+}
+
+// isWriteCommand reports whether a call of cmd with args may modify the
+// dataset: cmd is in writeCommands, or is SORT with a STORE destination.
+func isWriteCommand(cmd string, args parser.Array) bool {
+	if cmd == "SORT" {
+		strs, ok := bulkStringArgs(args)
+		return ok && len(sortStoreKey(strs)) > 0
+	}
+	return writeCommands[cmd]
+}
+
+func handlePing(store *Store, args []parser.Value) parser.Value {
+	return parser.SimpleString("PONG")
+}
+
+func handleEcho(store *Store, args []parser.Value) parser.Value {
+	if bs, ok := args[1].(parser.BulkString); ok {
+		return bs
+	}
+	return parser.Error("ERR wrong argument type")
+}
+
+func handleGet(store *Store, args []parser.Value) parser.Value {
+	bs, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	val, exists, err := store.GetWithTypeCheck(string(bs))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !exists {
+		return parser.BulkString(nil)
+	}
+	return parser.BulkString(val)
+}
+
+func handleDel(store *Store, args []parser.Value) parser.Value {
+	keys := make([]string, 0, len(args)-1)
+	for i := 1; i < len(args); i++ {
+		if bs, ok := args[i].(parser.BulkString); ok {
+			keys = append(keys, string(bs))
+		} else {
+			return parser.Error("ERR wrong argument type")
+		}
+	}
+	count := store.Del(keys...)
+	return parser.Integer(count)
+}
+
+func handleIncr(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+
+	newVal, err := store.Incr(string(key))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(newVal)
+}
+
+func handleDecr(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+
+	newVal, err := store.Decr(string(key))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(newVal)
+}
+
+func handleLPush(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	elements := make([][]byte, 0, len(args)-2)
+	for i := 2; i < len(args); i++ {
+		bs, ok := args[i].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+		elements = append(elements, []byte(bs))
+	}
+	n, err := store.LPush(string(key), elements...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleRPush(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	elements := make([][]byte, 0, len(args)-2)
+	for i := 2; i < len(args); i++ {
+		bs, ok := args[i].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+		elements = append(elements, []byte(bs))
+	}
+	n, err := store.RPush(string(key), elements...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleLPop(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	count := 0
+	hasCount := false
+	if len(args) > 2 {
+		countBS, ok := args[2].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+		c, err := strconv.Atoi(string(countBS))
+		if err != nil {
+			return parser.Error("ERR value is not an integer or out of range")
+		}
+		count = c
+		hasCount = true
+	}
+	if !hasCount {
+		count = 1
+	}
+	result, err := store.LPop(string(key), count)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if result == nil {
+		return parser.BulkString(nil)
+	}
+	if !hasCount {
+		return parser.BulkString(result[0])
+	}
+	arr := make([]parser.Value, len(result))
+	for i, v := range result {
+		arr[i] = parser.BulkString(v)
+	}
+	return parser.Array(arr)
+}
+
+func handleRPop(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	count := 0
+	hasCount := false
+	if len(args) > 2 {
+		countBS, ok := args[2].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+		c, err := strconv.Atoi(string(countBS))
+		if err != nil {
+			return parser.Error("ERR value is not an integer or out of range")
+		}
+		count = c
+		hasCount = true
+	}
+	if !hasCount {
+		count = 1
+	}
+	result, err := store.RPop(string(key), count)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if result == nil {
+		return parser.BulkString(nil)
+	}
+	if !hasCount {
+		return parser.BulkString(result[0])
+	}
+	arr := make([]parser.Value, len(result))
+	for i, v := range result {
+		arr[i] = parser.BulkString(v)
+	}
+	return parser.Array(arr)
+}
+
+func handleLRange(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	startBS, ok := args[2].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	stopBS, ok := args[3].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	start, err := strconv.Atoi(string(startBS))
+	if err != nil {
+		return parser.Error("ERR value is not an integer or out of range")
+	}
+	stop, err := strconv.Atoi(string(stopBS))
+	if err != nil {
+		return parser.Error("ERR value is not an integer or out of range")
+	}
+	result, err := store.LRange(string(key), start, stop)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	arr := make([]parser.Value, len(result))
+	for i, v := range result {
+		arr[i] = parser.BulkString(v)
+	}
+	return parser.Array(arr)
+}
+
+func handleLLen(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	n, err := store.LLen(string(key))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+// intArg parses a command argument as an int, replying with the standard
+// integer error otherwise.
+func intArg(v parser.Value) (int, parser.Value) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return 0, parser.Error("ERR wrong argument type")
+	}
+	n, err := strconv.Atoi(string(bs))
+	if err != nil {
+		return 0, parser.Error("ERR value is not an integer or out of range")
+	}
+	return n, nil
+}
+
+func handleLIndex(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	index, errReply := intArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	val, found, err := store.LIndex(string(key), index)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !found {
+		return parser.BulkString(nil)
+	}
+	return parser.BulkString(val)
+}
+
+func handleLSet(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	val, ok2 := args[3].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	index, errReply := intArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	if err := store.LSet(string(key), index, []byte(val)); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleLInsert(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	var before bool
+	switch strings.ToUpper(strs[1]) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+		before = false
+	default:
+		return parser.Error("ERR syntax error")
+	}
+	n, err := store.LInsert(strs[0], before, []byte(strs[2]), []byte(strs[3]))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleLRem(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	elem, ok2 := args[3].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	count, errReply := intArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	n, err := store.LRem(string(key), count, []byte(elem))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleLTrim(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	start, errReply := intArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	stop, errReply := intArg(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	if err := store.LTrim(string(key), start, stop); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleLPos(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	elem, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	rank, count, maxLen := 1, 0, 0
+	hasCount := false
+	for i := 3; i < len(args); i += 2 {
+		opt, ok := args[i].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+		name := strings.ToUpper(string(opt))
+		if i+1 >= len(args) || (name != "RANK" && name != "COUNT" && name != "MAXLEN") {
+			return parser.Error("ERR syntax error")
+		}
+		n, errReply := intArg(args[i+1])
+		if errReply != nil {
+			return errReply
+		}
+		switch name {
+		case "RANK":
+			if n == 0 {
+				return parser.Error("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				return parser.Error("ERR COUNT can't be negative")
+			}
+			count = n
+			hasCount = true
+		case "MAXLEN":
+			if n < 0 {
+				return parser.Error("ERR MAXLEN can't be negative")
+			}
+			maxLen = n
+		}
+	}
+	if !hasCount {
+		count = 1
+	}
+	matches, err := store.LPos(string(key), []byte(elem), rank, count, maxLen)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !hasCount {
+		if len(matches) == 0 {
+			return parser.BulkString(nil)
+		}
+		return parser.Integer(matches[0])
+	}
+	arr := make([]parser.Value, len(matches))
+	for i, m := range matches {
+		arr[i] = parser.Integer(m)
+	}
+	return parser.Array(arr)
+}
+
+func handleLMove(store *Store, args []parser.Value) parser.Value {
+	src, ok1 := args[1].(parser.BulkString)
+	dst, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	from, ok1 := parseListWhere(args[3])
+	to, ok2 := parseListWhere(args[4])
+	if !ok1 || !ok2 {
+		return parser.Error("ERR syntax error")
+	}
+	elem, err := store.LMove(string(src), string(dst), from, to)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.BulkString(elem)
+}
+
+func handleLMPop(store *Store, args []parser.Value) parser.Value {
+	keys, where, count, errReply := parseMPopArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	key, popped, err := store.LMPop(keys, where, count)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if popped == nil {
+		return parser.Array(nil)
+	}
+	return mpopReply(key, where, popped)
+}
+
+func handleLPushX(store *Store, args []parser.Value) parser.Value {
+	return pushX(store, args, listLeft)
+}
+
+func handleRPushX(store *Store, args []parser.Value) parser.Value {
+	return pushX(store, args, listRight)
+}
+
+func pushX(store *Store, args []parser.Value, where listWhere) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	elements := make([][]byte, len(strs)-1)
+	for i, e := range strs[1:] {
+		elements[i] = []byte(e)
+	}
+	n, err := store.PushX(strs[0], where, elements...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+// expireAtFor converts the argument of EXPIRE, PEXPIRE, EXPIREAT or
+// PEXPIREAT to an absolute expiry time, failing if it overflows a
+// millisecond timestamp.
+func expireAtFor(command string, t int64, now time.Time) (time.Time, bool) {
+	ms := t
+	switch command {
+	case "EXPIRE", "EXPIREAT":
+		if t > math.MaxInt64/1000 || t < math.MinInt64/1000 {
+			return time.Time{}, false
+		}
+		ms = t * 1000
+	}
+	switch command {
+	case "EXPIREAT", "PEXPIREAT":
+		return time.UnixMilli(ms), true
+	}
+	if addOverflows(ms, now.UnixMilli()) {
+		return time.Time{}, false
+	}
+	if ms < math.MaxInt64/int64(time.Millisecond) && ms > math.MinInt64/int64(time.Millisecond) {
+		return now.Add(time.Duration(ms) * time.Millisecond), true
+	}
+	return time.UnixMilli(now.UnixMilli() + ms), true
+}
+
+// parseExpireOptions parses the flags following EXPIRE key time. As in
+// Redis, XX may be combined with GT or LT, but NX with none of the others.
+func parseExpireOptions(args []parser.Value) (expireOptions, parser.Value) {
+	var opts expireOptions
+	for _, arg := range args {
+		bs, ok := arg.(parser.BulkString)
+		if !ok {
+			return opts, parser.Error("ERR wrong argument type")
+		}
+		switch strings.ToUpper(string(bs)) {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GT":
+			opts.gt = true
+		case "LT":
+			opts.lt = true
+		default:
+			return opts, parser.Error("ERR Unsupported option " + string(bs))
+		}
+	}
+	if opts.nx && (opts.xx || opts.gt || opts.lt) {
+		return opts, parser.Error("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if opts.gt && opts.lt {
+		return opts, parser.Error("ERR GT and LT options at the same time are not compatible")
+	}
+	return opts, nil
+}
+
+func handleExpire(store *Store, args []parser.Value) parser.Value {
+	command, ok := args[0].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	cmd := strings.ToUpper(string(command))
+	opts, errReply := parseExpireOptions(args[3:])
+	if errReply != nil {
+		return errReply
+	}
+	timeString, ok := args[2].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+	t, err := strconv.ParseInt(string(timeString), 10, 64)
+		if  err != nil {
+			return parser.Error("ERR value is not an integer or out of range")
+		}
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	now := time.Now()
+	expireAt, ok := expireAtFor(cmd, t, now)
+	if !ok {
+		return parser.Error("ERR invalid expire time in '" + strings.ToLower(cmd) + "' command")
+	}
+	exp := ExpirationTime{expiryTime: expireAt, durationSet: expireAt.Sub(now)}
+	if !store.Expire(string(key), exp, opts) {
+		return parser.Integer(0)
+	}
+	return parser.Integer(1)
+}
+
+func handleTTL(store *Store, args []parser.Value) parser.Value {
+	return ttlReply(store, args, false, false)
+}
+
+func handlePTTL(store *Store, args []parser.Value) parser.Value {
+	return ttlReply(store, args, true, false)
+}
+
+func handleExpireTime(store *Store, args []parser.Value) parser.Value {
+	return ttlReply(store, args, false, true)
+}
+
+func handlePExpireTime(store *Store, args []parser.Value) parser.Value {
+	return ttlReply(store, args, true, true)
+}
+
+// ttlReply reports the remaining TTL of a key, or its absolute expiry as a
+// Unix timestamp, in milliseconds or rounded to the nearest second. A
+// missing key gives -2 and a key without a TTL -1.
+func ttlReply(store *Store, args []parser.Value, ms, abs bool) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if store.Exists(string(key)) == 0 {
+		return parser.Integer(-2)
+	}
+	expiry, err := store.volatileKeyMap.GetSetExpiry(string(key))
+	if err != nil {
+		return parser.Integer(-1)
+	}
+	ttl := expiry.UnixMilli()
+	if !abs {
+		ttl = max(time.Until(expiry).Milliseconds(), 0)
+	}
+	if ms {
+		return parser.Integer(ttl)
+	}
+	return parser.Integer((ttl + 500) / 1000)
+}
+
+func handlePersist(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if !store.isVolatile(string(key)) {
+		return parser.Integer(0)
+	}
+	store.volatileKeyMap.Delete(string(key))
+	return parser.Integer(1)
+}
+
+
+func arityOK(arity, n int) bool {
+	if arity > 0 {
+		return n == arity
+	}
+	return n >= -arity
+}
+
+// dispatch looks up and runs a single command for client.
+func dispatch(client *Client, store *Store, arr parser.Array) parser.Value {
+	var cmdName string
+	switch v := arr[0].(type) {
+	case parser.BulkString:
+		cmdName = string(v)
+	case parser.SimpleString:
+		cmdName = string(v)
+	default:
+		return parser.Error("ERR protocol error")
+	}
+
+	cmd := strings.ToUpper(string(cmdName))
+	write := isWriteCommand(cmd, arr)
+	if write && client.master == nil && store.readOnlyReplica() {
+		return parser.Error("READONLY You can't write against a read only replica.")
+	}
+	if spec, exists := commands[cmd]; exists {
+		if !arityOK(spec.arity, len(arr)) {
+			return parser.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd))
+		}
+		return store.call(client, cmd, arr, write, func() parser.Value { return spec.handler(store, arr) })
+	}
+	if spec, exists := clientCommands[cmd]; exists {
+		if !arityOK(spec.arity, len(arr)) {
+			return parser.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd))
+		}
+		reply := store.countWrite(write, spec.handler(client, store, arr))
+		if write {
+			client.woff = store.replOffset()
+		}
+		return reply
+	}
+	return parser.Error(fmt.Sprintf("ERR unknown command '%s'", cmd))
+}
+
+func connHandler(conn net.Conn, store *Store) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	client := newClient(conn, reader)
+	defer client.close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(READ_TIMEOUT))
+		value, err := parser.Deserialize(reader)
+		if err != nil {
+			if err == io.EOF {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+			return
+		}
+		arr, ok := value.(parser.Array)
+		if !ok || len(arr) == 0 {
+			reply, _ := parser.Serialize(parser.Error("ERR protocol error"))
+			conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			conn.Write(reply)
+			continue
+		}
+
+		result := store.clusterRedirect(client, arr)
+		if result == nil {
+			result = dispatch(client, store, arr)
+		}
+		if client.replica != nil {
+			// Replicas are sent the replication stream, not replies.
+			continue
+		}
+		reply, _ := parser.Serialize(result)
+		conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+		fmt.Println("writing to conn")
+		if _, err := conn.Write(reply); err != nil {
+    		log.Println("write error:", err)
+    		return
+		}
+	}
+}
+
+// Main runs the server with the options given on the command line.
+func Main() {
+	dir := flag.String("dir", ".", "directory for the RDB file and the AOF")
+	dbfilename := flag.String("dbfilename", defaultDBFilename, "name of the RDB file")
+	save := flag.String("save", defaultSaveParams, "snapshot rules as \"<seconds> <changes> ...\", empty to disable")
+	rdbSkipUnsupported := flag.String("rdb-skip-unsupported-types", "no", "drop keys of unsupported types, such as sets, when loading an RDB file instead of failing (yes or no)")
+	appendonly := flag.String("appendonly", "no", "log every write to the append-only file (yes or no)")
+	appendfilename := flag.String("appendfilename", defaultAppendFilename, "prefix of the append-only file names")
+	appenddirname := flag.String("appenddirname", defaultAppendDirname, "directory in dir holding the append-only files")
+	appendfsync := flag.String("appendfsync", aofFsyncEverySec, "when to fsync the append-only file: always, everysec or no")
+	port := flag.String("port", SERVER_PORT, "port to listen on")
+	replicaof := flag.String("replicaof", "", "replicate the master at \"<host> <port>\"")
+	clusterEnabled := flag.String("cluster-enabled", "no", "run as a node of a Redis Cluster (yes or no)")
+	clusterConfigFile := flag.String("cluster-config-file", defaultClusterConfigFile, "name of the cluster configuration file in dir")
+	clusterPort := flag.Int("cluster-port", 0, "port of the cluster bus, 0 for the port plus 10000")
+	clusterNodeTimeout := flag.String("cluster-node-timeout", "15000", "milliseconds a node may be unreachable before it is deemed failing")
+	clusterRequireFullCoverage := flag.String("cluster-require-full-coverage", "yes", "stop serving when some slots are not covered (yes or no)")
+	flag.Parse()
+
+	log.Println("Starting server.")
+
+	store := newStore()
+	for _, opt := range [][2]string{{"dir", *dir}, {"dbfilename", *dbfilename}, {"save", *save}, {"rdb-skip-unsupported-types", *rdbSkipUnsupported}, {"appendfsync", *appendfsync}} {
+		if err := configParams[opt[0]].set(store, opt[1]); err != nil {
+			log.Fatalf("Invalid %s: %v", opt[0], err)
+		}
+	}
+	aofOn, err := parseYesNo(*appendonly)
+	if err != nil {
+		log.Fatalf("Invalid appendonly: %v", err)
+	}
+	if *appendfilename == "" || filepath.Base(*appendfilename) != *appendfilename {
+		log.Fatalf("Invalid appendfilename: appendfilename can't be a path, just a filename")
+	}
+	if *appenddirname == "" || filepath.Base(*appenddirname) != *appenddirname {
+		log.Fatalf("Invalid appenddirname: appenddirname can't be a path, just a directory name")
+	}
+	store.aof.filename = *appendfilename
+	store.aof.dirname = *appenddirname
+
+	if store.repl.port, err = strconv.Atoi(*port); err != nil {
+		log.Fatalf("Invalid port: %v", err)
+	}
+	clusterOn, err := parseYesNo(*clusterEnabled)
+	if err != nil {
+		log.Fatalf("Invalid cluster-enabled: %v", err)
+	}
+	if clusterOn {
+		if *replicaof != "" {
+			log.Fatalf("replicaof directive not allowed in cluster mode")
+		}
+		for _, opt := range [][2]string{{"cluster-node-timeout", *clusterNodeTimeout}, {"cluster-require-full-coverage", *clusterRequireFullCoverage}} {
+			if err := configParams[opt[0]].set(store, opt[1]); err != nil {
+				log.Fatalf("Invalid %s: %v", opt[0], err)
+			}
+		}
+		if *clusterConfigFile == "" || filepath.Base(*clusterConfigFile) != *clusterConfigFile {
+			log.Fatalf("Invalid cluster-config-file: cluster-config-file can't be a path, just a filename")
+		}
+		if *clusterPort < 0 || *clusterPort > 65535 {
+			log.Fatalf("Invalid cluster-port: %d", *clusterPort)
+		}
+		store.cluster.configFile = *clusterConfigFile
+		store.cluster.port = *clusterPort
+		if err := store.enableCluster(); err != nil {
+			log.Fatalf("Can't start in cluster mode: %v", err)
+		}
+	}
+
+	// With the AOF on it holds the most complete dataset, so the RDB file is
+	// only read when there is no AOF yet.
+	start := time.Now()
+	aofFound := false
+	if aofOn {
+		var n int
+		n, aofFound, err = store.LoadAppendOnly()
+		if err != nil {
+			log.Fatalf("Failed loading the append only file: %v", err)
+		}
+		if aofFound {
+			log.Printf("DB loaded from append only file: %d keys and commands in %.3f seconds", n, time.Since(start).Seconds())
+			if err := store.openAppendOnly(); err != nil {
+				log.Fatalf("Can't open the append-only file: %v", err)
+			}
+		}
+	}
+	if !aofFound {
+		rdbPath := filepath.Join(*dir, *dbfilename)
+		loaded, err := store.LoadRDB(rdbPath)
+		if err != nil {
+			log.Fatalf("Failed loading %s: %v", rdbPath, err)
+		}
+		if loaded > 0 {
+			log.Printf("DB loaded from disk: %d keys in %.3f seconds", loaded, time.Since(start).Seconds())
+		}
+		if aofOn {
+			if err := store.StartAppendOnly(); err != nil {
+				log.Fatalf("Can't create the append-only file: %v", err)
+			}
+		}
+	}
+
+	if *replicaof != "" {
+		master := strings.Fields(*replicaof)
+		if len(master) != 2 {
+			log.Fatalf("Invalid replicaof: expected \"<host> <port>\"")
+		}
+		masterPort, err := strconv.Atoi(master[1])
+		if err != nil {
+			log.Fatalf("Invalid replicaof port: %v", err)
+		}
+		store.ReplicaOf(master[0], masterPort)
+	}
+
+	listener, err := net.Listen("tcp", ":"+*port)
+	if err != nil {
+		log.Fatal("Failed to bind to port "+*port+": ", err)
+	}
+	log.Println("Server started on port " + *port)
+	if clusterOn {
+		busPort := strconv.Itoa(store.cluster.myself.busPort)
+		busListener, err := net.Listen("tcp", ":"+busPort)
+		if err != nil {
+			log.Fatal("Failed to bind the cluster bus to port "+busPort+": ", err)
+		}
+		store.startClusterBus(busListener)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Error accepting connection:", err)
+			continue
+		}
+		go connHandler(conn, store)
+	}
+}
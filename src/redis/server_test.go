@@ -1,8 +1,9 @@
-package main
+package redis
 
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"net"
 	"strconv"
 	"testing"
@@ -671,9 +672,9 @@ func TestTTL(t *testing.T) {
 	//get the TTL, should be 3 seconds
 	res := sendCmd(t, conn, reader, "TTL mykey")
 	TTL := int64(res.(parser.Integer))
-	//TTL returns truncated time, will be 2
-	if TTL < 2 || TTL > 2 {
-    	t.Errorf("expected TTL of 2, got %v", TTL)
+	//TTL rounds to the nearest second, will be 3
+	if TTL != 3 {
+    	t.Errorf("expected TTL of 3, got %v", TTL)
 	}
 	
 }
@@ -982,6 +983,173 @@ func TestLLenCommand(t *testing.T) {
 	}
 }
 
+func TestLIndexLSetCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	sendCmd(t, conn, reader, "RPUSH mylist a b c")
+
+	resp := sendCmd(t, conn, reader, "LINDEX mylist -1")
+	if bs, ok := resp.(parser.BulkString); !ok || string(bs) != "c" {
+		t.Errorf("expected 'c', got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LINDEX mylist 10")
+	if resp != nil {
+		t.Errorf("expected nil, got %v", resp)
+	}
+
+	resp = sendCmd(t, conn, reader, "LSET mylist 0 z")
+	if str, ok := resp.(parser.SimpleString); !ok || str != "OK" {
+		t.Errorf("expected OK, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LSET mylist 10 z")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR index out of range" {
+		t.Errorf("expected index out of range, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LSET missing 0 z")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR no such key" {
+		t.Errorf("expected no such key, got %v", resp)
+	}
+}
+
+func TestLInsertLRemLTrimCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	sendCmd(t, conn, reader, "RPUSH mylist a c a")
+
+	resp := sendCmd(t, conn, reader, "LINSERT mylist BEFORE c b")
+	if num, ok := resp.(parser.Integer); !ok || num != 4 {
+		t.Errorf("expected 4, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LINSERT mylist SIDEWAYS c b")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR syntax error" {
+		t.Errorf("expected syntax error, got %v", resp)
+	}
+
+	resp = sendCmd(t, conn, reader, "LREM mylist -1 a")
+	if num, ok := resp.(parser.Integer); !ok || num != 1 {
+		t.Errorf("expected 1, got %v", resp)
+	}
+
+	resp = sendCmd(t, conn, reader, "LTRIM mylist 0 1")
+	if str, ok := resp.(parser.SimpleString); !ok || str != "OK" {
+		t.Errorf("expected OK, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LRANGE mylist 0 -1")
+	arr, ok := resp.(parser.Array)
+	if !ok || len(arr) != 2 {
+		t.Fatalf("expected array of 2, got %v", resp)
+	}
+	expected := []string{"a", "b"}
+	for i, v := range arr {
+		if bs, ok := v.(parser.BulkString); !ok || string(bs) != expected[i] {
+			t.Errorf("index %d: expected %q, got %v", i, expected[i], v)
+		}
+	}
+}
+
+func TestLPosCommand(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	sendCmd(t, conn, reader, "RPUSH mylist a b c 1 2 3 c c")
+
+	resp := sendCmd(t, conn, reader, "LPOS mylist c")
+	if num, ok := resp.(parser.Integer); !ok || num != 2 {
+		t.Errorf("expected 2, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LPOS mylist c RANK -1")
+	if num, ok := resp.(parser.Integer); !ok || num != 7 {
+		t.Errorf("expected 7, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LPOS mylist c COUNT 0 MAXLEN 7")
+	arr, ok := resp.(parser.Array)
+	if !ok || len(arr) != 2 || arr[0] != parser.Integer(2) || arr[1] != parser.Integer(6) {
+		t.Errorf("expected [2 6], got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LPOS mylist x")
+	if resp != nil {
+		t.Errorf("expected nil, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LPOS mylist x COUNT 1")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 0 {
+		t.Errorf("expected empty array, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LPOS mylist c RANK 0")
+	if err, ok := resp.(parser.Error); !ok || !bytes.Contains([]byte(err), []byte("RANK can't be zero")) {
+		t.Errorf("expected RANK error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LPOS mylist c COUNT -1")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR COUNT can't be negative" {
+		t.Errorf("expected COUNT error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LPOS mylist c NOPE x")
+	if resp != parser.Error("ERR syntax error") {
+		t.Errorf("expected a syntax error for an unknown option, got %v", resp)
+	}
+}
+
+func TestLMoveLMPopPushXCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp := sendCmd(t, conn, reader, "LPUSHX mylist a")
+	if num, ok := resp.(parser.Integer); !ok || num != 0 {
+		t.Errorf("expected 0, got %v", resp)
+	}
+	sendCmd(t, conn, reader, "RPUSH mylist a b c")
+	resp = sendCmd(t, conn, reader, "RPUSHX mylist d")
+	if num, ok := resp.(parser.Integer); !ok || num != 4 {
+		t.Errorf("expected 4, got %v", resp)
+	}
+
+	resp = sendCmd(t, conn, reader, "LMOVE mylist other RIGHT LEFT")
+	if bs, ok := resp.(parser.BulkString); !ok || string(bs) != "d" {
+		t.Errorf("expected 'd', got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LMOVE missing other LEFT LEFT")
+	if resp != nil {
+		t.Errorf("expected nil, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LMOVE mylist other UP LEFT")
+	if err, ok := resp.(parser.Error); !ok || string(err) != "ERR syntax error" {
+		t.Errorf("expected syntax error, got %v", resp)
+	}
+
+	resp = sendCmd(t, conn, reader, "LMPOP 2 missing mylist LEFT COUNT 2")
+	arr, ok := resp.(parser.Array)
+	if !ok || len(arr) != 2 {
+		t.Fatalf("expected [key, elements], got %v", resp)
+	}
+	if bs, ok := arr[0].(parser.BulkString); !ok || string(bs) != "mylist" {
+		t.Errorf("expected key mylist, got %v", arr[0])
+	}
+	if elems, ok := arr[1].(parser.Array); !ok || len(elems) != 2 {
+		t.Errorf("expected 2 elements, got %v", arr[1])
+	}
+	resp = sendCmd(t, conn, reader, "LMPOP 1 missing LEFT")
+	if resp != nil {
+		t.Errorf("expected nil, got %v", resp)
+	}
+}
+
 func TestListArityErrors(t *testing.T) {
 	srv := startTestServer(t)
 	defer srv.Close()
@@ -1087,3 +1255,127 @@ func TestWrongTypeCrossCommands(t *testing.T) {
 }
 
 
+
+func TestMillisecondExpiry(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	sendCmd(t, conn, reader, "SET mykey myvalue")
+	if resp := sendCmd(t, conn, reader, "PEXPIRE mykey 1800"); resp != parser.Integer(1) {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	pttl, ok := sendCmd(t, conn, reader, "PTTL mykey").(parser.Integer)
+	if !ok || pttl > 1800 || pttl < 1700 {
+		t.Errorf("expected PTTL close to 1800, got %v", pttl)
+	}
+	// TTL rounds to the nearest second, as in Redis.
+	if resp := sendCmd(t, conn, reader, "TTL mykey"); resp != parser.Integer(2) {
+		t.Errorf("expected TTL 2, got %v", resp)
+	}
+
+	at := time.Now().Add(time.Hour).UnixMilli()
+	sendCmd(t, conn, reader, fmt.Sprintf("PEXPIREAT mykey %d", at))
+	if resp := sendCmd(t, conn, reader, "PEXPIRETIME mykey"); resp != parser.Integer(at) {
+		t.Errorf("expected %d, got %v", at, resp)
+	}
+	if resp := sendCmd(t, conn, reader, "EXPIRETIME mykey"); resp != parser.Integer((at+500)/1000) {
+		t.Errorf("expected %d, got %v", (at+500)/1000, resp)
+	}
+
+	sendCmd(t, conn, reader, "SET plain v")
+	for _, cmd := range []string{"PTTL", "EXPIRETIME", "PEXPIRETIME"} {
+		if resp := sendCmd(t, conn, reader, cmd+" plain"); resp != parser.Integer(-1) {
+			t.Errorf("%s: expected -1 without a TTL, got %v", cmd, resp)
+		}
+		if resp := sendCmd(t, conn, reader, cmd+" missing"); resp != parser.Integer(-2) {
+			t.Errorf("%s: expected -2 for a missing key, got %v", cmd, resp)
+		}
+	}
+	if resp := sendCmd(t, conn, reader, "PEXPIRE missing 100"); resp != parser.Integer(0) {
+		t.Errorf("expected 0 for a missing key, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "PEXPIRE plain 9223372036854775807"); resp != parser.Error("ERR invalid expire time in 'pexpire' command") {
+		t.Errorf("expected invalid expire time, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "PEXPIRE plain -1"); resp != parser.Integer(1) {
+		t.Errorf("expected 1, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "GET plain"); resp != nil {
+		t.Errorf("expected a past expiry to delete the key, got %v", resp)
+	}
+}
+
+func TestExpireGTLT(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	sendCmd(t, conn, reader, "SET k v")
+	// A key without a TTL never expires: GT cannot shorten it, LT can.
+	if resp := sendCmd(t, conn, reader, "EXPIRE k 100 GT"); resp != parser.Integer(0) {
+		t.Errorf("expected GT on a persistent key to fail, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "EXPIRE k 100 LT"); resp != parser.Integer(1) {
+		t.Errorf("expected LT on a persistent key to succeed, got %v", resp)
+	}
+	// GT/LT compare absolute expiry times, whichever command set them.
+	later := time.Now().Add(200 * time.Second).Unix()
+	if resp := sendCmd(t, conn, reader, fmt.Sprintf("EXPIREAT k %d gt", later)); resp != parser.Integer(1) {
+		t.Errorf("expected a later EXPIREAT GT to succeed, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "PEXPIRE k 150000 GT"); resp != parser.Integer(0) {
+		t.Errorf("expected an earlier PEXPIRE GT to fail, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "PEXPIRE k 150000 LT"); resp != parser.Integer(1) {
+		t.Errorf("expected an earlier PEXPIRE LT to succeed, got %v", resp)
+	}
+	if resp := sendCmd(t, conn, reader, "PEXPIRE k 10 NX"); resp != parser.Integer(0) {
+		t.Errorf("expected NX on a volatile key to fail, got %v", resp)
+	}
+	if ttl := sendCmd(t, conn, reader, "TTL k"); ttl != parser.Integer(150) {
+		t.Errorf("expected TTL 150, got %v", ttl)
+	}
+}
+
+func TestExpireOptions(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	sendCmd(t, conn, reader, "SET k v")
+	sendCmd(t, conn, reader, "EXPIRE k 100")
+	tests := []struct {
+		cmd  string
+		want parser.Value
+	}{
+		{"EXPIRE k 10 NX XX", parser.Error("ERR NX and XX, GT or LT options at the same time are not compatible")},
+		{"PEXPIRE k 10 gt nx", parser.Error("ERR NX and XX, GT or LT options at the same time are not compatible")},
+		{"EXPIREAT k 10 NX LT", parser.Error("ERR NX and XX, GT or LT options at the same time are not compatible")},
+		{"EXPIRE k 10 GT LT", parser.Error("ERR GT and LT options at the same time are not compatible")},
+		{"EXPIRE k 10 XX bogus", parser.Error("ERR Unsupported option bogus")},
+		{"EXPIRE k x bogus", parser.Error("ERR Unsupported option bogus")},
+		{"EXPIRE k 200 XX GT", parser.Integer(1)},
+		{"EXPIRE k 300 XX LT", parser.Integer(0)},
+		{"EXPIRE k 150 LT XX", parser.Integer(1)},
+		{"EXPIRE k 10 NX NX", parser.Integer(0)},
+		{"EXPIRE missing 10 XX GT", parser.Integer(0)},
+	}
+	for _, tt := range tests {
+		if resp := sendCmd(t, conn, reader, tt.cmd); resp != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.cmd, tt.want, resp)
+		}
+	}
+	if ttl := sendCmd(t, conn, reader, "TTL k"); ttl != parser.Integer(150) {
+		t.Errorf("expected TTL 150, got %v", ttl)
+	}
+}
@@ -0,0 +1,318 @@
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+var errSortScore = errors.New("ERR One or more scores can't be converted into double")
+
+// sortOptions holds the parsed arguments of SORT and SORT_RO.
+type sortOptions struct {
+	by          string // weight key pattern, empty to sort by the elements
+	dontSort    bool   // BY pattern without '*': keep the stored order
+	gets        []string
+	desc, alpha bool
+	offset      int
+	count       int // -1 for no LIMIT
+	store       string
+}
+
+type sortItem struct {
+	elem   []byte
+	score  float64
+	cmp    []byte // ALPHA weight from the BY pattern, nil if missing
+	hasCmp bool
+}
+
+// sortLookup resolves a BY or GET pattern for elem: "#" is the element
+// itself, otherwise the first '*' is replaced by elem to name a string key.
+// A "->field" suffix dereferences a hash field; there is no hash type yet,
+// so such lookups never find a value.
+func (s *Store) sortLookup(pattern string, elem []byte) ([]byte, bool) {
+	if pattern == "#" {
+		return elem, true
+	}
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return nil, false
+	}
+	keyEnd := len(pattern)
+	if arrow := strings.Index(pattern[star+1:], "->"); arrow >= 0 && star+1+arrow+2 < len(pattern) {
+		keyEnd = star + 1 + arrow
+	}
+	val, exists := s.lookupKeyRead(pattern[:star] + string(elem) + pattern[star+1:keyEnd])
+	if !exists || keyEnd < len(pattern) {
+		return nil, false
+	}
+	b, ok := WrapValue(val)
+	if !ok {
+		return nil, false
+	}
+	if b == nil {
+		b = []byte{}
+	}
+	return b, true
+}
+
+// parseSortScore converts a weight like strtod does, accepting leading
+// whitespace and treating the empty string as 0.
+func parseSortScore(b []byte) (float64, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimLeft(string(b), " \t\n\v\f\r"), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errSortScore
+	}
+	return f, nil
+}
+
+// sortLimit clamps LIMIT to n elements the way Redis does, returning the
+// half-open output range.
+func sortLimit(offset, count, n int) (int, int) {
+	start := max(offset, 0)
+	end := n - 1
+	if count >= 0 {
+		end = start + count - 1
+	}
+	if start >= n {
+		start, end = n-1, n-2
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if end < start {
+		return 0, 0
+	}
+	return start, end + 1
+}
+
+func sortCompare(a, b *sortItem, opts sortOptions) int {
+	var cmp int
+	switch {
+	case !opts.alpha:
+		switch {
+		case a.score > b.score:
+			cmp = 1
+		case a.score < b.score:
+			cmp = -1
+		default:
+			// Equal scores fall back to the elements to keep the result
+			// deterministic.
+			cmp = bytes.Compare(a.elem, b.elem)
+		}
+	case opts.by != "":
+		switch {
+		case !a.hasCmp || !b.hasCmp:
+			if a.hasCmp == b.hasCmp {
+				cmp = 0
+			} else if !a.hasCmp {
+				cmp = -1
+			} else {
+				cmp = 1
+			}
+		default:
+			cmp = bytes.Compare(a.cmp, b.cmp)
+		}
+	default:
+		cmp = bytes.Compare(a.elem, b.elem)
+	}
+	if opts.desc {
+		return -cmp
+	}
+	return cmp
+}
+
+// Sort implements SORT and SORT_RO over lists and sorted sets. It returns
+// one value per element, or per GET pattern for each element, with nil for
+// values that do not exist. With opts.store the result is stored as a list
+// instead, and Sort returns it with missing values as empty strings.
+func (s *Store) Sort(key string, opts sortOptions) ([][]byte, error) {
+	var val interface{}
+	var exists bool
+	if opts.store != "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		val, exists = s.lookupKeyWrite(key)
+	} else {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		val, exists = s.lookupKeyRead(key)
+	}
+
+	var elems [][]byte
+	if exists {
+		switch v := val.(type) {
+		case *quicklist:
+			v.forEach(listLeft, func(_ int, e []byte) bool {
+				elems = append(elems, bytes.Clone(e))
+				return true
+			})
+		case *zset:
+			for x := v.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+				elems = append(elems, []byte(x.member))
+			}
+		default:
+			return nil, errWrongType
+		}
+	}
+
+	if opts.dontSort {
+		if opts.desc {
+			for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+				elems[i], elems[j] = elems[j], elems[i]
+			}
+		}
+	} else {
+		items := make([]sortItem, len(elems))
+		for i, e := range elems {
+			items[i].elem = e
+			weight, found := e, true
+			if opts.by != "" {
+				weight, found = s.sortLookup(opts.by, e)
+			}
+			if opts.alpha {
+				items[i].cmp, items[i].hasCmp = weight, found
+				continue
+			}
+			if found {
+				score, err := parseSortScore(weight)
+				if err != nil {
+					return nil, err
+				}
+				items[i].score = score
+			}
+		}
+		sort.SliceStable(items, func(i, j int) bool {
+			return sortCompare(&items[i], &items[j], opts) < 0
+		})
+		for i := range items {
+			elems[i] = items[i].elem
+		}
+	}
+	start, end := sortLimit(opts.offset, opts.count, len(elems))
+	elems = elems[start:end]
+
+	result := elems
+	if len(opts.gets) > 0 {
+		result = make([][]byte, 0, len(elems)*len(opts.gets))
+		for _, e := range elems {
+			for _, pattern := range opts.gets {
+				v, _ := s.sortLookup(pattern, e)
+				result = append(result, v)
+			}
+		}
+	}
+
+	if opts.store != "" {
+		if len(result) == 0 {
+			s.deleteKey(opts.store)
+			return result, nil
+		}
+		list := newQuicklist(s.listMaxListpackSize, s.listCompressDepth)
+		for i, v := range result {
+			if v == nil {
+				v = []byte{}
+				result[i] = v
+			}
+			list.push(listRight, bytes.Clone(v))
+		}
+		s.deleteKey(opts.store)
+		s.setKey(opts.store, list)
+		s.access.touch(opts.store)
+		s.signalKeyAsReady(opts.store)
+		s.serveBlockedClients()
+	}
+	return result, nil
+}
+
+// parseSortOptions parses the arguments after the key. SORT_RO passes
+// readOnly, which rejects STORE.
+func parseSortOptions(args []string, readOnly bool) (sortOptions, parser.Value) {
+	opts := sortOptions{count: -1}
+	for i := 0; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "ASC":
+			opts.desc = false
+		case opt == "DESC":
+			opts.desc = true
+		case opt == "ALPHA":
+			opts.alpha = true
+		case opt == "LIMIT" && left >= 2:
+			offset, err1 := strconv.Atoi(args[i+1])
+			count, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return opts, parser.Error("ERR value is not an integer or out of range")
+			}
+			opts.offset, opts.count = offset, count
+			i += 2
+		case opt == "STORE" && left >= 1 && !readOnly:
+			opts.store = args[i+1]
+			i++
+		case opt == "BY" && left >= 1:
+			opts.by = args[i+1]
+			if !strings.Contains(opts.by, "*") {
+				opts.dontSort = true
+			}
+			i++
+		case opt == "GET" && left >= 1:
+			opts.gets = append(opts.gets, args[i+1])
+			i++
+		default:
+			return opts, parser.Error("ERR syntax error")
+		}
+	}
+	return opts, nil
+}
+
+func sortCommand(store *Store, args []parser.Value, readOnly bool) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	opts, errReply := parseSortOptions(strs[1:], readOnly)
+	if errReply != nil {
+		return errReply
+	}
+	// In cluster mode the keys a pattern names must be in the slot of the
+	// sorted key, which only a hash tag in the pattern guarantees.
+	if store.cluster.enabled {
+		slot := keyHashSlot(strs[0])
+		if opts.by != "" && !opts.dontSort && patternHashSlot(opts.by) != slot {
+			return parser.Error("ERR BY option of SORT denied in Cluster mode when keys formed by the pattern may be in different slots.")
+		}
+		for _, pattern := range opts.gets {
+			if pattern != "#" && patternHashSlot(pattern) != slot {
+				return parser.Error("ERR GET option of SORT denied in Cluster mode when keys formed by the pattern may be in different slots.")
+			}
+		}
+	}
+	result, err := store.Sort(strs[0], opts)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if opts.store != "" {
+		return parser.Integer(len(result))
+	}
+	reply := make(parser.Array, len(result))
+	for i, v := range result {
+		reply[i] = parser.BulkString(v)
+	}
+	return reply
+}
+
+func handleSort(store *Store, args []parser.Value) parser.Value {
+	return sortCommand(store, args, false)
+}
+
+func handleSortRO(store *Store, args []parser.Value) parser.Value {
+	return sortCommand(store, args, true)
+}
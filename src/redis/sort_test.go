@@ -0,0 +1,99 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestSortLimit(t *testing.T) {
+	tests := []struct {
+		offset, count, n int
+		start, end       int
+	}{
+		{0, -1, 5, 0, 5},
+		{1, 2, 5, 1, 3},
+		{-3, 2, 5, 0, 2},
+		{3, 10, 5, 3, 5},
+		{5, 1, 5, 0, 0},
+		{0, 0, 5, 0, 0},
+		{0, -1, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		if start, end := sortLimit(tt.offset, tt.count, tt.n); start != tt.start || end != tt.end {
+			t.Errorf("sortLimit(%d, %d, %d) = %d, %d, want %d, %d", tt.offset, tt.count, tt.n, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestSortCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	sendCmd(t, conn, reader, "RPUSH nums 3 10 1 2 2")
+	sendCmd(t, conn, reader, "RPUSH names bob alice carol")
+	sendCmd(t, conn, reader, "MSET weight_bob 2 weight_alice 3 weight_carol 1 name_bob Bob name_carol Carol")
+	sendCmd(t, conn, reader, "SET str v")
+	sendCmd(t, conn, reader, "GEOADD geo 13.361389 38.115556 palermo 15.087269 37.502669 catania")
+
+	strs := func(v parser.Value) string {
+		arr, ok := v.(parser.Array)
+		if !ok {
+			return fmt.Sprint(v)
+		}
+		out := make([]string, len(arr))
+		for i, e := range arr {
+			if e == nil {
+				out[i] = "nil"
+			} else {
+				out[i] = string(e.(parser.BulkString))
+			}
+		}
+		return fmt.Sprint(out)
+	}
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"SORT nums", "[1 2 2 3 10]"},
+		{"SORT nums DESC", "[10 3 2 2 1]"},
+		{"SORT nums ALPHA", "[1 10 2 2 3]"},
+		{"SORT nums LIMIT 1 2", "[2 2]"},
+		{"SORT nums LIMIT 10 2", "[]"},
+		{"SORT names", "ERR One or more scores can't be converted into double"},
+		{"SORT names ALPHA DESC", "[carol bob alice]"},
+		{"SORT names BY weight_*", "[carol bob alice]"},
+		{"SORT names BY nosort", "[bob alice carol]"},
+		{"SORT names BY nosort DESC LIMIT 0 2", "[carol alice]"},
+		{"SORT names BY weight_* GET # GET name_*", "[carol Carol bob Bob alice nil]"},
+		{"SORT names BY weight_* GET name_*->first", "[nil nil nil]"},
+		{"SORT names BY name_* ALPHA", "[alice bob carol]"},
+		{"SORT_RO names BY weight_* DESC", "[alice bob carol]"},
+		{"SORT_RO names STORE dst", "ERR syntax error"},
+		{"SORT geo ALPHA", "[catania palermo]"},
+		{"SORT geo BY nosort", "[palermo catania]"},
+		{"SORT geo BY nosort DESC", "[catania palermo]"},
+		{"SORT missing", "[]"},
+		{"SORT str", errWrongType.Error()},
+		{"SORT nums LIMIT x 1", "ERR value is not an integer or out of range"},
+		{"SORT nums LIMIT 1", "ERR syntax error"},
+		{"SORT nums NOPE", "ERR syntax error"},
+		{"SORT names BY weight_* GET name_* STORE dst", "3"},
+		{"LRANGE dst 0 -1", "[Carol Bob ]"},
+		{"SORT missing STORE dst", "0"},
+		{"EXISTS dst", "0"},
+	}
+	for _, tt := range tests {
+		if got := strs(sendCmd(t, conn, reader, tt.cmd)); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.cmd, tt.want, got)
+		}
+	}
+}
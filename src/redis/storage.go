@@ -0,0 +1,941 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type ExpirationTime struct {
+    expiryTime time.Time
+    durationSet time.Duration
+}
+
+type expirationSetter func(key string)
+
+type TTLMap struct {
+    mu   sync.RWMutex
+    data map[string]ExpirationTime
+}
+
+
+type Store struct {
+	mu   sync.RWMutex
+	data map[string]interface{}
+	volatileKeyMap TTLMap
+	access         accessMap
+	blocking       blockingState
+
+	// index holds the keys of data in a hash table that SCAN can walk with a
+	// stable cursor.
+	index keyIndex
+	slotKeys *slotKeys // nil unless in cluster mode
+
+	// Quicklist parameters for newly created lists, set through CONFIG.
+	listMaxListpackSize int
+	listCompressDepth   int
+
+	// Largest sparse HyperLogLog, header included, before it is promoted to
+	// the dense encoding.
+	hllSparseMaxBytes int
+
+	cow         cowState
+	persistence persistenceState
+	aof         aofState
+	repl        replicationState
+	cluster     clusterState
+}
+
+const (
+	activeExpireSampleSize = 20
+	activeExpireThreshold  = 0.25
+	activeExpireInterval   = 100 * time.Millisecond
+)
+
+func newStore() *Store {
+	s := &Store{
+		data:           make(map[string]interface{}),
+		volatileKeyMap: TTLMap{data: make(map[string]ExpirationTime)},
+		access:         accessMap{data: make(map[string]time.Time)},
+
+		listMaxListpackSize: listDefaultFill,
+		hllSparseMaxBytes:   hllDefaultSparseMaxBytes,
+	}
+	s.persistence.dir = "."
+	s.persistence.dbfilename = defaultDBFilename
+	s.persistence.lastSave = time.Now()
+	s.persistence.lastBgsaveOK = true
+	s.aof.filename = defaultAppendFilename
+	s.aof.fsync = aofFsyncEverySec
+	s.aof.loadTruncated = true
+	s.aof.dirname = defaultAppendDirname
+	s.aof.useRDBPreamble = true
+	s.aof.autoRewritePercentage = defaultAutoRewritePercentage
+	s.aof.autoRewriteMinSize = defaultAutoRewriteMinSize
+	s.aof.lastRewriteOK = true
+	s.repl.replid = newReplID()
+	s.repl.replid2 = noReplID
+	s.repl.secondOffset = -1
+	s.repl.backlogSize = defaultReplBacklogSize
+	s.repl.readOnly = true
+	s.repl.pingPeriod = defaultReplPingPeriod
+	s.repl.timeout = defaultReplTimeout
+	s.repl.disklessSync = true
+	s.repl.disklessSyncDelay = defaultReplDisklessSyncDelay
+	s.repl.disklessLoad = replDisklessLoadDisabled
+	s.cluster.nodeTimeout = defaultClusterNodeTimeout
+	s.cluster.requireFullCoverage = true
+	s.cluster.configFile = defaultClusterConfigFile
+	go s.activeExpireLoop()
+	go s.persistenceCron()
+	go s.replicationCron()
+	return s
+}
+
+func (s *Store) activeExpireLoop() {
+	ticker := time.NewTicker(activeExpireInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.activeExpireCycle()
+	}
+}
+
+func (s *Store) activeExpireCycle() {
+	for {
+		keys := s.volatileKeyMap.sampleKeys(activeExpireSampleSize)
+		if len(keys) == 0 {
+			return
+		}
+		expired := 0
+		for _, k := range keys {
+			if !s.volatileKeyMap.IsValid(k) {
+				s.Del(k)
+				expired++
+			}
+		}
+		if float64(expired)/float64(len(keys)) < activeExpireThreshold {
+			return
+		}
+	}
+}
+
+func (m *TTLMap) sampleKeys(n int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	size := len(m.data)
+	if size == 0 {
+		return nil
+	}
+	if n > size {
+		n = size
+	}
+	keys := make([]string, 0, size)
+	for k := range m.data {
+		keys = append(keys, k)
+	}
+	rand.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	return keys[:n]
+}
+
+func WrapValue(val interface{}) ([]byte, bool) {
+	switch v := val.(type) {
+	case []byte:
+		return v, true
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), true
+	case *quicklist:
+		return nil, false
+	default:
+		return nil, false
+	}
+}
+
+var errWrongType = fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+func (s *Store) Get(key string) ([]byte, bool) {
+	s.mu.RLock()
+	val, exists := s.data[key]
+	s.lend(key, val)
+	s.mu.RUnlock()
+
+	if !exists {
+		return nil, false
+	}
+	if _, isList := val.(*quicklist); isList {
+		return nil, false
+	}
+	// Only delete after RLock released
+	if s.isVolatile(key) && !s.volatileKeyMap.IsValid(key) {
+		defer func() {
+			s.Del(key)
+		}()
+		return nil, false
+	}
+	return WrapValue(val)
+}
+
+func (s *Store) GetWithTypeCheck(key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	val, exists := s.data[key]
+	s.lend(key, val)
+	s.mu.RUnlock()
+
+	if !exists {
+		return nil, false, nil
+	}
+	if _, isList := val.(*quicklist); isList {
+		return nil, false, errWrongType
+	}
+	if s.isVolatile(key) && !s.volatileKeyMap.IsValid(key) {
+		defer func() {
+			s.Del(key)
+		}()
+		return nil, false, nil
+	}
+	b, ok := WrapValue(val)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	s.access.touch(key)
+	return b, true, nil
+}
+
+func (s *Store) Set(key string, val []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storeString(key, val, time.Time{}, false)
+}
+
+func (s *Store) Del(keys ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, key := range keys {
+		if _, exists := s.lookupKeyWrite(key); exists {
+			s.deleteKey(key)
+			count++
+		}
+	}
+	return count
+}
+
+// setKey stores val at key, adding new keys to the SCAN index. Caller must
+// hold s.mu for writing.
+func (s *Store) setKey(key string, val interface{}) {
+	if _, exists := s.data[key]; !exists {
+		s.index.add(key)
+		if s.slotKeys != nil {
+			s.slotKeys.add(key)
+		}
+	}
+	s.data[key] = val
+}
+
+// deleteKey removes key along with its TTL and access time. A value stored
+// at key later, such as the source of a RENAME, may be one a snapshot holds,
+// so the key no longer counts as owned. Caller must hold s.mu for writing.
+func (s *Store) deleteKey(key string) {
+	if _, exists := s.data[key]; exists {
+		s.index.remove(key)
+		if s.slotKeys != nil {
+			s.slotKeys.remove(key)
+		}
+	}
+	delete(s.data, key)
+	delete(s.cow.owned, key)
+	s.cow.lent.Delete(key)
+	s.volatileKeyMap.Delete(key)
+	s.access.delete(key)
+}
+
+// emptyLocked deletes every key. Caller must hold s.mu for writing.
+func (s *Store) emptyLocked() {
+	for key := range s.data {
+		s.deleteKey(key)
+	}
+}
+
+// newDataset returns a bare store, with the list parameters of s, to load
+// a dataset into before swapping it in.
+func (s *Store) newDataset() *Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dataset := &Store{
+		data:                make(map[string]interface{}),
+		volatileKeyMap:      TTLMap{data: make(map[string]ExpirationTime)},
+		access:              accessMap{data: make(map[string]time.Time)},
+		listMaxListpackSize: s.listMaxListpackSize,
+		listCompressDepth:   s.listCompressDepth,
+		hllSparseMaxBytes:   s.hllSparseMaxBytes,
+	}
+	if s.slotKeys != nil {
+		dataset.slotKeys = new(slotKeys)
+	}
+	return dataset
+}
+
+// swapDatasetLocked replaces the dataset with that of other. Caller must
+// hold s.mu for writing.
+func (s *Store) swapDatasetLocked(other *Store) {
+	s.data, s.index, s.slotKeys = other.data, other.index, other.slotKeys
+	s.cow.lent.Clear()
+	s.volatileKeyMap.mu.Lock()
+	s.volatileKeyMap.data = other.volatileKeyMap.data
+	s.volatileKeyMap.mu.Unlock()
+	s.access.mu.Lock()
+	s.access.data = other.access.data
+	s.access.mu.Unlock()
+}
+
+// Exists returns how many of keys exist, counting repeated keys each time.
+func (s *Store) Exists(keys ...string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, key := range keys {
+		if _, exists := s.peekKey(key); exists {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Store) IncrBy(key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, exists := s.lookupKeyWrite(key)
+	if !exists {
+		s.setKey(key, delta)
+		return delta, nil
+	}
+
+	switch v := val.(type) {
+	case []byte:
+		num64, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("ERR value is not an integer or out of range")
+		}
+		if addOverflows(num64, delta) {
+			return 0, errIncrOverflow
+		}
+		num64 += delta // Clear intent: add delta
+		s.setKey(key, num64)
+		return num64, nil
+	case int64:
+		if addOverflows(v, delta) {
+			return 0, errIncrOverflow
+		}
+		v += delta // Clear intent: add delta
+		s.setKey(key, v)
+		return v, nil
+	case *quicklist:
+		return 0, errWrongType
+	default:
+		return 0, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+}
+
+func (s *Store) Incr(key string) (int64, error) {
+	return s.IncrBy(key, 1)
+}
+
+func (s *Store) Decr(key string) (int64, error) {
+	return s.IncrBy(key, -1)
+}
+
+// lookupKeyRead returns the value stored at key, treating a key whose TTL has
+// passed as missing. Caller must hold s.mu.
+func (s *Store) lookupKeyRead(key string) (interface{}, bool) {
+	val, exists := s.peekKey(key)
+	if exists {
+		s.access.touch(key)
+	}
+	return val, exists
+}
+
+// peekKey is lookupKeyRead for commands such as TYPE and OBJECT that must not
+// count as an access to the key. Caller must hold s.mu.
+func (s *Store) peekKey(key string) (interface{}, bool) {
+	val, exists := s.data[key]
+	if !exists || s.volatileKeyMap.isExpired(key) {
+		return nil, false
+	}
+	return val, true
+}
+
+// lookupKeyWrite is lookupKeyRead for callers holding s.mu for writing, and
+// also deletes the key when it has expired.
+func (s *Store) lookupKeyWrite(key string) (interface{}, bool) {
+	val, exists := s.data[key]
+	if !exists {
+		return nil, false
+	}
+	if s.volatileKeyMap.isExpired(key) {
+		s.deleteKey(key)
+		return nil, false
+	}
+	s.access.touch(key)
+	return val, true
+}
+
+// getString returns the string stored at key. Integer-encoded values are
+// converted to their decimal form. Caller must hold s.mu.
+func (s *Store) getString(key string) ([]byte, bool, error) {
+	val, exists := s.lookupKeyRead(key)
+	if !exists {
+		return nil, false, nil
+	}
+	b, ok := WrapValue(val)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return b, true, nil
+}
+
+// getStringForWrite is getString for callers about to modify the value in
+// place: integer-encoded values are stored back as bytes first. Caller must
+// hold s.mu for writing.
+func (s *Store) getStringForWrite(key string) ([]byte, bool, error) {
+	val, exists := s.lookupKeyWrite(key)
+	if !exists {
+		return nil, false, nil
+	}
+	switch v := val.(type) {
+	case []byte:
+		return s.mutable(key, v).([]byte), true, nil
+	case int64:
+		b := []byte(strconv.FormatInt(v, 10))
+		s.setKey(key, b)
+		return b, true, nil
+	default:
+		return nil, false, errWrongType
+	}
+}
+
+// expireOptions are the NX, XX, GT and LT flags of EXPIRE and its variants.
+type expireOptions struct {
+	nx, xx, gt, lt bool
+}
+
+// Expire sets the expiry of key to exp if opts allow it, and reports
+// whether it did. As in Redis, GT and LT compare absolute expiry times, and
+// a key without a TTL counts as never expiring. An expiry time in the past
+// deletes the key.
+func (s *Store) Expire(key string, exp ExpirationTime, opts expireOptions) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.lookupKeyWrite(key); !exists {
+		return false
+	}
+	expireAt := exp.expiryTime
+	current, err := s.volatileKeyMap.GetSetExpiry(key)
+	volatile := err == nil
+	if opts.nx && volatile || opts.xx && !volatile ||
+		opts.gt && (!volatile || !expireAt.After(current)) ||
+		opts.lt && volatile && !expireAt.Before(current) {
+		return false
+	}
+	if !expireAt.After(time.Now()) {
+		s.deleteKey(key)
+		return true
+	}
+	s.volatileKeyMap.setExpiration(key, exp)
+	return true
+}
+
+func (s *Store) isVolatile(key string) bool {
+	s.volatileKeyMap.mu.RLock()
+	defer s.volatileKeyMap.mu.RUnlock()
+	_, exists := s.volatileKeyMap.data[key]
+
+	if !exists {
+		return false
+	}
+	return true
+}
+
+func (m *TTLMap) setExpiration(key string, exp ExpirationTime) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[key] = exp
+}
+
+func withUnixExpiry(m *TTLMap, t time.Time) (expirationSetter, time.Duration) {
+	d := t.Sub(time.Now())
+	return func(key string) {
+		m.setExpiration(key, ExpirationTime{
+			expiryTime:  t,
+			durationSet: d,
+		})
+	}, d
+}
+
+func withTTL(m *TTLMap, ttl time.Duration) expirationSetter {
+	return func(key string) {
+		m.setExpiration(key, ExpirationTime{
+			expiryTime:  time.Now().Add(ttl),
+			durationSet: ttl,
+		})
+	}
+}
+
+func (m *TTLMap) Set(key string, ttl time.Duration) {
+	m.setExpiration(key, ExpirationTime{
+		expiryTime:  time.Now().Add(ttl),
+		durationSet: ttl,
+	})
+}
+
+func (m *TTLMap) apply(key string, set expirationSetter) {
+	set(key)
+}
+
+func (m *TTLMap) Delete(key string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+	_, ok := m.data[key]
+
+	if !ok {
+        return
+    }
+
+    delete(m.data, key)
+}
+
+func (m *TTLMap) GetSetExpiry(key string) (time.Time, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    timeEvent, ok := m.data[key]
+	if !ok {
+        return time.Now(), fmt.Errorf("Key does not have a TTL or does not exist")
+    }
+	expiry := timeEvent.expiryTime
+	return expiry, nil
+}
+
+func (m *TTLMap) GetTTL(key string) (time.Duration, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    timeEvent, ok := m.data[key]
+	if !ok {
+        return time.Duration(time.Microsecond), fmt.Errorf("Key does not have a TTL or does not exist")
+    }
+	expiry := timeEvent.expiryTime
+	//expired key that was not deleted yet
+	if !time.Now().Before(expiry){
+		return time.Duration(time.Microsecond), fmt.Errorf("Key does not have a TTL or does not exist")
+	}
+	return expiry.Sub(time.Now()), nil
+}
+
+func (m *TTLMap) GetSetDuration(key string) (time.Duration, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    timeEvent, ok := m.data[key]
+	if !ok {
+        return time.Duration(0), fmt.Errorf("Key does not have a TTL or does not exist")
+    }
+	Duration := timeEvent.durationSet
+	return Duration, nil
+}
+
+// isExpired reports whether key has a TTL that has passed, without removing
+// it.
+func (m *TTLMap) isExpired(key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	exp, ok := m.data[key]
+	return ok && !time.Now().Before(exp.expiryTime)
+}
+
+func (m *TTLMap) IsValid(key string) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    TimeEvent, ok := m.data[key]
+    if !ok {
+        return false
+    }
+	expiry := TimeEvent.expiryTime
+
+    if !time.Now().Before(expiry) {
+        delete(m.data, key)
+        return false
+    }
+
+    return true
+}
+
+func (s *Store) getList(key string) (*quicklist, bool, error) {
+	val, exists := s.data[key]
+	if !exists {
+		return nil, false, nil
+	}
+	switch v := val.(type) {
+	case *quicklist:
+		return v, true, nil
+	default:
+		return nil, false, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+}
+
+// getListForWrite is getList for callers about to change the list in
+// place. Caller must hold s.mu for writing.
+func (s *Store) getListForWrite(key string) (*quicklist, bool, error) {
+	list, exists, err := s.getList(key)
+	if !exists || err != nil {
+		return list, exists, err
+	}
+	return s.mutable(key, list).(*quicklist), true, nil
+}
+
+type listWhere int
+
+const (
+	listLeft listWhere = iota
+	listRight
+)
+
+// listPush adds elements at one end of the list stored at key, creating it if
+// needed, and marks the key as ready for clients blocked on it. Caller must
+// hold s.mu.
+func (s *Store) listPush(key string, where listWhere, elements ...[]byte) (int64, error) {
+	list, exists, err := s.getListForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		list = newQuicklist(s.listMaxListpackSize, s.listCompressDepth)
+		s.setKey(key, list)
+	}
+	for _, e := range elements {
+		list.push(where, e)
+	}
+	if len(elements) > 0 {
+		s.signalKeyAsReady(key)
+	}
+	return int64(list.Len()), nil
+}
+
+// listPop removes up to count elements from one end of the list stored at
+// key, deleting the key once it is empty. Elements popped from the right are
+// returned in list order. Caller must hold s.mu.
+func (s *Store) listPop(key string, where listWhere, count int) ([][]byte, error) {
+	list, exists, err := s.getListForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	if count > list.Len() {
+		count = list.Len()
+	}
+	result := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		if where == listLeft {
+			result[i] = list.pop(listLeft)
+		} else {
+			result[count-1-i] = list.pop(listRight)
+		}
+	}
+	if list.Len() == 0 {
+		s.deleteKey(key)
+	}
+	return result, nil
+}
+
+func (s *Store) LPush(key string, elements ...[]byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.listPush(key, listLeft, elements...)
+	s.serveBlockedClients()
+	return n, err
+}
+
+func (s *Store) RPush(key string, elements ...[]byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.listPush(key, listRight, elements...)
+	s.serveBlockedClients()
+	return n, err
+}
+
+func (s *Store) LPop(key string, count int) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listPop(key, listLeft, count)
+}
+
+func (s *Store) RPop(key string, count int) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listPop(key, listRight, count)
+}
+
+func (s *Store) LRange(key string, start, stop int) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list, exists, err := s.getList(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return [][]byte{}, nil
+	}
+	length := list.Len()
+	// Normalize negative indices
+	if start < 0 {
+		start = length + start
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	// Clamp
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop {
+		return [][]byte{}, nil
+	}
+	return list.slice(start, stop), nil
+}
+
+func (s *Store) LLen(key string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list, exists, err := s.getList(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	return int64(list.Len()), nil
+}
+
+
+// normalizeIndex converts a possibly negative list index into an offset from
+// the head, reporting whether it falls inside a list of the given length.
+func normalizeIndex(index, length int) (int, bool) {
+	if index < 0 {
+		index = length + index
+	}
+	return index, index >= 0 && index < length
+}
+
+func (s *Store) LIndex(key string, index int) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list, exists, err := s.getList(key)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	i, ok := normalizeIndex(index, list.Len())
+	if !ok {
+		return nil, false, nil
+	}
+	return list.index(i), true, nil
+}
+
+func (s *Store) LSet(key string, index int, element []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, exists, err := s.getListForWrite(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("ERR no such key")
+	}
+	i, ok := normalizeIndex(index, list.Len())
+	if !ok {
+		return fmt.Errorf("ERR index out of range")
+	}
+	list.replace(i, element)
+	return nil
+}
+
+// LInsert inserts element before or after the first occurrence of pivot. It
+// returns the new length, -1 if pivot was not found and 0 if key is missing.
+func (s *Store) LInsert(key string, before bool, pivot, element []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, exists, err := s.getListForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	at := -1
+	list.forEach(listLeft, func(i int, v []byte) bool {
+		if bytes.Equal(v, pivot) {
+			at = i
+			return false
+		}
+		return true
+	})
+	if at < 0 {
+		return -1, nil
+	}
+	if !before {
+		at++
+	}
+	list.insert(at, element)
+	return int64(list.Len()), nil
+}
+
+// LRem removes occurrences of element: the first count from the head when
+// count > 0, the last -count from the tail when count < 0, all when 0.
+func (s *Store) LRem(key string, count int, element []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, exists, err := s.getListForWrite(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	from, limit := listLeft, count
+	if count < 0 {
+		from, limit = listRight, -count
+	}
+	drop := make(map[int]struct{})
+	list.forEach(from, func(i int, v []byte) bool {
+		if bytes.Equal(v, element) {
+			drop[i] = struct{}{}
+		}
+		return limit == 0 || len(drop) < limit
+	})
+	if len(drop) == 0 {
+		return 0, nil
+	}
+	kept := newQuicklist(list.fill, list.depth)
+	list.forEach(listLeft, func(i int, v []byte) bool {
+		if _, ok := drop[i]; !ok {
+			kept.push(listRight, v)
+		}
+		return true
+	})
+	if kept.Len() == 0 {
+		s.deleteKey(key)
+	} else {
+		s.setKey(key, kept)
+	}
+	return int64(len(drop)), nil
+}
+
+// LTrim keeps only the elements between start and stop inclusive, using the
+// same index rules as LRange, and deletes the key if nothing is left.
+func (s *Store) LTrim(key string, start, stop int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, exists, err := s.getListForWrite(key)
+	if err != nil || !exists {
+		return err
+	}
+	length := list.Len()
+	if start < 0 {
+		start = length + start
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= length {
+		s.deleteKey(key)
+		return nil
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	list.trim(listLeft, start)
+	list.trim(listRight, length-1-stop)
+	return nil
+}
+
+// LPos returns the indexes of element matches. rank selects the first match
+// to report (negative ranks scan from the tail), count caps the number of
+// matches (0 means all) and maxLen caps the number of elements compared
+// (0 means the whole list).
+func (s *Store) LPos(key string, element []byte, rank, count, maxLen int) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list, exists, err := s.getList(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	matches := []int64{}
+	from, skip := listLeft, rank-1
+	if rank < 0 {
+		from, skip = listRight, -rank-1
+	}
+	compared := 0
+	list.forEach(from, func(i int, v []byte) bool {
+		if maxLen > 0 && compared >= maxLen {
+			return false
+		}
+		compared++
+		if !bytes.Equal(v, element) {
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
+		}
+		matches = append(matches, int64(i))
+		return count == 0 || len(matches) < count
+	})
+	return matches, nil
+}
+
+// PushX pushes elements only if key already holds a list, returning 0
+// otherwise.
+func (s *Store) PushX(key string, where listWhere, elements ...[]byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists, err := s.getList(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	n, err := s.listPush(key, where, elements...)
+	s.serveBlockedClients()
+	return n, err
+}
+
+func (s *Store) LMove(src, dst string, from, to listWhere) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, err := s.listMove(src, dst, from, to)
+	s.serveBlockedClients()
+	return elem, err
+}
+
+// LMPop pops up to count elements from the first non-empty list among keys.
+func (s *Store) LMPop(keys []string, where listWhere, count int) (string, [][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		_, exists, err := s.getList(key)
+		if err != nil {
+			return "", nil, err
+		}
+		if exists {
+			popped, _ := s.listPop(key, where, count)
+			return key, popped, nil
+		}
+	}
+	return "", nil, nil
+}
@@ -1,4 +1,4 @@
-package main
+package redis
 
 import (
 	"bytes"
@@ -385,6 +385,29 @@ func TestIsVolatileRace(t *testing.T) {
 	wg.Wait()
 }
 
+// TestExpireConcurrentDel checks that an EXPIRE racing with a DEL never
+// leaves a TTL behind on the deleted key.
+func TestExpireConcurrentDel(t *testing.T) {
+	store := newStore()
+	for i := 0; i < 1000; i++ {
+		store.Set("k", []byte("v"))
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			store.Del("k")
+		}()
+		go func() {
+			defer wg.Done()
+			store.Expire("k", ExpirationTime{expiryTime: time.Now().Add(time.Minute), durationSet: time.Minute}, expireOptions{})
+		}()
+		wg.Wait()
+		if store.Exists("k") == 0 && store.isVolatile("k") {
+			t.Fatalf("a deleted key kept its TTL")
+		}
+	}
+}
+
 func TestTTLMapConcurrentAccessRace(t *testing.T) {
 	m := newTTLMap()
 	var wg sync.WaitGroup
@@ -717,6 +740,273 @@ func TestLRangeWrongType(t *testing.T) {
 	}
 }
 
+func listOf(t *testing.T, store *Store, key string) []string {
+	t.Helper()
+	result, err := store.LRange(key, 0, -1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := make([]string, len(result))
+	for i, v := range result {
+		out[i] = string(v)
+	}
+	return out
+}
+
+func expectList(t *testing.T, store *Store, key string, expected ...string) {
+	t.Helper()
+	got := listOf(t, store, key)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestLIndexBasic(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("a"), []byte("b"), []byte("c"))
+	val, found, err := store.LIndex("mylist", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || string(val) != "b" {
+		t.Errorf("expected 'b', got %q", val)
+	}
+}
+
+func TestLIndexNegativeIndices(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("a"), []byte("b"), []byte("c"))
+	val, found, _ := store.LIndex("mylist", -1)
+	if !found || string(val) != "c" {
+		t.Errorf("expected 'c', got %q", val)
+	}
+	val, found, _ = store.LIndex("mylist", -3)
+	if !found || string(val) != "a" {
+		t.Errorf("expected 'a', got %q", val)
+	}
+}
+
+func TestLIndexOutOfBounds(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("a"))
+	if _, found, _ := store.LIndex("mylist", 1); found {
+		t.Error("expected index 1 to be out of range")
+	}
+	if _, found, _ := store.LIndex("mylist", -2); found {
+		t.Error("expected index -2 to be out of range")
+	}
+	if _, found, _ := store.LIndex("missing", 0); found {
+		t.Error("expected missing key to return nothing")
+	}
+}
+
+func TestLIndexWrongType(t *testing.T) {
+	store := newStore()
+	store.Set("str", []byte("hello"))
+	if _, _, err := store.LIndex("str", 0); err == nil {
+		t.Fatal("expected WRONGTYPE error")
+	}
+}
+
+func TestLSetBasic(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("a"), []byte("b"), []byte("c"))
+	if err := store.LSet("mylist", -1, []byte("z")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectList(t, store, "mylist", "a", "b", "z")
+}
+
+func TestLSetErrors(t *testing.T) {
+	store := newStore()
+	if err := store.LSet("missing", 0, []byte("x")); err == nil || err.Error() != "ERR no such key" {
+		t.Errorf("expected no such key, got %v", err)
+	}
+	store.RPush("mylist", []byte("a"))
+	if err := store.LSet("mylist", 5, []byte("x")); err == nil || err.Error() != "ERR index out of range" {
+		t.Errorf("expected index out of range, got %v", err)
+	}
+}
+
+func TestLInsert(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("a"), []byte("c"))
+	n, err := store.LInsert("mylist", true, []byte("c"), []byte("b"))
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3, got %d (%v)", n, err)
+	}
+	n, _ = store.LInsert("mylist", false, []byte("c"), []byte("d"))
+	if n != 4 {
+		t.Errorf("expected 4, got %d", n)
+	}
+	expectList(t, store, "mylist", "a", "b", "c", "d")
+
+	if n, _ := store.LInsert("mylist", true, []byte("nope"), []byte("x")); n != -1 {
+		t.Errorf("expected -1 for missing pivot, got %d", n)
+	}
+	if n, _ := store.LInsert("missing", true, []byte("a"), []byte("x")); n != 0 {
+		t.Errorf("expected 0 for missing key, got %d", n)
+	}
+}
+
+func TestLRemFromHead(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("x"), []byte("a"), []byte("x"), []byte("b"), []byte("x"))
+	n, err := store.LRem("mylist", 2, []byte("x"))
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2, got %d (%v)", n, err)
+	}
+	expectList(t, store, "mylist", "a", "b", "x")
+}
+
+func TestLRemFromTail(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("x"), []byte("a"), []byte("x"), []byte("b"), []byte("x"))
+	n, _ := store.LRem("mylist", -2, []byte("x"))
+	if n != 2 {
+		t.Fatalf("expected 2, got %d", n)
+	}
+	expectList(t, store, "mylist", "x", "a", "b")
+}
+
+func TestLRemAllDeletesKey(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("x"), []byte("x"))
+	n, _ := store.LRem("mylist", 0, []byte("x"))
+	if n != 2 {
+		t.Fatalf("expected 2, got %d", n)
+	}
+	if _, exists := store.data["mylist"]; exists {
+		t.Error("expected key to be deleted")
+	}
+}
+
+func TestLTrimBasic(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("a"), []byte("b"), []byte("c"), []byte("d"))
+	if err := store.LTrim("mylist", 1, -2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectList(t, store, "mylist", "b", "c")
+}
+
+func TestLTrimOutOfBounds(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("a"), []byte("b"), []byte("c"))
+	store.LTrim("mylist", -100, 100)
+	expectList(t, store, "mylist", "a", "b", "c")
+}
+
+func TestLTrimEmptyRangeDeletesKey(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("a"), []byte("b"))
+	store.LTrim("mylist", 5, 10)
+	if _, exists := store.data["mylist"]; exists {
+		t.Error("expected key to be deleted")
+	}
+}
+
+func TestLPosRankCountMaxLen(t *testing.T) {
+	store := newStore()
+	// index:            0           1           2           3           4           5
+	store.RPush("mylist", []byte("a"), []byte("b"), []byte("c"), []byte("b"), []byte("d"), []byte("b"))
+
+	tests := []struct {
+		rank, count, maxLen int
+		expected            []int64
+	}{
+		{1, 1, 0, []int64{1}},
+		{2, 1, 0, []int64{3}},
+		{-1, 1, 0, []int64{5}},
+		{-2, 0, 0, []int64{3, 1}},
+		{1, 0, 0, []int64{1, 3, 5}},
+		{1, 2, 0, []int64{1, 3}},
+		{1, 0, 3, []int64{1}},
+		{-1, 0, 2, []int64{5}},
+		{4, 1, 0, []int64{}},
+	}
+	for _, tt := range tests {
+		got, err := store.LPos("mylist", []byte("b"), tt.rank, tt.count, tt.maxLen)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+			t.Errorf("rank=%d count=%d maxlen=%d: expected %v, got %v", tt.rank, tt.count, tt.maxLen, tt.expected, got)
+		}
+	}
+}
+
+func TestPushXRequiresExistingList(t *testing.T) {
+	store := newStore()
+	n, err := store.PushX("mylist", listLeft, []byte("a"))
+	if err != nil || n != 0 {
+		t.Fatalf("expected 0, got %d (%v)", n, err)
+	}
+	store.RPush("mylist", []byte("b"))
+	store.PushX("mylist", listLeft, []byte("a"))
+	store.PushX("mylist", listRight, []byte("c"), []byte("d"))
+	expectList(t, store, "mylist", "a", "b", "c", "d")
+}
+
+func TestLMoveDirections(t *testing.T) {
+	store := newStore()
+	store.RPush("src", []byte("a"), []byte("b"), []byte("c"))
+	store.RPush("dst", []byte("x"))
+
+	elem, err := store.LMove("src", "dst", listRight, listLeft)
+	if err != nil || string(elem) != "c" {
+		t.Fatalf("expected 'c', got %q (%v)", elem, err)
+	}
+	elem, _ = store.LMove("src", "dst", listLeft, listRight)
+	if string(elem) != "a" {
+		t.Fatalf("expected 'a', got %q", elem)
+	}
+	expectList(t, store, "src", "b")
+	expectList(t, store, "dst", "c", "x", "a")
+}
+
+func TestLMoveRotateSameKey(t *testing.T) {
+	store := newStore()
+	store.RPush("mylist", []byte("a"), []byte("b"), []byte("c"))
+	store.LMove("mylist", "mylist", listLeft, listRight)
+	expectList(t, store, "mylist", "b", "c", "a")
+}
+
+func TestLMoveMissingSourceAndWrongType(t *testing.T) {
+	store := newStore()
+	elem, err := store.LMove("missing", "dst", listLeft, listLeft)
+	if err != nil || elem != nil {
+		t.Errorf("expected nil, got %q (%v)", elem, err)
+	}
+	store.RPush("src", []byte("a"))
+	store.Set("str", []byte("v"))
+	if _, err := store.LMove("src", "str", listLeft, listLeft); err == nil {
+		t.Fatal("expected WRONGTYPE error")
+	}
+	expectList(t, store, "src", "a")
+}
+
+func TestLMPopFirstNonEmpty(t *testing.T) {
+	store := newStore()
+	store.RPush("second", []byte("a"), []byte("b"))
+	key, popped, err := store.LMPop([]string{"first", "second"}, listLeft, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != "second" || len(popped) != 2 {
+		t.Errorf("expected both elements from second, got %q %v", key, popped)
+	}
+	key, popped, _ = store.LMPop([]string{"first", "second"}, listLeft, 1)
+	if key != "" || popped != nil {
+		t.Errorf("expected nothing, got %q %v", key, popped)
+	}
+}
+
 func TestLLenExisting(t *testing.T) {
 	store := newStore()
 	store.RPush("mylist", []byte("a"), []byte("b"), []byte("c"))
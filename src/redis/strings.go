@@ -0,0 +1,787 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// setOptions holds the flags of SET and its variants.
+type setOptions struct {
+	nx, xx  bool
+	keepTTL bool
+	get     bool
+	// expireAt is the absolute expiry from EX/PX/EXAT/PXAT, zero for none.
+	expireAt time.Time
+}
+
+// storeString writes val at key. The key's TTL becomes expireAt if set and is
+// otherwise cleared, unless keepTTL is true. Caller must hold s.mu for
+// writing.
+func (s *Store) storeString(key string, val []byte, expireAt time.Time, keepTTL bool) {
+	s.setKey(key, val)
+	s.access.touch(key)
+	switch {
+	case !expireAt.IsZero():
+		s.volatileKeyMap.setExpiration(key, ExpirationTime{
+			expiryTime:  expireAt,
+			durationSet: time.Until(expireAt),
+		})
+	case !keepTTL:
+		s.volatileKeyMap.Delete(key)
+	}
+}
+
+// SetWithOptions implements SET. It returns the previous string value when
+// opts.get is set, and whether val was written given the NX/XX condition.
+func (s *Store) SetWithOptions(key string, val []byte, opts setOptions) ([]byte, bool, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, exists := s.lookupKeyWrite(key)
+	var old []byte
+	if opts.get && exists {
+		b, ok := WrapValue(cur)
+		if !ok {
+			return nil, false, false, errWrongType
+		}
+		old = bytes.Clone(b)
+	}
+	if opts.nx && exists || opts.xx && !exists {
+		return old, exists, false, nil
+	}
+	s.storeString(key, val, opts.expireAt, opts.keepTTL)
+	return old, exists, true, nil
+}
+
+// GetDel returns the string at key and deletes it.
+func (s *Store) GetDel(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, exists, err := s.getString(key)
+	if !exists || err != nil {
+		return nil, false, err
+	}
+	s.deleteKey(key)
+	return val, true, nil
+}
+
+// GetEx returns the string at key, then gives it the expiry expireAt or, with
+// persist, removes its TTL. An expiry in the past deletes the key.
+func (s *Store) GetEx(key string, expireAt time.Time, persist bool) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, exists, err := s.getString(key)
+	if !exists || err != nil {
+		return nil, false, err
+	}
+	s.lend(key, val)
+	switch {
+	case !expireAt.IsZero() && !time.Now().Before(expireAt):
+		s.deleteKey(key)
+	case !expireAt.IsZero():
+		s.volatileKeyMap.setExpiration(key, ExpirationTime{
+			expiryTime:  expireAt,
+			durationSet: time.Until(expireAt),
+		})
+	case persist:
+		s.volatileKeyMap.Delete(key)
+	}
+	return val, true, nil
+}
+
+// expireArg converts the argument of an EX, PX, EXAT or PXAT option to an
+// absolute time, rejecting non-positive values and values that overflow a
+// millisecond timestamp like Redis does.
+func expireArg(unit string, v parser.Value, now time.Time, cmd string) (time.Time, parser.Value) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return time.Time{}, parser.Error("ERR wrong argument type")
+	}
+	n, err := strconv.ParseInt(string(bs), 10, 64)
+	if err != nil {
+		return time.Time{}, parser.Error("ERR value is not an integer or out of range")
+	}
+	invalid := parser.Error("ERR invalid expire time in '" + cmd + "' command")
+	if n <= 0 {
+		return time.Time{}, invalid
+	}
+	if unit == "EX" || unit == "EXAT" {
+		if n > math.MaxInt64/1000 {
+			return time.Time{}, invalid
+		}
+		n *= 1000
+	}
+	if unit == "EX" || unit == "PX" {
+		if n > math.MaxInt64-now.UnixMilli() {
+			return time.Time{}, invalid
+		}
+		n += now.UnixMilli()
+	}
+	return time.UnixMilli(n), nil
+}
+
+func isExpireOption(opt string) bool {
+	return opt == "EX" || opt == "PX" || opt == "EXAT" || opt == "PXAT"
+}
+
+// parseSetOptions parses the flags following SET key value.
+func parseSetOptions(args []parser.Value) (setOptions, parser.Value) {
+	var opts setOptions
+	syntaxErr := parser.Error("ERR syntax error")
+	now := time.Now()
+	for i := 0; i < len(args); i++ {
+		bs, ok := args[i].(parser.BulkString)
+		if !ok {
+			return opts, parser.Error("ERR wrong argument type")
+		}
+		opt := strings.ToUpper(string(bs))
+		switch {
+		case opt == "NX" && !opts.xx:
+			opts.nx = true
+		case opt == "XX" && !opts.nx:
+			opts.xx = true
+		case opt == "GET":
+			opts.get = true
+		case opt == "KEEPTTL" && opts.expireAt.IsZero():
+			opts.keepTTL = true
+		case isExpireOption(opt) && !opts.keepTTL && opts.expireAt.IsZero() && i+1 < len(args):
+			at, errReply := expireArg(opt, args[i+1], now, "set")
+			if errReply != nil {
+				return opts, errReply
+			}
+			opts.expireAt = at
+			i++
+		default:
+			return opts, syntaxErr
+		}
+	}
+	return opts, nil
+}
+
+func setReply(old []byte, hadOld, written bool, opts setOptions) parser.Value {
+	switch {
+	case opts.get && hadOld:
+		return parser.BulkString(old)
+	case opts.get || !written:
+		return parser.BulkString(nil)
+	default:
+		return parser.SimpleString("OK")
+	}
+}
+
+func handleSet(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	val, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	opts, errReply := parseSetOptions(args[3:])
+	if errReply != nil {
+		return errReply
+	}
+	old, hadOld, written, err := store.SetWithOptions(string(key), []byte(val), opts)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return setReply(old, hadOld, written, opts)
+}
+
+func handleSetNX(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	val, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	_, _, written, _ := store.SetWithOptions(string(key), []byte(val), setOptions{nx: true})
+	if written {
+		return parser.Integer(1)
+	}
+	return parser.Integer(0)
+}
+
+func handleSetEX(store *Store, args []parser.Value) parser.Value {
+	return setWithExpire(store, args, "EX", "setex")
+}
+
+func handlePSetEX(store *Store, args []parser.Value) parser.Value {
+	return setWithExpire(store, args, "PX", "psetex")
+}
+
+func setWithExpire(store *Store, args []parser.Value, unit, cmd string) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	val, ok2 := args[3].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	at, errReply := expireArg(unit, args[2], time.Now(), cmd)
+	if errReply != nil {
+		return errReply
+	}
+	store.SetWithOptions(string(key), []byte(val), setOptions{expireAt: at})
+	return parser.SimpleString("OK")
+}
+
+func handleGetSet(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	val, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	opts := setOptions{get: true}
+	old, hadOld, written, err := store.SetWithOptions(string(key), []byte(val), opts)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return setReply(old, hadOld, written, opts)
+}
+
+func handleGetDel(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	val, exists, err := store.GetDel(string(key))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !exists {
+		return parser.BulkString(nil)
+	}
+	return parser.BulkString(val)
+}
+
+func handleGetEx(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	var expireAt time.Time
+	persist := false
+	now := time.Now()
+	for i := 2; i < len(args); i++ {
+		bs, ok := args[i].(parser.BulkString)
+		if !ok {
+			return parser.Error("ERR wrong argument type")
+		}
+		opt := strings.ToUpper(string(bs))
+		switch {
+		case opt == "PERSIST" && expireAt.IsZero() && !persist:
+			persist = true
+		case isExpireOption(opt) && expireAt.IsZero() && !persist && i+1 < len(args):
+			at, errReply := expireArg(opt, args[i+1], now, "getex")
+			if errReply != nil {
+				return errReply
+			}
+			expireAt = at
+			i++
+		default:
+			return parser.Error("ERR syntax error")
+		}
+	}
+	val, exists, err := store.GetEx(string(key), expireAt, persist)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !exists {
+		return parser.BulkString(nil)
+	}
+	return parser.BulkString(val)
+}
+
+var (
+	errIncrOverflow   = fmt.Errorf("ERR increment or decrement would overflow")
+	errStringTooLarge = fmt.Errorf("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	errNotFloat       = fmt.Errorf("ERR value is not a valid float")
+	errFloatRange     = fmt.Errorf("ERR increment would produce NaN or Infinity")
+)
+
+func addOverflows(a, b int64) bool {
+	return b > 0 && a > math.MaxInt64-b || b < 0 && a < math.MinInt64-b
+}
+
+// MGet returns the string at each key, nil for keys that are missing or hold
+// another type.
+func (s *Store) MGet(keys ...string) [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	vals := make([][]byte, len(keys))
+	for i, key := range keys {
+		if val, exists, err := s.getString(key); exists && err == nil {
+			vals[i] = val
+			s.lend(key, val)
+		}
+	}
+	return vals
+}
+
+// MSet stores vals[i] at keys[i], clearing any TTLs. With nx nothing is
+// written unless all of the keys are missing; the result reports whether the
+// values were written.
+func (s *Store) MSet(keys []string, vals [][]byte, nx bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nx {
+		for _, key := range keys {
+			if _, exists := s.lookupKeyWrite(key); exists {
+				return false
+			}
+		}
+	}
+	for i, key := range keys {
+		s.storeString(key, vals[i], time.Time{}, false)
+	}
+	return true
+}
+
+func (s *Store) Append(key string, val []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, exists, err := s.getStringForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		s.setKey(key, bytes.Clone(val))
+		return int64(len(val)), nil
+	}
+	if len(cur)+len(val) > maxStringSize {
+		return 0, errStringTooLarge
+	}
+	cur = append(cur, val...)
+	s.setKey(key, cur)
+	return int64(len(cur)), nil
+}
+
+func (s *Store) StrLen(key string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, _, err := s.getString(key)
+	return int64(len(val)), err
+}
+
+// GetRange returns the substring between the inclusive offsets start and
+// end, where negative offsets count from the end of the string.
+func (s *Store) GetRange(key string, start, end int64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, _, err := s.getString(key)
+	if err != nil {
+		return nil, err
+	}
+	length := int64(len(val))
+	if start < 0 && end < 0 && start > end {
+		return []byte{}, nil
+	}
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if end < 0 {
+		end = max(length+end, 0)
+	}
+	end = min(end, length-1)
+	if start > end || length == 0 {
+		return []byte{}, nil
+	}
+	return bytes.Clone(val[start : end+1]), nil
+}
+
+// SetRange overwrites the string at key from offset with val, zero-padding it
+// as needed, and returns the resulting length.
+func (s *Store) SetRange(key string, offset int64, val []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, _, err := s.getStringForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) == 0 {
+		return int64(len(cur)), nil
+	}
+	if offset > maxStringSize-int64(len(val)) {
+		return 0, errStringTooLarge
+	}
+	cur = s.growString(key, cur, int(offset)+len(val))
+	copy(cur[offset:], val)
+	return int64(len(cur)), nil
+}
+
+// Redis does INCRBYFLOAT arithmetic in C long double; on x86 that is the
+// 80-bit extended format, emulated here with a 64-bit mantissa big.Float.
+const (
+	longDoublePrec   = 64
+	longDoubleMaxExp = 16384
+	longDoubleMinExp = -16445
+)
+
+// parseLongDouble parses s as strtold would, rejecting NaN and values out of
+// the long double range. Infinities are accepted.
+func parseLongDouble(s string) (*big.Float, bool) {
+	f, _, err := big.ParseFloat(s, 10, longDoublePrec, big.ToNearestEven)
+	if err != nil {
+		return nil, false
+	}
+	return f, f.IsInf() || longDoubleInRange(f)
+}
+
+func longDoubleInRange(f *big.Float) bool {
+	if f.Sign() == 0 {
+		return true
+	}
+	exp := f.MantExp(nil)
+	return exp <= longDoubleMaxExp && exp > longDoubleMinExp
+}
+
+// formatLongDouble formats f like Redis' human-friendly ld2string: 17
+// decimal places with trailing zeros removed.
+func formatLongDouble(f *big.Float) []byte {
+	b := []byte(f.Text('f', 17))
+	b = bytes.TrimRight(b, "0")
+	b = bytes.TrimSuffix(b, []byte("."))
+	if string(b) == "-0" {
+		return []byte("0")
+	}
+	return b
+}
+
+func (s *Store) IncrByFloat(key string, incr *big.Float) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, exists, err := s.getString(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := new(big.Float).SetPrec(longDoublePrec)
+	if exists {
+		cur, ok := parseLongDouble(string(val))
+		if !ok || cur.IsInf() {
+			return nil, errNotFloat
+		}
+		sum.Set(cur)
+	}
+	if incr.IsInf() {
+		return nil, errFloatRange
+	}
+	sum.Add(sum, incr)
+	if !longDoubleInRange(sum) {
+		return nil, errFloatRange
+	}
+	b := formatLongDouble(sum)
+	s.setKey(key, b)
+	return bytes.Clone(b), nil
+}
+
+// LCSStrings returns the strings at a and b for LCS, treating missing keys
+// as empty.
+func (s *Store) LCSStrings(a, b string) ([]byte, []byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	aval, _, aerr := s.getString(a)
+	bval, _, berr := s.getString(b)
+	if aerr != nil || berr != nil {
+		return nil, nil, errLCSWrongType
+	}
+	return bytes.Clone(aval), bytes.Clone(bval), nil
+}
+
+var (
+	errLCSWrongType = fmt.Errorf("ERR The specified keys must contain string values")
+	errLCSMemory    = fmt.Errorf("ERR Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+)
+
+// lcsMatch is one common run reported by LCS IDX, as inclusive offsets into
+// each string.
+type lcsMatch struct {
+	a, b [2]int
+}
+
+// lcs computes the longest common subsequence of a and b with the classic
+// dynamic programming table, and the matching runs from the end of the
+// strings backwards, in the order Redis reports them.
+func lcs(a, b []byte) ([]byte, []lcsMatch, error) {
+	if (uint64(len(a))+1)*(uint64(len(b))+1)*4 > maxStringSize {
+		return nil, nil, errLCSMemory
+	}
+	stride := len(b) + 1
+	dp := make([]uint32, (len(a)+1)*stride)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				dp[i*stride+j] = dp[(i-1)*stride+j-1] + 1
+			} else {
+				dp[i*stride+j] = max(dp[(i-1)*stride+j], dp[i*stride+j-1])
+			}
+		}
+	}
+
+	idx := dp[len(a)*stride+len(b)]
+	result := make([]byte, idx)
+	var matches []lcsMatch
+	inRange := false
+	var cur lcsMatch
+	for i, j := len(a), len(b); i > 0 && j > 0; {
+		emit := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if !inRange {
+				cur = lcsMatch{a: [2]int{i - 1, i - 1}, b: [2]int{j - 1, j - 1}}
+				inRange = true
+			} else {
+				// Walking backwards, each match extends the run down by one.
+				cur.a[0]--
+				cur.b[0]--
+			}
+			// A run touching the start of either string cannot grow further.
+			emit = i == 1 || j == 1
+			idx--
+			i--
+			j--
+		} else {
+			if dp[(i-1)*stride+j] > dp[i*stride+j-1] {
+				i--
+			} else {
+				j--
+			}
+			emit = inRange
+		}
+		if emit {
+			matches = append(matches, cur)
+			inRange = false
+		}
+	}
+	return result, matches, nil
+}
+
+func handleMGet(store *Store, args []parser.Value) parser.Value {
+	keys, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	vals := store.MGet(keys...)
+	res := make(parser.Array, len(vals))
+	for i, val := range vals {
+		res[i] = parser.BulkString(val)
+	}
+	return res
+}
+
+func handleMSet(store *Store, args []parser.Value) parser.Value {
+	if _, ok := msetArgs(store, args, false); !ok {
+		return parser.Error("ERR wrong number of arguments for 'mset' command")
+	}
+	return parser.SimpleString("OK")
+}
+
+func handleMSetNX(store *Store, args []parser.Value) parser.Value {
+	written, ok := msetArgs(store, args, true)
+	if !ok {
+		return parser.Error("ERR wrong number of arguments for 'msetnx' command")
+	}
+	if written {
+		return parser.Integer(1)
+	}
+	return parser.Integer(0)
+}
+
+func msetArgs(store *Store, args []parser.Value, nx bool) (bool, bool) {
+	if len(args)%2 == 0 {
+		return false, false
+	}
+	keys := make([]string, 0, len(args)/2)
+	vals := make([][]byte, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		key, ok1 := args[i].(parser.BulkString)
+		val, ok2 := args[i+1].(parser.BulkString)
+		if !ok1 || !ok2 {
+			return false, false
+		}
+		keys = append(keys, string(key))
+		vals = append(vals, []byte(val))
+	}
+	return store.MSet(keys, vals, nx), true
+}
+
+func handleAppend(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	val, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	n, err := store.Append(string(key), []byte(val))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleStrLen(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	n, err := store.StrLen(string(key))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleGetRange(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	start, errReply := intArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	end, errReply := intArg(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	val, err := store.GetRange(string(key), int64(start), int64(end))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.BulkString(val)
+}
+
+func handleSetRange(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	val, ok2 := args[3].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	offset, errReply := intArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	if offset < 0 {
+		return parser.Error("ERR offset is out of range")
+	}
+	n, err := store.SetRange(string(key), int64(offset), []byte(val))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleIncrBy(store *Store, args []parser.Value) parser.Value {
+	return incrByArg(store, args, 1)
+}
+
+func handleDecrBy(store *Store, args []parser.Value) parser.Value {
+	return incrByArg(store, args, -1)
+}
+
+func incrByArg(store *Store, args []parser.Value, sign int64) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	delta, errReply := intArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	if sign < 0 {
+		if delta == math.MinInt64 {
+			return parser.Error("ERR decrement would overflow")
+		}
+		delta = -delta
+	}
+	n, err := store.IncrBy(string(key), int64(delta))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleIncrByFloat(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	incrArg, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	incr, ok := parseLongDouble(string(incrArg))
+	if !ok {
+		return parser.Error(errNotFloat.Error())
+	}
+	val, err := store.IncrByFloat(string(key), incr)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.BulkString(val)
+}
+
+func handleLCS(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	var getLen, getIdx, withMatchLen bool
+	minMatchLen := 0
+	for i := 2; i < len(strs); i++ {
+		switch strings.ToUpper(strs[i]) {
+		case "LEN":
+			getLen = true
+		case "IDX":
+			getIdx = true
+		case "WITHMATCHLEN":
+			withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 >= len(strs) {
+				return parser.Error("ERR syntax error")
+			}
+			n, errReply := intArg(args[i+2])
+			if errReply != nil {
+				return errReply
+			}
+			minMatchLen = max(n, 0)
+			i++
+		default:
+			return parser.Error("ERR syntax error")
+		}
+	}
+	if getLen && getIdx {
+		return parser.Error("ERR If you want both the length and indexes, please just use IDX.")
+	}
+
+	a, b, err := store.LCSStrings(strs[0], strs[1])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	common, matches, err := lcs(a, b)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	switch {
+	case getLen:
+		return parser.Integer(len(common))
+	case !getIdx:
+		return parser.BulkString(common)
+	}
+	reply := parser.Array{}
+	for _, m := range matches {
+		matchLen := m.a[1] - m.a[0] + 1
+		if matchLen < minMatchLen {
+			continue
+		}
+		entry := parser.Array{
+			parser.Array{parser.Integer(m.a[0]), parser.Integer(m.a[1])},
+			parser.Array{parser.Integer(m.b[0]), parser.Integer(m.b[1])},
+		}
+		if withMatchLen {
+			entry = append(entry, parser.Integer(matchLen))
+		}
+		reply = append(reply, entry)
+	}
+	return parser.Array{
+		parser.BulkString("matches"), reply,
+		parser.BulkString("len"), parser.Integer(len(common)),
+	}
+}
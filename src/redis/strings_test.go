@@ -0,0 +1,254 @@
+package redis
+
+import (
+	"bufio"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestSetClearsTTL(t *testing.T) {
+	store := newStore()
+	store.Set("k", []byte("v1"))
+	store.volatileKeyMap.Set("k", time.Minute)
+	store.Set("k", []byte("v2"))
+	if store.isVolatile("k") {
+		t.Errorf("expected an overwrite to clear the TTL")
+	}
+
+	store.SetWithOptions("k", []byte("v3"), setOptions{expireAt: time.Now().Add(time.Minute)})
+	store.SetWithOptions("k", []byte("v4"), setOptions{keepTTL: true})
+	if !store.isVolatile("k") {
+		t.Errorf("expected KEEPTTL to retain the TTL")
+	}
+	if val, _ := store.Get("k"); string(val) != "v4" {
+		t.Errorf("expected v4, got %q", val)
+	}
+}
+
+func TestSetConditions(t *testing.T) {
+	store := newStore()
+	if _, _, written, _ := store.SetWithOptions("k", []byte("a"), setOptions{xx: true}); written {
+		t.Errorf("expected XX to skip a missing key")
+	}
+	if _, _, written, _ := store.SetWithOptions("k", []byte("a"), setOptions{nx: true}); !written {
+		t.Errorf("expected NX to set a missing key")
+	}
+	old, hadOld, written, _ := store.SetWithOptions("k", []byte("b"), setOptions{nx: true, get: true})
+	if written || !hadOld || string(old) != "a" {
+		t.Errorf("expected NX GET to return a without writing, got %q %v %v", old, hadOld, written)
+	}
+	store.LPush("list", []byte("x"))
+	if _, _, _, err := store.SetWithOptions("list", []byte("b"), setOptions{get: true}); err != errWrongType {
+		t.Errorf("expected WRONGTYPE, got %v", err)
+	}
+	if _, _, written, _ := store.SetWithOptions("list", []byte("b"), setOptions{}); !written {
+		t.Errorf("expected plain SET to overwrite a list")
+	}
+
+	// An expired key counts as missing for NX.
+	store.SetWithOptions("old", []byte("a"), setOptions{expireAt: time.Now().Add(-time.Second)})
+	if _, _, written, _ := store.SetWithOptions("old", []byte("b"), setOptions{nx: true}); !written {
+		t.Errorf("expected NX to replace an expired key")
+	}
+}
+
+func TestSetCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		cmd  string
+		want parser.Value
+	}{
+		{"SET lock owner1 EX 10 NX", parser.SimpleString("OK")},
+		{"SET lock owner2 EX 10 NX", nil},
+		{"TTL lock", parser.Integer(10)},
+		{"SET lock owner3 XX KEEPTTL GET", parser.BulkString("owner1")},
+		{"TTL lock", parser.Integer(10)},
+		{"SET lock owner4", parser.SimpleString("OK")},
+		{"TTL lock", parser.Integer(-1)},
+		{"SET k v NX XX", parser.Error("ERR syntax error")},
+		{"SET k v EX 10 PX 100", parser.Error("ERR syntax error")},
+		{"SET k v KEEPTTL EX 10", parser.Error("ERR syntax error")},
+		{"SET k v EX", parser.Error("ERR syntax error")},
+		{"SET k v EX 0", parser.Error("ERR invalid expire time in 'set' command")},
+		{"SET k v EX ten", parser.Error("ERR value is not an integer or out of range")},
+		{"SET k v EX 9223372036854775807", parser.Error("ERR invalid expire time in 'set' command")},
+		{"SET k v PXAT 1", parser.SimpleString("OK")},
+		{"GET k", nil},
+		{"SET k v GET", nil},
+		{"SETNX k other", parser.Integer(0)},
+		{"SETNX k2 v2", parser.Integer(1)},
+		{"SETEX k 100 v", parser.SimpleString("OK")},
+		{"TTL k", parser.Integer(100)},
+		{"SETEX k -1 v", parser.Error("ERR invalid expire time in 'setex' command")},
+		{"PSETEX k 0 v", parser.Error("ERR invalid expire time in 'psetex' command")},
+		{"GETSET k new", parser.BulkString("v")},
+		{"TTL k", parser.Integer(-1)},
+		{"GETEX k EX 50", parser.BulkString("new")},
+		{"TTL k", parser.Integer(50)},
+		{"GETEX k PERSIST", parser.BulkString("new")},
+		{"TTL k", parser.Integer(-1)},
+		{"GETEX k PERSIST EX 10", parser.Error("ERR syntax error")},
+		{"GETEX k PXAT 1", parser.BulkString("new")},
+		{"GET k", nil},
+		{"GETDEL k2", parser.BulkString("v2")},
+		{"GETDEL k2", nil},
+		{"LPUSH list a", parser.Integer(1)},
+		{"GETDEL list", parser.Error(errWrongType.Error())},
+		{"GETSET list a", parser.Error(errWrongType.Error())},
+	}
+	for _, tt := range tests {
+		resp := sendCmd(t, conn, reader, tt.cmd)
+		if ttl, ok := tt.want.(parser.Integer); ok && ttl > 0 && strings.HasPrefix(tt.cmd, "TTL") {
+			// TTL may have ticked below the value just set.
+			if got, ok := resp.(parser.Integer); !ok || got > ttl || got < ttl-1 {
+				t.Errorf("%s: expected about %d, got %v", tt.cmd, ttl, resp)
+			}
+		} else if bs, ok := resp.(parser.BulkString); ok {
+			if want, ok := tt.want.(parser.BulkString); !ok || string(bs) != string(want) {
+				t.Errorf("%s: expected %v, got %q", tt.cmd, tt.want, bs)
+			}
+		} else if resp != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.cmd, tt.want, resp)
+		}
+	}
+}
+
+func TestIncrByFloatFormatting(t *testing.T) {
+	store := newStore()
+	tests := []struct {
+		start, incr, want string
+	}{
+		{"10.50", "0.1", "10.6"},
+		{"10.6", "-5", "5.6"},
+		{"5.0e3", "2.0e2", "5200"},
+		{"0.1", "0.2", "0.3"},
+		{"1", "-1", "0"},
+		{"3", "1.5", "4.5"},
+	}
+	for _, tt := range tests {
+		store.Set("f", []byte(tt.start))
+		incr, _ := parseLongDouble(tt.incr)
+		got, err := store.IncrByFloat("f", incr)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s + %s = %s, %v; want %s", tt.start, tt.incr, got, err, tt.want)
+		}
+	}
+	store.Set("f", []byte("abc"))
+	if _, err := store.IncrByFloat("f", big.NewFloat(1)); err != errNotFloat {
+		t.Errorf("expected not a float error, got %v", err)
+	}
+	store.Set("f", []byte("1"))
+	inf, ok := parseLongDouble("inf")
+	if _, err := store.IncrByFloat("f", inf); !ok || err != errFloatRange {
+		t.Errorf("expected NaN or Infinity error, got %v", err)
+	}
+	if _, ok := parseLongDouble("1e5000"); ok {
+		t.Errorf("expected 1e5000 to be out of range")
+	}
+	if _, ok := parseLongDouble(" 1"); ok {
+		t.Errorf("expected leading whitespace to be rejected")
+	}
+}
+
+func TestLCS(t *testing.T) {
+	common, matches, _ := lcs([]byte("ohmytext"), []byte("mynewtext"))
+	if string(common) != "mytext" {
+		t.Errorf("expected mytext, got %q", common)
+	}
+	want := []lcsMatch{{a: [2]int{4, 7}, b: [2]int{5, 8}}, {a: [2]int{2, 3}, b: [2]int{0, 1}}}
+	if len(matches) != len(want) || matches[0] != want[0] || matches[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, matches)
+	}
+	if common, matches, _ := lcs(nil, []byte("abc")); len(common) != 0 || len(matches) != 0 {
+		t.Errorf("expected nothing in common with an empty string")
+	}
+}
+
+func TestStringCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		cmd  string
+		want parser.Value
+	}{
+		{"MSET a 1 b 2", parser.SimpleString("OK")},
+		{"MSET a 1 b", parser.Error("ERR wrong number of arguments for 'mset' command")},
+		{"MSETNX b 3 c 3", parser.Integer(0)},
+		{"GET c", nil},
+		{"MSETNX c 3 d 4", parser.Integer(1)},
+		{"APPEND a bc", parser.Integer(3)},
+		{"APPEND new xyz", parser.Integer(3)},
+		{"STRLEN a", parser.Integer(3)},
+		{"STRLEN missing", parser.Integer(0)},
+		{"SET s Hello", parser.SimpleString("OK")},
+		{"GETRANGE s 0 3", parser.BulkString("Hell")},
+		{"GETRANGE s -3 -1", parser.BulkString("llo")},
+		{"GETRANGE s 0 -100", parser.BulkString("H")},
+		{"GETRANGE s -1 -5", parser.BulkString("")},
+		{"GETRANGE s 10 20", parser.BulkString("")},
+		{"SETRANGE s 6 World", parser.Integer(11)},
+		{"GET s", parser.BulkString("Hello\x00World")},
+		{"SETRANGE s -1 x", parser.Error("ERR offset is out of range")},
+		{"SETRANGE s 536870912 x", parser.Error("ERR string exceeds maximum allowed size (proto-max-bulk-len)")},
+		{"INCRBY c 10", parser.Integer(13)},
+		{"DECRBY c 20", parser.Integer(-7)},
+		{"SET big 9223372036854775806", parser.SimpleString("OK")},
+		{"INCRBY big 2", parser.Error("ERR increment or decrement would overflow")},
+		{"DECRBY big -9223372036854775808", parser.Error("ERR decrement would overflow")},
+		{"INCRBY big x", parser.Error("ERR value is not an integer or out of range")},
+		{"SET f 10.50", parser.SimpleString("OK")},
+		{"INCRBYFLOAT f 0.1", parser.BulkString("10.6")},
+		{"INCRBYFLOAT f x", parser.Error("ERR value is not a valid float")},
+		{"MSET k1 ohmytext k2 mynewtext", parser.SimpleString("OK")},
+		{"LCS k1 k2", parser.BulkString("mytext")},
+		{"LCS k1 k2 LEN", parser.Integer(6)},
+		{"LCS k1 k2 LEN IDX", parser.Error("ERR If you want both the length and indexes, please just use IDX.")},
+		{"LPUSH list a", parser.Integer(1)},
+		{"LCS k1 list", parser.Error("ERR The specified keys must contain string values")},
+		{"APPEND list a", parser.Error(errWrongType.Error())},
+	}
+	for _, tt := range tests {
+		resp := sendCmd(t, conn, reader, tt.cmd)
+		if bs, ok := resp.(parser.BulkString); ok {
+			if want, ok := tt.want.(parser.BulkString); !ok || string(bs) != string(want) {
+				t.Errorf("%s: expected %v, got %q", tt.cmd, tt.want, bs)
+			}
+		} else if resp != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.cmd, tt.want, resp)
+		}
+	}
+
+	resp := sendCmd(t, conn, reader, "MGET a list nothing d")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 4 || string(arr[0].(parser.BulkString)) != "1bc" || arr[1] != nil || arr[2] != nil || string(arr[3].(parser.BulkString)) != "4" {
+		t.Errorf("unexpected MGET reply %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "LCS k1 k2 IDX MINMATCHLEN 4 WITHMATCHLEN")
+	arr, ok := resp.(parser.Array)
+	if !ok || len(arr) != 4 || arr[3] != parser.Integer(6) {
+		t.Fatalf("unexpected LCS IDX reply %v", resp)
+	}
+	matches := arr[1].(parser.Array)
+	if len(matches) != 1 {
+		t.Fatalf("expected one match of at least 4 bytes, got %v", matches)
+	}
+	match := matches[0].(parser.Array)
+	if match[0].(parser.Array)[0] != parser.Integer(4) || match[1].(parser.Array)[1] != parser.Integer(8) || match[2] != parser.Integer(4) {
+		t.Errorf("unexpected match %v", match)
+	}
+}
@@ -0,0 +1,118 @@
+#!/bin/sh
+# Regenerates the golden RDB files in this directory from real Redis
+# servers run under Docker. Each file is the SAVE output of the image named
+# in its function below; the redis-ver aux field of the file records the
+# exact server version.
+#
+#	./gen-golden.sh [3.0|6.2|7.2|7.4]...
+set -eu
+cd "$(dirname "$0")"
+
+name=golden-rdb-$$
+
+# start image file args... runs a server writing file to this directory.
+start() {
+	image=$1 file=$2
+	shift 2
+	rm -f "$file"
+	docker run -d --rm --name "$name" --user "$(id -u):$(id -g)" -v "$PWD:/data" \
+		"$image" redis-server --dir /data --dbfilename "$file" --save '' "$@" >/dev/null
+	until cli PING >/dev/null 2>&1; do sleep 0.1; done
+}
+
+# start_stack is start for Redis Stack, which loads RedisJSON and RedisBloom.
+# Its save rules stay on; the final SAVE replaces any earlier snapshot.
+start_stack() {
+	image=$1 file=$2
+	rm -f "$file"
+	docker run -d --rm --name "$name" --user "$(id -u):$(id -g)" -v "$PWD:/data" \
+		-e REDIS_ARGS="--dir /data --dbfilename $file" "$image" >/dev/null
+	until cli PING >/dev/null 2>&1; do sleep 0.1; done
+}
+
+cli() {
+	docker exec "$name" redis-cli "$@"
+}
+
+finish() {
+	cli SAVE >/dev/null
+	docker stop "$name" >/dev/null
+}
+
+# Expiring keys expire at 2100-01-01.
+expire_at=4102444800000
+
+gen_3_0() {
+	start redis:3.0.7 redis-3.0.rdb
+	cli RPUSH list a 7 -5 'hello world' 300 70000 5000000000
+	cli ZADD zset -inf neg 1 one 3.14 pi
+	cli CONFIG SET zset-max-ziplist-entries 0
+	cli ZADD bigzset 1 m1 inf m2 2.5 m3
+	cli SET ttl later
+	cli PEXPIREAT ttl $expire_at
+	cli SADD set 1 2 3
+	cli HSET hash f v
+	finish
+}
+
+gen_6_2() {
+	start redis:6.2.14 redis-6.2.rdb
+	cli SET str hello
+	cli SET int8 -12
+	cli SET int16 1000
+	cli SET int32 100000
+	cli SET lzf "$(printf 'a%.0s' $(seq 100))"
+	cli SET ttl later PXAT $expire_at
+	# gone expires while active expiry is off, so SAVE still writes it.
+	cli DEBUG SET-ACTIVE-EXPIRE 0
+	cli SET gone soon PX 100
+	sleep 1
+	cli CONFIG SET list-max-ziplist-size 8
+	cli RPUSH list a 7 -5 'hello world' 300 70000 5000000000 \
+		"$(printf 'b%.0s' $(seq 300))" after -100000
+	cli ZADD zset -inf neg 1 one 3.14 pi
+	cli SADD set 1 2 3
+	cli HSET hash f v
+	finish
+}
+
+gen_7_2() {
+	start_stack redis/redis-stack-server:7.2.0-v10 redis-7.2.rdb
+	cli FUNCTION LOAD "$(printf "#!lua name=mylib\nredis.register_function('f', function() return 1 end)")"
+	cli SET str hello
+	cli SET ttl later PXAT $expire_at
+	cli RPUSH list a 1 -1 1000 hello
+	cli CONFIG SET list-max-listpack-size 1
+	cli RPUSH biglist "$(printf 'z%.0s' $(seq 9000))" x
+	cli ZADD zset 1 a 2.5 b
+	cli CONFIG SET zset-max-listpack-entries 0
+	cli ZADD bigzset 2.5 hi -1 lo
+	cli SADD set x y
+	cli CONFIG SET set-max-listpack-entries 0
+	cli SADD bigset x y
+	cli HSET hash f v
+	cli CONFIG SET hash-max-listpack-entries 0
+	cli HSET bighash f v
+	cli XADD stream 1700000000000-0 f v
+	cli XGROUP CREATE stream g 0
+	cli XREADGROUP GROUP g c STREAMS stream '>'
+	cli JSON.SET json '$' '{"a":[1,true,"x"]}'
+	cli BF.ADD bf x
+	finish
+}
+
+gen_7_4() {
+	start redis:7.4.1 redis-7.4.rdb
+	cli SET str hello
+	cli RPUSH list a b
+	cli HSET hash f v g w
+	cli HPEXPIREAT hash $expire_at FIELDS 1 f
+	cli CONFIG SET hash-max-listpack-entries 0
+	cli HSET bighash f v g w
+	cli HPEXPIREAT bighash $expire_at FIELDS 1 f
+	finish
+}
+
+for version in ${@:-3.0 6.2 7.2 7.4}; do
+	"gen_$(echo "$version" | tr . _)"
+done
@@ -0,0 +1,476 @@
+package redis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// Top-K uses HeavyKeeper, as RedisBloom does: depth rows of width buckets
+// holding a fingerprint and a count. An item that hits a bucket owned by
+// another fingerprint decays that count with probability decay^count and
+// takes the bucket over once it reaches zero. The k heaviest items seen are
+// kept in a min-heap keyed by their largest bucket count. Decay draws come
+// from a generator stored with the sketch rather than a global one, so that
+// replaying the same commands from the AOF or on a replica gives the same
+// sketch.
+const (
+	topkDefaultWidth = 8
+	topkDefaultDepth = 7
+	topkDefaultDecay = 0.9
+	topkDecayTable   = 256
+	topkFpSeed       = 1919
+	topkMaxIncrement = 100000
+)
+
+var (
+	errTopKNoKey     = fmt.Errorf("TopK: key does not exist")
+	errTopKKeyExists = fmt.Errorf("TopK: key already exists")
+	errTopKTooLarge  = fmt.Errorf("TopK: sketch is too large")
+)
+
+type topkBucket struct {
+	fp    uint32
+	count uint32
+}
+
+type topkHeapItem struct {
+	item  []byte // nil for an unused slot
+	fp    uint32
+	count uint32
+}
+
+type topK struct {
+	k, width, depth uint32
+	decay           float64
+	rng             uint64 // state of the decay generator
+	buckets         []topkBucket
+	heap            []topkHeapItem
+	decayTable      [topkDecayTable]float64
+}
+
+func newTopK(k, width, depth uint32, decay float64) (*topK, error) {
+	if (uint64(width)*uint64(depth)+uint64(k))*8 > maxStringSize {
+		return nil, errTopKTooLarge
+	}
+	t := &topK{
+		k: k, width: width, depth: depth, decay: decay,
+		buckets: make([]topkBucket, width*depth),
+		heap:    make([]topkHeapItem, k),
+	}
+	t.initDecayTable()
+	return t, nil
+}
+
+func (t *topK) initDecayTable() {
+	for i := range t.decayTable {
+		t.decayTable[i] = math.Pow(t.decay, float64(i))
+	}
+}
+
+func (t *topK) decayChance(count uint32) float64 {
+	if count < topkDecayTable {
+		return t.decayTable[count]
+	}
+	return math.Pow(t.decayTable[topkDecayTable-1], float64(count/(topkDecayTable-1))) *
+		t.decayTable[count%(topkDecayTable-1)]
+}
+
+// random returns the next number in [0, 1) from the sketch's generator, a
+// splitmix64.
+func (t *topK) random() float64 {
+	t.rng += 0x9e3779b97f4a7c15
+	z := t.rng
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return float64(z>>11) / (1 << 53)
+}
+
+func topkFingerprint(item []byte) uint32 {
+	return uint32(murmurHash64A(item, topkFpSeed))
+}
+
+// find returns the heap slot holding item, or -1.
+func (t *topK) find(item []byte, fp uint32) int {
+	for i := range t.heap {
+		if t.heap[i].item != nil && t.heap[i].fp == fp && string(t.heap[i].item) == string(item) {
+			return i
+		}
+	}
+	return -1
+}
+
+// siftDown restores the min-heap order below slot i.
+func (t *topK) siftDown(i int) {
+	for {
+		least := i
+		for _, c := range []int{2*i + 1, 2*i + 2} {
+			if c < len(t.heap) && t.heap[c].count < t.heap[least].count {
+				least = c
+			}
+		}
+		if least == i {
+			return
+		}
+		t.heap[i], t.heap[least] = t.heap[least], t.heap[i]
+		i = least
+	}
+}
+
+// add counts incr occurrences of item and returns the item it pushed out of
+// the top k, if any.
+func (t *topK) add(item []byte, incr uint32) []byte {
+	fp := topkFingerprint(item)
+	maxCount := uint32(0)
+	for row := uint32(0); row < t.depth; row++ {
+		loc := murmurHash64A(item, uint64(row)) % uint64(t.width)
+		b := &t.buckets[row*t.width+uint32(loc)]
+		switch {
+		case b.count == 0:
+			b.fp, b.count = fp, incr
+		case b.fp == fp:
+			b.count += incr
+		default:
+			for local := incr; local > 0; local-- {
+				if t.random() < t.decayChance(b.count) {
+					b.count--
+					if b.count == 0 {
+						b.fp, b.count = fp, local
+						break
+					}
+				}
+			}
+		}
+		if b.fp == fp {
+			maxCount = max(maxCount, b.count)
+		}
+	}
+
+	if maxCount < t.heap[0].count {
+		return nil
+	}
+	if i := t.find(item, fp); i >= 0 {
+		t.heap[i].count = maxCount
+		t.siftDown(i)
+		return nil
+	}
+	expelled := t.heap[0].item
+	t.heap[0] = topkHeapItem{item: append([]byte(nil), item...), fp: fp, count: maxCount}
+	t.siftDown(0)
+	return expelled
+}
+
+// list returns the items currently in the top k, heaviest first.
+func (t *topK) list() []topkHeapItem {
+	items := make([]topkHeapItem, 0, len(t.heap))
+	for _, h := range t.heap {
+		if h.item != nil {
+			items = append(items, h)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].count > items[j].count })
+	return items
+}
+
+// encode returns the persisted form of the sketch: its parameters, the
+// state of its generator, the buckets and then the heap.
+func (t *topK) encode() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, t.k)
+	b = binary.LittleEndian.AppendUint32(b, t.width)
+	b = binary.LittleEndian.AppendUint32(b, t.depth)
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(t.decay))
+	b = binary.LittleEndian.AppendUint64(b, t.rng)
+	for _, bk := range t.buckets {
+		b = binary.LittleEndian.AppendUint32(b, bk.fp)
+		b = binary.LittleEndian.AppendUint32(b, bk.count)
+	}
+	for _, h := range t.heap {
+		b = binary.LittleEndian.AppendUint32(b, h.fp)
+		b = binary.LittleEndian.AppendUint32(b, h.count)
+		if h.item == nil {
+			b = binary.LittleEndian.AppendUint32(b, math.MaxUint32)
+			continue
+		}
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(h.item)))
+		b = append(b, h.item...)
+	}
+	return b
+}
+
+func decodeTopK(data []byte) (*topK, error) {
+	r := &sketchReader{b: data}
+	k, width, depth := r.u32(), r.u32(), r.u32()
+	decay := math.Float64frombits(r.u64())
+	rng := r.u64()
+	if r.err || k == 0 || width == 0 || depth == 0 || !(decay > 0 && decay <= 1) ||
+		(uint64(width)*uint64(depth)+uint64(k))*8 > uint64(len(r.b)) {
+		return nil, errSketchCorrupt
+	}
+	t := &topK{
+		k: k, width: width, depth: depth, decay: decay, rng: rng,
+		buckets: make([]topkBucket, width*depth),
+		heap:    make([]topkHeapItem, k),
+	}
+	for i := range t.buckets {
+		t.buckets[i] = topkBucket{fp: r.u32(), count: r.u32()}
+	}
+	for i := range t.heap {
+		t.heap[i] = topkHeapItem{fp: r.u32(), count: r.u32()}
+		if n := r.u32(); n != math.MaxUint32 {
+			t.heap[i].item = append([]byte{}, r.bytes(uint64(n))...)
+		}
+	}
+	if err := r.done(); err != nil {
+		return nil, err
+	}
+	t.initDecayTable()
+	return t, nil
+}
+
+// getTopK returns the sketch stored at key. Caller must hold s.mu.
+func (s *Store) getTopK(key string) (*topK, bool, error) {
+	val, exists := s.lookupKeyRead(key)
+	if !exists {
+		return nil, false, nil
+	}
+	t, ok := val.(*topK)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return t, true, nil
+}
+
+// getTopKForWrite is getTopK for callers holding s.mu for writing.
+func (s *Store) getTopKForWrite(key string) (*topK, bool, error) {
+	val, exists := s.lookupKeyWrite(key)
+	if !exists {
+		return nil, false, nil
+	}
+	t, ok := val.(*topK)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return s.mutable(key, t).(*topK), true, nil
+}
+
+func (s *Store) TopKReserve(key string, k, width, depth uint32, decay float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.lookupKeyWrite(key); exists {
+		return errTopKKeyExists
+	}
+	t, err := newTopK(k, width, depth, decay)
+	if err != nil {
+		return err
+	}
+	s.setKey(key, t)
+	return nil
+}
+
+// TopKIncrBy counts each item by the matching amount and returns, per item,
+// the item it expelled from the top k or nil.
+func (s *Store) TopKIncrBy(key string, items [][]byte, incrs []uint32) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, exists, err := s.getTopKForWrite(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errTopKNoKey
+	}
+	expelled := make([][]byte, len(items))
+	for i, item := range items {
+		expelled[i] = t.add(item, incrs[i])
+	}
+	return expelled, nil
+}
+
+// TopKQuery reports for each item whether it is currently in the top k.
+func (s *Store) TopKQuery(key string, items ...[]byte) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, exists, err := s.getTopK(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errTopKNoKey
+	}
+	found := make([]bool, len(items))
+	for i, item := range items {
+		found[i] = t.find(item, topkFingerprint(item)) >= 0
+	}
+	return found, nil
+}
+
+func (s *Store) TopKList(key string) ([]topkHeapItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, exists, err := s.getTopK(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errTopKNoKey
+	}
+	return t.list(), nil
+}
+
+func (s *Store) TopKInfo(key string) (k, width, depth uint32, decay float64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, exists, err := s.getTopK(key)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if !exists {
+		return 0, 0, 0, 0, errTopKNoKey
+	}
+	return t.k, t.width, t.depth, t.decay, nil
+}
+
+// handleTopKReserve implements TOPK.RESERVE key topk [width depth decay].
+func handleTopKReserve(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	if len(strs) != 2 && len(strs) != 5 {
+		return parser.Error("ERR wrong number of arguments for 'TOPK.RESERVE' command")
+	}
+	k, ok := positiveUint32(strs[1])
+	if !ok {
+		return parser.Error("TopK: invalid k")
+	}
+	width, depth, decay := uint32(topkDefaultWidth), uint32(topkDefaultDepth), topkDefaultDecay
+	if len(strs) == 5 {
+		if width, ok = positiveUint32(strs[2]); !ok {
+			return parser.Error("TopK: invalid width")
+		}
+		if depth, ok = positiveUint32(strs[3]); !ok {
+			return parser.Error("TopK: invalid depth")
+		}
+		var err error
+		if decay, err = strconv.ParseFloat(strs[4], 64); err != nil || decay <= 0 || decay > 1 {
+			return parser.Error("TopK: invalid decay value. must be '<= 1' & '> 0'")
+		}
+	}
+	if err := store.TopKReserve(strs[0], k, width, depth, decay); err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.SimpleString("OK")
+}
+
+func expelledReply(expelled [][]byte) parser.Value {
+	reply := make(parser.Array, len(expelled))
+	for i, item := range expelled {
+		reply[i] = parser.BulkString(item)
+	}
+	return reply
+}
+
+func handleTopKAdd(store *Store, args []parser.Value) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	incrs := make([]uint32, len(items)-1)
+	for i := range incrs {
+		incrs[i] = 1
+	}
+	expelled, err := store.TopKIncrBy(string(items[0]), items[1:], incrs)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return expelledReply(expelled)
+}
+
+func handleTopKIncrBy(store *Store, args []parser.Value) parser.Value {
+	if len(args)%2 != 0 {
+		return parser.Error("ERR wrong number of arguments for 'TOPK.INCRBY' command")
+	}
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	n := (len(items) - 1) / 2
+	keys, incrs := make([][]byte, n), make([]uint32, n)
+	for i := 0; i < n; i++ {
+		keys[i] = items[1+2*i]
+		incr, err := strconv.ParseUint(string(items[2+2*i]), 10, 32)
+		if err != nil || incr > topkMaxIncrement {
+			return parser.Error("TopK: increment must be an integer greater or equal to 0 and less than or equal to 100,000")
+		}
+		incrs[i] = uint32(incr)
+	}
+	expelled, err := store.TopKIncrBy(string(items[0]), keys, incrs)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return expelledReply(expelled)
+}
+
+func handleTopKQuery(store *Store, args []parser.Value) parser.Value {
+	items, ok := byteArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	found, err := store.TopKQuery(string(items[0]), items[1:]...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return boolsReply(found)
+}
+
+// handleTopKList implements TOPK.LIST key [WITHCOUNT].
+func handleTopKList(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	withCount := false
+	if len(strs) == 2 {
+		if !strings.EqualFold(strs[1], "WITHCOUNT") {
+			return parser.Error("ERR syntax error")
+		}
+		withCount = true
+	} else if len(strs) > 2 {
+		return parser.Error("ERR wrong number of arguments for 'TOPK.LIST' command")
+	}
+	items, err := store.TopKList(strs[0])
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	reply := make(parser.Array, 0, 2*len(items))
+	for _, h := range items {
+		reply = append(reply, parser.BulkString(h.item))
+		if withCount {
+			reply = append(reply, parser.Integer(h.count))
+		}
+	}
+	return reply
+}
+
+func handleTopKInfo(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	k, width, depth, decay, err := store.TopKInfo(string(key))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Array{
+		parser.SimpleString("k"), parser.Integer(k),
+		parser.SimpleString("width"), parser.Integer(width),
+		parser.SimpleString("depth"), parser.Integer(depth),
+		parser.SimpleString("decay"), parser.BulkString(strconv.FormatFloat(decay, 'f', -1, 64)),
+	}
+}
@@ -0,0 +1,106 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestTopKHeavyHitters(t *testing.T) {
+	store := newStore()
+	if err := store.TopKReserve("topk", 3, 50, 4, 0.9); err != nil {
+		t.Fatalf("TopKReserve: %v", err)
+	}
+	if err := store.TopKReserve("topk", 3, 50, 4, 0.9); err != errTopKKeyExists {
+		t.Errorf("expected key exists error, got %v", err)
+	}
+	// Three heavy items among many light ones.
+	for round := 0; round < 100; round++ {
+		items := [][]byte{[]byte("heavy:a"), []byte("heavy:b"), []byte("heavy:c")}
+		incrs := []uint32{3, 2, 1}
+		for i := 0; i < 5; i++ {
+			items = append(items, []byte(fmt.Sprintf("light:%d:%d", round, i)))
+			incrs = append(incrs, 1)
+		}
+		if _, err := store.TopKIncrBy("topk", items, incrs); err != nil {
+			t.Fatalf("TopKIncrBy: %v", err)
+		}
+	}
+	list, _ := store.TopKList("topk")
+	if len(list) != 3 || string(list[0].item) != "heavy:a" || string(list[1].item) != "heavy:b" || string(list[2].item) != "heavy:c" {
+		t.Fatalf("unexpected top k %v", list)
+	}
+	if list[0].count < 250 || list[0].count > 300 {
+		t.Errorf("expected a count near 300, got %d", list[0].count)
+	}
+	if found, _ := store.TopKQuery("topk", []byte("heavy:a"), []byte("light:0:0")); !found[0] || found[1] {
+		t.Errorf("expected [true false], got %v", found)
+	}
+
+	data := store.data["topk"].(*topK).encode()
+	decoded, err := decodeTopK(data)
+	if err != nil || string(decoded.encode()) != string(data) {
+		t.Errorf("encoding does not round trip: %v", err)
+	}
+	if _, err := decodeTopK(data[:len(data)-1]); err != errSketchCorrupt {
+		t.Errorf("expected corrupt payload error, got %v", err)
+	}
+}
+
+func TestTopKExpelled(t *testing.T) {
+	tk, _ := newTopK(1, 8, 7, 0.9)
+	if expelled := tk.add([]byte("a"), 1); expelled != nil {
+		t.Errorf("expected nothing expelled from an empty slot, got %q", expelled)
+	}
+	if expelled := tk.add([]byte("b"), 5); string(expelled) != "a" {
+		t.Errorf("expected a to be expelled, got %q", expelled)
+	}
+	if expelled := tk.add([]byte("b"), 1); expelled != nil {
+		t.Errorf("expected b to stay in place, got %q", expelled)
+	}
+}
+
+func TestTopKCommands(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	conn, _ := net.Dial("tcp", srv.Addr())
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp := sendCmd(t, conn, reader, "TOPK.RESERVE topk 2")
+	if str, ok := resp.(parser.SimpleString); !ok || str != "OK" {
+		t.Errorf("expected OK, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "TOPK.ADD topk a b a")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 3 || arr[0] != nil || arr[1] != nil || arr[2] != nil {
+		t.Errorf("expected three nils, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "TOPK.INCRBY topk c 10")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 1 || string(arr[0].(parser.BulkString)) != "b" {
+		t.Errorf("expected b to be expelled, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "TOPK.LIST topk WITHCOUNT")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 4 || string(arr[0].(parser.BulkString)) != "c" || arr[1] != parser.Integer(10) || string(arr[2].(parser.BulkString)) != "a" {
+		t.Errorf("unexpected TOPK.LIST reply %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "TOPK.QUERY topk a b")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 2 || arr[0] != parser.Integer(1) || arr[1] != parser.Integer(0) {
+		t.Errorf("expected [1 0], got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "TOPK.INFO topk")
+	if arr, ok := resp.(parser.Array); !ok || len(arr) != 8 || arr[1] != parser.Integer(2) || string(arr[7].(parser.BulkString)) != "0.9" {
+		t.Errorf("unexpected TOPK.INFO reply %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "TOPK.RESERVE bad 2 8 7 1.5")
+	if err, ok := resp.(parser.Error); !ok || err != "TopK: invalid decay value. must be '<= 1' & '> 0'" {
+		t.Errorf("expected decay error, got %v", resp)
+	}
+	resp = sendCmd(t, conn, reader, "TOPK.ADD missing a")
+	if err, ok := resp.(parser.Error); !ok || err != "TopK: key does not exist" {
+		t.Errorf("expected missing key error, got %v", resp)
+	}
+}
@@ -0,0 +1,185 @@
+package redis
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// offsetNotifier wakes the goroutines waiting for an offset to advance.
+type offsetNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel closed at the next notify.
+func (n *offsetNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *offsetNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// aofFsyncedOffset returns the replication offset synced to the AOF, or
+// -1 with the AOF off.
+func (s *Store) aofFsyncedOffset() int64 {
+	s.aof.mu.Lock()
+	defer s.aof.mu.Unlock()
+	if !s.aof.enabled {
+		return -1
+	}
+	return s.aof.fsyncedOffset
+}
+
+// countAcks returns how many replicas acknowledged offset, and how many
+// synced it to their AOF.
+func (s *Store) countAcks(offset int64) (int, int) {
+	rs := &s.repl
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	acked, synced := 0, 0
+	for _, r := range rs.replicas {
+		r.mu.Lock()
+		if r.state == replicaStateOnline {
+			if r.ackOffset >= offset {
+				acked++
+			}
+			if r.aofOffset >= offset {
+				synced++
+			}
+		}
+		r.mu.Unlock()
+	}
+	return acked, synced
+}
+
+// requestAcks asks the replicas to acknowledge their offset at once rather
+// than at their next periodic ACK.
+func (s *Store) requestAcks() {
+	getack, _ := parser.Serialize(commandArgs("REPLCONF", "GETACK", "*"))
+	s.aof.propMu.Lock()
+	defer s.aof.propMu.Unlock()
+	rs := &s.repl
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.masterHost == "" && len(rs.replicas) > 0 {
+		rs.feedLocked(getack)
+	}
+}
+
+// waitForAcks blocks c until done reports true, the timeout elapses (zero
+// waits forever) or the connection goes away. Only c is blocked: writes
+// from other clients go on, and are what the replicas acknowledge.
+func (s *Store) waitForAcks(c *Client, timeout time.Duration, done func() bool) {
+	if done() {
+		return
+	}
+	s.requestAcks()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	gone, stopWatching := c.watchDisconnect()
+	defer stopWatching()
+	for {
+		acked := s.repl.acked.wait()
+		if done() {
+			return
+		}
+		select {
+		case <-acked:
+		case <-expired:
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+func waitTimeoutArg(v parser.Value) (time.Duration, parser.Value) {
+	bs, ok := v.(parser.BulkString)
+	if !ok {
+		return 0, parser.Error("ERR wrong argument type")
+	}
+	ms, err := strconv.ParseInt(string(bs), 10, 64)
+	if err != nil {
+		return 0, parser.Error("ERR timeout is not an integer or out of range")
+	}
+	if ms < 0 {
+		return 0, parser.Error("ERR timeout is negative")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// handleWait blocks until numreplicas replicas acknowledged the last write
+// of the client, and returns how many did.
+func handleWait(c *Client, store *Store, args []parser.Value) parser.Value {
+	if store.isReplica() {
+		return parser.Error("ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.")
+	}
+	numreplicas, errReply := intArg(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	timeout, errReply := waitTimeoutArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	woff := c.woff
+	store.waitForAcks(c, timeout, func() bool {
+		acked, _ := store.countAcks(woff)
+		return acked >= numreplicas
+	})
+	acked, _ := store.countAcks(woff)
+	return parser.Integer(acked)
+}
+
+// handleWaitAOF blocks until the last write of the client is synced to the
+// local AOF when numlocal is 1, and to the AOF of numreplicas replicas. It
+// returns both counts.
+func handleWaitAOF(c *Client, store *Store, args []parser.Value) parser.Value {
+	if store.isReplica() {
+		return parser.Error("ERR WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+	}
+	numlocal, errReply := intArg(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	numreplicas, errReply := intArg(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	timeout, errReply := waitTimeoutArg(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	if numlocal > 0 && store.aofFsyncedOffset() < 0 {
+		return parser.Error("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+	woff := c.woff
+	counts := func() (int, int) {
+		_, synced := store.countAcks(woff)
+		return boolInt(store.aofFsyncedOffset() >= woff), synced
+	}
+	store.waitForAcks(c, timeout, func() bool {
+		local, synced := counts()
+		return local >= numlocal && synced >= numreplicas
+	})
+	local, synced := counts()
+	return parser.Array{parser.Integer(local), parser.Integer(synced)}
+}
@@ -0,0 +1,78 @@
+package redis
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+func TestWait(t *testing.T) {
+	master := startReplServer(t)
+	replica := startReplServer(t)
+	replicate(t, replica, master)
+
+	conn, reader := dial(t, master)
+	defer conn.Close()
+	sendCmd(t, conn, reader, "SET a 1")
+	if resp := sendCmd(t, conn, reader, "WAIT 1 2000"); resp != parser.Integer(1) {
+		t.Errorf("expected 1 replica to acknowledge, got %v", resp)
+	}
+	start := time.Now()
+	if resp := sendCmd(t, conn, reader, "WAIT 2 100"); resp != parser.Integer(1) {
+		t.Errorf("expected WAIT to time out with 1 replica, got %v", resp)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected WAIT to block until its timeout, returned after %v", elapsed)
+	}
+
+	// A client waiting forever blocks no one else.
+	waiting, _ := dial(t, master)
+	defer waiting.Close()
+	sendOnly(t, waiting, "SET b 1")
+	sendOnly(t, waiting, "WAIT 2 0")
+	if resp := sendCmd(t, conn, reader, "SET c 1"); resp != parser.SimpleString("OK") {
+		t.Errorf("expected writes to go on during WAIT, got %v", resp)
+	}
+
+	rconn, rreader := dial(t, replica)
+	defer rconn.Close()
+	if resp := sendCmd(t, rconn, rreader, "WAIT 1 0"); !strings.Contains(string(resp.(parser.Error)), "replica instances") {
+		t.Errorf("expected WAIT to be refused on a replica, got %v", resp)
+	}
+}
+
+func TestWaitAOF(t *testing.T) {
+	store := newAOFStore(t)
+	c := &Client{}
+	dispatch(c, store, commandArgs("SET", "a", "1"))
+	resp := dispatch(c, store, commandArgs("WAITAOF", "1", "0", "3000"))
+	if arr, ok := resp.(parser.Array); !ok || arr[0] != parser.Integer(1) || arr[1] != parser.Integer(0) {
+		t.Errorf("expected the write to be synced locally, got %v", resp)
+	}
+	if store.aofFsyncedOffset() < c.woff {
+		t.Errorf("expected the AOF to be synced past offset %d", c.woff)
+	}
+
+	master := startReplServer(t)
+	replica := startReplServer(t)
+	run(replica.store, "CONFIG", "SET", "dir", t.TempDir())
+	run(replica.store, "CONFIG", "SET", "appendfsync", "always")
+	if resp := run(replica.store, "CONFIG", "SET", "appendonly", "yes"); resp != parser.SimpleString("OK") {
+		t.Fatalf("CONFIG SET appendonly: %v", resp)
+	}
+	t.Cleanup(func() { replica.store.StopAppendOnly() })
+	replicate(t, replica, master)
+
+	conn, reader := dial(t, master)
+	defer conn.Close()
+	if resp := sendCmd(t, conn, reader, "WAITAOF 1 0 0"); !strings.Contains(string(resp.(parser.Error)), "appendonly is disabled") {
+		t.Errorf("expected WAITAOF to need the local AOF, got %v", resp)
+	}
+	sendCmd(t, conn, reader, "SET b 2")
+	resp = sendCmd(t, conn, reader, "WAITAOF 0 1 2000")
+	if arr, ok := resp.(parser.Array); !ok || arr[0] != parser.Integer(0) || arr[1] != parser.Integer(1) {
+		t.Errorf("expected the write to be synced by the replica, got %v", resp)
+	}
+}
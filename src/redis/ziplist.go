@@ -0,0 +1,140 @@
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Ziplists are the packed encoding Redis used before listpacks, found in
+// RDB files written by Redis 6.2 and older. They are only ever read. After
+// a header holding the total size, the tail offset and the entry count,
+// each entry is the length of the previous entry, an encoding and the data:
+//
+//	00LLLLLL <data>                  string up to 63 bytes
+//	01LLLLLL LLLLLLLL <data>         string up to 16383 bytes, big endian
+//	10000000 <4 byte len> <data>     longer string, big endian length
+//	11000000, 11010000, 11100000     16, 32 and 64 bit signed integers
+//	11110000                         24 bit signed integer
+//	11111110                         8 bit signed integer
+//	1111xxxx                         integer xxxx-1, from 0 to 12
+//	11111111                         end of the ziplist
+const (
+	zlHeaderSize   = 10
+	zlEnd          = 0xff
+	zlBigPrevlen   = 254
+	zlEncInt16     = 0xc0
+	zlEncInt32     = 0xd0
+	zlEncInt64     = 0xe0
+	zlEncInt24     = 0xf0
+	zlEncInt8      = 0xfe
+	zlUnknownCount = 65535
+)
+
+var errZiplistCorrupt = errors.New("corrupt ziplist")
+
+// decodeZiplist returns the entries of a ziplist, with integers in their
+// decimal form. Like decodeListpack it validates the whole structure.
+func decodeZiplist(b []byte) ([][]byte, error) {
+	if len(b) < zlHeaderSize+1 || int(binary.LittleEndian.Uint32(b)) != len(b) ||
+		int(binary.LittleEndian.Uint32(b[4:])) >= len(b) || b[len(b)-1] != zlEnd {
+		return nil, errZiplistCorrupt
+	}
+	count := int(binary.LittleEndian.Uint16(b[8:]))
+	var entries [][]byte
+	p, prev := zlHeaderSize, 0
+	for b[p] != zlEnd {
+		v, size, prevlen, err := zlDecodeEntry(b[p : len(b)-1])
+		if err != nil {
+			return nil, err
+		}
+		if prevlen != prev {
+			return nil, errZiplistCorrupt
+		}
+		entries = append(entries, v)
+		p += size
+		prev = size
+	}
+	if count != zlUnknownCount && count != len(entries) {
+		return nil, errZiplistCorrupt
+	}
+	return entries, nil
+}
+
+// zlDecodeEntry decodes the entry at the start of b, returning its value,
+// its total size and the previous entry length it records.
+func zlDecodeEntry(b []byte) ([]byte, int, int, error) {
+	if len(b) == 0 {
+		return nil, 0, 0, errZiplistCorrupt
+	}
+	prevlen, p := int(b[0]), 1
+	if b[0] == zlBigPrevlen {
+		if len(b) < 5 {
+			return nil, 0, 0, errZiplistCorrupt
+		}
+		prevlen, p = int(binary.LittleEndian.Uint32(b[1:])), 5
+	}
+	if p >= len(b) {
+		return nil, 0, 0, errZiplistCorrupt
+	}
+	enc := b[p]
+	var n int64
+	var width int
+	switch {
+	case enc>>6 == 0:
+		return zlString(b, prevlen, p+1, int(enc&0x3f))
+	case enc>>6 == 1:
+		if p+2 > len(b) {
+			return nil, 0, 0, errZiplistCorrupt
+		}
+		return zlString(b, prevlen, p+2, int(enc&0x3f)<<8|int(b[p+1]))
+	case enc == 0x80:
+		if p+5 > len(b) {
+			return nil, 0, 0, errZiplistCorrupt
+		}
+		l := binary.BigEndian.Uint32(b[p+1:])
+		if uint64(l) > uint64(len(b)) {
+			return nil, 0, 0, errZiplistCorrupt
+		}
+		return zlString(b, prevlen, p+5, int(l))
+	case enc == zlEncInt8:
+		width = 1
+	case enc == zlEncInt16:
+		width = 2
+	case enc == zlEncInt24:
+		width = 3
+	case enc == zlEncInt32:
+		width = 4
+	case enc == zlEncInt64:
+		width = 8
+	case enc >= 0xf1 && enc <= 0xfd:
+		return []byte(strconv.Itoa(int(enc&0x0f) - 1)), p + 1, prevlen, nil
+	default:
+		return nil, 0, 0, errZiplistCorrupt
+	}
+	data := b[p+1:]
+	if len(data) < width {
+		return nil, 0, 0, errZiplistCorrupt
+	}
+	switch width {
+	case 1:
+		n = int64(int8(data[0]))
+	case 2:
+		n = int64(int16(binary.LittleEndian.Uint16(data)))
+	case 3:
+		u := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+		n = int64(int32(u<<8) >> 8)
+	case 4:
+		n = int64(int32(binary.LittleEndian.Uint32(data)))
+	case 8:
+		n = int64(binary.LittleEndian.Uint64(data))
+	}
+	return []byte(strconv.FormatInt(n, 10)), p + 1 + width, prevlen, nil
+}
+
+func zlString(b []byte, prevlen, hdr, l int) ([]byte, int, int, error) {
+	if hdr+l > len(b) {
+		return nil, 0, 0, errZiplistCorrupt
+	}
+	return b[hdr : hdr+l : hdr+l], hdr + l, prevlen, nil
+}
@@ -0,0 +1,364 @@
+package redis
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+
+	"github.com/haxip-com/go-redis/src/parser"
+)
+
+// zset is the sorted set representation: a skiplist ordered by (score,
+// member) for range queries, plus a map for O(1) score lookups, as in Redis.
+type zset struct {
+	dict map[string]float64
+	zsl  *zskiplist
+}
+
+const (
+	zskiplistMaxLevel = 32
+	zskiplistP        = 0.25
+)
+
+type zskiplistNode struct {
+	member   string
+	score    float64
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int
+}
+
+type zskiplist struct {
+	header, tail *zskiplistNode
+	length       int
+	level        int
+}
+
+// zrangespec is a score interval; minex and maxex make the bounds exclusive.
+type zrangespec struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func newZskiplist() *zskiplist {
+	return &zskiplist{
+		header: &zskiplistNode{level: make([]zskiplistLevel, zskiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func zslRandomLevel() int {
+	level := 1
+	for level < zskiplistMaxLevel && rand.Float64() < zskiplistP {
+		level++
+	}
+	return level
+}
+
+// zslLess reports whether (score, member) sorts before node n.
+func zslLess(n *zskiplistNode, score float64, member string) bool {
+	return n.score < score || n.score == score && n.member < member
+}
+
+func (zsl *zskiplist) insert(score float64, member string) *zskiplistNode {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	var rank [zskiplistMaxLevel]int
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+	x = &zskiplistNode{member: member, score: score, level: make([]zskiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+func (zsl *zskiplist) deleteNode(x *zskiplistNode, update []*zskiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+func (zsl *zskiplist) delete(score float64, member string) bool {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	zsl.deleteNode(x, update)
+	return true
+}
+
+func (spec zrangespec) gteMin(score float64) bool {
+	if spec.minex {
+		return score > spec.min
+	}
+	return score >= spec.min
+}
+
+func (spec zrangespec) lteMax(score float64) bool {
+	if spec.maxex {
+		return score < spec.max
+	}
+	return score <= spec.max
+}
+
+// firstInRange returns the first node with a score inside spec, or nil.
+func (zsl *zskiplist) firstInRange(spec zrangespec) *zskiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !spec.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !spec.lteMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+func newZset() *zset {
+	return &zset{dict: make(map[string]float64), zsl: newZskiplist()}
+}
+
+func (z *zset) clone() *zset {
+	c := newZset()
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		c.add(x.member, x.score, zaddFlags{})
+	}
+	return c
+}
+
+func (z *zset) Len() int {
+	return len(z.dict)
+}
+
+func (z *zset) score(member string) (float64, bool) {
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// zaddFlags are the ZADD-style update conditions shared by sorted set
+// writers such as GEOADD.
+type zaddFlags struct {
+	nx, xx bool
+}
+
+// add sets member's score under flags, reporting whether it was added or
+// had its score changed.
+func (z *zset) add(member string, score float64, flags zaddFlags) (added, updated bool) {
+	cur, exists := z.dict[member]
+	if exists {
+		if flags.nx || cur == score {
+			return false, false
+		}
+		z.zsl.delete(cur, member)
+		z.zsl.insert(score, member)
+		z.dict[member] = score
+		return false, true
+	}
+	if flags.xx {
+		return false, false
+	}
+	z.zsl.insert(score, member)
+	z.dict[member] = score
+	return true, false
+}
+
+func (z *zset) remove(member string) bool {
+	score, exists := z.dict[member]
+	if !exists {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.dict, member)
+	return true
+}
+
+// rangeByScore calls fn for each member inside spec in order, until fn
+// returns false.
+func (z *zset) rangeByScore(spec zrangespec, fn func(member string, score float64) bool) {
+	for x := z.zsl.firstInRange(spec); x != nil && spec.lteMax(x.score); x = x.level[0].forward {
+		if !fn(x.member, x.score) {
+			return
+		}
+	}
+}
+
+// getZset returns the sorted set stored at key. Caller must hold s.mu.
+func (s *Store) getZset(key string) (*zset, bool, error) {
+	val, exists := s.lookupKeyRead(key)
+	if !exists {
+		return nil, false, nil
+	}
+	z, ok := val.(*zset)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return z, true, nil
+}
+
+// getZsetForWrite is getZset for callers holding s.mu for writing.
+func (s *Store) getZsetForWrite(key string) (*zset, bool, error) {
+	val, exists := s.lookupKeyWrite(key)
+	if !exists {
+		return nil, false, nil
+	}
+	z, ok := val.(*zset)
+	if !ok {
+		return nil, false, errWrongType
+	}
+	return s.mutable(key, z).(*zset), true, nil
+}
+
+func (s *Store) ZScore(key, member string) (float64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	z, exists, err := s.getZset(key)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+	score, ok := z.score(member)
+	return score, ok, nil
+}
+
+func (s *Store) ZCard(key string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	z, exists, err := s.getZset(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return int64(z.Len()), nil
+}
+
+func (s *Store) ZRem(key string, members ...string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, exists, err := s.getZsetForWrite(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	removed := int64(0)
+	for _, m := range members {
+		if z.remove(m) {
+			removed++
+		}
+	}
+	if z.Len() == 0 {
+		s.deleteKey(key)
+	}
+	return removed, nil
+}
+
+// formatDouble renders a score the way Redis replies with doubles: integral
+// values without an exponent, anything else in shortest round-trip form.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case f == math.Trunc(f) && math.Abs(f) < 1<<53:
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func handleZScore(store *Store, args []parser.Value) parser.Value {
+	key, ok1 := args[1].(parser.BulkString)
+	member, ok2 := args[2].(parser.BulkString)
+	if !ok1 || !ok2 {
+		return parser.Error("ERR wrong argument type")
+	}
+	score, exists, err := store.ZScore(string(key), string(member))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	if !exists {
+		return parser.BulkString(nil)
+	}
+	return parser.BulkString(formatDouble(score))
+}
+
+func handleZCard(store *Store, args []parser.Value) parser.Value {
+	key, ok := args[1].(parser.BulkString)
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	n, err := store.ZCard(string(key))
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
+
+func handleZRem(store *Store, args []parser.Value) parser.Value {
+	strs, ok := bulkStringArgs(args[1:])
+	if !ok {
+		return parser.Error("ERR wrong argument type")
+	}
+	n, err := store.ZRem(strs[0], strs[1:]...)
+	if err != nil {
+		return parser.Error(err.Error())
+	}
+	return parser.Integer(n)
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/haxip-com/go-redis/src/redis"
+
+func main() {
+	redis.Main()
+}